@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// adminHandler serves the admin API, which is kept apart from proxy traffic
+// on its own listen address.
+func (hw *HandlerWrapper) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transactions", hw.handleTransactions)
+	mux.HandleFunc("/pause", hw.handlePause)
+	mux.HandleFunc("/resume", hw.handlePause)
+	mux.HandleFunc("/cert-failures", hw.handleCertFailures)
+	mux.HandleFunc("/certs", hw.handleCerts)
+	mux.HandleFunc("/ca.p12", hw.handlePKCS12)
+	mux.HandleFunc("/events", hw.handleEvents)
+	return mux
+}
+
+// handlePause turns interception off on POST /pause and back on on POST
+// /resume. While paused, new connections are tunneled and plain http is
+// relayed untouched; connections already intercepted stay so.
+func (hw *HandlerWrapper) handlePause(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.Header().Set("Allow", "POST")
+		respError(resp, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var paused int32
+	if req.URL.Path == "/pause" {
+		paused = 1
+	}
+	atomic.StoreInt32(&hw.paused, paused)
+	logger.Infoln("interception paused:", paused == 1)
+	writeJSON(resp, map[string]bool{"paused": paused == 1})
+}
+
+// handleTransactions returns the most recent transactions as JSON, newest
+// first. The n query parameter limits how many are returned.
+func (hw *HandlerWrapper) handleTransactions(resp http.ResponseWriter, req *http.Request) {
+	if hw.history == nil {
+		respError(resp, http.StatusNotFound, "transaction history is disabled")
+		return
+	}
+	n := -1
+	if s := req.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			respError(resp, http.StatusBadRequest, "invalid n: "+s)
+			return
+		}
+	}
+	writeJSON(resp, hw.history.Recent(n))
+}
+
+// cachedCert is a minted cert in the cache, as listed by the admin API.
+type cachedCert struct {
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleCerts lists the cached mitm certs by name on GET /certs. DELETE
+// /certs?name=host purges the cert for host, so the next handshake for it
+// mints a new one.
+func (hw *HandlerWrapper) handleCerts(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		certs := []cachedCert{}
+		for name, expires := range hw.dynamicCerts.Expirations() {
+			certs = append(certs, cachedCert{name, expires})
+		}
+		sort.Slice(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+		writeJSON(resp, certs)
+	case "DELETE":
+		name := req.URL.Query().Get("name")
+		if name == "" {
+			respError(resp, http.StatusBadRequest, "missing name")
+			return
+		}
+		// don't race a handshake minting the cert for name
+		unlock := hw.certLocks.lock(name)
+		found := hw.dynamicCerts.Delete(name)
+		unlock()
+		if !found {
+			respError(resp, http.StatusNotFound, "no cached cert for "+name)
+			return
+		}
+		logger.Infoln("purged cached mitm cert for", name)
+		writeJSON(resp, map[string]string{"purged": name})
+	default:
+		resp.Header().Set("Allow", "GET, DELETE")
+		respError(resp, http.StatusMethodNotAllowed, "use GET or DELETE")
+	}
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(v); err != nil {
+		logger.Warnln("write json error:", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// post sends an empty POST to url and returns the status.
+func post(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	return resp.StatusCode
+}
+
+func TestPauseAndResumeInterception(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-intercept-ports", portOf(origin))
+	p.trust(origin)
+	admin := p.admin(t)
+	issuedBy := func() string {
+		t.Helper()
+		resp, err := p.clientTrusting(origin).Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); body != "tls origin" {
+			t.Errorf("body %q", body)
+		}
+		return issuer(resp)
+	}
+
+	if got := issuedBy(); got != "gomitmproxy"+Version {
+		t.Fatalf("before pausing shown a cert issued by %q", got)
+	}
+	if status := post(t, admin.URL+"/pause"); status != http.StatusOK {
+		t.Fatalf("pause got %d", status)
+	}
+	if got := issuedBy(); got == "gomitmproxy"+Version {
+		t.Error("paused proxy still intercepting")
+	}
+	if status := post(t, admin.URL+"/resume"); status != http.StatusOK {
+		t.Fatalf("resume got %d", status)
+	}
+	if got := issuedBy(); got != "gomitmproxy"+Version {
+		t.Errorf("resumed proxy shown a cert issued by %q", got)
+	}
+}
+
+func TestPausedRelaysPlainHTTPUntouched(t *testing.T) {
+	body := strings.Repeat("compressible text ", 500)
+	origin := textOrigin(t, body)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-compress")
+	post(t, p.admin(t).URL+"/pause")
+	req, _ := http.NewRequest("GET", origin.URL+"/relayed", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); resp.Header.Get("Content-Encoding") != "" || got != body {
+		t.Errorf("paused relay got Content-Encoding %q and %d bytes", resp.Header.Get("Content-Encoding"), len(got))
+	}
+	if recent := p.history.Recent(1); len(recent) > 0 {
+		t.Errorf("paused relay recorded %s", recent[0].URL)
+	}
+}
+
+func TestPauseNeedsPost(t *testing.T) {
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	resp, err := http.Get(p.admin(t).URL + "/pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Errorf("GET /pause got %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+	if p.paused != 0 {
+		t.Error("GET /pause paused the proxy")
+	}
+}
+
+// deleteCert purges the cached cert for name through the admin API and
+// returns the status.
+func deleteCert(t *testing.T, admin *httptest.Server, name string) int {
+	t.Helper()
+	req, _ := http.NewRequest("DELETE", admin.URL+"/certs?name="+name, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	return resp.StatusCode
+}
+
+func TestCachedCertsListedAndPurged(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-intercept-ports", portOf(origin))
+	admin := p.admin(t)
+	first := handshakeThrough(t, p, origin, "b.certs.test")
+	handshakeThrough(t, p, origin, "a.certs.test")
+
+	var certs []cachedCert
+	if status := getJSON(t, admin.URL+"/certs", &certs); status != http.StatusOK {
+		t.Fatalf("GET /certs got %d", status)
+	}
+	if len(certs) != 2 || certs[0].Name != "a.certs.test" || certs[1].Name != "b.certs.test" {
+		t.Fatalf("listed %+v, want both names sorted", certs)
+	}
+	if certs[1].Expires.Sub(first.NotAfter).Abs() > 2*time.Second {
+		t.Errorf("listed expiry %s, cert expires %s", certs[1].Expires, first.NotAfter)
+	}
+
+	if status := deleteCert(t, admin, "b.certs.test"); status != http.StatusOK {
+		t.Fatalf("DELETE got %d", status)
+	}
+	// the next handshake mints a new cert
+	if again := handshakeThrough(t, p, origin, "b.certs.test"); again.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("purged cert still handed out")
+	}
+	if status := deleteCert(t, admin, "missing.test"); status != http.StatusNotFound {
+		t.Errorf("DELETE of an uncached name got %d, want 404", status)
+	}
+	if status := deleteCert(t, admin, ""); status != http.StatusBadRequest {
+		t.Errorf("DELETE without a name got %d, want 400", status)
+	}
+	if status := post(t, admin.URL+"/certs"); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST /certs got %d, want 405", status)
+	}
+}
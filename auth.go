@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// hostCredential holds the credentials injected into requests to hosts
+// matching pattern.
+type hostCredential struct {
+	pattern  string
+	username string
+	password string
+}
+
+// parseCredentials parses a comma separated list of pattern=user:password
+// entries. Patterns are matched against the request host, e.g. *.example.com.
+func parseCredentials(s string) ([]*hostCredential, error) {
+	var creds []*hostCredential
+	for _, item := range splitList(s) {
+		eq := strings.Index(item, "=")
+		colon := strings.LastIndex(item, ":")
+		if eq <= 0 || colon < eq {
+			return nil, fmt.Errorf("Invalid credentials %q, want host=user:password", item)
+		}
+		creds = append(creds, &hostCredential{
+			pattern:  item[:eq],
+			username: item[eq+1 : colon],
+			password: item[colon+1:],
+		})
+	}
+	return creds, nil
+}
+
+// matchHost reports whether host, with any port stripped, matches the shell
+// pattern.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return matched
+}
+
+// hostPathRule matches requests whose host matches pattern, a shell
+// pattern, and whose path starts with prefix.
+type hostPathRule struct {
+	pattern string
+	prefix  string
+}
+
+// parseHostPathRules parses a comma separated list of host[/path]
+// entries, e.g. *.example.com or localhost/healthz.
+func parseHostPathRules(s string) []*hostPathRule {
+	var rules []*hostPathRule
+	for _, item := range splitList(s) {
+		rule := &hostPathRule{pattern: item}
+		if i := strings.Index(item, "/"); i >= 0 {
+			rule.pattern, rule.prefix = item[:i], item[i:]
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matchHostPath reports whether one of rules matches req.
+func matchHostPath(rules []*hostPathRule, req *http.Request) bool {
+	for _, rule := range rules {
+		if matchHost(rule.pattern, req.Host) && strings.HasPrefix(req.URL.Path, rule.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hw *HandlerWrapper) credentialFor(host string) *hostCredential {
+	for _, cred := range hw.credentials {
+		if matchHost(cred.pattern, host) {
+			return cred
+		}
+	}
+	return nil
+}
+
+func (cred *hostCredential) basic() string {
+	auth := cred.username + ":" + cred.password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
+
+// digestChallenge returns the parameters of a Digest challenge in resp, if
+// it carries one.
+func digestChallenge(resp *http.Response) string {
+	for _, value := range resp.Header["Www-Authenticate"] {
+		if len(value) > 7 && strings.EqualFold(value[:7], "digest ") {
+			return value[7:]
+		}
+	}
+	return ""
+}
+
+// parseAuthParams splits a list of key=value or key="quoted, value" params.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				end = len(s) - 1
+			}
+			value = s[1 : end+1]
+			s = s[end+1:]
+			if len(s) > 0 {
+				s = s[1:]
+			}
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// digest answers a Digest challenge (RFC 7616) for req.
+func (cred *hostCredential) digest(req *http.Request, challenge string) string {
+	params := parseAuthParams(challenge)
+	algorithm := params["algorithm"]
+	var h func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "SHA-256":
+		h = sha256.New
+	default:
+		h = md5.New
+	}
+	hexHash := func(parts ...string) string {
+		d := h()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	nc := "00000001"
+	uri := req.URL.RequestURI()
+
+	ha1 := hexHash(cred.username, params["realm"], cred.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = hexHash(ha1, params["nonce"], cnonce)
+	}
+	ha2 := hexHash(req.Method, uri)
+
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	var response string
+	if qop != "" {
+		response = hexHash(ha1, params["nonce"], nc, cnonce, qop, ha2)
+	} else {
+		response = hexHash(ha1, params["nonce"], ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		cred.username, params["realm"], params["nonce"], uri, response)
+	if algorithm != "" {
+		auth += ", algorithm=" + algorithm
+	}
+	if qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthBasicAdded(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		io.WriteString(w, user+":"+password)
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-auth", "127.0.0.1=user:pass:word")
+
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "user:pass:word" {
+		t.Errorf("origin got credentials %q", got)
+	}
+
+	// a client's own credentials are left alone
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.SetBasicAuth("client", "secret")
+	resp, err = p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "client:secret" {
+		t.Errorf("origin got credentials %q, want the client's", got)
+	}
+}
+
+func TestAuthNotAddedForOtherHosts(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-auth", "*.example.com=user:password")
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "" {
+		t.Errorf("origin not matching the pattern got Authorization %q", got)
+	}
+}
+
+func TestAuthDigestChallengeAnswered(t *testing.T) {
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Digest ") {
+			w.Header().Set("WWW-Authenticate", `Digest realm="test", nonce="abc123", qop="auth,auth-int", opaque="xyz"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		params := parseAuthParams(auth[7:])
+		ha1 := md5hex("user:test:password")
+		ha2 := md5hex(r.Method + ":" + r.URL.RequestURI())
+		want := md5hex(strings.Join([]string{ha1, "abc123", params["nc"], params["cnonce"], "auth", ha2}, ":"))
+		if params["response"] != want || params["opaque"] != "xyz" || params["uri"] != r.URL.RequestURI() {
+			t.Errorf("wrong digest answer %s", auth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(body)
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-auth", "127.0.0.1=user:password")
+
+	resp, err := p.client().Post(origin.URL+"/upload?x=1", "text/plain", strings.NewReader("the body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, resp)
+	if resp.StatusCode != http.StatusOK || got != "the body" {
+		t.Errorf("got %s %q, want the body sent again with the digest answer", resp.Status, got)
+	}
+}
+
+func TestParseCredentialsRejectsMalformed(t *testing.T) {
+	for _, s := range []string{"nouser", "=user:pass", "host=user"} {
+		if err := initError("-auth", s); err == nil {
+			t.Errorf("-auth %q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// logAuthAttempt logs the credentials req carries, as logAuthValue shows
+// them, with -log-auth.
+func logAuthAttempt(id string, req *http.Request, from string) {
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		for _, value := range req.Header.Values(name) {
+			logger.Infoln(id, "auth attempt by", from, "for", req.URL, name+":", logAuthValue(value))
+		}
+	}
+}
+
+// logAuthChallenge logs the challenges of a 401 or 407 response to req with
+// -log-auth. They carry no secrets and are logged as they are.
+func logAuthChallenge(id string, req *http.Request, resp *http.Response) {
+	name := "WWW-Authenticate"
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		name = "Proxy-Authenticate"
+	} else if resp.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	challenges := resp.Header.Values(name)
+	if len(challenges) == 0 {
+		logger.Infoln(id, "auth challenge", resp.StatusCode, "for", req.URL, "without", name)
+	}
+	for _, challenge := range challenges {
+		logger.Infoln(id, "auth challenge", resp.StatusCode, "for", req.URL, name+":", challenge)
+	}
+}
+
+// logAuthValue returns an Authorization value fit for the log: the scheme
+// and who is authenticating, with the secret redacted.
+func logAuthValue(value string) string {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest))
+		if user, _, ok := strings.Cut(string(decoded), ":"); err == nil && ok {
+			return fmt.Sprintf("%s user=%q password=%s", scheme, user, redactedValue)
+		}
+	case "digest":
+		params := parseAuthParams(rest)
+		return fmt.Sprintf("%s username=%q realm=%q uri=%q response=%s",
+			scheme, params["username"], params["realm"], params["uri"], redactedValue)
+	}
+	return scheme + " " + redactedValue
+}
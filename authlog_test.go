@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// basicAuthOrigin challenges requests without credentials.
+func basicAuthOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func authGet(t *testing.T, p *testProxy, url, authorization string) int {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	return resp.StatusCode
+}
+
+func TestAuthChallengeAndAttemptLogged(t *testing.T) {
+	logged := captureLog(t, LevelInfo)
+	origin := basicAuthOrigin(t)
+	p := newTestProxy(t, "-log-auth")
+	if status := authGet(t, p, origin.URL+"/private", ""); status != http.StatusUnauthorized {
+		t.Fatalf("request without credentials got %d", status)
+	}
+	// alice:hunter2
+	if status := authGet(t, p, origin.URL+"/private", "Basic YWxpY2U6aHVudGVyMg=="); status != http.StatusOK {
+		t.Fatalf("request with credentials got %d", status)
+	}
+	for _, want := range []string{
+		"auth challenge 401 for " + origin.URL + `/private WWW-Authenticate: Basic realm="test"`,
+		"auth attempt by client for " + origin.URL + `/private Authorization: Basic user="alice" password=` + redactedValue,
+	} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log lacks %q, got:\n%s", want, logged)
+		}
+	}
+	if out := logged.String(); strings.Contains(out, "hunter2") || strings.Contains(out, "YWxpY2U6aHVudGVyMg") {
+		t.Errorf("password logged:\n%s", out)
+	}
+}
+
+func TestAuthAddedByProxyLogged(t *testing.T) {
+	logged := captureLog(t, LevelInfo)
+	origin := basicAuthOrigin(t)
+	p := newTestProxy(t, "-log-auth", "-auth", "127.0.0.1=bob:s3cret")
+	if status := authGet(t, p, origin.URL, ""); status != http.StatusOK {
+		t.Fatalf("request the proxy adds credentials to got %d", status)
+	}
+	want := "auth attempt by proxy for " + origin.URL + `/ Authorization: Basic user="bob" password=` + redactedValue
+	if out := logged.String(); !strings.Contains(out, want) || strings.Contains(out, "s3cret") {
+		t.Errorf("log lacks %q or holds the password, got:\n%s", want, out)
+	}
+}
+
+func TestAuthNotLoggedByDefault(t *testing.T) {
+	logged := captureLog(t, LevelDebug)
+	origin := basicAuthOrigin(t)
+	p := newTestProxy(t)
+	authGet(t, p, origin.URL, "")
+	authGet(t, p, origin.URL, "Basic YWxpY2U6aHVudGVyMg==")
+	if out := logged.String(); strings.Contains(out, "auth challenge") || strings.Contains(out, "auth attempt") {
+		t.Errorf("auth logged without -log-auth:\n%s", out)
+	}
+}
+
+func TestLogAuthValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"Basic YWxpY2U6aHVudGVyMg==": `Basic user="alice" password=` + redactedValue,
+		"Basic not-base64":           "Basic " + redactedValue,
+		"Bearer eyJhbGciOi.x.y":      "Bearer " + redactedValue,
+		`Digest username="alice", realm="r", uri="/a", nonce="n", response="0123abcd"`: `Digest username="alice" realm="r" uri="/a" response=` + redactedValue,
+	} {
+		if got := logAuthValue(value); got != want {
+			t.Errorf("logAuthValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
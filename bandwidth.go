@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bandwidthRule paces responses to requests whose host matches pattern and
+// whose path starts with prefix to rate bytes a second.
+type bandwidthRule struct {
+	pattern string
+	prefix  string
+	rate    int64
+}
+
+// parseBandwidthRules parses a comma separated list of
+// host[/path]=bytes_per_second entries, e.g. *.example.com=65536. The host
+// is a shell pattern, the path a prefix.
+func parseBandwidthRules(s string) ([]*bandwidthRule, error) {
+	var rules []*bandwidthRule
+	for _, item := range splitList(s) {
+		target, rate, ok := strings.Cut(item, "=")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("Invalid bandwidth rule %q, want host[/path]=bytes_per_second", item)
+		}
+		rule := &bandwidthRule{pattern: target}
+		if i := strings.Index(target, "/"); i >= 0 {
+			rule.pattern, rule.prefix = target[:i], target[i:]
+		}
+		var err error
+		if rule.rate, err = strconv.ParseInt(rate, 10, 64); err != nil || rule.rate <= 0 {
+			return nil, fmt.Errorf("Invalid bandwidth rule %q: %q is not a positive number of bytes a second", item, rate)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// bandwidthFor returns the rate in bytes a second of the first bandwidth
+// rule matching req, 0 if none does.
+func (hw *HandlerWrapper) bandwidthFor(req *http.Request) int64 {
+	for _, rule := range hw.bandwidth {
+		if matchHost(rule.pattern, req.Host) && strings.HasPrefix(req.URL.Path, rule.prefix) {
+			return rule.rate
+		}
+	}
+	return 0
+}
+
+// pacedWriter writes to w at no more than rate bytes a second on average,
+// as a client behind a link of that bandwidth would receive a response, so
+// a large one takes proportionally longer. The clock starts at the first
+// write.
+type pacedWriter struct {
+	ctx   context.Context
+	w     io.Writer
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func (p *pacedWriter) Write(b []byte) (int, error) {
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	// a twentieth of a second's worth at a time keeps the pace smooth
+	size := int(max(p.rate/20, 1))
+	n := 0
+	for len(b) > 0 {
+		m, err := p.w.Write(b[:min(len(b), size)])
+		n += m
+		p.sent += int64(m)
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+		due := p.start.Add(time.Duration(float64(p.sent) / float64(p.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-p.ctx.Done():
+				timer.Stop()
+				return n, p.ctx.Err()
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthPacesMatchingResponses(t *testing.T) {
+	body := strings.Repeat("x", 20000)
+	origin := textOrigin(t, body)
+	p := newTestProxy(t, "-bandwidth", "127.0.0.1/slow=40000")
+
+	start := time.Now()
+	if _, got := getThrough(t, p, origin.URL+"/slow/file"); got != body {
+		t.Errorf("paced response got %d bytes, want %d", len(got), len(body))
+	}
+	// 20000 bytes at 40000 a second, plus the head
+	if took := time.Since(start); took < 450*time.Millisecond || took > 3*time.Second {
+		t.Errorf("paced response took %s, want about 500ms", took)
+	}
+
+	start = time.Now()
+	if _, got := getThrough(t, p, origin.URL+"/fast"); got != body {
+		t.Errorf("unpaced response got %d bytes", len(got))
+	}
+	if took := time.Since(start); took > 200*time.Millisecond {
+		t.Errorf("response outside -bandwidth took %s", took)
+	}
+}
+
+func TestPacedWriterStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var out bytes.Buffer
+	w := &pacedWriter{ctx: ctx, w: &out, rate: 100}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	// would take 10s at 100 bytes a second
+	n, err := w.Write(make([]byte, 1000))
+	if err != context.Canceled || n >= 1000 || n != out.Len() {
+		t.Errorf("canceled write wrote %d bytes with %v", n, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("canceled write took %s", took)
+	}
+}
+
+func TestBandwidthRules(t *testing.T) {
+	rules, err := parseBandwidthRules("*.example.com=65536, api.test/v1/=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].pattern != "*.example.com" || rules[0].prefix != "" || rules[0].rate != 65536 ||
+		rules[1].pattern != "api.test" || rules[1].prefix != "/v1/" || rules[1].rate != 1000 {
+		t.Errorf("parsed rules %+v %+v", rules[0], rules[1])
+	}
+	for _, s := range []string{"example.com", "=100", "example.com=0", "example.com=-5", "example.com=fast"} {
+		if err := initError("-bandwidth", s); err == nil {
+			t.Errorf("-bandwidth %q accepted", s)
+		}
+	}
+}
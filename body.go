@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+)
+
+// maxDumpBody is how much of a request body is kept for monitoring and
+// capture.
+const maxDumpBody = 1 << 20
+
+// dumpHeaderExclude lists the header fields dumpRequestHead writes itself.
+var dumpHeaderExclude = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+}
+
+// dumpRequestHead dumps the request line and header of req as they are sent
+// to the origin. httputil.DumpRequestOut would make up a stand-in for the
+// whole body even when asked to leave it out.
+func dumpRequestHead(req *http.Request) []byte {
+	var b bytes.Buffer
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	if req.ContentLength > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", req.ContentLength)
+	} else if isChunked(req.TransferEncoding) {
+		b.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	req.Header.WriteSubset(&b, dumpHeaderExclude)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// dechunk decodes a chunked body, dropping any trailer. A body that isn't
+// validly chunked is returned as is.
+func dechunk(body []byte) []byte {
+	decoded, err := ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+	if err != nil {
+		logger.Debugln("dechunk body error:", err)
+		return body
+	}
+	return decoded
+}
+
+// hijackedBody returns a reader for the body of req from br, the reader of
+// the hijacked client connection conn. The server's own body reader must not
+// be used after a hijack, reaching its end starts a read on the connection.
+// A client waiting for 100 Continue is sent one on the first read.
+func hijackedBody(req *http.Request, conn net.Conn, br *bufio.Reader) io.ReadCloser {
+	var r io.Reader
+	switch {
+	case req.ContentLength > 0:
+		r = io.LimitReader(br, req.ContentLength)
+	case isChunked(req.TransferEncoding):
+		r = &chunkedBody{r: httputil.NewChunkedReader(br), br: br}
+	default:
+		return http.NoBody
+	}
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Header.Del("Expect")
+		r = &continueReader{r: r, conn: conn}
+	}
+	return ioutil.NopCloser(r)
+}
+
+// chunkedBody reads a chunked body and the trailer following it.
+type chunkedBody struct {
+	r  io.Reader
+	br *bufio.Reader
+}
+
+func (cb *chunkedBody) Read(p []byte) (int, error) {
+	n, err := cb.r.Read(p)
+	if err == io.EOF {
+		if _, terr := textproto.NewReader(cb.br).ReadMIMEHeader(); terr != nil {
+			err = terr
+		}
+	}
+	return n, err
+}
+
+// continueReader tells the client to send the body once it is first read.
+type continueReader struct {
+	r    io.Reader
+	conn net.Conn
+	sent bool
+}
+
+func (cr *continueReader) Read(p []byte) (int, error) {
+	if !cr.sent {
+		cr.sent = true
+		if _, err := io.WriteString(cr.conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	return cr.r.Read(p)
+}
+
+// writeInformational writes a 1xx response with header to w.
+func writeInformational(w io.Writer, code int, header http.Header) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// bodyCapture keeps the first max bytes of a body as it is read and counts
+// all of them. The kept bytes are added to lease.
+type bodyCapture struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	max   int
+	n     int64
+	lease *budgetLease
+}
+
+func (bc *bodyCapture) Read(p []byte) (int, error) {
+	n, err := bc.ReadCloser.Read(p)
+	bc.n += int64(n)
+	if room := bc.max - bc.buf.Len(); room > 0 {
+		kept := min(n, room)
+		bc.buf.Write(p[:kept])
+		bc.lease.add(kept)
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadOrigin answers with the length and sha256 of the bodies it gets,
+// telling started once the first byte of one arrived.
+func uploadOrigin(t *testing.T) (*httptest.Server, chan struct{}) {
+	started := make(chan struct{}, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		if _, err := br.Peek(1); err == nil {
+			started <- struct{}{}
+		}
+		h := sha256.New()
+		n, _ := io.Copy(h, br)
+		fmt.Fprintf(w, "%d %x", n, h.Sum(nil))
+	}))
+	t.Cleanup(origin.Close)
+	return origin, started
+}
+
+func TestUploadStreamedToOrigin(t *testing.T) {
+	origin, started := uploadOrigin(t)
+	c := newCollector(t)
+	p := newTestProxy(t, "-collector", c.URL, "-collector-batch", "1")
+	chunk := bytes.Repeat([]byte("upload data 0123"), 1<<16)
+	const chunks = 16
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(chunk)
+		// the rest only follows once the origin is receiving
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(fmt.Errorf("upload held back until the client finished it"))
+			return
+		}
+		for i := 1; i < chunks; i++ {
+			pw.Write(chunk)
+		}
+		pw.Close()
+	}()
+	// a body of unknown length goes chunked
+	resp, err := p.client().Post(origin.URL+"/upload", "application/octet-stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.New()
+	for i := 0; i < chunks; i++ {
+		want.Write(chunk)
+	}
+	if got := readAll(t, resp); got != fmt.Sprintf("%d %x", chunks*len(chunk), want.Sum(nil)) {
+		t.Errorf("origin got %s, want %d bytes", got, chunks*len(chunk))
+	}
+
+	// only the start of the body is captured, all of it counted
+	var tr *Transaction
+	select {
+	case batch := <-c.got:
+		tr = batch[0]
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload never exported")
+	}
+	if len(tr.RequestBody) != maxDumpBody || !strings.HasPrefix(tr.RequestBody, "upload data 0123") {
+		t.Errorf("captured %d bytes of the body, want the first %d", len(tr.RequestBody), maxDumpBody)
+	}
+	if tr.RequestSize < int64(chunks*len(chunk)) {
+		t.Errorf("request size %d, less than the %d byte body", tr.RequestSize, chunks*len(chunk))
+	}
+}
+
+func TestUploadWithContentLength(t *testing.T) {
+	origin, _ := uploadOrigin(t)
+	p := newTestProxy(t)
+	body := bytes.Repeat([]byte("x"), 3<<20)
+	resp, err := p.client().Post(origin.URL, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != fmt.Sprintf("%d %x", len(body), sha256.Sum256(body)) {
+		t.Errorf("origin got %s, want %d bytes", got, len(body))
+	}
+}
+
+func TestUploadExpectContinue(t *testing.T) {
+	origin, _ := uploadOrigin(t)
+	p := newTestProxy(t)
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "POST %s/ HTTP/1.1\r\nHost: %s\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	// the body is only sent once the proxy says to go on
+	line, err := br.ReadString('\n')
+	if err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("got %q %v, want 100 Continue", line, err)
+	}
+	br.ReadString('\n')
+	io.WriteString(conn, "hello")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != fmt.Sprintf("5 %x", sha256.Sum256([]byte("hello"))) {
+		t.Errorf("origin got %s", got)
+	}
+}
+
+func TestChunkedResponseDecodedInCaptures(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range []string{"first part, ", "second part"} {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer origin.Close()
+	c := newCollector(t)
+	p := newTestProxy(t, "-collector", c.URL, "-collector-batch", "1")
+
+	// the client still gets the origin's chunked framing
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isChunked(resp.TransferEncoding) {
+		t.Errorf("client got Transfer-Encoding %v, want chunked", resp.TransferEncoding)
+	}
+	if body := readAll(t, resp); body != "first part, second part" {
+		t.Errorf("client got %q", body)
+	}
+
+	select {
+	case batch := <-c.got:
+		if got := batch[0].ResponseBody; got != "first part, second part" {
+			t.Errorf("captured body %q, want the decoded content", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing posted to the collector")
+	}
+}
+
+func TestDechunk(t *testing.T) {
+	for body, want := range map[string]string{
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n":        "hello world",
+		"5\r\nhello\r\n0\r\nX-Trailer: dropped\r\n\r\n": "hello",
+		"not chunked at all":                            "not chunked at all",
+		"5\r\nhel":                                      "5\r\nhel",
+	} {
+		if got := string(dechunk([]byte(body))); got != want {
+			t.Errorf("dechunk(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+// methodOrigin answers with the method, framing and body of each request.
+func methodOrigin(t *testing.T, newServer func(http.Handler) *httptest.Server) *httptest.Server {
+	origin := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s te=%v cl=%d body=%q", r.Method, r.TransferEncoding, r.ContentLength, b)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestArbitraryMethodsForwarded(t *testing.T) {
+	const propfind = `<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`
+	for _, newServer := range []func(http.Handler) *httptest.Server{httptest.NewServer, httptest.NewTLSServer} {
+		origin := methodOrigin(t, newServer)
+		p := newTestProxy(t, "-intercept-ports", portOf(origin))
+		if origin.TLS != nil {
+			p.trust(origin)
+		}
+		for _, tc := range []struct {
+			method string
+			body   io.Reader
+			want   string
+		}{
+			{"PROPFIND", strings.NewReader(propfind), fmt.Sprintf("PROPFIND te=[] cl=%d body=%q", len(propfind), propfind)},
+			{"PATCH", strings.NewReader(`{"op":"replace"}`), `PATCH te=[] cl=16 body="{\"op\":\"replace\"}"`},
+			{"PATCH", nil, `PATCH te=[] cl=0 body=""`},
+			{"MKCALENDAR", nil, `MKCALENDAR te=[] cl=0 body=""`},
+			{"X-CUSTOM_verb", strings.NewReader("custom"), `X-CUSTOM_verb te=[] cl=6 body="custom"`},
+			// a body of unknown length stays chunked
+			{"PROPFIND", io.MultiReader(strings.NewReader(propfind)), fmt.Sprintf("PROPFIND te=[chunked] cl=-1 body=%q", propfind)},
+		} {
+			req, _ := http.NewRequest(tc.method, origin.URL+"/dav/", tc.body)
+			resp, err := p.client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readAll(t, resp); got != tc.want {
+				t.Errorf("%s got %q, want %q", origin.URL, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestChunkedRequestDumpedWithLength(t *testing.T) {
+	origin := methodOrigin(t, httptest.NewServer)
+	p := newTestProxy(t, "-m", "-monitor-block")
+	printed := monitorOutput(t, p.monitor)
+	// a form of unknown length goes chunked
+	req, _ := http.NewRequest("POST", origin.URL, io.MultiReader(strings.NewReader("a=1&b=two")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != `POST te=[chunked] cl=-1 body="a=1&b=two"` {
+		t.Errorf("origin got %q", got)
+	}
+	select {
+	case out := <-printed:
+		// the dump parses, so the monitor shows the form
+		if !strings.Contains(out, "Content-Length: 9") || !strings.Contains(out, "[two]") {
+			t.Errorf("monitor printed:\n%s", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing printed by the monitor")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxBreakerHosts is how many hosts a Breaker tracks at most.
+const maxBreakerHosts = 4096
+
+// Breaker is a per-host circuit breaker. After threshold consecutive failures
+// a host is cut off for the cooldown, after which a single probe request is
+// let through to find out whether it has recovered. Hosts that failed no
+// request for a cooldown, and aren't cut off, are forgotten once another
+// host fails, and the longest idle make room when maxBreakerHosts are
+// tracked.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	mutex     sync.Mutex
+	hosts     map[string]*breakerState
+}
+
+type breakerState struct {
+	failures    int
+	openUntil   time.Time
+	lastFailure time.Time
+}
+
+// NewBreaker creates a Breaker opening after threshold consecutive failures.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*breakerState),
+	}
+}
+
+// Allow reports whether a request to host may be attempted. Every allowed
+// request has to be followed by a call to Success or Failure.
+func (b *Breaker) Allow(host string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state := b.hosts[host]
+	if state == nil || state.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(state.openUntil) {
+		return false
+	}
+	// let this request probe the host, holding off others until it is done
+	state.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Success records a successful request to host, closing its breaker.
+func (b *Breaker) Success(host string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if state := b.hosts[host]; state != nil && state.failures >= b.threshold {
+		log.Printf("circuit breaker for %s closed", host)
+	}
+	delete(b.hosts, host)
+}
+
+// Failure records a failed request to host, opening its breaker once the
+// threshold is reached.
+func (b *Breaker) Failure(host string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	state := b.hosts[host]
+	if state == nil {
+		b.prune(now)
+		state = &breakerState{}
+		b.hosts[host] = state
+	}
+	state.failures++
+	state.lastFailure = now
+	if state.failures >= b.threshold {
+		if state.failures == b.threshold {
+			log.Printf("circuit breaker for %s opened after %d failures", host, state.failures)
+		}
+		state.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// prune drops the hosts that haven't failed for a cooldown and aren't cut
+// off, then the longest idle until there is room for another host. b.mutex
+// must be held.
+func (b *Breaker) prune(now time.Time) {
+	for host, state := range b.hosts {
+		if now.Sub(state.lastFailure) >= b.cooldown && !now.Before(state.openUntil) {
+			delete(b.hosts, host)
+		}
+	}
+	for len(b.hosts) >= maxBreakerHosts {
+		var oldest string
+		for host, state := range b.hosts {
+			if oldest == "" || state.lastFailure.Before(b.hosts[oldest].lastFailure) {
+				oldest = host
+			}
+		}
+		delete(b.hosts, oldest)
+	}
+}
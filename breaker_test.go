@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	var hits, status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-breaker-failures", "2", "-breaker-cooldown", "300ms")
+	get := func() *http.Response {
+		t.Helper()
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get(); resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("request %d got %s from the origin", i, resp.Status)
+		}
+	}
+	resp := get()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("open breaker answered %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+	if hits.Load() != 2 {
+		t.Errorf("origin got %d requests through an open breaker", hits.Load()-2)
+	}
+
+	// after the cooldown a probe finds the origin recovered
+	status.Store(http.StatusOK)
+	time.Sleep(400 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if resp := get(); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d after recovery got %s", i, resp.Status)
+		}
+	}
+}
+
+func TestBreakerCountsDialFailures(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	origin.Close()
+	p := newTestProxy(t, "-breaker-failures", "1", "-breaker-cooldown", "1m")
+	statuses := []int{}
+	for i := 0; i < 2; i++ {
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if statuses[0] != http.StatusBadGateway || statuses[1] != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want a 502 then the open breaker's 503", statuses)
+	}
+}
+
+func TestBreakerLetsOneProbeThrough(t *testing.T) {
+	b := NewBreaker(1, 100*time.Millisecond)
+	b.Failure("a:80")
+	if b.Allow("a:80") {
+		t.Fatal("open breaker allowed a request")
+	}
+	if !b.Allow("b:80") {
+		t.Fatal("breaker of one host held back another")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow("a:80") {
+		t.Fatal("no probe allowed after the cooldown")
+	}
+	if b.Allow("a:80") {
+		t.Error("second request allowed while the probe is out")
+	}
+	b.Success("a:80")
+	if !b.Allow("a:80") {
+		t.Error("breaker stayed open after a successful probe")
+	}
+}
+
+func TestBreakerForgetsIdleHosts(t *testing.T) {
+	b := NewBreaker(2, 50*time.Millisecond)
+	b.Failure("idle:80")
+	b.Failure("open:80")
+	b.Failure("open:80")
+	time.Sleep(60 * time.Millisecond)
+	// open:80 was probed and failed again, so it stays cut off
+	if !b.Allow("open:80") {
+		t.Fatal("no probe allowed after the cooldown")
+	}
+	b.Failure("open:80")
+	b.Failure("new:80")
+	if _, ok := b.hosts["idle:80"]; ok || len(b.hosts) != 2 {
+		t.Errorf("tracking %d hosts after the idle one's cooldown", len(b.hosts))
+	}
+	if b.Allow("open:80") {
+		t.Error("open breaker forgotten")
+	}
+
+	for i := 0; i <= maxBreakerHosts; i++ {
+		b.Failure(fmt.Sprintf("host%d:80", i))
+	}
+	if len(b.hosts) > maxBreakerHosts {
+		t.Errorf("tracking %d hosts, above the cap of %d", len(b.hosts), maxBreakerHosts)
+	}
+}
@@ -28,15 +28,21 @@ func NewCache() *Cache {
 // hasn't expired.  If the key was never set, or has expired, found will be
 // false.
 func (cache *Cache) Get(key string) (val interface{}, found bool) {
+	val, _, found = cache.GetWithExpiration(key)
+	return
+}
+
+// GetWithExpiration is like Get, but also returns when the value expires.
+func (cache *Cache) GetWithExpiration(key string) (val interface{}, expiration time.Time, found bool) {
 	cache.mutex.RLock()
 	defer cache.mutex.RUnlock()
 	entry := cache.entries[key]
 	if entry == nil {
-		return nil, false
+		return nil, time.Time{}, false
 	} else if entry.expiration.Before(time.Now()) {
-		return nil, false
+		return nil, time.Time{}, false
 	} else {
-		return entry.data, true
+		return entry.data, entry.expiration, true
 	}
 }
 
@@ -46,3 +52,27 @@ func (cache *Cache) Set(key string, data interface{}, ttl time.Duration) {
 	defer cache.mutex.Unlock()
 	cache.entries[key] = &entry{data, time.Now().Add(ttl)}
 }
+
+// Delete removes the value for the given key, reporting whether there was an
+// unexpired one.
+func (cache *Cache) Delete(key string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := cache.entries[key]
+	delete(cache.entries, key)
+	return entry != nil && !entry.expiration.Before(time.Now())
+}
+
+// Expirations returns when each unexpired value expires, by key.
+func (cache *Cache) Expirations() map[string]time.Time {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	now := time.Now()
+	expirations := make(map[string]time.Time, len(cache.entries))
+	for key, entry := range cache.entries {
+		if !entry.expiration.Before(now) {
+			expirations[key] = entry.expiration
+		}
+	}
+	return expirations
+}
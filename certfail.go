@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCertFailing is returned for hosts whose cert recently failed to mint.
+var errCertFailing = errors.New("cert recently failed to mint")
+
+// certFailure is how minting certs for a host has been failing.
+type certFailure struct {
+	Count      int       `json:"count"`
+	Error      string    `json:"error"`
+	RetryAfter time.Time `json:"retryAfter"`
+}
+
+// maxCertFailures is how many hosts certFailures remembers at most.
+const maxCertFailures = 1024
+
+// certFailures counts cert minting failures per host and remembers them for
+// ttl, so handshakes for a host whose cert can't be minted fail fast
+// instead of minting again. Hosts are forgotten once their ttl is over and
+// another host fails, and the ones closest to a retry make room when
+// maxCertFailures are remembered.
+type certFailures struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	hosts map[string]*certFailure
+}
+
+func newCertFailures(ttl time.Duration) *certFailures {
+	return &certFailures{ttl: ttl, hosts: make(map[string]*certFailure)}
+}
+
+// check returns an error wrapping errCertFailing if minting for name failed
+// less than ttl ago.
+func (f *certFailures) check(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	failure, ok := f.hosts[name]
+	if !ok || !time.Now().Before(failure.RetryAfter) {
+		return nil
+	}
+	return fmt.Errorf("%w for %s, retrying after %s: %s", errCertFailing, name,
+		failure.RetryAfter.Format(time.RFC3339), failure.Error)
+}
+
+// fail records that minting for name failed with err.
+func (f *certFailures) fail(name string, err error) {
+	f.mutex.Lock()
+	failure, ok := f.hosts[name]
+	if !ok {
+		f.prune(time.Now())
+		failure = &certFailure{}
+		f.hosts[name] = failure
+	}
+	failure.Count++
+	failure.Error = err.Error()
+	failure.RetryAfter = time.Now().Add(f.ttl)
+	count := failure.Count
+	f.mutex.Unlock()
+	logger.Warnf("minting mitm cert for %s failed %d times, not retrying for %s: %s", name, count, f.ttl, err)
+}
+
+// prune drops the failures whose ttl is over, then the ones closest to a
+// retry until there is room for another host. f.mutex must be held.
+func (f *certFailures) prune(now time.Time) {
+	for name, failure := range f.hosts {
+		if !now.Before(failure.RetryAfter) {
+			delete(f.hosts, name)
+		}
+	}
+	for len(f.hosts) >= maxCertFailures {
+		var oldest string
+		for name, failure := range f.hosts {
+			if oldest == "" || failure.RetryAfter.Before(f.hosts[oldest].RetryAfter) {
+				oldest = name
+			}
+		}
+		delete(f.hosts, oldest)
+	}
+}
+
+// succeed forgets the failures for name.
+func (f *certFailures) succeed(name string) {
+	f.mutex.Lock()
+	delete(f.hosts, name)
+	f.mutex.Unlock()
+}
+
+// snapshot returns a copy of the failures by host.
+func (f *certFailures) snapshot() map[string]certFailure {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	hosts := make(map[string]certFailure, len(f.hosts))
+	for name, failure := range f.hosts {
+		hosts[name] = *failure
+	}
+	return hosts
+}
+
+// handleCertFailures returns the hosts whose certs failed to mint as JSON.
+func (hw *HandlerWrapper) handleCertFailures(resp http.ResponseWriter, req *http.Request) {
+	writeJSON(resp, hw.certFailures.snapshot())
+}
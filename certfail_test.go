@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// failedHandshake intercepts a tunnel to origin asking for server name sni,
+// failing the test if the handshake succeeds.
+func failedHandshake(t *testing.T, p *testProxy, addr, sni string) {
+	t.Helper()
+	conn := p.connect(t, addr)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Fatalf("handshake for %s succeeded without a cert", sni)
+	}
+}
+
+func TestCertFailuresFailFast(t *testing.T) {
+	origin := tlsOrigin(t)
+	addr := origin.Listener.Addr().String()
+	pk, cert := tempCA(t)
+	// names outside the CA's constraints can't be minted for
+	p := newTestProxyCA(t, pk, cert, "-intercept-ports", portOf(origin), "-admin", "127.0.0.1:0",
+		"-ca-domains", "example.com", "-cert-fail-ttl", "300ms")
+	admin := p.admin(t)
+	failures := func() map[string]certFailure {
+		var hosts map[string]certFailure
+		if status := getJSON(t, admin.URL+"/cert-failures", &hosts); status != http.StatusOK {
+			t.Fatalf("/cert-failures got %d", status)
+		}
+		return hosts
+	}
+
+	failedHandshake(t, p, addr, "other.test")
+	got := failures()["other.test"]
+	if got.Count != 1 || got.Error == "" {
+		t.Fatalf("first failure recorded as %+v", got)
+	}
+	// within the ttl handshakes fail without minting again
+	failedHandshake(t, p, addr, "other.test")
+	if _, err := p.FakeCertForName("other.test"); !errors.Is(err, errCertFailing) {
+		t.Errorf("minting within the ttl got %v, want errCertFailing", err)
+	}
+	if got := failures()["other.test"]; got.Count != 1 {
+		t.Errorf("%d failures within the ttl, want no retries", got.Count)
+	}
+	// the other hosts still mint
+	if _, err := p.FakeCertForName("www.example.com"); err != nil {
+		t.Errorf("minting for a permitted host: %s", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	failedHandshake(t, p, addr, "other.test")
+	if got := failures()["other.test"]; got.Count != 2 {
+		t.Errorf("%d failures after the ttl, want a retry", got.Count)
+	}
+}
+
+func TestCertFailuresPruned(t *testing.T) {
+	f := newCertFailures(50 * time.Millisecond)
+	f.fail("expired.test", errors.New("failed"))
+	time.Sleep(50 * time.Millisecond)
+	f.fail("recent.test", errors.New("failed"))
+	hosts := f.snapshot()
+	if _, ok := hosts["expired.test"]; ok || len(hosts) != 1 {
+		t.Errorf("remembered %v after its ttl", hosts)
+	}
+}
+
+func TestCertFailuresCapped(t *testing.T) {
+	f := newCertFailures(time.Hour)
+	for i := 0; i < maxCertFailures+10; i++ {
+		f.fail(fmt.Sprintf("host%d.test", i), errors.New("failed"))
+	}
+	hosts := f.snapshot()
+	if len(hosts) != maxCertFailures {
+		t.Fatalf("%d hosts remembered, want at most %d", len(hosts), maxCertFailures)
+	}
+	// the ones failing first made room
+	if _, ok := hosts["host0.test"]; ok {
+		t.Error("oldest failure kept over the cap")
+	}
+	if _, ok := hosts[fmt.Sprintf("host%d.test", maxCertFailures+9)]; !ok {
+		t.Error("latest failure not remembered")
+	}
+}
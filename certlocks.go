@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// nameLocks hands out one lock per name, so minting a cert for one host
+// doesn't hold up handshakes needing a cert for another. A name's lock is
+// dropped once nobody holds or waits on it. The zero value is ready to use.
+type nameLocks struct {
+	mutex sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks name and returns the function unlocking it.
+func (l *nameLocks) lock(name string) (unlock func()) {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*nameLock)
+	}
+	nl := l.locks[name]
+	if nl == nil {
+		nl = &nameLock{}
+		l.locks[name] = nl
+	}
+	nl.refs++
+	l.mutex.Unlock()
+
+	nl.Lock()
+	return func() {
+		nl.Unlock()
+		l.mutex.Lock()
+		nl.refs--
+		if nl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mutex.Unlock()
+	}
+}
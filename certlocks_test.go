@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentHandshakesShareMintedCert(t *testing.T) {
+	hw := newTestHandler(t)
+	names := []string{"a.example.test", "b.example.test", "c.example.test", "d.example.test"}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	minted := make(map[string][][]byte)
+	for i := 0; i < 64; i++ {
+		name := names[i%len(names)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := hw.FakeCertForName(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := cert.Leaf.VerifyHostname(name); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			minted[name] = append(minted[name], cert.Certificate[0])
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	// each name was minted once, every handshake for it got that cert
+	for name, certs := range minted {
+		for _, cert := range certs[1:] {
+			if !bytes.Equal(cert, certs[0]) {
+				t.Errorf("%s minted more than once", name)
+				break
+			}
+		}
+	}
+	if n := len(hw.certLocks.locks); n != 0 {
+		t.Errorf("%d name locks left once all handshakes are done", n)
+	}
+}
+
+func TestMintingOneNameDoesntHoldUpOthers(t *testing.T) {
+	hw := newTestHandler(t)
+	// a mint for slow.example.test is under way
+	unlock := hw.certLocks.lock("slow.example.test")
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := hw.FakeCertForName("slow.example.test")
+		slowDone <- err
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := hw.FakeCertForName("other.example.test")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mint for another name waited on slow.example.test")
+	}
+	select {
+	case <-slowDone:
+		t.Fatal("second mint for slow.example.test didn't wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkFakeCertForNameDistinct mints certs for distinct names from
+// parallel handshakes, as when many new hosts are intercepted at once.
+func BenchmarkFakeCertForNameDistinct(b *testing.B) {
+	hw := newTestHandler(b)
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := hw.FakeCertForName(fmt.Sprintf("host%d.example.test", n.Add(1))); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// BenchmarkFakeCertForNameCached gets the cached certs of a few names from
+// parallel handshakes.
+func BenchmarkFakeCertForNameCached(b *testing.B) {
+	hw := newTestHandler(b)
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := hw.FakeCertForName(fmt.Sprintf("host%d.example.test", n.Add(1)%8)); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ClientAuth makes intercepted handshakes for server names matching
+// Pattern ask the client for a certificate.
+type ClientAuth struct {
+	Pattern string
+	Type    tls.ClientAuthType
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+	"verify":  tls.RequireAndVerifyClientCert,
+}
+
+// parseClientAuth parses comma separated host=mode rules, e.g.
+// *.bank.test=verify. request asks for a cert, require fails the handshake
+// without one and verify also checks it against the client CAs.
+func parseClientAuth(s string) ([]*ClientAuth, error) {
+	var rules []*ClientAuth
+	for _, item := range splitList(s) {
+		pattern, mode, ok := strings.Cut(item, "=")
+		authType, known := clientAuthTypes[mode]
+		if !ok || pattern == "" || !known {
+			return nil, fmt.Errorf("Invalid client auth rule %q, want host=request, require or verify", item)
+		}
+		rules = append(rules, &ClientAuth{Pattern: pattern, Type: authType})
+	}
+	return rules, nil
+}
+
+// loadClientCAs reads the PEM certs in path into a pool.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certs found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientAuthConfig returns config asking for a client cert as the first rule
+// matching name says, nil if none does.
+func (tc *TlsConfig) clientAuthConfig(config *tls.Config, name string) *tls.Config {
+	for _, rule := range tc.ClientAuth {
+		if !matchHost(rule.Pattern, name) {
+			continue
+		}
+		config = config.Clone()
+		config.ClientAuth = rule.Type
+		config.ClientCAs = tc.ClientCAs
+		return config
+	}
+	return nil
+}
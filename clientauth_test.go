@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientCA makes a CA for client certs, returning a file holding its cert
+// and a func issuing client certs for cn.
+func clientCA(t *testing.T) (string, func(cn string) tls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	path := filepath.Join(t.TempDir(), "client-ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	issue := func(cn string) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: crypto.Signer(key)}
+	}
+	return path, issue
+}
+
+// peerCertFilter keeps the common name of the cert the client presented
+// with the request for each path, "" for none.
+type peerCertFilter struct {
+	mu  sync.Mutex
+	got map[string]string
+}
+
+func (f *peerCertFilter) Match(req *http.Request) bool {
+	cn := ""
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cn = req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	f.mu.Lock()
+	f.got[req.URL.Path] = cn
+	f.mu.Unlock()
+	return false
+}
+
+func (f *peerCertFilter) Filter(*http.Request, *capturedResponse) {}
+
+// clientWithCert returns a client like p.client presenting cert, if any.
+func clientWithCert(p *testProxy, cert *tls.Certificate) *http.Client {
+	c := p.client()
+	if cert != nil {
+		c.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	return c
+}
+
+func TestClientAuthRequest(t *testing.T) {
+	caFile, issue := clientCA(t)
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-client-auth", "127.0.0.*=request", "-client-ca", caFile)
+	p.trust(origin)
+	f := &peerCertFilter{got: map[string]string{}}
+	p.filters = append(p.filters, f)
+
+	alice := issue("alice")
+	for path, cert := range map[string]*tls.Certificate{"/with": &alice, "/without": nil} {
+		resp, err := clientWithCert(p, cert).Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+	}
+	// the request made with the cert shows it, the one without goes on
+	// without one
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if with, without := f.got["/with"], f.got["/without"]; with != "alice" || without != "" {
+		t.Errorf("requests saw client certs %q and %q", with, without)
+	}
+}
+
+func TestClientAuthRequire(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-client-auth", "127.0.0.1=require")
+	p.trust(origin)
+	if resp, err := p.client().Get(origin.URL); err == nil {
+		resp.Body.Close()
+		t.Error("handshake without a client cert passed -client-auth require")
+	}
+	// require takes any cert, there are no client CAs to check it against
+	_, issue := clientCA(t)
+	cert := issue("mallory")
+	resp, err := clientWithCert(p, &cert).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "tls origin" {
+		t.Errorf("request with an untrusted cert under require got %q", body)
+	}
+}
+
+func TestClientAuthVerify(t *testing.T) {
+	caFile, issue := clientCA(t)
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-client-auth", "127.0.0.1=verify", "-client-ca", caFile)
+	p.trust(origin)
+
+	_, otherIssue := clientCA(t)
+	untrusted := otherIssue("mallory")
+	if resp, err := clientWithCert(p, &untrusted).Get(origin.URL); err == nil {
+		resp.Body.Close()
+		t.Error("handshake with a cert from another CA passed -client-auth verify")
+	}
+	trusted := issue("alice")
+	resp, err := clientWithCert(p, &trusted).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "tls origin" {
+		t.Errorf("request with a trusted cert got %q", body)
+	}
+}
+
+func TestClientAuthOnlyMatchingNames(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-client-auth", "*.bank.test=require")
+	p.trust(origin)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatalf("handshake for a name no rule matches asked for a cert: %s", err)
+	}
+	readAll(t, resp)
+}
+
+func TestClientAuthConfig(t *testing.T) {
+	for _, args := range [][]string{
+		{"-client-auth", "example.com=maybe"},
+		{"-client-auth", "=request"},
+		{"-client-auth", "example.com=verify"},
+		{"-client-ca", "no-such-file.pem"},
+	} {
+		if err := initError(args...); err == nil || !strings.Contains(err.Error(), "-client-") {
+			t.Errorf("%q got error %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responses smaller than this are not worth compressing
+const minCompressSize = 1024
+
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// acceptsGzip reports whether the client listed gzip in its Accept-Encoding
+// with a qvalue above 0.
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+			return qvalue(params[1:]) > 0
+		}
+	}
+	return false
+}
+
+// qvalue returns the weight the q parameter among params gives a coding,
+// 1 without one. A malformed weight counts as 0, refusing the coding.
+func qvalue(params []string) float64 {
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// streamingTypes are the compressible looking types whose bodies are
+// read by clients as they arrive, which gzip would hold back
+var streamingTypes = []string{
+	"text/event-stream",
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range streamingTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponse gzips the body of resp in place when the client accepts
+// gzip and the origin sent compressible content without any encoding. The
+// body is compressed while it is streamed, so it is never fully buffered.
+func compressResponse(resp *http.Response, req *http.Request) error {
+	if req.Method == "HEAD" || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.Body == nil {
+		return nil
+	}
+	// a range is a slice of the unencoded body, which the client pieces
+	// together with other slices, so it has to stay as it is
+	if resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Range") != "" {
+		return nil
+	}
+	if !acceptsGzip(req) || resp.Header.Get("Content-Encoding") != "" ||
+		!isCompressible(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minCompressSize {
+		return nil
+	}
+
+	head := make([]byte, minCompressSize)
+	n, err := io.ReadFull(resp.Body, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(head[:n]))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		w := gzip.NewWriter(pw)
+		_, err := io.Copy(w, io.MultiReader(bytes.NewReader(head), body))
+		if err == nil {
+			err = w.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	if req.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	} else {
+		// HTTP/1.0 clients know no chunks, the body ends with the
+		// connection
+		resp.TransferEncoding = nil
+		resp.Close = true
+	}
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	return nil
+}
+
+// compressRequest gzips the body of req in place when it has no encoding
+// and a known length between min and max bytes, so the origin is sent it
+// compressed. The body is buffered to give the origin its new length, and
+// sent as it was if compressing doesn't make it smaller. It returns the
+// bytes buffered.
+func compressRequest(req *http.Request, min, max int64) (int, error) {
+	if req.ContentLength < min || req.ContentLength > max || req.ContentLength == 0 ||
+		req.Header.Get("Content-Encoding") != "" {
+		return 0, nil
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return len(body), err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	if buf.Len() >= len(body) {
+		return len(body), nil
+	}
+	req.Body = ioutil.NopCloser(&buf)
+	req.ContentLength = int64(buf.Len())
+	req.Header.Set("Content-Encoding", "gzip")
+	return len(body) + buf.Len(), nil
+}
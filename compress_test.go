@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gunzip(t *testing.T, r io.Reader) string {
+	t.Helper()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func textOrigin(t *testing.T, body string) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("compressible text ", 500)
+	origin := textOrigin(t, body)
+	p := newTestProxy(t, "-compress")
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	if got := gunzip(t, resp.Body); got != body {
+		t.Errorf("decompressed body differs, %d bytes want %d", len(got), len(body))
+	}
+
+	// no gzip for clients not asking for it
+	resp, err = p.client().Get(origin.URL + "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); resp.Header.Get("Content-Encoding") != "" || got != body {
+		t.Errorf("client without gzip got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCompressSkipsSmallBodies(t *testing.T) {
+	origin := textOrigin(t, "tiny")
+	p := newTestProxy(t, "-compress")
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); resp.Header.Get("Content-Encoding") != "" || got != "tiny" {
+		t.Errorf("small body got Content-Encoding %q, body %q", resp.Header.Get("Content-Encoding"), got)
+	}
+}
+
+func TestCompressHTTP10ClientIsCloseDelimited(t *testing.T) {
+	body := strings.Repeat("compressible text ", 500)
+	origin := textOrigin(t, body)
+	p := newTestProxy(t, "-compress")
+
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.0\r\nAccept-Encoding: gzip\r\n\r\n", origin.URL)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) > 0 {
+		t.Fatalf("HTTP/1.0 client sent Transfer-Encoding %v", resp.TransferEncoding)
+	}
+	if !resp.Close {
+		t.Error("response to an HTTP/1.0 client isn't close delimited")
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	if got := gunzip(t, resp.Body); got != body {
+		t.Errorf("decompressed body differs, %d bytes want %d", len(got), len(body))
+	}
+}
+
+func TestCompressLeavesEventStreams(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// large enough to be compressed if it were a plain text type
+		fmt.Fprintf(w, "data: %s\n\n", strings.Repeat("x", 2*minCompressSize))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+	p := newTestProxy(t, "-compress")
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("event stream got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	// the first event arrives while the origin holds the stream open
+	line := make(chan string, 1)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		if !strings.HasPrefix(l, "data: xxx") {
+			t.Errorf("first event line %.20q", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event held back by the proxy")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"gzip":                 true,
+		"deflate, GZIP":        true,
+		"gzip;q=0.5":           true,
+		"gzip; q=1.0, br":      true,
+		"br":                   false,
+		"gzip;q=0":             false,
+		"gzip;q=0.0":           false,
+		"gzip; q=0.000":        false,
+		"br;q=1, gzip ; Q=0.0": false,
+		"gzip;q=high":          false,
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(req); got != want {
+			t.Errorf("Accept-Encoding %q accepts gzip: %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestCompressSkipsRanges(t *testing.T) {
+	body := strings.Repeat("compressible text ", 500)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "text.txt", time.Time{}, strings.NewReader(body))
+	}))
+	t.Cleanup(origin.Close)
+	p := newTestProxy(t, "-compress")
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-1999")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, resp)
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" || got != body[:2000] {
+		t.Errorf("range got %d with Content-Encoding %q and %d bytes", resp.StatusCode, resp.Header.Get("Content-Encoding"), len(got))
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"text/html; charset=utf-8":         true,
+		"application/json":                 true,
+		"image/svg+xml":                    true,
+		"image/png":                        false,
+		"text/event-stream":                false,
+		"Text/Event-Stream; charset=utf-8": false,
+	} {
+		if got := isCompressible(contentType); got != want {
+			t.Errorf("isCompressible(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+// encodingOrigin sends what it got of each request to the returned channel:
+// its Content-Encoding, Content-Length and body, decoded if gzipped.
+func encodingOrigin(t *testing.T) (*httptest.Server, chan [3]string) {
+	got := make(chan [3]string, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := ""
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body = gunzip(t, r.Body)
+		} else {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+		}
+		got <- [3]string{r.Header.Get("Content-Encoding"), fmt.Sprint(r.ContentLength), body}
+	}))
+	t.Cleanup(origin.Close)
+	return origin, got
+}
+
+func TestGzipRequests(t *testing.T) {
+	origin, got := encodingOrigin(t)
+	p := newTestProxy(t, "-gzip-requests", "127.0.0.1/upload", "-gzip-requests-max", "8192")
+	large := strings.Repeat("compressible text ", 100)
+	random := make([]byte, 2048)
+	rand.Read(random)
+	for _, c := range []struct {
+		path, body, encoding string
+		gzipped              bool
+	}{
+		{"/upload/a", large, "", true},
+		{"/other", large, "", false},
+		{"/upload/small", "short", "", false},
+		{"/upload/big", strings.Repeat("x", 8193), "", false},
+		{"/upload/encoded", large, "br", false},
+		// not made smaller
+		{"/upload/random", string(random), "", false},
+	} {
+		req, _ := http.NewRequest("POST", origin.URL+c.path, strings.NewReader(c.body))
+		if c.encoding != "" {
+			req.Header.Set("Content-Encoding", c.encoding)
+		}
+		resp, err := p.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		g := <-got
+		if g[2] != c.body {
+			t.Errorf("%s: origin got a body of %d bytes, want the %d sent", c.path, len(g[2]), len(c.body))
+		}
+		switch {
+		case c.gzipped && (g[0] != "gzip" || g[1] == fmt.Sprint(len(c.body))):
+			t.Errorf("%s: origin got Content-Encoding %q and length %s, want it gzipped", c.path, g[0], g[1])
+		case !c.gzipped && (g[0] != c.encoding || g[1] != fmt.Sprint(len(c.body))):
+			t.Errorf("%s: origin got Content-Encoding %q and length %s, want it as sent", c.path, g[0], g[1])
+		}
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
 	"time"
 )
 
@@ -13,11 +16,160 @@ const (
 )
 
 type Cfg struct {
-	Port    *string
-	Raddr   *string
-	Log     *string
-	Monitor *bool
-	Tls     *bool
+	Port          *string
+	ReusePort     *bool
+	Listeners     *int
+	Unix          *string
+	Raddr         *string
+	NoProxy       *string
+	UpstreamRules *string
+	UpstreamH2    *string
+	Log           *string
+	LogLevel      *string
+	Monitor       *bool
+	Tls           *bool
+	H2C           *bool
+	Compress      *bool
+	KeepAlive     *bool
+	Rechunk       *bool
+	Relay1xx      *bool
+	LogAuth       *bool
+	LogDoH        *bool
+
+	HeaderOrder *bool
+	Via         *string
+
+	TransactionHeader *string
+
+	HTTPPort  *string
+	HTTPSPort *string
+
+	MaxHeaderBytes *int
+	MaxHeaders     *int
+
+	HeaderTimeout *time.Duration
+	ClientIdle    *time.Duration
+
+	MaxResponse       *int64
+	MaxResponseAction *string
+
+	GzipRequests    *string
+	GzipRequestsMin *int64
+	GzipRequestsMax *int64
+
+	WebSocketLog *bool
+
+	MonitorWorkers *int
+	MonitorQueue   *int
+	MonitorBlock   *bool
+
+	InterceptPorts *string
+	InterceptHosts *string
+	InterceptSNI   *string
+	SNIMismatch    *string
+	RouteBy        *string
+
+	Collector      *string
+	CollectorBatch *int
+	CollectorQueue *int
+	CollectorKeep  *bool
+	Record         *string
+	Tee            *string
+	RedactHeaders  *string
+	RedactBody     *string
+
+	CollectorTimeout *time.Duration
+
+	Shadow        *string
+	ShadowDiff    *bool
+	ShadowTimeout *time.Duration
+
+	Auth            *string
+	Rewrite         *string
+	LocationRewrite *string
+	StatusRewrite   *string
+
+	CADomains   *string
+	NoCertCache *bool
+	CertTTL     *time.Duration
+	CertRefresh *time.Duration
+	WarmCerts   *string
+	CertFailTTL *time.Duration
+	SCTFiles    *string
+	UpstreamTLS *string
+	ClientAuth  *string
+	ClientCA    *string
+	MintRate    *float64
+	MintBurst   *int
+
+	StrictUpstreamTLS *bool
+
+	TicketRotation *time.Duration
+	ForceHTTP1     *bool
+
+	CookieStrip  *string
+	CookieDomain *string
+	CookieJar    *bool
+
+	Landing        *string
+	Pac            *string
+	Wpad           *bool
+	CAInterstitial *bool
+
+	CacheEntries   *int
+	CacheEntrySize *int64
+	Mirror         *string
+	MirrorOffline  *bool
+
+	BreakerFailures *int
+	BreakerCooldown *time.Duration
+
+	MaxInflight  *int64
+	InflightWait *time.Duration
+
+	MaxConcurrent *int
+	QueueWait     *time.Duration
+	Priority      *string
+
+	UpgradeHTTPS  *string
+	UpgradeStatus *int
+
+	Replace       *listFlag
+	ReplaceRegexp *listFlag
+	ReplaceTypes  *string
+	ReplaceMax    *int64
+
+	Pipe        *string
+	PipeTypes   *string
+	PipeBodies  *string
+	PipeTimeout *time.Duration
+	PipeMax     *int64
+
+	DialTimeout   *time.Duration
+	ForwardIdle   *time.Duration
+	FallbackDelay *time.Duration
+	TCPKeepAlive  *time.Duration
+	UpstreamIdle  *time.Duration
+	NoDelay       *bool
+	TunnelLinger  *time.Duration
+
+	FragmentSize  *int
+	FragmentDelay *time.Duration
+	Bandwidth     *string
+
+	Transparent   *string
+	Reverse       *string
+	ReverseListen *string
+
+	Admin        *string
+	P12Password  *string
+	History      *int
+	HistoryBytes *int64
+	EventsBuffer *int
+
+	Health     *string
+	HealthPath *string
+	ReadyPath  *string
 }
 
 type TlsConfig struct {
@@ -26,6 +178,47 @@ type TlsConfig struct {
 	Organization    string
 	CommonName      string
 	ServerTLSConfig *tls.Config
+
+	// PermittedDNSDomains limits the issuing CA to these domains with a
+	// Name Constraint, so a leaked CA can't be used for other sites.
+	PermittedDNSDomains []string
+
+	// DisableCertCache mints a fresh leaf cert for every handshake, which
+	// helps when debugging cert issues.
+	DisableCertCache bool
+
+	// CertTTL is how long minted leaf certs are valid. Cached certs closer
+	// than CertRefresh to expiring are replaced in the background.
+	CertTTL     time.Duration
+	CertRefresh time.Duration
+
+	// CertFailTTL is how long handshakes for a host whose cert failed to
+	// mint fail fast before minting is tried again.
+	CertFailTTL time.Duration
+
+	// MintRate caps how many new certs are minted per second, up to
+	// MintBurst at once, so scans with random SNIs can't keep the proxy
+	// minting. Handshakes needing a cert over the limit fail; cached certs
+	// are served as usual. 0 mints without limit.
+	MintRate  float64
+	MintBurst int
+
+	// LeafExtensions are added to every minted leaf cert, e.g. the SCT
+	// list for clients that insist on Certificate Transparency.
+	LeafExtensions []pkix.Extension
+
+	// ForceHTTP1 negotiates http/1.1 with intercepted clients through ALPN,
+	// whatever else they offer.
+	ForceHTTP1 bool
+
+	// Upstream overrides ServerTLSConfig when dialing matching origins,
+	// for origins that need particular versions, ciphers or ALPN.
+	Upstream []*UpstreamTLS
+
+	// ClientAuth asks clients for a cert in intercepted handshakes for
+	// matching names, verified against ClientCAs with the verify mode.
+	ClientAuth []*ClientAuth
+	ClientCAs  *x509.CertPool
 }
 
 func NewTlsConfig(pk, cert, org, cn string) *TlsConfig {
@@ -34,6 +227,8 @@ func NewTlsConfig(pk, cert, org, cn string) *TlsConfig {
 		CertFile:       cert,
 		Organization:   org,
 		CommonName:     cn,
+		CertTTL:        TWO_WEEKS,
+		CertRefresh:    ONE_DAY,
 		ServerTLSConfig: &tls.Config{
 			CipherSuites: []uint16{
 				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
@@ -51,3 +246,44 @@ func NewTlsConfig(pk, cert, org, cn string) *TlsConfig {
 		},
 	}
 }
+
+// sameStrings reports whether a and b hold the same strings in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		if seen[s] == 0 {
+			return false
+		}
+		seen[s]--
+	}
+	return true
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listFlag is a flag that may be given more than once, collecting its values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
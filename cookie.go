@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CookieRewriter rewrites the attributes of Set-Cookie response headers for
+// clients that can't meet them, leaving cookie names and values untouched.
+type CookieRewriter struct {
+	// lower case attribute names to remove, e.g. secure or samesite
+	strip map[string]bool
+	// cookie domains to replace, "*" matching any; an empty replacement
+	// removes the Domain attribute
+	domains map[string]string
+}
+
+// NewCookieRewriter parses a comma separated list of attributes to strip and
+// a comma separated list of from=to domain rewrites.
+func NewCookieRewriter(strip, domains string) (*CookieRewriter, error) {
+	cr := &CookieRewriter{
+		strip:   make(map[string]bool),
+		domains: make(map[string]string),
+	}
+	for _, attr := range splitList(strip) {
+		cr.strip[strings.ToLower(attr)] = true
+	}
+	for _, rule := range splitList(domains) {
+		eq := strings.Index(rule, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("Invalid cookie domain rewrite %q, want from=to", rule)
+		}
+		from := strings.ToLower(strings.TrimPrefix(rule[:eq], "."))
+		cr.domains[from] = strings.TrimSpace(rule[eq+1:])
+	}
+	return cr, nil
+}
+
+// Rewrite rewrites every Set-Cookie header in header.
+func (cr *CookieRewriter) Rewrite(header http.Header) {
+	cookies := header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = cr.rewrite(cookie)
+	}
+}
+
+func (cr *CookieRewriter) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	// parts[0] is the name=value pair, which is kept as is
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name := attr
+		value := ""
+		if eq := strings.Index(attr, "="); eq >= 0 {
+			name = strings.TrimSpace(attr[:eq])
+			value = strings.TrimSpace(attr[eq+1:])
+		}
+		name = strings.ToLower(name)
+
+		if cr.strip[name] {
+			continue
+		}
+		if name == "domain" {
+			to, ok := cr.domains[strings.ToLower(strings.TrimPrefix(value, "."))]
+			if !ok {
+				to, ok = cr.domains["*"]
+			}
+			if ok {
+				if to == "" {
+					continue
+				}
+				part = " Domain=" + to
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+// jarURL returns the url the cookies for req are kept under in a cookie
+// jar, that of the origin it is sent to.
+func jarURL(req *http.Request) *url.URL {
+	return &url.URL{Scheme: req.URL.Scheme, Host: req.Host, Path: req.URL.Path}
+}
+
+// addJarCookies adds the cookies jar holds for req's url to it, except
+// those the client sent itself, whose values win.
+func addJarCookies(jar http.CookieJar, req *http.Request) {
+	sent := make(map[string]bool)
+	for _, cookie := range req.Cookies() {
+		sent[cookie.Name] = true
+	}
+	for _, cookie := range jar.Cookies(jarURL(req)) {
+		if !sent[cookie.Name] {
+			req.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookieAttributesRewritten(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=a=b; Path=/; Domain=.example.com; Secure; SameSite=None; HttpOnly")
+		w.Header().Add("Set-Cookie", "pref=1; Domain=other.test; secure")
+		w.Header().Add("Set-Cookie", "plain=2")
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-cookie-strip", "Secure,samesite", "-cookie-domain", "example.com=localhost,*=")
+
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	want := []string{
+		"session=a=b; Path=/; Domain=localhost; HttpOnly",
+		"pref=1",
+		"plain=2",
+	}
+	got := resp.Header["Set-Cookie"]
+	if len(got) != len(want) {
+		t.Fatalf("got Set-Cookie %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Set-Cookie %q, want %q", got[i], want[i])
+		}
+	}
+}
+
+func TestCookiesUntouchedByDefault(t *testing.T) {
+	const cookie = "session=1; Domain=.example.com; Secure; SameSite=None"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", cookie)
+	}))
+	defer origin.Close()
+	p := newTestProxy(t)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if got := resp.Header.Get("Set-Cookie"); got != cookie {
+		t.Errorf("Set-Cookie %q, want it as the origin sent it", got)
+	}
+}
+
+func TestCookieDomainRewriteRejectsMalformed(t *testing.T) {
+	if err := initError("-cookie-domain", "example.com"); err == nil {
+		t.Error("domain rewrite without = accepted")
+	}
+}
+
+// jarOrigin sets the cookies in the set query parameter, answering each
+// request with the Cookie field it got.
+func jarOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, cookie := range r.URL.Query()["set"] {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+		w.Write([]byte(r.Header.Get("Cookie")))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// getWithCookie gets url through p, with cookie if it isn't empty, and
+// returns the Cookie field the origin got.
+func getWithCookie(t *testing.T, p *testProxy, url, cookie string) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, resp)
+}
+
+func TestCookieJarShared(t *testing.T) {
+	origin := jarOrigin(t)
+	p := newTestProxy(t, "-cookie-jar")
+	getWithCookie(t, p, origin.URL+"/login?set=session=abc%3B+Path=/&set=scoped=1%3B+Path=/admin", "")
+
+	// another client, knowing nothing of the login, gets the session
+	if got := getWithCookie(t, p, origin.URL+"/profile", ""); got != "session=abc" {
+		t.Errorf("later request sent Cookie %q, want the jar's session", got)
+	}
+	if got := getWithCookie(t, p, origin.URL+"/admin/users", ""); got != "session=abc; scoped=1" && got != "scoped=1; session=abc" {
+		t.Errorf("request under the cookie's path sent Cookie %q", got)
+	}
+	// a cookie the client sends itself wins over the jar's
+	if got := getWithCookie(t, p, origin.URL+"/profile", "session=mine; other=2"); got != "session=mine; other=2" {
+		t.Errorf("request with its own session sent Cookie %q", got)
+	}
+	// expiring it removes it from the jar
+	getWithCookie(t, p, origin.URL+"/logout?set=session=%3B+Path=/%3B+Max-Age=0", "")
+	if got := getWithCookie(t, p, origin.URL+"/profile", ""); got != "" {
+		t.Errorf("request after the logout sent Cookie %q", got)
+	}
+}
+
+func TestCookieJarPerHost(t *testing.T) {
+	origin := jarOrigin(t)
+	port := portOf(origin)
+	p := newTestProxy(t, "-cookie-jar", "-rewrite", "*.test=127.0.0.1")
+	getWithCookie(t, p, "http://a.test:"+port+"/?set=session=a", "")
+	if got := getWithCookie(t, p, "http://b.test:"+port+"/", ""); got != "" {
+		t.Errorf("request to another host sent Cookie %q", got)
+	}
+	if got := getWithCookie(t, p, "http://a.test:"+port+"/", ""); got != "session=a" {
+		t.Errorf("request to the host that set it sent Cookie %q", got)
+	}
+}
+
+func TestCookieJarOffByDefault(t *testing.T) {
+	origin := jarOrigin(t)
+	p := newTestProxy(t)
+	getWithCookie(t, p, origin.URL+"/login?set=session=abc", "")
+	if got := getWithCookie(t, p, origin.URL+"/profile", ""); got != "" {
+		t.Errorf("request without -cookie-jar sent Cookie %q", got)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxDiffBody is how much of a body is kept for diffing.
+	maxDiffBody = 4 << 20
+	// maxDiffs is how many differences are reported per response pair.
+	maxDiffs = 20
+)
+
+// volatileHeaders differ between any two responses and are not compared.
+var volatileHeaders = map[string]bool{
+	"Age":               true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Expires":           true,
+	"Keep-Alive":        true,
+	"Set-Cookie":        true,
+	"Transfer-Encoding": true,
+}
+
+// capturedResponse is the part of a response that gets diffed.
+type capturedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+
+	// tls is the state of the origin connection, nil without TLS. Filters
+	// can check the chain the origin presented in it.
+	tls *tls.ConnectionState
+}
+
+// parseCapturedResponse reads a response back from its dump, undoing chunked
+// and gzip encoding of the body.
+func parseCapturedResponse(dump []byte, req *http.Request) (*capturedResponse, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &capturedResponse{status: resp.StatusCode, header: resp.Header, body: decodeBody(resp.Header, body)}, nil
+}
+
+func decodeBody(header http.Header, body []byte) []byte {
+	if header.Get("Content-Encoding") != "gzip" {
+		return body
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// diffResponses lists the differences between the primary and the shadow
+// response: status, headers other than volatile ones, and body. Bodies that
+// are both JSON are compared structurally, others after trimming space.
+func diffResponses(primary, shadow *capturedResponse) []string {
+	var diffs []string
+	if primary.status != shadow.status {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", primary.status, shadow.status))
+	}
+
+	var names []string
+	for name := range primary.header {
+		names = append(names, name)
+	}
+	for name := range shadow.header {
+		if _, ok := primary.header[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// the encoding is undone before bodies are compared
+		if volatileHeaders[name] || name == "Content-Encoding" {
+			continue
+		}
+		if a, b := primary.header[name], shadow.header[name]; !reflect.DeepEqual(a, b) {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", name, a, b))
+		}
+	}
+
+	var a, b interface{}
+	if json.Unmarshal(primary.body, &a) == nil && json.Unmarshal(shadow.body, &b) == nil {
+		diffJSON("body $", a, b, &diffs)
+	} else if !bytes.Equal(bytes.TrimSpace(primary.body), bytes.TrimSpace(shadow.body)) {
+		diffs = append(diffs, fmt.Sprintf("body: %d bytes != %d bytes", len(primary.body), len(shadow.body)))
+	}
+
+	if len(diffs) > maxDiffs {
+		diffs = append(diffs[:maxDiffs], fmt.Sprintf("and %d more", len(diffs)-maxDiffs))
+	}
+	return diffs
+}
+
+// diffJSON appends the paths at which the decoded JSON values a and b differ.
+func diffJSON(path string, a, b interface{}, diffs *[]string) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			var keys []string
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				av, inA := a[k]
+				bv, inB := b[k]
+				if inA && inB {
+					diffJSON(path+"."+k, av, bv, diffs)
+				} else if inA {
+					*diffs = append(*diffs, fmt.Sprintf("%s.%s: %s != missing", path, k, jsonString(av)))
+				} else {
+					*diffs = append(*diffs, fmt.Sprintf("%s.%s: missing != %s", path, k, jsonString(bv)))
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			for i := 0; i < len(a) && i < len(b); i++ {
+				diffJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], diffs)
+			}
+			if len(a) != len(b) {
+				*diffs = append(*diffs, fmt.Sprintf("%s: length %d != %d", path, len(a), len(b)))
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, jsonString(a), jsonString(b)))
+	}
+}
+
+func jsonString(v interface{}) string {
+	s, _ := json.Marshal(v)
+	return strings.TrimSpace(string(s))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonOrigin answers with body as JSON, gzip encoded if zipped is set, with
+// an X-Backend header of name and a Date differing between backends.
+func jsonOrigin(t *testing.T, name, body string, zipped bool) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Backend", name)
+		w.Header().Set("Date", time.Now().Add(time.Duration(len(name))*time.Hour).Format(http.TimeFormat))
+		if zipped {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, body)
+			zw.Close()
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestShadowDiffComparesJSONStructurally(t *testing.T) {
+	c := newCollector(t)
+	primary := jsonOrigin(t, "primary", `{"id": 7, "tags": ["a", "b"], "name": "x"}`, true)
+	shadow := jsonOrigin(t, "comparison", `{"name":"x","tags":["a","c","d"],"id":7,"extra":null}`, false)
+	p := newTestProxy(t, "-shadow", shadow.URL, "-shadow-diff", "-collector", c.URL, "-collector-batch", "1")
+	logged := captureStdLog(t)
+
+	req, _ := http.NewRequest("GET", primary.URL+"/item", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := gunzip(t, resp.Body); resp.Header.Get("X-Backend") != "primary" || !strings.Contains(body, `"id": 7`) {
+		t.Errorf("client got %q from %q, want the primary's", body, resp.Header.Get("X-Backend"))
+	}
+	resp.Body.Close()
+
+	want := []string{
+		`header X-Backend: ["primary"] != ["comparison"]`,
+		`body $.extra: missing != null`,
+		`body $.tags[1]: "b" != "c"`,
+		`body $.tags: length 2 != 3`,
+	}
+	select {
+	case batch := <-c.got:
+		if got := batch[0].ShadowDiff; strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("recorded diff\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction never recorded")
+	}
+	if !strings.Contains(logged.String(), "shadow response differs for "+primary.URL+"/item") {
+		t.Errorf("diff not logged: %q", logged)
+	}
+}
+
+func TestDiffResponsesIgnoresNoise(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	io.WriteString(zw, "  same text\n")
+	zw.Close()
+	primary := &capturedResponse{
+		status: 200,
+		header: http.Header{"Date": {"Mon, 01 Jan 2024 00:00:00 GMT"}, "Content-Encoding": {"gzip"}, "Content-Length": {"40"}},
+		body:   decodeBody(http.Header{"Content-Encoding": {"gzip"}}, zipped.Bytes()),
+	}
+	shadow := &capturedResponse{
+		status: 200,
+		header: http.Header{"Date": {"Tue, 02 Jan 2024 00:00:00 GMT"}, "Set-Cookie": {"s=1"}},
+		body:   []byte("same text"),
+	}
+	if diffs := diffResponses(primary, shadow); len(diffs) > 0 {
+		t.Errorf("equal responses differ in %q", diffs)
+	}
+
+	primary.body, shadow.body = []byte(`{"a": 1, "b": 2}`), []byte(`{"b":2,"a":1}`)
+	if diffs := diffResponses(primary, shadow); len(diffs) > 0 {
+		t.Errorf("equal JSON in another order differs in %q", diffs)
+	}
+
+	shadow.status = 500
+	shadow.body = []byte("not json")
+	diffs := diffResponses(primary, shadow)
+	if len(diffs) != 2 || diffs[0] != "status: 200 != 500" || diffs[1] != "body: 16 bytes != 8 bytes" {
+		t.Errorf("got %q", diffs)
+	}
+}
+
+func TestDiffResponsesCapped(t *testing.T) {
+	a, b := []string{}, []string{}
+	for i := 0; i < maxDiffs+5; i++ {
+		a = append(a, "1")
+		b = append(b, "2")
+	}
+	primary := &capturedResponse{status: 200, body: []byte("[" + strings.Join(a, ",") + "]")}
+	shadow := &capturedResponse{status: 200, body: []byte("[" + strings.Join(b, ",") + "]")}
+	diffs := diffResponses(primary, shadow)
+	if len(diffs) != maxDiffs+1 || diffs[maxDiffs] != "and 5 more" {
+		t.Errorf("got %d diffs ending %q", len(diffs), diffs[len(diffs)-1])
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var errDNSMessage = errors.New("malformed dns message")
+
+// dnsTypes names the record types worth naming in the log.
+var dnsTypes = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 15: "MX", 16: "TXT",
+	28: "AAAA", 33: "SRV", 41: "OPT", 64: "SVCB", 65: "HTTPS", 255: "ANY",
+}
+
+var dnsRcodes = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"}
+
+func dnsTypeName(t uint16) string {
+	if name, ok := dnsTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  string
+}
+
+// dnsMessage is what the log shows of a DNS message (RFC 1035): its id,
+// rcode, questions and answers. Authority and additional records are left
+// out.
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	rcode     int
+	questions []dnsQuestion
+	answers   []dnsRecord
+}
+
+func parseDNSMessage(b []byte) (*dnsMessage, error) {
+	if len(b) < 12 {
+		return nil, errDNSMessage
+	}
+	m := &dnsMessage{
+		id:       binary.BigEndian.Uint16(b),
+		response: b[2]&0x80 != 0,
+		rcode:    int(b[3] & 0x0f),
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil || n+4 > len(b) {
+			return nil, errDNSMessage
+		}
+		m.questions = append(m.questions, dnsQuestion{name, binary.BigEndian.Uint16(b[n:])})
+		off = n + 4
+	}
+	for i := 0; i < ancount; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil || n+10 > len(b) {
+			return nil, errDNSMessage
+		}
+		r := dnsRecord{name: name, rtype: binary.BigEndian.Uint16(b[n:]), ttl: binary.BigEndian.Uint32(b[n+4:])}
+		length := int(binary.BigEndian.Uint16(b[n+8:]))
+		start := n + 10
+		if start+length > len(b) {
+			return nil, errDNSMessage
+		}
+		r.data = dnsRecordData(b, r.rtype, start, length)
+		m.answers = append(m.answers, r)
+		off = start + length
+	}
+	return m, nil
+}
+
+// dnsRecordData formats the data of addresses and names, and gives the
+// length of any other.
+func dnsRecordData(b []byte, rtype uint16, start, length int) string {
+	data := b[start : start+length]
+	switch {
+	case rtype == 1 && length == 4, rtype == 28 && length == 16:
+		return net.IP(data).String()
+	case rtype == 2 || rtype == 5 || rtype == 12:
+		if name, _, err := readDNSName(b, start); err == nil {
+			return name
+		}
+	}
+	return fmt.Sprintf("(%d bytes)", length)
+}
+
+// readDNSName reads the possibly compressed name at off, returning it and
+// the offset just past it.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	// every pointer must go back, which also bounds the jumps
+	limit := off
+	for {
+		if off >= len(b) {
+			return "", 0, errDNSMessage
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errDNSMessage
+			}
+			ptr := int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			if ptr >= limit {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off, limit = ptr, ptr
+		case length&0xc0 != 0 || off+1+length > len(b):
+			return "", 0, errDNSMessage
+		default:
+			labels = append(labels, string(b[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+func (m *dnsMessage) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "id=%d", m.id)
+	if m.response {
+		rcode := fmt.Sprintf("RCODE%d", m.rcode)
+		if m.rcode < len(dnsRcodes) {
+			rcode = dnsRcodes[m.rcode]
+		}
+		s.WriteString(" " + rcode)
+	}
+	for _, q := range m.questions {
+		fmt.Fprintf(&s, " question %s %s", q.name, dnsTypeName(q.qtype))
+	}
+	for _, r := range m.answers {
+		fmt.Fprintf(&s, " answer %s %s %s ttl=%d", r.name, dnsTypeName(r.rtype), r.data, r.ttl)
+	}
+	return s.String()
+}
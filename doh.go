@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+// dnsMessageType is the media type of DNS messages sent over https (RFC
+// 8484).
+const dnsMessageType = "application/dns-message"
+
+// maxDNSMessage is the largest DNS message there can be.
+const maxDNSMessage = 65535
+
+// isDoHRequest reports whether req looks like a DNS-over-HTTPS query: a
+// dns-message body or the usual /dns-query path.
+func isDoHRequest(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == dnsMessageType || req.URL.Path == "/dns-query"
+}
+
+// logDoHQuery logs the DNS query of a DoH request, carried in the dns
+// parameter of a GET or as the body of a POST. The body is read and put
+// back as it was.
+func logDoHQuery(id string, req *http.Request) {
+	var msg []byte
+	if param := req.URL.Query().Get("dns"); param != "" {
+		var err error
+		if msg, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			logger.Infoln(id, "DoH query to", req.URL.Host, "with undecodable dns parameter:", err)
+			return
+		}
+	} else if req.ContentLength > 0 && req.ContentLength <= maxDNSMessage {
+		var err error
+		if msg, err = readBody(req); err != nil {
+			logger.Debugln(id, "read DoH query error:", err)
+			return
+		}
+	} else {
+		return
+	}
+	logDNSMessage(id, "DoH query to "+req.URL.Host, msg)
+}
+
+// logDoHAnswer logs the DNS answer in resp, a response to a DoH query, and
+// puts the body back as it was.
+func logDoHAnswer(id string, req *http.Request, resp *http.Response) {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != dnsMessageType || resp.Body == nil || resp.ContentLength > maxDNSMessage {
+		return
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(msg), resp.Body), resp.Body}
+	if err != nil || len(msg) > maxDNSMessage {
+		return
+	}
+	logDNSMessage(id, "DoH answer from "+req.URL.Host, msg)
+}
+
+func logDNSMessage(id, what string, msg []byte) {
+	m, err := parseDNSMessage(msg)
+	if err != nil {
+		logger.Infoln(id, what, "of", len(msg), "bytes:", err)
+		return
+	}
+	logger.Infoln(id, what+":", m)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// dnsQuery builds a query with the given id for the A records of
+// example.com.
+func dnsQuery(id uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	b = append(b, "\x07example\x03com\x00"...)
+	return append(b, 0, 1, 0, 1)
+}
+
+// dnsAnswer answers query with one A record, its name pointing back at
+// the question.
+func dnsAnswer(query []byte) []byte {
+	b := append([]byte(nil), query...)
+	b[2], b[3] = 0x81, 0x80
+	b[7] = 1
+	b = append(b, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0x0e, 0x10, 0, 4, 93, 184, 216, 34)
+	return b
+}
+
+// dohOrigin answers DNS-over-HTTPS queries sent as a dns parameter or a
+// POST body, sending the queries it got to the returned channel.
+func dohOrigin(t *testing.T) (*httptest.Server, chan []byte) {
+	got := make(chan []byte, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		if param := r.URL.Query().Get("dns"); param != "" {
+			query, _ = base64.RawURLEncoding.DecodeString(param)
+		} else {
+			query, _ = io.ReadAll(r.Body)
+		}
+		got <- query
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(dnsAnswer(query))
+	}))
+	t.Cleanup(origin.Close)
+	return origin, got
+}
+
+const (
+	loggedQuery  = "DoH query to %s: id=4660 question example.com. A"
+	loggedAnswer = "DoH answer from %s: id=4660 NOERROR question example.com. A answer example.com. A 93.184.216.34 ttl=3600"
+)
+
+func TestDoHGetLogged(t *testing.T) {
+	logged := captureLog(t, LevelInfo)
+	origin, _ := dohOrigin(t)
+	p := newTestProxy(t, "-log-doh")
+	query := dnsQuery(0x1234)
+	resp, body := getThrough(t, p, origin.URL+"/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query))
+	if resp.StatusCode != http.StatusOK || body != string(dnsAnswer(query)) {
+		t.Errorf("DoH answer got %s %q", resp.Status, body)
+	}
+	host := strings.TrimPrefix(origin.URL, "http://")
+	for _, want := range []string{loggedQuery, loggedAnswer} {
+		if want = strings.Replace(want, "%s", host, 1); !strings.Contains(logged.String(), want) {
+			t.Errorf("log lacks %q, got:\n%s", want, logged)
+		}
+	}
+}
+
+func TestDoHPostLogged(t *testing.T) {
+	logged := captureLog(t, LevelInfo)
+	origin, got := dohOrigin(t)
+	p := newTestProxy(t, "-log-doh")
+	query := dnsQuery(0x1234)
+	resp, err := p.client().Post(origin.URL+"/resolve", dnsMessageType, bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reading the query and the answer to log them leaves both as they were
+	if body := readAll(t, resp); body != string(dnsAnswer(query)) {
+		t.Errorf("DoH answer got %q", body)
+	}
+	if g := <-got; !bytes.Equal(g, query) {
+		t.Errorf("origin got query %q", g)
+	}
+	host := strings.TrimPrefix(origin.URL, "http://")
+	if want := strings.Replace(loggedQuery, "%s", host, 1); !strings.Contains(logged.String(), want) {
+		t.Errorf("log lacks %q, got:\n%s", want, logged)
+	}
+}
+
+func TestDoHNotLoggedByDefault(t *testing.T) {
+	logged := captureLog(t, LevelDebug)
+	origin, _ := dohOrigin(t)
+	p := newTestProxy(t)
+	getThrough(t, p, origin.URL+"/dns-query?dns="+base64.RawURLEncoding.EncodeToString(dnsQuery(1)))
+	if strings.Contains(logged.String(), "DoH") {
+		t.Errorf("DoH logged without -log-doh:\n%s", logged)
+	}
+}
+
+func TestParseDNSMessageMalformed(t *testing.T) {
+	answer := dnsAnswer(dnsQuery(1))
+	loop := append([]byte(nil), answer...)
+	// the answer's name points at itself
+	loop[len(dnsQuery(1))+1] = byte(len(dnsQuery(1)))
+	for name, msg := range map[string][]byte{
+		"short header":   answer[:11],
+		"cut off answer": answer[:len(answer)-1],
+		"pointer loop":   loop,
+	} {
+		if _, err := parseDNSMessage(msg); err != errDNSMessage {
+			t.Errorf("%s parsed with error %v", name, err)
+		}
+	}
+}
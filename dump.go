@@ -13,7 +13,7 @@ import (
 	"strconv"
 )
 
-func httpDump(reqDump []byte, resp *http.Response) {
+func httpDump(w io.Writer, reqDump []byte, resp *http.Response, redactor *Redactor) {
 	defer resp.Body.Close()
 	var respStatusStr string
 	respStatus := resp.StatusCode
@@ -29,45 +29,48 @@ func httpDump(reqDump []byte, resp *http.Response) {
 		respStatusStr = Red("<--" + strconv.Itoa(respStatus))
 	}
 
-	fmt.Println(Green("Request:"), respStatusStr)
+	fmt.Fprintln(w, Green("Request:"), respStatusStr)
+	reqDump = redactor.Dump(reqDump)
+	fmt.Fprintln(w, string(reqDump))
+	fmt.Fprintln(w, "-----------------------")
 	req, _ := ParseReq(reqDump)
-	fmt.Printf("%s %s %s\n", Blue(req.Method), req.Host+req.RequestURI, respStatusStr)
-	fmt.Printf("%s %s\n", Blue("RemoteAddr:"), req.RemoteAddr)
+	fmt.Fprintf(w, "%s %s %s\n", Blue(req.Method), req.Host+req.RequestURI, respStatusStr)
+	fmt.Fprintf(w, "%s %s\n", Blue("RemoteAddr:"), req.RemoteAddr)
 	for headerName, headerContext := range req.Header {
-		fmt.Printf("%s: %s\n", Blue(headerName), headerContext)
+		fmt.Fprintf(w, "%s: %s\n", Blue(headerName), headerContext)
 	}
 
 	if req.Method == "POST" {
-		fmt.Println(Green("POST Param:"))
+		fmt.Fprintln(w, Green("POST Param:"))
 		err := req.ParseForm()
 		if err != nil {
-			logger.Println("parseForm error:", err)
+			logger.Debugln("parseForm error:", err)
 		} else {
 			for k, v := range req.Form {
-				fmt.Printf("\t%s: %s\n", Blue(k), v)
+				fmt.Fprintf(w, "\t%s: %s\n", Blue(k), v)
 			}
 		}
 	}
-	fmt.Println(Green("Response:"))
-	for headerName, headerContext := range resp.Header {
-		fmt.Printf("%s: %s\n", Blue(headerName), headerContext)
+	fmt.Fprintln(w, Green("Response:"))
+	for headerName, headerContext := range redactor.Header(resp.Header) {
+		fmt.Fprintf(w, "%s: %s\n", Blue(headerName), headerContext)
 	}
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		logger.Println("func httpDump read resp body err:", err)
+		logger.Debugln("func httpDump read resp body err:", err)
 	} else {
 		acceptEncode := resp.Header["Content-Encoding"]
 		var respBodyBin bytes.Buffer
-		w := bufio.NewWriter(&respBodyBin)
-		w.Write(respBody)
-		w.Flush()
+		bw := bufio.NewWriter(&respBodyBin)
+		bw.Write(respBody)
+		bw.Flush()
 		for _, compress := range acceptEncode {
 			switch compress {
 			case "gzip":
 				r, err := gzip.NewReader(&respBodyBin)
 				if err != nil {
-					logger.Println("gzip reader err:", err)
+					logger.Debugln("gzip reader err:", err)
 				} else {
 					defer r.Close()
 					respBody, _ = ioutil.ReadAll(r)
@@ -80,16 +83,14 @@ func httpDump(reqDump []byte, resp *http.Response) {
 				break
 			}
 		}
-		fmt.Printf("%s\n", string(respBody))
+		fmt.Fprintf(w, "%s\n", string(redactor.Body(respBody)))
 	}
 
-	fmt.Printf("%s%s%s\n", Black("####################"), Cyan("END"), Black("####################"))
+	fmt.Fprintf(w, "%s%s%s\n", Black("####################"), Cyan("END"), Black("####################"))
 }
 
 func ParseReq(b []byte) (*http.Request, error) {
 	// func ReadRequest(b *bufio.Reader) (req *Request, err error) { return readRequest(b, deleteHostHeader) }
-	fmt.Println(string(b))
-	fmt.Println("-----------------------")
 	var buf io.ReadWriter
 	buf = new(bytes.Buffer)
 	buf.Write(b)
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsAcceptGUID is appended to the client's key to compute
+// Sec-WebSocket-Accept, RFC 6455 section 1.3.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// largest frame read from an event stream subscriber, who has no reason to
+// send anything but control frames
+const maxEventFrame = 4096
+
+// TransactionEvent is sent to event stream subscribers when a transaction
+// starts and when it finishes. Status, Duration and the sizes are only set
+// on finish; Aborted is set when the transaction ended without a response
+// reaching the client in full.
+type TransactionEvent struct {
+	Type         string        `json:"type"`
+	ID           string        `json:"id"`
+	Time         time.Time     `json:"time"`
+	Method       string        `json:"method"`
+	URL          string        `json:"url"`
+	Status       int           `json:"status,omitempty"`
+	Duration     time.Duration `json:"duration,omitempty"`
+	RequestSize  int64         `json:"requestSize,omitempty"`
+	ResponseSize int64         `json:"responseSize,omitempty"`
+	Aborted      bool          `json:"aborted,omitempty"`
+}
+
+// EventHub fans transaction events out to the event stream subscribers.
+// Each subscriber has its own buffer; one that falls so far behind that
+// its buffer fills is dropped, so a slow consumer never holds up the proxy
+// or the other subscribers.
+type EventHub struct {
+	mutex    sync.Mutex
+	buffer   int
+	redactor *Redactor
+	subs     map[*eventSub]struct{}
+}
+
+// eventSub is one subscriber. events is closed when it is dropped.
+type eventSub struct {
+	events chan []byte
+}
+
+func NewEventHub(buffer int, redactor *Redactor) *EventHub {
+	return &EventHub{buffer: buffer, redactor: redactor, subs: make(map[*eventSub]struct{})}
+}
+
+func (h *EventHub) subscribe() *eventSub {
+	sub := &eventSub{events: make(chan []byte, h.buffer)}
+	h.mutex.Lock()
+	h.subs[sub] = struct{}{}
+	h.mutex.Unlock()
+	return sub
+}
+
+// unsubscribe removes sub, unless it was already dropped.
+func (h *EventHub) unsubscribe(sub *eventSub) {
+	h.mutex.Lock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+	h.mutex.Unlock()
+}
+
+// publish sends e to every subscriber, dropping those whose buffer is
+// full. Nothing is done on a nil hub or without subscribers.
+func (h *EventHub) publish(e *TransactionEvent) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	e.URL = string(h.redactor.Body([]byte(e.URL)))
+	msg, err := json.Marshal(e)
+	if err != nil {
+		logger.Warnln("marshal transaction event error:", err)
+		return
+	}
+	for sub := range h.subs {
+		select {
+		case sub.events <- msg:
+		default:
+			logger.Warnln("event stream subscriber fell", h.buffer, "events behind, dropping it")
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// start publishes the start of transaction id.
+func (h *EventHub) start(id string, start time.Time, req *http.Request) {
+	h.publish(&TransactionEvent{Type: "start", ID: id, Time: start, Method: req.Method, URL: req.URL.String()})
+}
+
+// finish publishes the end of transaction id, t being what was recorded of
+// it or nil if it ended before a response was relayed.
+func (h *EventHub) finish(id string, start time.Time, req *http.Request, t *Transaction) {
+	e := &TransactionEvent{Type: "finish", ID: id, Time: start, Method: req.Method, URL: req.URL.String(),
+		Duration: time.Since(start)}
+	if t == nil {
+		e.Aborted = true
+	} else {
+		e.Status, e.Duration = t.Status, t.Duration
+		e.RequestSize, e.ResponseSize = t.RequestSize, t.ResponseSize
+	}
+	h.publish(e)
+}
+
+// handleEvents streams transaction events as websocket text messages, one
+// JSON TransactionEvent each, until the client closes the stream or is
+// dropped for falling behind.
+func (hw *HandlerWrapper) handleEvents(resp http.ResponseWriter, req *http.Request) {
+	if hw.events == nil {
+		respError(resp, http.StatusNotFound, "event stream is disabled")
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" || !isUpgradeRequest(req) ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		resp.Header().Set("Upgrade", "websocket")
+		respError(resp, http.StatusUpgradeRequired, "the event stream is served over websocket")
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		resp.Header().Set("Sec-WebSocket-Version", "13")
+		respError(resp, http.StatusBadRequest, "unsupported websocket version")
+		return
+	}
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		respError(resp, http.StatusInternalServerError, "Unable to hijack the connection")
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Warnln("hijack event stream error:", err)
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err = bufrw.Flush(); err != nil {
+		return
+	}
+
+	sub := hw.events.subscribe()
+	defer hw.events.unsubscribe(sub)
+	logger.Debugln("event stream subscriber", req.RemoteAddr, "connected")
+	// the reader answers pings and hands them to the writer, which owns
+	// the connection's write side
+	control := make(chan wsControl)
+	done := make(chan struct{})
+	defer close(done)
+	go readEventClient(bufrw.Reader, control, done)
+	for {
+		select {
+		case msg, ok := <-sub.events:
+			if !ok {
+				// dropped for falling behind
+				writeWSFrame(bufrw.Writer, 0x8, closePayload(1008))
+				bufrw.Flush()
+				return
+			}
+			if err = writeWSFrame(bufrw.Writer, 0x1, msg); err == nil {
+				err = bufrw.Flush()
+			}
+		case c, ok := <-control:
+			if !ok {
+				return
+			}
+			if err = writeWSFrame(bufrw.Writer, c.opcode, c.payload); err == nil {
+				err = bufrw.Flush()
+			}
+			if c.opcode == 0x8 {
+				return
+			}
+		}
+		if err != nil {
+			logger.Debugln("write event stream to", req.RemoteAddr, "error:", err)
+			return
+		}
+	}
+}
+
+// wsControl is a control frame to send back to an event stream client.
+type wsControl struct {
+	opcode  byte
+	payload []byte
+}
+
+// readEventClient reads the frames a subscriber sends, passing back a pong
+// for each ping and a close echoing the client's. control is closed once
+// the client is gone. It stops once done is closed.
+func readEventClient(r *bufio.Reader, control chan<- wsControl, done <-chan struct{}) {
+	defer close(control)
+	for {
+		frame, payload, err := readWSFrame(r)
+		if err != nil {
+			return
+		}
+		var reply wsControl
+		switch frame.opcode {
+		case 0x8:
+			reply = wsControl{0x8, payload}
+		case 0x9:
+			reply = wsControl{0xa, payload}
+		default:
+			continue
+		}
+		select {
+		case control <- reply:
+		case <-done:
+			return
+		}
+		if reply.opcode == 0x8 {
+			return
+		}
+	}
+}
+
+// readWSFrame reads one frame and its unmasked payload from r.
+func readWSFrame(r *bufio.Reader) (*wsFrame, []byte, error) {
+	head, err := r.Peek(2)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err = r.Peek(wsHeaderLen(head))
+	if err != nil {
+		return nil, nil, err
+	}
+	frame, err := parseWSHeader(head)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Discard(len(head))
+	if frame.length > maxEventFrame {
+		return nil, nil, io.ErrShortBuffer
+	}
+	payload := make([]byte, frame.length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if frame.masked {
+		for i := range payload {
+			payload[i] ^= frame.mask[i%4]
+		}
+	}
+	return frame, payload, nil
+}
+
+// writeWSFrame writes payload as a single unmasked frame, as servers send
+// them.
+func writeWSFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	w.WriteByte(0x80 | opcode)
+	switch n := len(payload); {
+	case n < 126:
+		w.WriteByte(byte(n))
+	case n <= 0xffff:
+		w.WriteByte(126)
+		w.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		w.WriteByte(127)
+		w.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// closePayload is the body of a close frame with status code.
+func closePayload(code uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, code)
+}
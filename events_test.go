@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribeEvents opens the event stream of the admin api served by admin.
+func subscribeEvents(t *testing.T, admin *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", admin.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET /events HTTP/1.1\r\nHost: admin\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("event stream handshake got %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	// subscribing happens after the handshake is answered
+	time.Sleep(50 * time.Millisecond)
+	return conn, br
+}
+
+// nextFrame reads a frame from an event stream, failing the test if none
+// comes.
+func nextFrame(t *testing.T, conn net.Conn, br *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, payload, err := readWSFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame.opcode, payload
+}
+
+func nextEvent(t *testing.T, conn net.Conn, br *bufio.Reader) *TransactionEvent {
+	t.Helper()
+	opcode, payload := nextFrame(t, conn, br)
+	if opcode != 0x1 {
+		t.Fatalf("event stream sent opcode %#x", opcode)
+	}
+	e := &TransactionEvent{}
+	if err := json.Unmarshal(payload, e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// sendMasked sends a frame as clients do, masked.
+func sendMasked(conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+func TestEventsStartAndFinish(t *testing.T) {
+	origin := textOrigin(t, "watched")
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	conn, br := subscribeEvents(t, p.admin(t))
+	getThrough(t, p, origin.URL+"/a")
+
+	start := nextEvent(t, conn, br)
+	if start.Type != "start" || start.Method != "GET" || start.URL != origin.URL+"/a" || start.ID == "" || start.Status != 0 {
+		t.Errorf("start event %+v", start)
+	}
+	finish := nextEvent(t, conn, br)
+	if finish.Type != "finish" || finish.ID != start.ID || finish.Status != http.StatusOK ||
+		finish.ResponseSize == 0 || finish.Duration <= 0 || finish.Aborted {
+		t.Errorf("finish event %+v", finish)
+	}
+}
+
+func TestEventsFinishBeforeKeepAlive(t *testing.T) {
+	origin := textOrigin(t, "watched")
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	conn, br := subscribeEvents(t, p.admin(t))
+	// the client connection stays open for the next request, the
+	// transaction is finished all the same
+	client := p.client()
+	t.Cleanup(client.CloseIdleConnections)
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	nextEvent(t, conn, br)
+	if finish := nextEvent(t, conn, br); finish.Type != "finish" || finish.Status != http.StatusOK {
+		t.Errorf("finish event %+v", finish)
+	}
+}
+
+func TestEventsFinishBeforeRelay(t *testing.T) {
+	origin := wsEchoOrigin(t)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	conn, br := subscribeEvents(t, p.admin(t))
+	upgradeThrough(t, p, origin)
+	nextEvent(t, conn, br)
+	if finish := nextEvent(t, conn, br); finish.Type != "finish" || finish.Status != http.StatusSwitchingProtocols {
+		t.Errorf("finish event of an upgrade still relayed %+v", finish)
+	}
+}
+
+func TestEventsAborted(t *testing.T) {
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	conn, br := subscribeEvents(t, p.admin(t))
+	// nothing listens there, no response reaches the client
+	resp, _ := getThrough(t, p, "http://127.0.0.1:1/")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("request to a closed port got %s", resp.Status)
+	}
+	nextEvent(t, conn, br)
+	if finish := nextEvent(t, conn, br); finish.Type != "finish" || !finish.Aborted || finish.Status != 0 {
+		t.Errorf("finish event of a failed request %+v", finish)
+	}
+}
+
+func TestEventsRedactURL(t *testing.T) {
+	origin := textOrigin(t, "watched")
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-redact-body", `token=([^&]*)`)
+	conn, br := subscribeEvents(t, p.admin(t))
+	getThrough(t, p, origin.URL+"/?token=hunter2&a=1")
+	if e := nextEvent(t, conn, br); e.URL != origin.URL+"/?token=[REDACTED]&a=1" {
+		t.Errorf("event URL %q", e.URL)
+	}
+}
+
+func TestEventsPingAndClose(t *testing.T) {
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	conn, br := subscribeEvents(t, p.admin(t))
+	sendMasked(conn, 0x9, []byte("still there?"))
+	if opcode, payload := nextFrame(t, conn, br); opcode != 0xa || string(payload) != "still there?" {
+		t.Errorf("ping answered with opcode %#x %q", opcode, payload)
+	}
+	sendMasked(conn, 0x8, closePayload(1000))
+	if opcode, payload := nextFrame(t, conn, br); opcode != 0x8 || string(payload) != string(closePayload(1000)) {
+		t.Errorf("close answered with opcode %#x %q", opcode, payload)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("event stream still open after the close handshake")
+	}
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	h := NewEventHub(2, nil)
+	slow := h.subscribe()
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	for i := 0; i < 3; i++ {
+		h.start(fmt.Sprint(i), time.Now(), req)
+	}
+	// what was buffered is still delivered, then the stream ends
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("dropped subscriber got %d events, want the 2 buffered", n)
+	}
+	if !strings.Contains(logged.String(), "dropping it") {
+		t.Errorf("drop not logged:\n%s", logged)
+	}
+	// a new subscriber isn't affected
+	fresh := h.subscribe()
+	h.start("3", time.Now(), req)
+	if e := <-fresh.events; !strings.Contains(string(e), `"id":"3"`) {
+		t.Errorf("new subscriber got %s", e)
+	}
+	h.unsubscribe(slow)
+	h.unsubscribe(fresh)
+}
+
+func TestEventsNeedWebSocket(t *testing.T) {
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	resp, err := http.Get(p.admin(t).URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("plain GET of /events got %s, Upgrade %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	p = newTestProxy(t, "-admin", "127.0.0.1:0", "-events-buffer", "0")
+	resp, err = http.Get(p.admin(t).URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/events with -events-buffer 0 got %s", resp.Status)
+	}
+}
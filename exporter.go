@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const exportInterval = time.Second
+
+// Transaction is a captured request/response pair.
+type Transaction struct {
+	ID              string      `json:"id"`
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Status          int         `json:"status"`
+	RequestHeader   http.Header `json:"requestHeader"`
+	RequestBody     string      `json:"requestBody"`
+	ResponseHeader  http.Header `json:"responseHeader"`
+	ResponseBody    string      `json:"responseBody"`
+	ResponseTrailer http.Header `json:"responseTrailer,omitempty"`
+
+	Duration     time.Duration `json:"duration"`
+	RequestSize  int64         `json:"requestSize"`
+	ResponseSize int64         `json:"responseSize"`
+	Timing       *Timing       `json:"timing,omitempty"`
+
+	// UpstreamCerts is the chain the origin presented, leaf first.
+	UpstreamCerts []*peerCert `json:"upstreamCerts,omitempty"`
+
+	// ShadowDiff lists how the shadow upstream's response differed.
+	ShadowDiff []string `json:"shadowDiff,omitempty"`
+}
+
+func newTransaction(start time.Time, req *http.Request, reqDump []byte, resp *http.Response, respDump []byte) *Transaction {
+	respBody := dumpBody(respDump)
+	if isChunked(resp.TransferEncoding) {
+		// captures hold the content, the client got the chunks
+		respBody = dechunk(respBody)
+	}
+	return &Transaction{
+		Time:            start,
+		Method:          req.Method,
+		URL:             req.URL.String(),
+		Status:          resp.StatusCode,
+		RequestHeader:   req.Header,
+		RequestBody:     string(dumpBody(reqDump)),
+		ResponseHeader:  resp.Header,
+		ResponseBody:    string(respBody),
+		ResponseTrailer: resp.Trailer,
+		Duration:        time.Since(start),
+		RequestSize:     int64(len(reqDump)),
+		UpstreamCerts:   peerCerts(resp.TLS),
+	}
+}
+
+// dumpBody returns the part of a raw http dump following the header block.
+func dumpBody(dump []byte) []byte {
+	i := bytes.Index(dump, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil
+	}
+	return dump[i+4:]
+}
+
+// Exporter posts captured transactions to a remote collector as JSON arrays.
+// Transactions are queued and sent in batches from a single goroutine so a
+// slow collector never blocks the proxy; when the queue is full new
+// transactions are dropped. After a failed post the collector is left alone
+// for a backoff doubling up to maxExportBackoff.
+type Exporter struct {
+	url       string
+	client    *http.Client
+	queue     chan *Transaction
+	batchSize int
+	keep      bool
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// maxExportBackoff is the longest wait before posting to a failing
+// collector again.
+const maxExportBackoff = time.Minute
+
+// NewExporter starts an Exporter sending to url. If keep is true, batches the
+// collector failed to accept are retried with the next send instead of being
+// dropped, up to queueSize transactions, the oldest going first.
+func NewExporter(url string, client *http.Client, batchSize, queueSize int, keep bool) *Exporter {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if queueSize < batchSize {
+		queueSize = batchSize
+	}
+	e := &Exporter{
+		url:       url,
+		client:    client,
+		queue:     make(chan *Transaction, queueSize),
+		batchSize: batchSize,
+		keep:      keep,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues t for sending, dropping it if the queue is full.
+func (e *Exporter) Export(t *Transaction) {
+	select {
+	case e.queue <- t:
+	default:
+		logger.Warnln("exporter queue full, dropping transaction", t.URL)
+	}
+}
+
+// Close sends the transactions still queued or kept, once, and stops the
+// exporter.
+func (e *Exporter) Close() {
+	e.closeOnce.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	var batch []*Transaction
+	var backoff time.Duration
+	var retry time.Time
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	add := func(t *Transaction) {
+		batch = append(batch, t)
+		if over := len(batch) - cap(e.queue); over > 0 {
+			logger.Warnln("exporter holding too many transactions, dropping the", over, "oldest")
+			batch = batch[over:]
+		}
+	}
+	flush := func(now bool) {
+		if len(batch) == 0 || (!now && time.Now().Before(retry)) {
+			return
+		}
+		err := e.send(batch)
+		if err == nil {
+			batch = nil
+			backoff = 0
+			return
+		}
+		backoff = min(max(2*backoff, exportInterval), maxExportBackoff)
+		retry = time.Now().Add(backoff)
+		logger.Warnln("export to collector error:", err, "retrying in", backoff)
+		if !e.keep {
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case t := <-e.queue:
+			add(t)
+			if len(batch) >= e.batchSize {
+				flush(false)
+			}
+		case <-ticker.C:
+			flush(false)
+		case <-e.stop:
+			for {
+				select {
+				case t := <-e.queue:
+					add(t)
+					continue
+				default:
+				}
+				break
+			}
+			flush(true)
+			return
+		}
+	}
+}
+
+func (e *Exporter) send(batch []*Transaction) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
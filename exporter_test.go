@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collector is a test collector recording the transactions posted to it
+// and answering with status.
+type collector struct {
+	*httptest.Server
+	posts  atomic.Int32
+	status atomic.Int32
+	got    chan []*Transaction
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{got: make(chan []*Transaction, 100)}
+	c.status.Store(http.StatusOK)
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.posts.Add(1)
+		var batch []*Transaction
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("collector got invalid json: %s", err)
+		}
+		w.WriteHeader(int(c.status.Load()))
+		if c.status.Load() == http.StatusOK {
+			c.got <- batch
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestExporterPostsProxiedTransactions(t *testing.T) {
+	c := newCollector(t)
+	origin := textOrigin(t, "exported")
+	p := newTestProxy(t, "-collector", c.URL, "-collector-batch", "1")
+	resp, err := p.client().Get(origin.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	select {
+	case batch := <-c.got:
+		if len(batch) != 1 || batch[0].URL != origin.URL+"/page" || batch[0].ResponseBody != "exported" {
+			t.Errorf("collector got %+v", batch[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing posted to the collector")
+	}
+}
+
+func TestExporterBacksOffFailingCollector(t *testing.T) {
+	c := newCollector(t)
+	c.status.Store(http.StatusServiceUnavailable)
+	e := NewExporter(c.URL, &http.Client{Timeout: time.Second}, 1, 100, true)
+	defer e.Close()
+	for i := 0; i < 50; i++ {
+		e.Export(&Transaction{URL: "http://example.com/"})
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 500ms of transactions: one post, then a second's backoff
+	if posts := c.posts.Load(); posts > 2 {
+		t.Errorf("%d posts to a failing collector within the backoff", posts)
+	}
+
+	// once it recovers, the kept transactions all arrive
+	c.status.Store(http.StatusOK)
+	total := 0
+	deadline := time.After(5 * time.Second)
+	for total < 50 {
+		select {
+		case batch := <-c.got:
+			total += len(batch)
+		case <-deadline:
+			t.Fatalf("%d of 50 kept transactions arrived", total)
+		}
+	}
+}
+
+func TestExporterCapsKeptTransactions(t *testing.T) {
+	c := newCollector(t)
+	c.status.Store(http.StatusServiceUnavailable)
+	e := NewExporter(c.URL, &http.Client{Timeout: time.Second}, 1, 10, true)
+	for i := 0; i < 30; i++ {
+		e.Export(&Transaction{URL: "http://example.com/"})
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.status.Store(http.StatusOK)
+	e.Close()
+	total := 0
+	for len(c.got) > 0 {
+		total += len(<-c.got)
+	}
+	if total == 0 || total > 10 {
+		t.Errorf("%d transactions kept, want 1 to the queue size of 10", total)
+	}
+}
+
+func TestExporterTimesOutHungCollector(t *testing.T) {
+	release := make(chan struct{})
+	var posts atomic.Int32
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	e := NewExporter(hung.URL, &http.Client{Timeout: 100 * time.Millisecond}, 1, 100, true)
+	defer e.Close()
+	e.Export(&Transaction{URL: "http://example.com/"})
+	deadline := time.Now().Add(5 * time.Second)
+	for posts.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if posts.Load() < 2 {
+		t.Error("exporter stuck on a hung collector")
+	}
+}
+
+func TestCloseFlushesExporter(t *testing.T) {
+	c := newCollector(t)
+	origin := textOrigin(t, "exported")
+	// batches of 100 wait for the ticker, closing must not lose them
+	p := newTestProxy(t, "-collector", c.URL, "-collector-batch", "100")
+	for i := 0; i < 3; i++ {
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+	}
+	time.Sleep(100 * time.Millisecond)
+	p.Close()
+	total := 0
+	for len(c.got) > 0 {
+		total += len(<-c.got)
+	}
+	if total != 3 {
+		t.Errorf("collector got %d of 3 transactions by close", total)
+	}
+}
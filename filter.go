@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// A BodyFilter inspects the bodies of the responses it matches. Matching
+// responses are buffered and sent to the client unchanged first; the filter
+// then gets a decoded copy, so it can't break what the client receives.
+type BodyFilter interface {
+	// Match and Filter get the decrypted request, whose TLS field holds
+	// the intercepted client's connection state, with any client cert it
+	// presented.
+	Match(req *http.Request) bool
+	// Filter is called in the background and must not modify resp, which
+	// is shared with the other filters matching req.
+	Filter(req *http.Request, resp *capturedResponse)
+}
+
+// filtersFor returns the filters matching req.
+func (hw *HandlerWrapper) filtersFor(req *http.Request) []BodyFilter {
+	var matched []BodyFilter
+	for _, f := range hw.filters {
+		if f.Match(req) {
+			matched = append(matched, f)
+		}
+	}
+	return matched
+}
+
+// runFilters hands the response in respDump, received over a connection in
+// state, to the filters matching req.
+func (hw *HandlerWrapper) runFilters(req *http.Request, respDump []byte, state *tls.ConnectionState) {
+	filters := hw.filtersFor(req)
+	if len(filters) == 0 || respDump == nil {
+		return
+	}
+	resp, err := parseCapturedResponse(respDump, req)
+	if err != nil {
+		logger.Warnln("parse response for filters error:", err)
+		return
+	}
+	resp.tls = state
+	go func() {
+		for _, f := range filters {
+			f.Filter(req, resp)
+		}
+	}()
+}
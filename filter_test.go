@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pathFilter passes on the bodies of responses to requests for path.
+type pathFilter struct {
+	path string
+	got  chan string
+}
+
+func (f *pathFilter) Match(req *http.Request) bool {
+	return req.URL.Path == f.path
+}
+
+func (f *pathFilter) Filter(req *http.Request, resp *capturedResponse) {
+	f.got <- string(resp.body)
+}
+
+func TestBodyFilterGetsDecodedCopy(t *testing.T) {
+	origin := jsonOrigin(t, "origin", `{"memberid": 42}`, true)
+	p := newTestProxy(t)
+	f := &pathFilter{"/filtered", make(chan string, 10)}
+	p.filters = append(p.filters, f)
+
+	for _, path := range []string{"/filtered", "/other"} {
+		req, _ := http.NewRequest("GET", origin.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := p.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the client gets the response as the origin sent it
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("%s got Content-Encoding %q", path, resp.Header.Get("Content-Encoding"))
+		}
+		if body := gunzip(t, resp.Body); body != `{"memberid": 42}` {
+			t.Errorf("%s got %q", path, body)
+		}
+		resp.Body.Close()
+	}
+	select {
+	case body := <-f.got:
+		if body != `{"memberid": 42}` {
+			t.Errorf("filter got %q, want the decoded body", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("filter never called")
+	}
+	select {
+	case body := <-f.got:
+		t.Errorf("filter called for an unmatched request with %q", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlimamaFilterReportsMemberID(t *testing.T) {
+	origin := jsonOrigin(t, "alimama", `{"data": {"memberid": 1234}, "ok": true}`, true)
+	reports := make(chan RealTbkSetCookieReq, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report RealTbkSetCookieReq
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+		w.Write([]byte(`{"state": 1}`))
+	}))
+	defer collector.Close()
+	p := newTestProxy(t, "-rewrite", "pub.alimama.com="+origin.Listener.Addr().String())
+	// the collector's address is fixed, send its reports to the test one
+	p.filters = []BodyFilter{&alimamaFilter{&http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, collector.Listener.Addr().String())
+		},
+	}}}}
+
+	req, _ := http.NewRequest("GET", "http://pub.alimama.com/common/getUnionPubContextInfo.json", nil)
+	req.Header.Set("Cookie", "t=abc")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); !strings.Contains(body, "1234") {
+		t.Errorf("client got %q", body)
+	}
+	select {
+	case report := <-reports:
+		if report.MemberId != 1234 || report.Cookies != "t=abc" {
+			t.Errorf("reported %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("member id never reported")
+	}
+}
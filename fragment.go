@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// fragmentWriter writes to w in chunks of at most size bytes, waiting delay
+// between them, so clients see a response arrive in many small reads. With
+// Nagle's algorithm off (-nodelay) each chunk leaves in its own segment.
+type fragmentWriter struct {
+	ctx   context.Context
+	w     io.Writer
+	size  int
+	delay time.Duration
+	// wrote is set after the first chunk, the first one isn't delayed
+	wrote bool
+}
+
+func (f *fragmentWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if f.wrote && f.delay > 0 {
+			timer := time.NewTimer(f.delay)
+			select {
+			case <-timer.C:
+			case <-f.ctx.Done():
+				timer.Stop()
+				return n, f.ctx.Err()
+			}
+		}
+		chunk := p[:min(len(p), f.size)]
+		m, err := f.w.Write(chunk)
+		n += m
+		f.wrote = true
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkRecorder records the size of each write.
+type chunkRecorder struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.Buffer.Write(p)
+}
+
+func TestFragmentWriterChunks(t *testing.T) {
+	rec := &chunkRecorder{}
+	f := &fragmentWriter{ctx: context.Background(), w: rec, size: 4, delay: 10 * time.Millisecond}
+	start := time.Now()
+	f.Write([]byte("0123456789"))
+	f.Write([]byte("ab"))
+	// the first chunk goes out at once, the other three after a pause
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("4 chunks written in %s, want 3 pauses of 10ms", elapsed)
+	}
+	if fmt.Sprint(rec.sizes) != "[4 4 2 2]" || rec.String() != "0123456789ab" {
+		t.Errorf("wrote %q in chunks of %v", rec.String(), rec.sizes)
+	}
+}
+
+func TestFragmentWriterStopsWhenDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := &chunkRecorder{}
+	f := &fragmentWriter{ctx: ctx, w: rec, size: 1, delay: time.Hour}
+	cancel()
+	if n, err := f.Write([]byte("abc")); n != 1 || err != context.Canceled {
+		t.Errorf("write after the exchange was abandoned = %d, %v", n, err)
+	}
+}
+
+func TestResponseFragmented(t *testing.T) {
+	body := strings.Repeat("fragmented ", 10)
+	origin := textOrigin(t, body)
+	p := newTestProxy(t, "-fragment-size", "7", "-fragment-delay", "20ms")
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", origin.URL, origin.Listener.Addr())
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// with -nodelay on by default, each chunk arrives on its own
+	var got bytes.Buffer
+	reads := 0
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 7 {
+			t.Fatalf("read %d bytes at once, want chunks of at most 7", n)
+		}
+		got.Write(buf[:n])
+		reads++
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads < got.Len()/7 {
+		t.Errorf("%d bytes in %d reads", got.Len(), reads)
+	}
+	// the client puts the response back together
+	resp, err := http.ReadResponse(bufio.NewReader(&got), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readAll(t, resp); b != body {
+		t.Errorf("reassembled body %q", b)
+	}
+}
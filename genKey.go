@@ -12,6 +12,7 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -23,6 +24,11 @@ const (
 
 var (
 	tenYearsFromToday = time.Now().AddDate(10, 0, 0)
+
+	// serialNumberBits is the size of the random serial numbers of new
+	// certificates, large enough that two certs from the same issuer never
+	// share one.
+	serialNumberBits = 128
 )
 
 // PrivateKey is a convenience wrapper for rsa.PrivateKey
@@ -85,7 +91,7 @@ func (key *PrivateKey) WriteToFile(filename string) (err error) {
 		return fmt.Errorf("Unable to PEM encode private key: %s", err)
 	}
 	if err := keyOut.Close(); err != nil {
-		logger.Printf("Unable to close file: %v", err)
+		logger.Errorf("Unable to close file: %v", err)
 	}
 	return
 }
@@ -139,21 +145,32 @@ func (key *PrivateKey) CertificateForKey(template *x509.Certificate, issuer *Cer
 //
 //     organization: the org name for the cert.
 //     name:         used as the common name for the cert.  If name is an IP
-//                   address, it is also added as an IP SAN.
+//                   address, it is also added as an IP SAN, otherwise a
+//                   leaf gets it as a DNS SAN.
 //     validUntil:   time at which certificate expires
 //     isCA:         whether or not this cert is a CA
 //     issuer:       the certificate which is issuing the new cert.  If nil, the
 //                   new cert will be a self-signed CA certificate.
+//     permittedDomains: for a CA, the DNS domains it may issue certs for as
+//                   a Name Constraint.  If empty, it is unconstrained.
+//     extensions:   extra extensions added to the cert as they are, e.g.
+//                   embedded SCTs.
 //
 func (key *PrivateKey) TLSCertificateFor(
 	organization string,
 	name string,
 	validUntil time.Time,
 	isCA bool,
-	issuer *Certificate) (cert *Certificate, err error) {
+	issuer *Certificate,
+	permittedDomains []string,
+	extensions []pkix.Extension) (cert *Certificate, err error) {
 
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
 	template := &x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(int64(time.Now().UnixNano())),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{organization},
 			CommonName:   name,
@@ -163,29 +180,52 @@ func (key *PrivateKey) TLSCertificateFor(
 
 		BasicConstraintsValid: true,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtraExtensions:       extensions,
 	}
 
-	// If name is an ip address, add it as an IP SAN
+	// If name is an ip address, add it as an IP SAN, otherwise a leaf gets
+	// it as a DNS SAN.  Clients no longer look at the common name, Apple's
+	// among them.
 	ip := net.ParseIP(name)
 	if ip != nil {
 		template.IPAddresses = []net.IP{ip}
+	} else if !isCA {
+		template.DNSNames = []string{name}
 	}
 
 	isSelfSigned := issuer == nil
 	if isSelfSigned {
 		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	} else if !isCA {
+		// Apple platforms reject server certs without the serverAuth EKU
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
 	}
 
 	// If it's a CA, add certificate signing
 	if isCA {
 		template.KeyUsage = template.KeyUsage | x509.KeyUsageCertSign
 		template.IsCA = true
+		if len(permittedDomains) > 0 {
+			template.PermittedDNSDomains = permittedDomains
+			template.PermittedDNSDomainsCritical = true
+		}
 	}
 
 	cert, err = key.Certificate(template, issuer)
 	return
 }
 
+// newSerialNumber returns a random serial number of serialNumberBits bits,
+// with the top bit set so it is always that long.
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(serialNumberBits-1))
+	serialNumber, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate serial number: %s", err)
+	}
+	return serialNumber.SetBit(serialNumber, serialNumberBits-1, 1), nil
+}
+
 // LoadCertificateFromFile loads a Certificate from a PEM-encoded file
 func LoadCertificateFromFile(filename string) (*Certificate, error) {
 	certificateData, err := ioutil.ReadFile(filename)
@@ -236,7 +276,7 @@ func (cert *Certificate) WriteToFile(filename string) (err error) {
 	}
 	defer func() {
 		if err := certOut.Close(); err != nil {
-			logger.Printf("Unable to close file: %v", err)
+			logger.Errorf("Unable to close file: %v", err)
 		}
 	}()
 	return pem.Encode(certOut, cert.pemBlock())
@@ -264,7 +304,7 @@ func (cert *Certificate) WriteToDERFile(filename string) (err error) {
 	}
 	defer func() {
 		if err := certOut.Close(); err != nil {
-			logger.Printf("Unable to close file: %v", err)
+			logger.Errorf("Unable to close file: %v", err)
 		}
 	}()
 	_, err = certOut.Write(cert.derBytes)
@@ -296,6 +336,28 @@ func (cert *Certificate) ExpiresBefore(time time.Time) bool {
 	return cert.cert.NotAfter.Before(time)
 }
 
+// PermitsDNSName reports whether the Name Constraints of this cert allow it
+// to issue for name. A constraint of example.com allows example.com and its
+// subdomains, .example.com only its subdomains.
+func (cert *Certificate) PermitsDNSName(name string) bool {
+	domains := cert.cert.PermittedDNSDomains
+	if len(domains) == 0 || net.ParseIP(name) != nil {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if strings.HasPrefix(domain, ".") {
+			if strings.HasSuffix(name, domain) {
+				return true
+			}
+		} else if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
 func bytesToCert(derBytes []byte) (*Certificate, error) {
 	cert, err := x509.ParseCertificate(derBytes)
 	if err != nil {
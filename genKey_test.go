@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempCA copies the tests' CA key into a temporary directory and returns
+// the paths for a CA key and cert there, the cert not yet made.
+func tempCA(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	key, err := os.ReadFile(filepath.Join(testCADir, "ca-pk.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := filepath.Join(dir, "ca-pk.pem")
+	if err := os.WriteFile(pk, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pk, filepath.Join(dir, "ca-cert.pem")
+}
+
+func TestCANameConstraints(t *testing.T) {
+	pk, cert := tempCA(t)
+	hw := newTestHandlerCA(t, pk, cert, "-ca-domains", "example.com,.internal.test")
+	ca := hw.issuingCert.X509()
+	if !sameStrings(ca.PermittedDNSDomains, []string{"example.com", ".internal.test"}) || !ca.PermittedDNSDomainsCritical {
+		t.Fatalf("CA permits %v critical=%v", ca.PermittedDNSDomains, ca.PermittedDNSDomainsCritical)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	for _, name := range []string{"example.com", "www.example.com", "api.internal.test"} {
+		leaf, err := hw.FakeCertForName(name)
+		if err != nil {
+			t.Errorf("minting for %s: %s", name, err)
+			continue
+		}
+		x, _ := x509.ParseCertificate(leaf.Certificate[0])
+		if _, err := x.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("cert for %s doesn't verify: %s", name, err)
+		}
+	}
+	for _, name := range []string{"example.org", "notexample.com", "internal.test"} {
+		if _, err := hw.FakeCertForName(name); err == nil {
+			t.Errorf("minted a cert for %s outside the constraints", name)
+		}
+	}
+}
+
+func TestCARegeneratedWhenDomainsChange(t *testing.T) {
+	pk, cert := tempCA(t)
+	hw := newTestHandlerCA(t, pk, cert)
+	if len(hw.issuingCert.X509().PermittedDNSDomains) > 0 {
+		t.Fatal("unconstrained CA has name constraints")
+	}
+	first, _ := os.ReadFile(cert)
+
+	// the same domains keep the CA, so clients trusting it still do
+	newTestHandlerCA(t, pk, cert)
+	if again, _ := os.ReadFile(cert); string(again) != string(first) {
+		t.Error("CA regenerated without its domains changing")
+	}
+
+	hw = newTestHandlerCA(t, pk, cert, "-ca-domains", "example.com")
+	if got := hw.issuingCert.X509().PermittedDNSDomains; !sameStrings(got, []string{"example.com"}) {
+		t.Errorf("CA permits %v after -ca-domains changed", got)
+	}
+	saved, _ := LoadCertificateFromFile(cert)
+	if !sameStrings(saved.X509().PermittedDNSDomains, []string{"example.com"}) {
+		t.Error("regenerated CA not saved")
+	}
+	if saved.X509().NotAfter.Before(time.Now().AddDate(0, 11, 0)) {
+		t.Errorf("regenerated CA expires %s", saved.X509().NotAfter)
+	}
+}
+
+func TestPermitsDNSName(t *testing.T) {
+	pk, cert := tempCA(t)
+	hw := newTestHandlerCA(t, pk, cert, "-ca-domains", "Example.com,.sub.test")
+	for name, want := range map[string]bool{
+		"example.com":     true,
+		"A.EXAMPLE.COM":   true,
+		"badexample.com":  false,
+		"sub.test":        false,
+		"x.sub.test":      true,
+		"10.0.0.1":        true,
+		"unrelated.other": false,
+	} {
+		if got := hw.issuingCert.PermitsDNSName(name); got != want {
+			t.Errorf("PermitsDNSName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMintedCertsGetUniqueRandomSerials(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-no-cert-cache")
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		// minted back to back for the same name, only the serial tells them apart
+		cert := handshakeThrough(t, p, origin, "serial.test")
+		serial := cert.SerialNumber
+		if serial.BitLen() != serialNumberBits {
+			t.Errorf("serial %x is %d bits, want %d", serial, serial.BitLen(), serialNumberBits)
+		}
+		if seen[serial.String()] {
+			t.Fatalf("serial %x handed out twice", serial)
+		}
+		seen[serial.String()] = true
+	}
+}
+
+func TestMintedLeafHasSANAndServerAuth(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	leaf := handshakeThrough(t, p, origin, "apple.example.test")
+	// clients like Apple's ignore the common name and want serverAuth
+	if !sameStrings(leaf.DNSNames, []string{"apple.example.test"}) || len(leaf.IPAddresses) > 0 {
+		t.Errorf("leaf SANs %v %v, want the name as a DNS SAN", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("leaf EKUs %v, want serverAuth", leaf.ExtKeyUsage)
+	}
+
+	ipLeaf, err := p.FakeCertForName("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _ := x509.ParseCertificate(ipLeaf.Certificate[0])
+	if len(x.DNSNames) > 0 || len(x.IPAddresses) != 1 || x.IPAddresses[0].String() != "10.0.0.1" {
+		t.Errorf("leaf for an ip has SANs %v %v, want only the ip", x.DNSNames, x.IPAddresses)
+	}
+	// the CA names no servers
+	if ca := p.issuingCert.X509(); len(ca.DNSNames) > 0 {
+		t.Errorf("CA has DNS SANs %v", ca.DNSNames)
+	}
+}
+
+func TestCertTTLCappedForApple(t *testing.T) {
+	hw := newTestHandler(t, "-cert-ttl", maxCertTTL.String())
+	leaf, err := hw.FakeCertForName("longest.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _ := x509.ParseCertificate(leaf.Certificate[0])
+	if validity := x.NotAfter.Sub(x.NotBefore); validity > 825*24*time.Hour {
+		t.Errorf("leaf valid for %s with the longest -cert-ttl, Apple accepts 825 days", validity)
+	}
+	if err := initError("-cert-ttl", (maxCertTTL + time.Hour).String()); err == nil {
+		t.Error("-cert-ttl over the Apple limit accepted")
+	}
+}
@@ -4,11 +4,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -21,16 +28,10 @@ var (
 )
 
 var logFile *os.File
-var logger *log.Logger
+var logger *Logger
 
 func main() {
-	var conf Cfg
-
-	conf.Port = flag.String("port", "8080", "Listen port")
-	conf.Raddr = flag.String("raddr", "", "Remote addr")
-	conf.Log = flag.String("log", "./error.log", "log file path")
-	conf.Monitor = flag.Bool("m", false, "monitor mode")
-	conf.Tls = flag.Bool("tls", false, "tls connect")
+	conf := defineFlags(flag.CommandLine)
 	help := flag.Bool("h", false, "help")
 	flag.Parse()
 
@@ -43,39 +44,336 @@ func main() {
 		log.Fatalln("fail to create log file!")
 	}
 
-	logger = log.New(logFile, "[gomitmproxy]", log.LstdFlags|log.Llongfile)
+	level, err := ParseLevel(*conf.LogLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger = NewLogger(logFile, level)
 
 	wg.Add(1)
-	gomitmproxy(&conf)
+	gomitmproxy(conf)
 	wg.Wait()
 }
 
+// defineFlags defines the proxy's flags on fs, returning the config they
+// fill in once fs is parsed.
+func defineFlags(fs *flag.FlagSet) *Cfg {
+	var conf Cfg
+
+	conf.Port = fs.String("port", "8080", "Listen port")
+	conf.ReusePort = fs.Bool("reuse-port", false, "listen with SO_REUSEPORT so other processes can share the port, and the kernel spreads connections between them")
+	conf.Listeners = fs.Int("listeners", 1, "sockets listening on the port within this process, above 1 needs -reuse-port")
+	conf.Raddr = fs.String("raddr", "", "Remote addr")
+	conf.NoProxy = fs.String("no-proxy", noProxyEnv(), "comma separated hosts, domains, IPs or CIDRs handled directly instead of through -raddr, defaults to $NO_PROXY")
+	conf.UpstreamH2 = fs.String("upstream-h2", "", "open tunnels through -raddr and -upstream-rules proxies as CONNECT streams over http/2: tls, or h2c for prior knowledge http/2 in the clear; empty uses http/1.1 CONNECT")
+	conf.UpstreamRules = fs.String("upstream-rules", "", "comma separated host=proxy rules sending matching hosts, e.g. *.example.de, through another upstream proxy than -raddr, or host=direct around it; the first match wins")
+	conf.Log = fs.String("log", "./error.log", "log file path")
+	conf.LogLevel = fs.String("loglevel", "info", "log verbosity: error, warn, info or debug")
+	conf.Monitor = fs.Bool("m", false, "monitor mode")
+	conf.MonitorWorkers = fs.Int("monitor-workers", 1, "goroutines printing monitored requests, more than one can interleave their output")
+	conf.MonitorQueue = fs.Int("monitor-queue", 256, "monitored requests waiting to be printed before the oldest is dropped")
+	conf.MonitorBlock = fs.Bool("monitor-block", false, "make requests wait for room in a full monitor queue instead of dropping the oldest waiting one")
+	conf.Tls = fs.Bool("tls", false, "tls connect")
+	conf.H2C = fs.Bool("h2c", false, "accept prior knowledge http/2 from clients without tls as well; CONNECT over http/2 is tunnelled within the stream, extended CONNECT for websockets needs GODEBUG=http2xconnect=1")
+	conf.Compress = fs.Bool("compress", false, "gzip plaintext responses for clients that accept it")
+	conf.GzipRequests = fs.String("gzip-requests", "", "comma separated host[/path] entries, e.g. api.example.com/upload, whose uncompressed request bodies are sent to the origin gzipped")
+	conf.GzipRequestsMin = fs.Int64("gzip-requests-min", minCompressSize, "smallest request body in bytes -gzip-requests compresses")
+	conf.GzipRequestsMax = fs.Int64("gzip-requests-max", 1<<20, "largest request body in bytes -gzip-requests compresses, bodies are buffered to give the origin their compressed length")
+	conf.KeepAlive = fs.Bool("keepalive", true, "keep client connections open between requests")
+	conf.HeaderTimeout = fs.Duration("header-timeout", 30*time.Second, "how long a client may take to send a request's header block before its connection is closed")
+	conf.ClientIdle = fs.Duration("client-idle", 2*time.Minute, "how long a kept-alive client connection may sit idle between requests before it is closed")
+	conf.MaxHeaderBytes = fs.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "largest request header block accepted, larger ones get 431")
+	conf.MaxResponse = fs.Int64("max-response", 0, "largest response body in bytes passed on to clients, 0 allows any size")
+	conf.MaxResponseAction = fs.String("max-response-action", "reject", "what happens to responses over -max-response: reject answers 502, or aborts the response if it was already streaming, truncate cuts the body short")
+	conf.MaxHeaders = fs.Int("max-headers", 0, "most request header fields accepted, 0 for no limit")
+	conf.Rechunk = fs.Bool("rechunk", false, "send bodies the origin delimits by closing the connection as chunks, keeping the client connection open")
+	conf.Relay1xx = fs.Bool("relay-1xx", true, "pass informational responses from origins, e.g. 103 Early Hints, on to clients ahead of the final response; false drops them")
+	conf.LogAuth = fs.Bool("log-auth", false, "log authentication challenges in 401 and 407 responses and the Authorization and Proxy-Authorization sent, with passwords and digests redacted")
+	conf.LogDoH = fs.Bool("log-doh", false, "decode and log the DNS queries and answers of DNS-over-HTTPS requests, application/dns-message or to /dns-query; they are forwarded unchanged")
+	conf.HeaderOrder = fs.Bool("header-order", false, "pass upstream response header fields on in the order and case the origin sent them")
+	conf.Via = fs.String("via", "", "identifier added in a Via header to forwarded requests and responses, requests already carrying it are refused as loops; empty adds none")
+	conf.TransactionHeader = fs.String("transaction-header", "", "header carrying each transaction's id to the origin and back to the client, e.g. X-Transaction-Id; empty adds none")
+	conf.WebSocketLog = fs.Bool("ws", false, "log websocket frames")
+	conf.HTTPPort = fs.String("http-port", "80", "port dialed for http hosts given without one")
+	conf.HTTPSPort = fs.String("https-port", "443", "port dialed for https and CONNECT hosts given without one")
+	conf.InterceptPorts = fs.String("intercept-ports", "443", "comma separated CONNECT ports to intercept, others are tunneled")
+	conf.InterceptHosts = fs.String("intercept-hosts", "", "comma separated host patterns to intercept, e.g. *.example.com, others are tunneled; empty intercepts all")
+	conf.InterceptSNI = fs.String("intercept-sni", "", "regexp the TLS server name must match for a connection to be intercepted, e.g. '.*\\.internal$', others are tunneled")
+	conf.SNIMismatch = fs.String("sni-mismatch", "ignore", "what to do with intercepted requests whose Host differs from the TLS server name, as in domain fronting: ignore, log, or reject with 421")
+	conf.RouteBy = fs.String("route-by", "host", "where intercepted requests are sent: host follows the Host header, sni the TLS server name, keeping the Host header as sent")
+	conf.Collector = fs.String("collector", "", "collector url to post captured transactions to")
+	conf.CollectorBatch = fs.Int("collector-batch", 50, "transactions per collector post")
+	conf.CollectorQueue = fs.Int("collector-queue", 1000, "transactions queued for the collector before dropping")
+	conf.CollectorKeep = fs.Bool("collector-keep", false, "keep and retry transactions the collector failed to accept")
+	conf.CollectorTimeout = fs.Duration("collector-timeout", 10*time.Second, "how long a post to the collector may take before it counts as failed")
+	conf.Record = fs.String("record", "", "sqlite database file to record transactions into, needs a build with -tags sqlite")
+	conf.Tee = fs.String("tee", "", "sink for decrypted https bytes with connection metadata: tcp:host:port, unix:path or a file or pipe path, gzip compressed for paths ending in .gz")
+	conf.RedactHeaders = fs.String("redact-headers", "", "comma separated header fields shown as [REDACTED] in monitor output and captured transactions, e.g. Authorization,Cookie")
+	conf.RedactBody = fs.String("redact-body", "", "regexp whose matches, or only the groups in them, are shown as [REDACTED] in monitored and captured urls and bodies; the tee stays unredacted")
+	conf.Shadow = fs.String("shadow", "", "shadow upstream url that gets a copy of every request")
+	conf.ShadowDiff = fs.Bool("shadow-diff", false, "log and record how shadow responses differ from the primary ones, comparing json bodies structurally")
+	conf.ShadowTimeout = fs.Duration("shadow-timeout", 30*time.Second, "how long a shadow request may take, from connecting to reading its response, before it is abandoned")
+	conf.Auth = fs.String("auth", "", "comma separated host=user:password credentials added to upstream requests")
+	conf.Rewrite = fs.String("rewrite", "", "comma separated host=target rules dialing target for matching hosts, keeping the original name for SNI and certs")
+	conf.LocationRewrite = fs.String("location-rewrite", "", "comma separated host=target rules pointing redirects to matching hosts at target, host[:port] or scheme://host[:port]; relative locations are resolved first")
+	conf.StatusRewrite = fs.String("status-rewrite", "", "comma separated host[/path]=from:to rules replacing status from with to in responses to matching requests, e.g. api.example.com/v1/=301:302; the path is a prefix")
+	conf.BreakerFailures = fs.Int("breaker-failures", 0, "consecutive upstream failures before failing fast, 0 disables")
+	conf.BreakerCooldown = fs.Duration("breaker-cooldown", 30*time.Second, "how long to fail fast before probing a failing upstream")
+	conf.Replace = new(listFlag)
+	fs.Var(conf.Replace, "replace", "literal find and replace rule for response bodies of -replace-types, /find/replacement with any separator find lacks, e.g. '|api.example.com|localhost:8080'; repeat for more")
+	conf.ReplaceRegexp = new(listFlag)
+	fs.Var(conf.ReplaceRegexp, "replace-regexp", "like -replace with a regexp to find, the replacement may use $1; applied after the -replace rules")
+	conf.ReplaceTypes = fs.String("replace-types", "text/*,application/json,application/*+json,application/javascript,application/xml", "comma separated content type patterns of the response bodies -replace applies to")
+	conf.ReplaceMax = fs.Int64("replace-max", 1<<20, "largest response body in bytes -replace applies to, larger ones are passed on unchanged")
+	conf.Pipe = fs.String("pipe", "", "shell command bodies of -pipe-types are piped through, its output replacing them, e.g. 'jq -c .'")
+	conf.PipeTypes = fs.String("pipe-types", "application/json", "comma separated content type patterns of the bodies piped through -pipe, e.g. text/*")
+	conf.PipeBodies = fs.String("pipe-bodies", "response", "bodies piped through -pipe: request, response or both")
+	conf.PipeTimeout = fs.Duration("pipe-timeout", 5*time.Second, "how long -pipe may take before the body is passed on unchanged")
+	conf.PipeMax = fs.Int64("pipe-max", 1<<20, "largest body, and output, in bytes piped through -pipe; larger ones are passed on unchanged")
+	conf.MaxInflight = fs.Int64("max-inflight", 0, "bytes of bodies and dumps buffered across requests before new requests wait, 0 disables")
+	conf.InflightWait = fs.Duration("inflight-wait", 5*time.Second, "how long a request waits for buffered bytes to drop below -max-inflight before a 503, 0 refuses at once")
+	conf.MaxConcurrent = fs.Int("max-concurrent", 0, "requests proxied at once before new ones wait in line, 0 for no limit")
+	conf.QueueWait = fs.Duration("queue-wait", 10*time.Second, "how long a request waits in line for -max-concurrent before a 503, 0 refuses at once")
+	conf.Priority = fs.String("priority", "", "comma separated host[/path] entries, e.g. localhost/healthz, whose requests go ahead of others waiting for -max-concurrent")
+	conf.UpgradeHTTPS = fs.String("upgrade-https", "", "comma separated host[/path] entries, e.g. *.example.com or example.org/login, whose plain http requests are redirected to https instead of proxied")
+	conf.UpgradeStatus = fs.Int("upgrade-status", 301, "status of the -upgrade-https redirects, 301 or 308 to keep the method")
+	conf.DialTimeout = fs.Duration("dial-timeout", 30*time.Second, "how long connecting to an origin or upstream proxy, and the CONNECT handshake with the latter, may take")
+	conf.ForwardIdle = fs.Duration("forward-idle", 0, "close connections relayed through an upstream proxy (-raddr) once no data passed either way for this long, 0 never does")
+	conf.FallbackDelay = fs.Duration("fallback-delay", 300*time.Millisecond, "delay before racing the other address family when dialing dual-stack hosts")
+	conf.TCPKeepAlive = fs.Duration("tcp-keepalive", 15*time.Second, "tcp keep-alive period of client and upstream connections, negative disables")
+	conf.UpstreamIdle = fs.Duration("upstream-idle", 0, "keep upstream connections for reuse by later requests and close them once idle this long, 0 closes them after each response; not with -tee")
+	conf.NoDelay = fs.Bool("nodelay", true, "disable Nagle's algorithm on client and upstream connections, -nodelay=false batches small writes instead")
+	conf.TunnelLinger = fs.Duration("tunnel-linger", 2*time.Second, "how long a tunnel waits for one side to finish sending after the other half-closed it, 0 closes both at once")
+	conf.FragmentSize = fs.Int("fragment-size", 0, "write responses to clients in chunks of at most this many bytes, to test how they handle fragmented reads, 0 disables")
+	conf.FragmentDelay = fs.Duration("fragment-delay", 0, "pause between the chunks of -fragment-size")
+	conf.Bandwidth = fs.String("bandwidth", "", "comma separated host[/path]=bytes_per_second rules pacing responses to matching requests, e.g. *.example.com=65536, so large ones take proportionally longer; the path is a prefix")
+	conf.Transparent = fs.String("transparent", "", "listen address, e.g. :8082, for connections an iptables REDIRECT rule sends to the proxy; each goes on to the address its client connected to (linux only)")
+	conf.Reverse = fs.String("reverse", "", "backend url, e.g. http://127.0.0.1:3000, to run a reverse proxy in front of on -reverse-listen; requests go through the same filtering and capture as intercepted ones")
+	conf.ReverseListen = fs.String("reverse-listen", ":8443", "listen address of the -reverse proxy, serving tls with certs minted for the names clients ask for")
+	conf.Admin = fs.String("admin", "", "admin api listen address, e.g. 127.0.0.1:8081")
+	conf.P12Password = fs.String("p12-password", "", "password encrypting the PKCS#12 files served on /ca.p12 of the admin api, which needs a build with -tags pkcs12; the CA key is only included with a password and -admin on a loopback address")
+	conf.History = fs.Int("history", 100, "recent transactions kept for the admin api")
+	conf.HistoryBytes = fs.Int64("history-bytes", 16<<20, "captured body bytes kept for the admin api, bodies are only captured when monitoring or exporting")
+	conf.EventsBuffer = fs.Int("events-buffer", 256, "transaction events buffered for each subscriber to the admin api's /events websocket, one falling further behind is dropped; 0 disables the stream")
+	conf.Unix = fs.String("unix", "", "unix socket path to accept proxy connections on as well")
+	conf.CADomains = fs.String("ca-domains", "", "comma separated domains the generated CA is constrained to")
+	conf.UpstreamTLS = fs.String("upstream-tls", "", "semicolon separated host=key:value,... upstream tls overrides, keys min, max, ciphers and alpn with + separated lists")
+	conf.ClientAuth = fs.String("client-auth", "", "comma separated host=mode rules asking intercepted clients for a cert, mode request, require, or verify against -client-ca")
+	conf.ClientCA = fs.String("client-ca", "", "PEM file of the CAs client certs are verified against for -client-auth verify")
+	conf.StrictUpstreamTLS = fs.Bool("strict-upstream-tls", false, "answer requests to origins whose cert fails to verify with the validation error and the chain they presented, not just a bare 502")
+	conf.Health = fs.String("health", "", "health check listen address, e.g. 127.0.0.1:8082")
+	conf.HealthPath = fs.String("health-path", "/healthz", "liveness probe path")
+	conf.ReadyPath = fs.String("ready-path", "/readyz", "readiness probe path")
+	conf.CookieStrip = fs.String("cookie-strip", "", "comma separated Set-Cookie attributes to remove, e.g. Secure,SameSite")
+	conf.CookieDomain = fs.String("cookie-domain", "", "comma separated from=to Set-Cookie domain rewrites, * matches any domain and an empty to removes it")
+	conf.CookieJar = fs.Bool("cookie-jar", false, "keep the cookies origins set in a jar shared by every client, and send them on later requests to those origins that don't carry them already")
+	conf.NoCertCache = fs.Bool("no-cert-cache", false, "mint a fresh cert for every intercepted handshake")
+	conf.CertTTL = fs.Duration("cert-ttl", TWO_WEEKS, "validity of minted certs, at most 19056h (794 days) so Apple platforms accept them")
+	conf.CertRefresh = fs.Duration("cert-refresh", ONE_DAY, "how long before they expire cached certs are minted again")
+	conf.CertFailTTL = fs.Duration("cert-fail-ttl", 30*time.Second, "how long handshakes for a host whose cert failed to mint fail fast before minting is retried")
+	conf.MintRate = fs.Float64("cert-mint-rate", 0, "new mitm certs minted per second at most, handshakes needing one over it fail while cached certs are still served; 0 for no limit")
+	conf.MintBurst = fs.Int("cert-mint-burst", 20, "new mitm certs minted at once at most under -cert-mint-rate")
+	conf.SCTFiles = fs.String("sct", "", "comma separated files each holding a binary SCT to embed in minted certs, for clients requiring certificate transparency")
+	conf.WarmCerts = fs.String("warm-certs", "", "comma separated host names to mint certs for at startup, sparing their first handshake the wait")
+	conf.TicketRotation = fs.Duration("ticket-rotation", time.Hour, "how often intercepted connections get a new session ticket key, the last 3 keys resume sessions; 0 gives every connection its own key, so sessions never resume")
+	conf.ForceHTTP1 = fs.Bool("force-http1", false, "negotiate http/1.1 with intercepted clients through ALPN even when they offer h2")
+	conf.Landing = fs.String("landing", "", "html file served to requests made directly to the proxy")
+	conf.Pac = fs.String("pac", "", "pac file served at "+pacPath+", by default one pointing at the proxy")
+	conf.Wpad = fs.Bool("wpad", false, "also serve the pac file for wpad.dat and to wpad hosts for WPAD discovery")
+	conf.CAInterstitial = fs.Bool("ca-interstitial", false, "after a client rejects a mitm cert, answer its next plain http page load with a page on installing the CA")
+	conf.CacheEntries = fs.Int("cache", 0, "responses kept in the response cache, 0 disables it")
+	conf.CacheEntrySize = fs.Int64("cache-entry-size", 1<<20, "largest response body kept in the response cache")
+	conf.Mirror = fs.String("mirror", "", "directory with host/path copies of sites to serve responses from")
+	conf.MirrorOffline = fs.Bool("mirror-offline", false, "answer requests missing from the mirror with 404 instead of going to the network")
+	return &conf
+}
+
+// listenConfig returns the config of the proxy's tcp listeners. Keep-alive
+// probes stop idle tunnels being dropped by NATs; accepted client
+// connections inherit them.
+func listenConfig(conf *Cfg) net.ListenConfig {
+	return net.ListenConfig{KeepAlive: *conf.TCPKeepAlive}
+}
+
+// listenProxy opens the sockets the proxy listens on at addr, -listeners
+// of them sharing its port through SO_REUSEPORT with -reuse-port.
+func listenProxy(conf *Cfg, addr string) ([]net.Listener, error) {
+	lc := listenConfig(conf)
+	if *conf.ReusePort {
+		lc.Control = reusePortControl
+	}
+	if *conf.Listeners > 1 && !*conf.ReusePort {
+		return nil, fmt.Errorf("-listeners above 1 needs -reuse-port")
+	}
+	var listeners []net.Listener
+	for i := 0; i < max(*conf.Listeners, 1); i++ {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		// the others share the port the first got
+		addr = listener.Addr().String()
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// newTlsConfig returns the TLS config set by conf for the CA in the pk and
+// cert files.
+func newTlsConfig(conf *Cfg, pk, cert string) (*TlsConfig, error) {
+	tlsConfig := NewTlsConfig(pk, cert, "", "")
+	tlsConfig.PermittedDNSDomains = splitList(*conf.CADomains)
+	tlsConfig.DisableCertCache = *conf.NoCertCache
+	tlsConfig.CertTTL = *conf.CertTTL
+	tlsConfig.CertRefresh = *conf.CertRefresh
+	tlsConfig.CertFailTTL = *conf.CertFailTTL
+	tlsConfig.MintRate = *conf.MintRate
+	tlsConfig.MintBurst = *conf.MintBurst
+	tlsConfig.ForceHTTP1 = *conf.ForceHTTP1
+	if sctFiles := splitList(*conf.SCTFiles); len(sctFiles) > 0 {
+		sctList, err := loadSCTExtension(sctFiles)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -sct: %s", err)
+		}
+		tlsConfig.LeafExtensions = append(tlsConfig.LeafExtensions, sctList)
+	}
+	upstreamTLS, err := parseUpstreamTLS(*conf.UpstreamTLS)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid -upstream-tls: %s", err)
+	}
+	tlsConfig.Upstream = upstreamTLS
+	if tlsConfig.ClientAuth, err = parseClientAuth(*conf.ClientAuth); err != nil {
+		return nil, fmt.Errorf("Invalid -client-auth: %s", err)
+	}
+	if *conf.ClientCA != "" {
+		if tlsConfig.ClientCAs, err = loadClientCAs(*conf.ClientCA); err != nil {
+			return nil, fmt.Errorf("Invalid -client-ca: %s", err)
+		}
+	}
+	for _, rule := range tlsConfig.ClientAuth {
+		if rule.Type == tls.RequireAndVerifyClientCert && tlsConfig.ClientCAs == nil {
+			return nil, fmt.Errorf("-client-auth %s=verify needs -client-ca", rule.Pattern)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
 func gomitmproxy(conf *Cfg) {
-	tlsConfig := NewTlsConfig("gomitmproxy-ca-pk.pem", "gomitmproxy-ca-cert.pem", "", "")
+	// serve health probes first so readiness can be watched during startup
+	health := &Health{}
+	if *conf.Health != "" {
+		go func() {
+			log.Printf("health check listening on %s", *conf.Health)
+			err := http.ListenAndServe(*conf.Health, health.Handler(*conf.HealthPath, *conf.ReadyPath))
+			if err != nil {
+				logger.Fatalf("Unable to start health check: %s", err)
+			}
+		}()
+	}
 
+	tlsConfig, err := newTlsConfig(conf, "gomitmproxy-ca-pk.pem", "gomitmproxy-ca-cert.pem")
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
 	handler, err := InitConfig(conf, tlsConfig)
 	if err != nil {
 		logger.Fatalf("InitConfig error: %s", err)
 	}
+	health.SetCALoaded()
 
-	server := &http.Server{
-		Addr:         ":" + *conf.Port,
-		Handler:      handler,
-		ReadTimeout:  1 * time.Hour,
-		WriteTimeout: 1 * time.Hour,
+	// finish capture files on shutdown, a cut off gzip stream is unreadable
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		handler.Close()
+		os.Exit(0)
+	}()
+
+	if *conf.Admin != "" {
+		go func() {
+			log.Printf("admin api listening on %s", *conf.Admin)
+			if err := http.ListenAndServe(*conf.Admin, handler.adminHandler()); err != nil {
+				logger.Fatalf("Unable to start admin api: %s", err)
+			}
+		}()
+	}
+
+	if *conf.Transparent != "" {
+		go func() {
+			lc := listenConfig(conf)
+			listener, err := lc.Listen(context.Background(), "tcp", *conf.Transparent)
+			if err != nil {
+				logger.Fatalf("Unable to start transparent proxy: %s", err)
+			}
+			log.Printf("transparent proxy listening on %s", *conf.Transparent)
+			if err := handler.ServeTransparent(listener); err != nil {
+				logger.Fatalf("Transparent proxy stopped: %s", err)
+			}
+		}()
+	}
+
+	if *conf.Reverse != "" {
+		go func() {
+			lc := listenConfig(conf)
+			listener, err := lc.Listen(context.Background(), "tcp", *conf.ReverseListen)
+			if err != nil {
+				logger.Fatalf("Unable to start reverse proxy: %s", err)
+			}
+			log.Printf("reverse proxy to %s listening on %s", *conf.Reverse, *conf.ReverseListen)
+			if err := handler.ServeReverse(listener); err != nil {
+				logger.Fatalf("Reverse proxy stopped: %s", err)
+			}
+		}()
+	}
+
+	server := handler.proxyServer()
+	if (*conf.Tls || *conf.H2C) && !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		logger.Infoln("extended CONNECT over http/2 is off, run with GODEBUG=http2xconnect=1 to proxy websockets over it")
+	}
+
+	if *conf.Unix != "" {
+		go func() {
+			log.Printf("proxy listening unix socket:%s", *conf.Unix)
+			if err := serveUnix(server, *conf.Unix); err != nil {
+				logger.Fatalf("Unable to start HTTP proxy on unix socket: %s", err)
+			}
+		}()
 	}
 
 	go func() {
 		log.Printf("proxy listening port:%s", *conf.Port)
 
+		listeners, err := listenProxy(conf, server.Addr)
+		if err != nil {
+			logger.Fatalf("Unable to start HTTP proxy: %s", err)
+		}
+		health.SetListening()
+
+		serve := func(listener net.Listener) error {
+			listener = &framingListener{listener, server.MaxHeaderBytes}
+			if *conf.Tls {
+				return server.ServeTLS(listener, "gomitmproxy-ca-cert.pem", "gomitmproxy-ca-pk.pem")
+			}
+			return server.Serve(listener)
+		}
 		if *conf.Tls {
 			log.Println("ListenAndServeTLS")
-			err = server.ListenAndServeTLS("gomitmproxy-ca-cert.pem", "gomitmproxy-ca-pk.pem")
 		} else {
 			log.Println("ListenAndServe")
-			err = server.ListenAndServe()
 		}
-		if err != nil {
+		for _, listener := range listeners[1:] {
+			go func() {
+				if err := serve(listener); err != nil {
+					logger.Fatalf("Unable to start HTTP proxy: %s", err)
+				}
+			}()
+		}
+		if err := serve(listeners[0]); err != nil {
 			logger.Fatalf("Unable to start HTTP proxy: %s", err)
 		}
 
@@ -86,3 +384,40 @@ func gomitmproxy(conf *Cfg) {
 
 	return
 }
+
+// serveUnix serves server on a unix socket at path, replacing a stale socket
+// left behind by a previous run.
+func serveUnix(server *http.Server, path string) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return server.Serve(&framingListener{listener, server.MaxHeaderBytes})
+}
+
+// proxyServer returns the http server taking proxy requests on -port.
+func (hw *HandlerWrapper) proxyServer() *http.Server {
+	conf := hw.MyConfig
+	server := &http.Server{
+		Addr:              ":" + *conf.Port,
+		Handler:           hw,
+		ReadTimeout:       1 * time.Hour,
+		WriteTimeout:      1 * time.Hour,
+		ReadHeaderTimeout: *conf.HeaderTimeout,
+		IdleTimeout:       *conf.ClientIdle,
+		MaxHeaderBytes:    *conf.MaxHeaderBytes,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return withFramingTap(hw.noDelayConnContext(ctx, conn), conn)
+		},
+	}
+	if *conf.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unixProxy serves hw's proxy server on a unix socket at path until the test
+// ends.
+func unixProxy(t *testing.T, hw *HandlerWrapper, path string) {
+	server := hw.proxyServer()
+	done := make(chan error, 1)
+	go func() { done <- serveUnix(server, path) }()
+	t.Cleanup(func() {
+		server.Close()
+		<-done
+	})
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("unix socket never accepted connections")
+}
+
+func dialUnix(t *testing.T, path string) net.Conn {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUnixSocketProxies(t *testing.T) {
+	origin := textOrigin(t, "over unix")
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	unixProxy(t, newTestHandler(t, "-unix", path), path)
+
+	conn := dialUnix(t, path)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "over unix" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestUnixSocketConnect(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled over unix")
+	}))
+	defer origin.Close()
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	unixProxy(t, newTestHandler(t, "-unix", path), path)
+
+	conn := dialUnix(t, path)
+	target := origin.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %v %v", resp, err)
+	}
+	pool := testCAPool()
+	pool.AddCert(origin.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: pool})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "tunneled over unix" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestUnixSocketReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	// a socket left behind by a run that didn't clean up
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("stale socket not left behind:", err)
+	}
+	unixProxy(t, newTestHandler(t, "-unix", path), path)
+}
+
+func TestUnixSocketKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.WriteFile(path, []byte("not a socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := serveUnix(newTestHandler(t).proxyServer(), path); err == nil {
+		t.Fatal("served over a regular file")
+	}
+	if b, _ := os.ReadFile(path); string(b) != "not a socket" {
+		t.Error("regular file at the socket path removed")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// streamConn is the tunnel carried by an HTTP/2 CONNECT stream, which can't
+// be hijacked: reads come from the request body and writes go out as the
+// response body. Writes fail once it is closed, as the stream can't be
+// written after the handler returns.
+type streamConn struct {
+	req    *http.Request
+	resp   http.ResponseWriter
+	rc     *http.ResponseController
+	mu     sync.Mutex
+	closed bool
+}
+
+func newStreamConn(resp http.ResponseWriter, req *http.Request) *streamConn {
+	return &streamConn{req: req, resp: resp, rc: http.NewResponseController(resp)}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.req.Body.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.resp.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	// unblock a write waiting on flow control before taking the lock
+	c.rc.SetWriteDeadline(time.Now())
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.req.Body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	addr, _ := c.req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", c.req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// ServeH2Connect answers a CONNECT received over HTTP/2. A plain CONNECT is
+// tunnelled to its authority within the stream, without interception. An
+// extended CONNECT (RFC 8441) for websocket is sent on to the origin as an
+// HTTP/1.1 upgrade and the frames relayed through the stream. raddr is the
+// upstream proxy to go through, if any.
+func (hw *HandlerWrapper) ServeH2Connect(resp http.ResponseWriter, req *http.Request, raddr string) {
+	switch protocol := req.Header.Get(":protocol"); protocol {
+	case "":
+		hw.h2Tunnel(resp, req, raddr)
+	case "websocket":
+		hw.h2WebSocket(resp, req, raddr)
+	default:
+		respError(resp, http.StatusNotImplemented, fmt.Sprintf("Extended CONNECT for %q is not supported, only websocket", protocol))
+	}
+}
+
+// dialTunnel connects to addr, through the upstream proxy raddr if set.
+func (hw *HandlerWrapper) dialTunnel(ctx context.Context, raddr, addr string) (net.Conn, error) {
+	if raddr == "" {
+		return hw.DialFunc(ctx, "tcp", hw.dialAddr(addr))
+	}
+	if hw.h2Upstream != nil {
+		ctx, cancel := context.WithTimeout(ctx, hw.dialer.Timeout)
+		defer cancel()
+		conn, err := hw.h2Upstream.connect(ctx, raddr, addr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s failed to connect to %s over http/2: %w", raddr, addr, err)
+		}
+		return conn, nil
+	}
+	conn, err := hw.DialFunc(ctx, "tcp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(hw.dialer.Timeout))
+	err = connectProxyServer(conn, addr)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s failed to connect to %s: %w", raddr, addr, err)
+	}
+	return conn, nil
+}
+
+func (hw *HandlerWrapper) h2Tunnel(resp http.ResponseWriter, req *http.Request, raddr string) {
+	addr := hostWithPort(req.Host, hw.defaultPort("https"))
+	connOut, err := hw.dialTunnel(req.Context(), raddr, addr)
+	if err != nil {
+		respError(resp, upstreamErrorStatus(err), fmt.Sprintf("Unable to dial %s: %s", addr, err))
+		return
+	}
+	defer connOut.Close()
+
+	resp.Header().Set("Proxy-Agent", "gomitmproxy/"+Version)
+	resp.WriteHeader(http.StatusOK)
+	connIn := newStreamConn(resp, req)
+	defer connIn.Close()
+	if err = connIn.rc.Flush(); err != nil {
+		logger.Debugln("write h2 connect response error:", err)
+		return
+	}
+	if err = Transport(connIn, connOut, *hw.MyConfig.TunnelLinger); err != nil {
+		logger.Debugln("h2 tunnel", req.Host, "error:", err)
+	}
+}
+
+// h2WebSocket serves an RFC 8441 websocket over an HTTP/2 stream from an
+// origin speaking HTTP/1.1. The scheme isn't known past the h2 server, so
+// the origin is reached over TLS on the https port and in the clear on any
+// other, where a TLS origin fails fast instead of stalling the handshake.
+func (hw *HandlerWrapper) h2WebSocket(resp http.ResponseWriter, req *http.Request, raddr string) {
+	addr := hostWithPort(req.Host, hw.defaultPort("https"))
+	scheme := "ws"
+	if hw.connectPort(addr) == hw.defaultPort("https") {
+		scheme = "wss"
+	}
+	target := scheme + "://" + req.Host + req.URL.RequestURI()
+
+	ctx, cancel := context.WithTimeout(req.Context(), hw.dialer.Timeout)
+	defer cancel()
+	connOut, err := hw.dialTunnel(ctx, raddr, addr)
+	if err != nil {
+		respError(resp, upstreamErrorStatus(err), fmt.Sprintf("Unable to dial %s: %s", addr, err))
+		return
+	}
+	defer func() {
+		connOut.Close()
+	}()
+	if scheme == "wss" {
+		tlsOut, err := handshake(ctx, connOut, addr, hw.tlsConfig.UpstreamConfig(addr), &Timing{})
+		if err != nil {
+			respBadGateway(resp, hw.upstreamErrorMessage(err))
+			return
+		}
+		connOut = tlsOut
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	upgrade := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery},
+		Host:       req.Host,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     req.Header.Clone(),
+	}
+	upgrade.Header.Del(":protocol")
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	upgrade.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	hw.addVia(upgrade.Header, req.ProtoMajor, req.ProtoMinor)
+	if err = upgrade.Write(connOut); err != nil {
+		respBadGateway(resp, fmt.Sprintf("Unable to send websocket upgrade to %s: %s", addr, err))
+		return
+	}
+	outReader := bufio.NewReader(connOut)
+	respOut, err := http.ReadResponse(outReader, upgrade)
+	if err != nil {
+		respBadGateway(resp, fmt.Sprintf("Unable to read websocket upgrade response from %s: %s", addr, err))
+		return
+	}
+	if respOut.StatusCode != http.StatusSwitchingProtocols {
+		// the origin refused the upgrade, its answer goes to the client
+		defer respOut.Body.Close()
+		for name, values := range respOut.Header {
+			resp.Header()[name] = values
+		}
+		resp.Header().Del("Connection")
+		resp.WriteHeader(respOut.StatusCode)
+		io.Copy(resp, respOut.Body)
+		return
+	}
+	for _, name := range []string{"Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"} {
+		if values := respOut.Header.Values(name); len(values) > 0 {
+			resp.Header()[name] = values
+		}
+	}
+	resp.WriteHeader(http.StatusOK)
+	connIn := newStreamConn(resp, req)
+	defer connIn.Close()
+	if err = connIn.rc.Flush(); err != nil {
+		logger.Debugln("write h2 websocket response error:", err)
+		return
+	}
+	logger.Debugln("relaying h2 websocket", target)
+	relayUpgraded(connIn, bufio.NewReader(connIn), connOut, outReader, target, *hw.MyConfig.WebSocketLog, *hw.MyConfig.TunnelLinger)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// h2cClient returns a client speaking prior knowledge http/2 to the proxy.
+func (p *testProxy) h2cClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// h2Connect sends a CONNECT for authority over http/2, an extended one
+// through extendedConnectProxy if protocol is set, and returns the answer
+// and the writing end of the stream.
+func h2Connect(t *testing.T, p *testProxy, authority, protocol, path string) (*http.Response, io.WriteCloser) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	req, err := http.NewRequest("CONNECT", "http://"+p.URL.Host+path, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = authority
+	if protocol != "" {
+		req.Header.Set("X-Protocol", protocol)
+	}
+	resp, err := p.h2cClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("CONNECT answered over %s", resp.Proto)
+	}
+	return resp, pw
+}
+
+// extendedConnectProxy serves the handler of p over prior knowledge http/2,
+// turning the X-Protocol field of a CONNECT into the :protocol pseudo field
+// of an RFC 8441 extended CONNECT, which net/http's client won't send.
+func extendedConnectProxy(t *testing.T, p *testProxy) *testProxy {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if protocol := r.Header.Get("X-Protocol"); protocol != "" {
+			r.Header.Del("X-Protocol")
+			r.Header.Set(":protocol", protocol)
+		}
+		p.ServeHTTP(w, r)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return &testProxy{p.HandlerWrapper, server, u}
+}
+
+func TestH2ConnectTunnels(t *testing.T) {
+	origin := textOrigin(t, "through the stream")
+	p := newTestProxy(t, "-h2c")
+	resp, w := h2Connect(t, p, origin.Listener.Addr().String(), "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	// the stream carries the bytes both ways
+	fmt.Fprintf(w, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr())
+	tunnelled, err := http.ReadResponse(bufio.NewReader(resp.Body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, tunnelled); body != "through the stream" {
+		t.Errorf("request through the tunnel got %q", body)
+	}
+}
+
+func TestH2ConnectDialFailure(t *testing.T) {
+	origin := textOrigin(t, "gone")
+	addr := origin.Listener.Addr().String()
+	origin.Close()
+	p := newTestProxy(t, "-h2c")
+	if resp, _ := h2Connect(t, p, addr, "", ""); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("CONNECT to a closed port got %s", resp.Status)
+	}
+}
+
+func TestH2COffByDefault(t *testing.T) {
+	p := newTestProxy(t)
+	req, _ := http.NewRequest("GET", "http://"+p.URL.Host+"/", nil)
+	if resp, err := p.h2cClient().Do(req); err == nil {
+		resp.Body.Close()
+		t.Errorf("prior knowledge http/2 without -h2c got %s", resp.Status)
+	}
+}
+
+func TestH2WebSocket(t *testing.T) {
+	origin := wsEchoOrigin(t)
+	p := extendedConnectProxy(t, newTestProxy(t))
+	resp, w := h2Connect(t, p, origin.Listener.Addr().String(), "websocket", "/chat")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("extended CONNECT got %s", resp.Status)
+	}
+	w.Write(wsFrameBytes(0x1, true, true, []byte("hello")))
+	echo := make([]byte, 7)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, echo)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo through the websocket")
+	}
+	if string(echo[2:]) != "hello" {
+		t.Errorf("echoed frame payload %q", echo[2:])
+	}
+}
+
+func TestH2ExtendedConnectOnlyForWebSocket(t *testing.T) {
+	origin := textOrigin(t, "not a tunnel")
+	p := extendedConnectProxy(t, newTestProxy(t))
+	if resp, _ := h2Connect(t, p, origin.Listener.Addr().String(), "connect-udp", "/"); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("extended CONNECT for connect-udp got %s", resp.Status)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// h2Upstream opens CONNECT tunnels through upstream proxies speaking
+// HTTP/2, over TLS or in the clear (h2c). Tunnels to the same proxy are
+// streams sharing one connection.
+type h2Upstream struct {
+	transport *http.Transport
+	scheme    string
+}
+
+// newH2Upstream returns an h2Upstream for mode tls or h2c, dialing with
+// hw.DialFunc and handshaking TLS as with origins.
+func (hw *HandlerWrapper) newH2Upstream(mode string) (*h2Upstream, error) {
+	protocols := new(http.Protocols)
+	u := &h2Upstream{transport: &http.Transport{
+		DialContext:     hw.DialFunc,
+		Protocols:       protocols,
+		IdleConnTimeout: 90 * time.Second,
+	}}
+	switch mode {
+	case "tls":
+		protocols.SetHTTP2(true)
+		u.scheme = "https"
+		u.transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := hw.DialFunc(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			config := hw.tlsConfig.UpstreamConfig(addr).Clone()
+			config.NextProtos = []string{"h2"}
+			tlsConn, err := handshake(ctx, conn, addr, config, &Timing{})
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+				tlsConn.Close()
+				return nil, fmt.Errorf("upstream proxy %s negotiated %q instead of h2", addr, proto)
+			}
+			return tlsConn, nil
+		}
+	case "h2c":
+		protocols.SetUnencryptedHTTP2(true)
+		u.scheme = "http"
+	default:
+		return nil, fmt.Errorf("Invalid upstream h2 mode %q, want tls or h2c", mode)
+	}
+	return u, nil
+}
+
+// connect opens a tunnel to addr through the upstream proxy raddr. The
+// proxy has until ctx is done to answer.
+func (u *h2Upstream) connect(ctx context.Context, raddr, addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        "CONNECT",
+		URL:           &url.URL{Scheme: u.scheme, Host: raddr},
+		Host:          addr,
+		Header:        make(http.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	// the stream outlives ctx, which only bounds the wait for the answer
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := u.transport.RoundTrip(req.WithContext(streamCtx))
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		pw.Close()
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return &h2TunnelConn{body: resp.Body, pw: pw, cancel: cancel, raddr: raddr}, nil
+}
+
+// Close closes the idle connections to upstream proxies.
+func (u *h2Upstream) Close() {
+	u.transport.CloseIdleConnections()
+}
+
+// h2TunnelConn is a tunnel carried by an HTTP/2 CONNECT stream to an
+// upstream proxy: reads come from the response body and writes go out as
+// the request body. Deadlines aren't supported, the tunnel is ended by
+// closing it.
+type h2TunnelConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	raddr  string
+	once   sync.Once
+}
+
+func (c *h2TunnelConn) Read(b []byte) (int, error)  { return c.body.Read(b) }
+func (c *h2TunnelConn) Write(b []byte) (int, error) { return c.pw.Write(b) }
+
+// CloseWrite ends the request stream, half-closing the tunnel.
+func (c *h2TunnelConn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+func (c *h2TunnelConn) Close() error {
+	c.once.Do(func() {
+		c.pw.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *h2TunnelConn) LocalAddr() net.Addr { return nil }
+
+func (c *h2TunnelConn) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", c.raddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+func (c *h2TunnelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *h2TunnelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *h2TunnelConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// h2UpstreamProxy is an upstream proxy taking CONNECTs only over http/2,
+// in the clear or over TLS. It sends the protocol and target of each to
+// got, refuses targets on port 1 and counts the connections made to it.
+func h2UpstreamProxy(t *testing.T, overTLS bool) (*httptest.Server, chan string, *atomic.Int32) {
+	got := make(chan string, 10)
+	conns := &atomic.Int32{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Proto + " " + r.Method + " " + r.Host
+		if r.Method != "CONNECT" || r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.HasSuffix(r.Host, ":1") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer conn.Close()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		go func() {
+			io.Copy(conn, r.Body)
+			conn.(*net.TCPConn).CloseWrite()
+		}()
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	if overTLS {
+		server.EnableHTTP2 = true
+		server.StartTLS()
+	} else {
+		server.Config.Protocols = new(http.Protocols)
+		server.Config.Protocols.SetUnencryptedHTTP2(true)
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server, got, conns
+}
+
+// getTunneled sends a GET for origin through a tunnel p opens to it.
+func getTunneled(t *testing.T, p *testProxy, origin *httptest.Server) string {
+	t.Helper()
+	conn := p.connect(t, origin.Listener.Addr().String())
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", origin.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, resp)
+}
+
+func TestUpstreamH2C(t *testing.T) {
+	upstream, got, conns := h2UpstreamProxy(t, false)
+	origin := textOrigin(t, "through h2c")
+	p := newTestProxy(t, "-raddr", upstream.Listener.Addr().String(), "-upstream-h2", "h2c")
+	for i := 0; i < 2; i++ {
+		if body := getTunneled(t, p, origin); body != "through h2c" {
+			t.Fatalf("tunnel %d got %q", i, body)
+		}
+		if g := <-got; g != "HTTP/2.0 CONNECT "+origin.Listener.Addr().String() {
+			t.Errorf("upstream proxy got %q", g)
+		}
+	}
+	// the tunnels are streams of one connection
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections to the upstream proxy, want 1", n)
+	}
+}
+
+func TestUpstreamH2OverTLS(t *testing.T) {
+	upstream, got, _ := h2UpstreamProxy(t, true)
+	origin := textOrigin(t, "through h2")
+	p := newTestProxy(t, "-raddr", upstream.Listener.Addr().String(), "-upstream-h2", "tls")
+	p.trust(upstream)
+	if body := getTunneled(t, p, origin); body != "through h2" {
+		t.Fatalf("tunnel got %q", body)
+	}
+	if g := <-got; g != "HTTP/2.0 CONNECT "+origin.Listener.Addr().String() {
+		t.Errorf("upstream proxy got %q", g)
+	}
+}
+
+func TestUpstreamH2PlainHTTP(t *testing.T) {
+	upstream, got, _ := h2UpstreamProxy(t, false)
+	origin := textOrigin(t, "plain through h2c")
+	p := newTestProxy(t, "-raddr", upstream.Listener.Addr().String(), "-upstream-h2", "h2c")
+	// plain http requests are sent down a tunnel to the origin as well
+	if resp, body := getThrough(t, p, origin.URL); resp.StatusCode != http.StatusOK || body != "plain through h2c" {
+		t.Errorf("plain request got %s %q", resp.Status, body)
+	}
+	if g := <-got; g != "HTTP/2.0 CONNECT "+origin.Listener.Addr().String() {
+		t.Errorf("upstream proxy got %q", g)
+	}
+}
+
+func TestUpstreamH2FromH2Client(t *testing.T) {
+	upstream, got, _ := h2UpstreamProxy(t, false)
+	origin := textOrigin(t, "stream to stream")
+	p := newTestProxy(t, "-h2c", "-raddr", upstream.Listener.Addr().String(), "-upstream-h2", "h2c")
+	resp, w := h2Connect(t, p, origin.Listener.Addr().String(), "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	fmt.Fprintf(w, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr())
+	tunneled, err := http.ReadResponse(bufio.NewReader(resp.Body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, tunneled); body != "stream to stream" {
+		t.Errorf("request through the tunnel got %q", body)
+	}
+	if g := <-got; g != "HTTP/2.0 CONNECT "+origin.Listener.Addr().String() {
+		t.Errorf("upstream proxy got %q", g)
+	}
+}
+
+func TestUpstreamH2Refused(t *testing.T) {
+	upstream, _, _ := h2UpstreamProxy(t, false)
+	p := newTestProxy(t, "-raddr", upstream.Listener.Addr().String(), "-upstream-h2", "h2c")
+	if status := connectStatus(t, p, "127.0.0.1:1"); status == http.StatusOK {
+		t.Error("client got 200 for a tunnel the upstream proxy refused")
+	}
+}
+
+func TestUpstreamH2Mode(t *testing.T) {
+	if err := initError("-upstream-h2", "h3"); err == nil {
+		t.Error("invalid -upstream-h2 accepted")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// maxHeaderOrderBytes bounds how much of a response is searched for the end
+// of its header block.
+const maxHeaderOrderBytes = 1 << 20
+
+var headerEnd = []byte("\r\n\r\n")
+
+// headerOrder records the order and spelling of the header fields of an
+// upstream response, which http.Header loses, so they can be restored when
+// the response is written to the client. Some anti-bot systems fingerprint
+// header order.
+type headerOrder struct {
+	names []string
+}
+
+// reader returns a reader recording the header fields of the response read
+// through it from r.
+func (o *headerOrder) reader(r io.Reader) io.Reader {
+	o.names = nil
+	return &headerOrderReader{r: r, order: o}
+}
+
+// writer returns a writer passing a response on to w with its header fields
+// in the recorded order and spelling. Fields the origin did not send follow
+// in their usual order.
+func (o *headerOrder) writer(w io.Writer) io.Writer {
+	if len(o.names) == 0 {
+		return w
+	}
+	return &headerOrderWriter{w: w, order: o}
+}
+
+// reorder rewrites the header block of a response, from the status line up to
+// and including the blank line ending it.
+func (o *headerOrder) reorder(block []byte) []byte {
+	lines := bytes.Split(bytes.TrimSuffix(block, headerEnd), []byte("\r\n"))
+	fields := make(map[string][][]byte)
+	var keys []string
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i < 0 {
+			return block
+		}
+		key := http.CanonicalHeaderKey(string(line[:i]))
+		if _, ok := fields[key]; !ok {
+			keys = append(keys, key)
+		}
+		fields[key] = append(fields[key], line[i:])
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(block))
+	out.Write(lines[0])
+	out.WriteString("\r\n")
+	writeField := func(name, key string) {
+		for _, rest := range fields[key] {
+			out.WriteString(name)
+			out.Write(rest)
+			out.WriteString("\r\n")
+		}
+		delete(fields, key)
+	}
+	for _, name := range o.names {
+		writeField(name, http.CanonicalHeaderKey(name))
+	}
+	for _, key := range keys {
+		writeField(key, key)
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+type headerOrderReader struct {
+	r     io.Reader
+	order *headerOrder
+	buf   []byte
+	done  bool
+}
+
+func (hr *headerOrderReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	if !hr.done && n > 0 {
+		hr.buf = append(hr.buf, p[:n]...)
+		for !hr.done {
+			i := bytes.Index(hr.buf, headerEnd)
+			if i < 0 {
+				if len(hr.buf) > maxHeaderOrderBytes {
+					hr.done, hr.buf = true, nil
+				}
+				break
+			}
+			if informational(hr.buf[:i]) {
+				// the final response's header block follows
+				hr.buf = hr.buf[i+len(headerEnd):]
+				continue
+			}
+			hr.record(hr.buf[:i])
+			hr.done, hr.buf = true, nil
+		}
+	}
+	return n, err
+}
+
+// informational reports whether block is the header block of a 1xx response
+// other than 101 Switching Protocols, after which the final response follows.
+func informational(block []byte) bool {
+	status, _, _ := bytes.Cut(block, []byte("\r\n"))
+	_, code, _ := bytes.Cut(status, []byte(" "))
+	return len(code) >= 3 && code[0] == '1' && !bytes.HasPrefix(code, []byte("101"))
+}
+
+// record notes the names of the fields in a header block, each once, in the
+// order they first appear.
+func (hr *headerOrderReader) record(block []byte) {
+	seen := make(map[string]bool)
+	lines := bytes.Split(block, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name := string(bytes.TrimSpace(line[:i]))
+		if key := http.CanonicalHeaderKey(name); !seen[key] {
+			seen[key] = true
+			hr.order.names = append(hr.order.names, name)
+		}
+	}
+}
+
+type headerOrderWriter struct {
+	w     io.Writer
+	order *headerOrder
+	buf   []byte
+	done  bool
+}
+
+func (ow *headerOrderWriter) Write(p []byte) (int, error) {
+	if ow.done {
+		return ow.w.Write(p)
+	}
+	ow.buf = append(ow.buf, p...)
+	i := bytes.Index(ow.buf, headerEnd)
+	if i < 0 && len(ow.buf) <= maxHeaderOrderBytes {
+		return len(p), nil
+	}
+	out := ow.buf
+	if i >= 0 {
+		end := i + len(headerEnd)
+		out = append(ow.order.reorder(ow.buf[:end]), ow.buf[end:]...)
+	}
+	ow.done, ow.buf = true, nil
+	if _, err := ow.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// headerLines sends a GET for url through p and returns the header lines of
+// the answer as they arrived, and its body.
+func headerLines(t *testing.T, p *testProxy, url string) ([]string, string) {
+	t.Helper()
+	conn := p.dial(t)
+	io.WriteString(conn, "GET "+url+" HTTP/1.1\r\nHost: origin\r\nConnection: close\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	var lines []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	body, _ := io.ReadAll(tp.R)
+	return lines[1:], string(body)
+}
+
+// fieldNames returns the names of header lines, skipping those the proxy
+// adds itself.
+func fieldNames(lines []string) []string {
+	var names []string
+	for _, line := range lines {
+		name, _, _ := strings.Cut(line, ":")
+		if name != "Connection" && name != "Via" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+const orderedResponse = "HTTP/1.1 200 OK\r\n" +
+	"x-zebra: 1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"X-ALPHA: 2\r\n" +
+	"x-zebra: 3\r\n" +
+	"content-length: 5\r\n" +
+	"\r\nhello"
+
+func TestHeaderOrderPreserved(t *testing.T) {
+	origin := rawOrigin(t, orderedResponse, false)
+	p := newTestProxy(t, "-header-order")
+	lines, body := headerLines(t, p, "http://"+origin.Addr().String()+"/")
+	if body != "hello" {
+		t.Errorf("body %q", body)
+	}
+	want := []string{"x-zebra", "x-zebra", "Content-Type", "X-ALPHA", "content-length"}
+	if got := fieldNames(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("header fields %q, want %q", got, want)
+	}
+}
+
+func TestHeaderOrderOffByDefault(t *testing.T) {
+	origin := rawOrigin(t, orderedResponse, false)
+	p := newTestProxy(t)
+	lines, _ := headerLines(t, p, "http://"+origin.Addr().String()+"/")
+	want := []string{"Content-Length", "Content-Type", "X-Alpha", "X-Zebra", "X-Zebra"}
+	if got := fieldNames(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("header fields %q, want them canonical and sorted %q", got, want)
+	}
+}
+
+func TestHeaderOrderReorder(t *testing.T) {
+	o := &headerOrder{names: []string{"b-field", "A-Field"}}
+	block := "HTTP/1.1 200 OK\r\nA-Field: 1\r\nAdded: x\r\nB-Field: 2\r\nA-Field: 3\r\n\r\n"
+	want := "HTTP/1.1 200 OK\r\nb-field: 2\r\nA-Field: 1\r\nA-Field: 3\r\nAdded: x\r\n\r\n"
+	if got := string(o.reorder([]byte(block))); got != want {
+		t.Errorf("reordered to %q, want %q", got, want)
+	}
+
+	// a block split across writes is held until it is complete
+	var out bytes.Buffer
+	w := o.writer(&out)
+	w.Write([]byte(block[:20]))
+	if out.Len() > 0 {
+		t.Errorf("partial header block written: %q", out.String())
+	}
+	w.Write([]byte(block[20:] + "body"))
+	if out.String() != want+"body" {
+		t.Errorf("wrote %q", out.String())
+	}
+}
+
+func TestHeaderOrderSkipsInformational(t *testing.T) {
+	o := &headerOrder{}
+	response := "HTTP/1.1 103 Early Hints\r\nlink: </style.css>\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\n\r\n" + orderedResponse
+	// read a byte at a time so blocks arrive split
+	body, err := io.ReadAll(o.reader(iotest.OneByteReader(strings.NewReader(response))))
+	if err != nil || string(body) != response {
+		t.Fatalf("read %q, %v", body, err)
+	}
+	want := []string{"x-zebra", "Content-Type", "X-ALPHA", "content-length"}
+	if !reflect.DeepEqual(o.names, want) {
+		t.Errorf("recorded %q, want the final response's %q", o.names, want)
+	}
+}
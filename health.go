@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Health answers liveness and readiness probes. The proxy is ready once its
+// CA is loaded and it is accepting connections.
+type Health struct {
+	caLoaded  int32
+	listening int32
+}
+
+func (h *Health) SetCALoaded() {
+	atomic.StoreInt32(&h.caLoaded, 1)
+}
+
+func (h *Health) SetListening() {
+	atomic.StoreInt32(&h.listening, 1)
+}
+
+func (h *Health) Ready() bool {
+	return atomic.LoadInt32(&h.caLoaded) == 1 && atomic.LoadInt32(&h.listening) == 1
+}
+
+// Handler serves liveness on livePath and readiness on readyPath.
+func (h *Health) Handler(livePath, readyPath string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(livePath, func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("ok"))
+	})
+	mux.HandleFunc(readyPath, func(resp http.ResponseWriter, req *http.Request) {
+		if !h.Ready() {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			resp.Write([]byte("not ready"))
+			return
+		}
+		resp.Write([]byte("ready"))
+	})
+	return mux
+}
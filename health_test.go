@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthProbes(t *testing.T) {
+	h := &Health{}
+	server := httptest.NewServer(h.Handler("/live", "/ready"))
+	defer server.Close()
+	status := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readAll(t, resp)
+		return resp.StatusCode, body
+	}
+
+	if code, body := status("/live"); code != http.StatusOK || body != "ok" {
+		t.Errorf("liveness got %d %q", code, body)
+	}
+	if code, _ := status("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness before startup got %d", code)
+	}
+	h.SetCALoaded()
+	if code, _ := status("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness before listening got %d", code)
+	}
+	h.SetListening()
+	if code, body := status("/ready"); code != http.StatusOK || body != "ready" {
+		t.Errorf("readiness once started got %d %q", code, body)
+	}
+	if code, _ := status("/other"); code != http.StatusNotFound {
+		t.Errorf("unknown path got %d", code)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// History keeps the most recent transactions, bounded both by their number
+// and by the total size of the bodies they hold.
+type History struct {
+	mutex      sync.Mutex
+	entries    *list.List
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+}
+
+// NewHistory creates a History holding at most maxEntries transactions with
+// at most maxBytes of bodies between them.
+func NewHistory(maxEntries int, maxBytes int64) *History {
+	return &History{
+		entries:    list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+func bodySize(t *Transaction) int64 {
+	return int64(len(t.RequestBody) + len(t.ResponseBody))
+}
+
+// Add records t, evicting the oldest transactions past the limits. The
+// bodies of a transaction too large to ever fit are dropped.
+func (h *History) Add(t *Transaction) {
+	if bodySize(t) > h.maxBytes {
+		stripped := *t
+		stripped.RequestBody = ""
+		stripped.ResponseBody = ""
+		t = &stripped
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries.PushFront(t)
+	h.bytes += bodySize(t)
+	for h.entries.Len() > h.maxEntries || h.bytes > h.maxBytes {
+		oldest := h.entries.Remove(h.entries.Back()).(*Transaction)
+		h.bytes -= bodySize(oldest)
+	}
+}
+
+// Recent returns up to n transactions, newest first. A negative n returns all
+// of them.
+func (h *History) Recent(n int) []*Transaction {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if n < 0 || n > h.entries.Len() {
+		n = h.entries.Len()
+	}
+	recent := make([]*Transaction, 0, n)
+	for e := h.entries.Front(); e != nil && len(recent) < n; e = e.Next() {
+		recent = append(recent, e.Value.(*Transaction))
+	}
+	return recent
+}
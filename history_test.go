@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHistoryServedByAdmin(t *testing.T) {
+	origin := textOrigin(t, "body")
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-history", "2")
+	admin := p.admin(t)
+	for _, path := range []string{"/one", "/two", "/three"} {
+		resp, err := p.client().Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+	}
+
+	var got []*Transaction
+	if status := getJSON(t, admin.URL+"/transactions", &got); status != http.StatusOK {
+		t.Fatalf("got %d", status)
+	}
+	if len(got) != 2 || !strings.HasSuffix(got[0].URL, "/three") || !strings.HasSuffix(got[1].URL, "/two") {
+		t.Errorf("history kept %d transactions: %+v", len(got), got)
+	}
+	if getJSON(t, admin.URL+"/transactions?n=1", &got); len(got) != 1 || !strings.HasSuffix(got[0].URL, "/three") {
+		t.Errorf("n=1 got %+v", got)
+	}
+	if status := getJSON(t, admin.URL+"/transactions?n=x", &got); status != http.StatusBadRequest {
+		t.Errorf("invalid n got %d", status)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-history", "0")
+	var got []*Transaction
+	if status := getJSON(t, p.admin(t).URL+"/transactions", &got); status != http.StatusNotFound {
+		t.Errorf("disabled history got %d", status)
+	}
+}
+
+func TestHistoryBoundsBodyBytes(t *testing.T) {
+	h := NewHistory(10, 10)
+	h.Add(&Transaction{URL: "a", ResponseBody: "12345"})
+	h.Add(&Transaction{URL: "b", ResponseBody: "12345"})
+	h.Add(&Transaction{URL: "c", ResponseBody: "123"})
+	recent := h.Recent(-1)
+	if len(recent) != 2 || recent[0].URL != "c" || recent[1].URL != "b" {
+		t.Errorf("got %d transactions, want c and b within 10 bytes", len(recent))
+	}
+	// one too large to ever fit is kept without its bodies
+	h.Add(&Transaction{URL: "d", ResponseBody: strings.Repeat("x", 11)})
+	if recent = h.Recent(1); recent[0].URL != "d" || recent[0].ResponseBody != "" {
+		t.Errorf("oversized transaction kept as %+v", recent[0])
+	}
+	if h.Recent(-1)[1].URL != "c" {
+		t.Error("a stripped transaction evicted the others")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// interceptedConn is what is known of the TLS connection a request was
+// decrypted from: the client's handshake and the CONNECT target, addr.
+type interceptedConn struct {
+	state tls.ConnectionState
+	addr  string
+}
+
+type interceptedConnKey struct{}
+
+// interceptedFrom returns the intercepted connection a request with ctx
+// came in on, nil for plain http.
+func interceptedFrom(ctx context.Context) *interceptedConn {
+	ic, _ := ctx.Value(interceptedConnKey{}).(*interceptedConn)
+	return ic
+}
+
+// interceptedHandler serves the requests decrypted from ic, each carrying
+// ic in its context and the client's handshake in req.TLS.
+func (hw *HandlerWrapper) interceptedHandler(ic *interceptedConn) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req = req.WithContext(context.WithValue(req.Context(), interceptedConnKey{}, ic))
+		req.TLS = &ic.state
+		if !hw.checkSNI(resp, req, ic) {
+			return
+		}
+		hw.serveIntercepted(resp, req)
+	})
+}
+
+// checkSNI applies -sni-mismatch to a request whose Host names another
+// server than the client asked for in its ClientHello, as domain fronting
+// does. It reports false if the request was rejected with a 421. Clients
+// sending no SNI, like those connecting to an ip, are never a mismatch.
+func (hw *HandlerWrapper) checkSNI(resp http.ResponseWriter, req *http.Request, ic *interceptedConn) bool {
+	policy := *hw.MyConfig.SNIMismatch
+	sni := ic.state.ServerName
+	if policy == "ignore" || sni == "" || sameHostName(req.Host, sni) {
+		return true
+	}
+	ip := clientIP(req.RemoteAddr)
+	if policy == "log" {
+		logger.Warnf("Client %s sent Host %q over a connection with SNI %q", ip, req.Host, sni)
+		return true
+	}
+	logger.Warnf("Client %s sent Host %q over a connection with SNI %q, rejecting", ip, req.Host, sni)
+	respError(resp, http.StatusMisdirectedRequest, "Host "+req.Host+" doesn't match the TLS server name "+sni)
+	return false
+}
+
+// sameHostName reports whether host, which may carry a port, names server.
+func sameHostName(host, server string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(server, "."))
+}
+
+// routeHost returns the host:port req is sent to. With -route-by sni a
+// request decrypted from a connection with SNI goes to that name, on the
+// CONNECT port, whatever its Host header says; the header itself is sent
+// on unchanged.
+func (hw *HandlerWrapper) routeHost(ctx context.Context, req *http.Request) string {
+	host := hostWithPort(req.Host, hw.defaultPort(req.URL.Scheme))
+	if *hw.MyConfig.RouteBy != "sni" {
+		return host
+	}
+	ic := interceptedFrom(ctx)
+	if ic == nil || ic.state.ServerName == "" {
+		return host
+	}
+	_, port, err := net.SplitHostPort(ic.addr)
+	if err != nil {
+		port = hw.defaultPort("https")
+	}
+	return net.JoinHostPort(ic.state.ServerName, port)
+}
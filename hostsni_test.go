@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedTLSOrigin answers with its name and the Host it got.
+func namedTLSOrigin(t *testing.T, name string) *httptest.Server {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" got "+r.Host)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// getOverSNI sends a request for host over a connection intercepted through
+// p from a CONNECT to origin, with sni in the ClientHello, returning the
+// status and body of the answer.
+func getOverSNI(t *testing.T, p *testProxy, origin *httptest.Server, sni, host string) (int, string) {
+	t.Helper()
+	conn := p.connect(t, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, RootCAs: testCAPool()})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, readAll(t, resp)
+}
+
+func TestSNIMismatchRejected(t *testing.T) {
+	front, hidden := namedTLSOrigin(t, "front"), namedTLSOrigin(t, "hidden")
+	p := newTestProxy(t, "-intercept-ports", portOf(front), "-sni-mismatch", "reject",
+		"-rewrite", "example.com=127.0.0.1:"+portOf(front))
+	p.trust(front)
+
+	// fronted by example.com, asking for another host
+	status, body := getOverSNI(t, p, front, "example.com", hidden.Listener.Addr().String())
+	if status != http.StatusMisdirectedRequest || !strings.Contains(body, "doesn't match the TLS server name example.com") {
+		t.Errorf("mismatched Host got %d %q", status, body)
+	}
+	// the SNI in another case isn't a mismatch
+	if status, body = getOverSNI(t, p, front, "example.com", "Example.COM"); status != http.StatusOK || body != "front got Example.COM" {
+		t.Errorf("matching Host got %d %q", status, body)
+	}
+	// nor is a connection without SNI
+	if status, body = getOverSNI(t, p, front, "127.0.0.1", hidden.Listener.Addr().String()); status != http.StatusOK || !strings.HasPrefix(body, "hidden") {
+		t.Errorf("Host over a connection without SNI got %d %q", status, body)
+	}
+}
+
+func TestSNIMismatchLogged(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	front, hidden := namedTLSOrigin(t, "front"), namedTLSOrigin(t, "hidden")
+	p := newTestProxy(t, "-intercept-ports", portOf(front), "-sni-mismatch", "log")
+	p.trust(front)
+	host := hidden.Listener.Addr().String()
+	if status, body := getOverSNI(t, p, front, "example.com", host); status != http.StatusOK || body != "hidden got "+host {
+		t.Errorf("mismatched Host with -sni-mismatch log got %d %q", status, body)
+	}
+	want := fmt.Sprintf("sent Host %q over a connection with SNI %q", host, "example.com")
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("log lacks %q, got:\n%s", want, logged)
+	}
+}
+
+func TestSNIMismatchIgnoredByDefault(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	front, hidden := namedTLSOrigin(t, "front"), namedTLSOrigin(t, "hidden")
+	p := newTestProxy(t, "-intercept-ports", portOf(front))
+	p.trust(front)
+	host := hidden.Listener.Addr().String()
+	if status, body := getOverSNI(t, p, front, "example.com", host); status != http.StatusOK || body != "hidden got "+host {
+		t.Errorf("mismatched Host got %d %q", status, body)
+	}
+	if strings.Contains(logged.String(), "SNI") {
+		t.Errorf("mismatch logged by default:\n%s", logged)
+	}
+}
+
+func TestRouteBySNI(t *testing.T) {
+	front, hidden := namedTLSOrigin(t, "front"), namedTLSOrigin(t, "hidden")
+	host := hidden.Listener.Addr().String()
+	for route, want := range map[string]string{
+		"host": "hidden got " + host,
+		// sent to the SNI on the CONNECT port, the Host header untouched
+		"sni": "front got " + host,
+	} {
+		p := newTestProxy(t, "-intercept-ports", portOf(front), "-route-by", route,
+			"-rewrite", "example.com=127.0.0.1")
+		p.trust(front)
+		if status, body := getOverSNI(t, p, front, "example.com", host); status != http.StatusOK || body != want {
+			t.Errorf("-route-by %s got %d %q, want %q", route, status, body, want)
+		}
+	}
+}
+
+func TestHostSNIConfig(t *testing.T) {
+	for _, args := range [][]string{{"-sni-mismatch", "block"}, {"-route-by", "ip"}} {
+		if err := initError(args...); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn notes the time whenever data is read from or written to it, on a
+// clock shared with the other side of a tunnel.
+type idleConn struct {
+	net.Conn
+	last *atomic.Int64
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// closeWhenIdle returns conn1 and conn2 wrapped so that both are closed
+// once no data has passed either way for idle, which ends a Transport
+// between them. stop ends the watch.
+func closeWhenIdle(conn1, conn2 net.Conn, idle time.Duration) (net.Conn, net.Conn, func()) {
+	last := new(atomic.Int64)
+	last.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(max(idle/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if time.Since(time.Unix(0, last.Load())) >= idle {
+				logger.Debugln("closing tunnel to", conn2.RemoteAddr(), "idle for", idle)
+				conn1.Close()
+				conn2.Close()
+				return
+			}
+		}
+	}()
+	return &idleConn{conn1, last}, &idleConn{conn2, last}, func() { close(done) }
+}
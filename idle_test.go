@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stallingProxy is an upstream proxy reading a request and then nothing
+// but what its client sends, answering CONNECT with 200 first when
+// answer is set. Its end of each connection is reported on closed once the
+// other side closes it.
+func stallingProxy(t *testing.T, answer bool) (string, chan struct{}) {
+	closed := make(chan struct{}, 10)
+	addr := upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		if answer {
+			io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		}
+		io.Copy(io.Discard, conn)
+		closed <- struct{}{}
+	})
+	return addr, closed
+}
+
+func TestForwardDialTimeout(t *testing.T) {
+	raddr, _ := stallingProxy(t, false)
+	p := newTestProxy(t, "-raddr", raddr, "-dial-timeout", "200ms")
+	start := time.Now()
+	status := connectStatus(t, p, "example.com:443")
+	if status < 500 || time.Since(start) > 3*time.Second {
+		t.Errorf("CONNECT through a proxy that never answers got %d after %s", status, time.Since(start))
+	}
+}
+
+func TestForwardIdleTornDown(t *testing.T) {
+	raddr, closed := stallingProxy(t, true)
+	p := newTestProxy(t, "-raddr", raddr, "-forward-idle", "200ms")
+	conn := p.connect(t, "example.com:443")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// both sides are closed once nothing has passed for -forward-idle
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read on an idle tunnel got %v, want EOF", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("upstream proxy connection left open")
+	}
+}
+
+func TestForwardIdleKeepsActiveTunnel(t *testing.T) {
+	raddr := upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		io.Copy(conn, conn)
+	})
+	p := newTestProxy(t, "-raddr", raddr, "-forward-idle", "200ms")
+	conn := p.connect(t, "example.com:443")
+	// traffic for several idle periods keeps it open
+	echo := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte{byte(i)})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, echo); err != nil || echo[0] != byte(i) {
+			t.Fatalf("echo %d got %v, %v", i, echo, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDialTimeoutChecked(t *testing.T) {
+	if err := initError("-dial-timeout", "0"); err == nil {
+		t.Error("-dial-timeout 0 accepted")
+	}
+}
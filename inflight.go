@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ByteBudget caps the bytes transactions hold in memory between them:
+// captured and buffered bodies and response dumps. Transactions in flight
+// keep what they buffered, new ones wait for room or are turned away once
+// the cap is reached.
+type ByteBudget struct {
+	mutex sync.Mutex
+	max   int64
+	used  int64
+	// room is closed, and replaced, whenever bytes are released
+	room chan struct{}
+}
+
+func NewByteBudget(max int64) *ByteBudget {
+	return &ByteBudget{max: max, room: make(chan struct{})}
+}
+
+// Admit reports whether a new transaction may start, waiting up to wait for
+// the bytes in use to drop below the cap.
+func (b *ByteBudget) Admit(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		b.mutex.Lock()
+		if b.used < b.max {
+			b.mutex.Unlock()
+			return true
+		}
+		room := b.room
+		b.mutex.Unlock()
+		select {
+		case <-room:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Used returns the bytes held by transactions in flight.
+func (b *ByteBudget) Used() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.used
+}
+
+func (b *ByteBudget) add(n int64) {
+	b.mutex.Lock()
+	b.used += n
+	if n < 0 {
+		close(b.room)
+		b.room = make(chan struct{})
+	}
+	b.mutex.Unlock()
+}
+
+// lease returns a budgetLease for one transaction, nil if b is nil.
+func (b *ByteBudget) lease() *budgetLease {
+	if b == nil {
+		return nil
+	}
+	return &budgetLease{budget: b}
+}
+
+// budgetLease counts what one transaction holds of a ByteBudget. A nil
+// lease counts nothing.
+type budgetLease struct {
+	budget *ByteBudget
+	n      int64
+}
+
+func (l *budgetLease) add(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.n += int64(n)
+	l.budget.add(int64(n))
+}
+
+// release gives back everything the transaction held.
+func (l *budgetLease) release() {
+	if l == nil || l.n == 0 {
+		return
+	}
+	l.budget.add(-l.n)
+	l.n = 0
+}
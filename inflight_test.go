@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upgradeThrough opens a websocket to origin through p, returning the
+// connection once the proxy relayed the switch.
+func upgradeThrough(t *testing.T, p *testProxy, origin *httptest.Server) net.Conn {
+	t.Helper()
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn
+}
+
+// holdingOrigin reads request bodies, then holds the response until release
+// is closed.
+func holdingOrigin(t *testing.T) (*httptest.Server, chan struct{}, chan struct{}) {
+	read, release := make(chan struct{}, 10), make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.Method == "POST" {
+			read <- struct{}{}
+			<-release
+		}
+		io.WriteString(w, "done")
+	}))
+	t.Cleanup(origin.Close)
+	return origin, read, release
+}
+
+// holdBudget sends a large POST through p to origin, returning once the
+// origin read it, and a channel getting the status it is answered with.
+func holdBudget(t *testing.T, p *testProxy, origin *httptest.Server, read chan struct{}) chan int {
+	t.Helper()
+	status := make(chan int, 1)
+	go func() {
+		resp, err := p.client().Post(origin.URL, "text/plain", strings.NewReader(strings.Repeat("x", 4096)))
+		if err != nil {
+			status <- 0
+			return
+		}
+		readAll(t, resp)
+		status <- resp.StatusCode
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("large request never reached the origin")
+	}
+	return status
+}
+
+// drained waits a while for p to hold no bytes in flight and returns what
+// it still holds.
+func drained(p *testProxy) int64 {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.inflight.Used() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return p.inflight.Used()
+}
+
+func TestInflightBudgetRefusesWhenFull(t *testing.T) {
+	c := newCollector(t)
+	origin, read, release := holdingOrigin(t)
+	// the captured request body alone is over the cap
+	p := newTestProxy(t, "-collector", c.URL, "-max-inflight", "1024", "-inflight-wait", "0")
+	held := holdBudget(t, p, origin, read)
+	if used := p.inflight.Used(); used < 4096 {
+		t.Fatalf("%d bytes in flight while holding a 4096 byte body", used)
+	}
+
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("request over the budget got %d with Retry-After %q, want 503", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	close(release)
+	if status := <-held; status != http.StatusOK {
+		t.Errorf("held request got %d", status)
+	}
+	// the client connection stays open for more requests
+	if used := drained(p); used != 0 {
+		t.Errorf("%d bytes still in flight once done", used)
+	}
+}
+
+func TestInflightBudgetWaitsForRoom(t *testing.T) {
+	c := newCollector(t)
+	origin, read, release := holdingOrigin(t)
+	p := newTestProxy(t, "-collector", c.URL, "-max-inflight", "1024", "-inflight-wait", "5s")
+	held := holdBudget(t, p, origin, read)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	// admitted once the held request is done
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); resp.StatusCode != http.StatusOK || body != "done" {
+		t.Errorf("waiting request got %d %q", resp.StatusCode, body)
+	}
+	<-held
+}
+
+func TestUpgradedConnectionReleasesInflight(t *testing.T) {
+	c := newCollector(t)
+	ws := wsEchoOrigin(t)
+	origin := textOrigin(t, "ok")
+	// the switch's response dump alone is over the cap
+	p := newTestProxy(t, "-collector", c.URL, "-max-inflight", "64", "-inflight-wait", "0")
+	conn := upgradeThrough(t, p, ws)
+	defer conn.Close()
+
+	// the relay is open, but holds none of the budget
+	if used := drained(p); used != 0 {
+		t.Fatalf("%d bytes held while relaying the websocket", used)
+	}
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); resp.StatusCode != http.StatusOK {
+		t.Errorf("request alongside an open websocket got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+// earlyHintsOrigin answers with 103 Early Hints ahead of its response.
+func earlyHintsOrigin(t *testing.T, newServer func(http.Handler) *httptest.Server) *httptest.Server {
+	origin := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		io.WriteString(w, "final")
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// getWith1xx gets url through p and returns the body and the informational
+// responses the client saw ahead of it, each as its status and Link field.
+func getWith1xx(t *testing.T, p *testProxy, url string) (string, []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var got []string
+	req, _ := http.NewRequest("GET", url, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			mu.Lock()
+			got = append(got, fmt.Sprint(code, " ", header.Get("Link")))
+			mu.Unlock()
+			return nil
+		},
+	}))
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readAll(t, resp)
+	mu.Lock()
+	defer mu.Unlock()
+	return body, got
+}
+
+func TestEarlyHintsRelayed(t *testing.T) {
+	for name, newServer := range map[string]func(http.Handler) *httptest.Server{
+		"http":  httptest.NewServer,
+		"https": httptest.NewTLSServer,
+	} {
+		origin := earlyHintsOrigin(t, newServer)
+		p := newTestProxy(t, "-intercept-ports", portOf(origin))
+		if origin.TLS != nil {
+			p.trust(origin)
+		}
+		body, got := getWith1xx(t, p, origin.URL)
+		if body != "final" || len(got) != 1 || got[0] != "103 </style.css>; rel=preload; as=style" {
+			t.Errorf("%s: client got %q after %q", name, body, got)
+		}
+	}
+}
+
+func TestEarlyHintsDroppedWithoutRelay1xx(t *testing.T) {
+	origin := earlyHintsOrigin(t, httptest.NewServer)
+	p := newTestProxy(t, "-relay-1xx=false")
+	if body, got := getWith1xx(t, p, origin.URL); body != "final" || len(got) != 0 {
+		t.Errorf("client got %q after %q", body, got)
+	}
+}
+
+func TestContinueSentOnce(t *testing.T) {
+	origin := earlyHintsOrigin(t, httptest.NewServer)
+	p := newTestProxy(t)
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("got %s before sending the body, want 100", resp.Status)
+	}
+	io.WriteString(conn, "body")
+	// the origin's own 100 isn't passed on, its 103 is
+	var codes []int
+	for resp.StatusCode < 200 {
+		if resp, err = http.ReadResponse(br, nil); err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, resp.StatusCode)
+	}
+	if fmt.Sprint(codes) != "[103 200]" {
+		t.Errorf("after the body the client got %v, want [103 200]", codes)
+	}
+}
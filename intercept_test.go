@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func tlsOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tls origin"))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// issuer returns the organization of the cert the client was shown.
+func issuer(resp *http.Response) string {
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	if org := resp.TLS.PeerCertificates[0].Issuer.Organization; len(org) > 0 {
+		return org[0]
+	}
+	return ""
+}
+
+func TestInterceptPorts(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	p.trust(origin)
+	resp, err := p.clientTrusting(origin).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "tls origin" {
+		t.Errorf("body %q", body)
+	}
+	if got := issuer(resp); got != "gomitmproxy"+Version {
+		t.Errorf("intercepted port shown a cert issued by %q", got)
+	}
+}
+
+func TestOtherPortsTunneled(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", "443")
+	resp, err := p.clientTrusting(origin).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "tls origin" {
+		t.Errorf("body %q", body)
+	}
+	if got := issuer(resp); got == "gomitmproxy"+Version {
+		t.Error("port missing from -intercept-ports was intercepted")
+	}
+}
+
+// handshakeThrough intercepts a tunnel to origin, asking for server name
+// sni, and returns the leaf cert the proxy presented.
+func handshakeThrough(t *testing.T, p *testProxy, origin *httptest.Server, sni string) *x509.Certificate {
+	t.Helper()
+	conn := p.connect(t, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, RootCAs: testCAPool()})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake for %q: %s", sni, err)
+	}
+	return tlsConn.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertMintedForClientHelloSNI(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	// the CONNECT names an ip, the ClientHello the name to mint for
+	leaf := handshakeThrough(t, p, origin, "sni.example.test")
+	if err := leaf.VerifyHostname("sni.example.test"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCertMintedForConnectHostWithoutSNI(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	conn := p.connect(t, origin.Listener.Addr().String())
+	// an ip as ServerName sends no SNI
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: testCAPool()})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsConn.ConnectionState().PeerCertificates[0].VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInterceptHostsAllowlist(t *testing.T) {
+	origin := tlsOrigin(t)
+	for _, tc := range []struct {
+		hosts       string
+		intercepted bool
+	}{
+		{"", true},
+		{"127.0.0.1", true},
+		{"other.test,*.0.0.1", true},
+		{"other.test,*.example.com", false},
+	} {
+		p := newTestProxy(t, "-intercept-ports", portOf(origin), "-intercept-hosts", tc.hosts)
+		p.trust(origin)
+		resp, err := p.clientTrusting(origin).Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); body != "tls origin" {
+			t.Errorf("-intercept-hosts %q body %q", tc.hosts, body)
+		}
+		if got := issuer(resp) == "gomitmproxy"+Version; got != tc.intercepted {
+			t.Errorf("-intercept-hosts %q intercepted %v, want %v", tc.hosts, got, tc.intercepted)
+		}
+		if minted := len(p.dynamicCerts.Expirations()) > 0; minted != tc.intercepted {
+			t.Errorf("-intercept-hosts %q minted a cert %v, want %v", tc.hosts, minted, tc.intercepted)
+		}
+	}
+}
+
+func TestForceHTTP1NegotiatedThroughALPN(t *testing.T) {
+	origin := tlsOrigin(t)
+	for _, force := range []bool{false, true} {
+		args := []string{"-intercept-ports", portOf(origin)}
+		if force {
+			args = append(args, "-force-http1")
+		}
+		p := newTestProxy(t, args...)
+		p.trust(origin)
+		conn := p.connect(t, origin.Listener.Addr().String())
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: testCAPool(), NextProtos: []string{"h2", "http/1.1"}})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if force {
+			want = "http/1.1"
+		}
+		if got := tlsConn.ConnectionState().NegotiatedProtocol; got != want {
+			t.Errorf("-force-http1=%v negotiated %q with a client offering h2, want %q", force, got, want)
+		}
+
+		// a client able to do h2 talks http/1.1
+		c := p.client()
+		c.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+		resp, err := c.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); resp.ProtoMajor != 1 || body != "tls origin" {
+			t.Errorf("-force-http1=%v h2 capable client got %s %q", force, resp.Proto, body)
+		}
+	}
+}
+
+// getWithSNI gets / from origin through a tunnel asking for server name sni,
+// without checking the cert, and returns the body and who issued the cert.
+func getWithSNI(t *testing.T, p *testProxy, origin *httptest.Server, sni string) (string, string) {
+	t.Helper()
+	conn := p.connect(t, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	if err := req.Write(tlsConn); err != nil {
+		t.Fatalf("request for %q: %s", sni, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		t.Fatalf("response for %q: %s", sni, err)
+	}
+	org := tlsConn.ConnectionState().PeerCertificates[0].Issuer.Organization
+	if len(org) == 0 {
+		return readAll(t, resp), ""
+	}
+	return readAll(t, resp), org[0]
+}
+
+func TestInterceptSNIPattern(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-intercept-sni", `.*\.internal$`)
+	p.trust(origin)
+	for sni, intercepted := range map[string]bool{
+		"api.internal":          true,
+		"a.b.internal":          true,
+		"public.example.com":    false,
+		"api.internal.evil.com": false,
+	} {
+		body, by := getWithSNI(t, p, origin, sni)
+		if body != "tls origin" {
+			t.Errorf("%q got body %q", sni, body)
+		}
+		if got := by == "gomitmproxy"+Version; got != intercepted {
+			t.Errorf("%q intercepted %v, want %v", sni, got, intercepted)
+		}
+	}
+	if n := len(p.dynamicCerts.Expirations()); n != 2 {
+		t.Errorf("%d certs minted, want 2 for the matching names", n)
+	}
+}
+
+func TestInterceptSNIPatternChecked(t *testing.T) {
+	if err := initError("-intercept-sni", "a("); err == nil {
+		t.Error("invalid -intercept-sni pattern accepted")
+	}
+}
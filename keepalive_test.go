@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// closedWithin reports whether the peer closes conn within d.
+func closedWithin(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+func TestKeepAliveReusesClientConnection(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t)
+	conn := p.dial(t)
+	br := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(conn, "GET %s/%d HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, i, origin.Listener.Addr())
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d on the kept-alive connection: %s", i, err)
+		}
+		readAll(t, resp)
+		if resp.Close {
+			t.Fatalf("request %d answered with Connection: close", i)
+		}
+	}
+}
+
+func TestKeepAliveOffClosesClientConnection(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t, "-keepalive=false")
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if !resp.Close {
+		t.Error("response lacks Connection: close with -keepalive=false")
+	}
+	if !closedWithin(conn, 2*time.Second) {
+		t.Error("connection left open with -keepalive=false")
+	}
+}
+
+func TestIdleClientConnectionClosed(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t, "-client-idle", "200ms")
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if !closedWithin(conn, 3*time.Second) {
+		t.Error("idle kept-alive connection not closed after -client-idle")
+	}
+}
+
+func TestIdleInterceptedConnectionClosed(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-client-idle", "200ms")
+	p.trust(origin)
+	conn := p.connect(t, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: testCAPool()})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	// the decrypted connection is served again once the response is done
+	if !closedWithin(tlsConn, 3*time.Second) {
+		t.Error("idle intercepted connection not closed after -client-idle")
+	}
+}
+
+func TestSlowHeaderClosed(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-header-timeout", "200ms")
+	conn := p.connect(t, origin.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: testCAPool()})
+	// a header block that never ends
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n", origin.Listener.Addr())
+	if !closedWithin(tlsConn, 3*time.Second) {
+		t.Error("connection with an unfinished header block not closed after -header-timeout")
+	}
+
+	plain := p.dial(t)
+	fmt.Fprintf(plain, "GET http://%s/ HTTP/1.1\r\n", origin.Listener.Addr())
+	if !closedWithin(plain, 3*time.Second) {
+		t.Error("proxy connection with an unfinished header block not closed after -header-timeout")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// caPath is where direct requests can download the issuing CA.
+const caPath = "/ca.pem"
+
+// pacPath is where direct requests can fetch a proxy auto-config file.
+const pacPath = "/proxy.pac"
+
+const defaultLandingPage = `<!DOCTYPE html>
+<html>
+<head><title>gomitmproxy</title></head>
+<body>
+<h1>gomitmproxy ` + Version + `</h1>
+<p>This is an http proxy, not a web server. Configure your browser or system
+to use this address as its http and https proxy, or point it at the
+<a href="` + pacPath + `">proxy auto-config file</a>.</p>
+<p>To inspect https traffic, <a href="` + caPath + `">download the CA certificate</a>
+and install it as a trusted root.</p>
+</body>
+</html>
+`
+
+// isDirectRequest reports whether req was sent to the proxy as if it were
+// the origin server, e.g. by a browser pointed straight at it, rather than
+// as a proxy request carrying an absolute url.
+func isDirectRequest(req *http.Request) bool {
+	return req.Method != "CONNECT" && !req.URL.IsAbs()
+}
+
+// ServeDirect answers requests made to the proxy itself with the landing page,
+// the CA certificate or the PAC file.
+func (hw *HandlerWrapper) ServeDirect(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == pacPath || (*hw.MyConfig.Wpad && isWpadRequest(req)) {
+		resp.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		resp.Write(hw.pac(req))
+		return
+	}
+	if req.URL.Path == caPath || req.URL.Path == "/ca.crt" {
+		resp.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		resp.Header().Set("Content-Disposition", `attachment; filename="gomitmproxy-ca-cert.pem"`)
+		resp.Write(hw.issuingCertPem)
+		return
+	}
+	if req.URL.Path != "/" {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Write(hw.landingPage)
+}
+
+// isWpadRequest reports whether req is a WPAD lookup, which fetches wpad.dat
+// from a host named wpad in the client's domain.
+func isWpadRequest(req *http.Request) bool {
+	host := strings.ToLower(req.Host)
+	return req.URL.Path == "/wpad.dat" || host == "wpad" || strings.HasPrefix(host, "wpad.") || strings.HasPrefix(host, "wpad:")
+}
+
+// pac returns the configured PAC file, or one sending everything through
+// the proxy at the address req was sent to.
+func (hw *HandlerWrapper) pac(req *http.Request) []byte {
+	if hw.pacFile != nil {
+		return hw.pacFile
+	}
+	addr := hostWithPort(req.Host, *hw.MyConfig.Port)
+	return []byte(fmt.Sprintf("function FindProxyForURL(url, host) {\n\treturn \"PROXY %s; DIRECT\";\n}\n", addr))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// direct sends a request for path straight to the proxy, as to a web server.
+func (p *testProxy) direct(t *testing.T, host, path string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", p.server.URL+path, nil)
+	if host != "" {
+		req.Host = host
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readAll(t, resp)
+}
+
+func TestLandingPageForDirectRequests(t *testing.T) {
+	p := newTestProxy(t)
+	resp, body := p.direct(t, "", "/")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(body, "This is an http proxy") {
+		t.Errorf("landing page got %s %q: %.60q", resp.Status, resp.Header.Get("Content-Type"), body)
+	}
+	if resp, _ := p.direct(t, "", "/elsewhere"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path got %s", resp.Status)
+	}
+}
+
+func TestLandingServesCA(t *testing.T) {
+	p := newTestProxy(t)
+	for _, path := range []string{"/ca.pem", "/ca.crt"} {
+		resp, body := p.direct(t, "", path)
+		if resp.Header.Get("Content-Type") != "application/x-x509-ca-cert" || body != string(p.issuingCertPem) {
+			t.Errorf("%s got %q and %d bytes, want the CA cert", path, resp.Header.Get("Content-Type"), len(body))
+		}
+	}
+}
+
+func TestLandingServesPAC(t *testing.T) {
+	p := newTestProxy(t, "-port", "3128")
+	resp, body := p.direct(t, "proxy.lan", "/proxy.pac")
+	if resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" ||
+		!strings.Contains(body, `"PROXY proxy.lan:3128; DIRECT"`) {
+		t.Errorf("pac got %q:\n%s", resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestCustomLandingPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "landing.html")
+	os.WriteFile(path, []byte("<p>ask the helpdesk</p>"), 0644)
+	p := newTestProxy(t, "-landing", path)
+	if _, body := p.direct(t, "", "/"); body != "<p>ask the helpdesk</p>" {
+		t.Errorf("got %q, want the -landing file", body)
+	}
+	if err := initError("-landing", filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("missing -landing file accepted")
+	}
+}
+
+func TestWpadServesPAC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	pac := "function FindProxyForURL(url, host) { return \"DIRECT\"; }\n"
+	os.WriteFile(path, []byte(pac), 0644)
+	p := newTestProxy(t, "-wpad", "-pac", path)
+	for _, req := range [][2]string{
+		{"proxy.lan", "/wpad.dat"},
+		{"wpad", "/wpad.dat"},
+		{"wpad.corp.example", "/"},
+		{"WPAD.corp.example:80", "/anything"},
+	} {
+		resp, body := p.direct(t, req[0], req[1])
+		if resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" || body != pac {
+			t.Errorf("%s%s got %s %q, want the pac file", req[0], req[1], resp.Status, resp.Header.Get("Content-Type"))
+		}
+	}
+	if resp, _ := p.direct(t, "wpadless.lan", "/"); resp.Header.Get("Content-Type") == "application/x-ns-proxy-autoconfig" {
+		t.Error("host only starting with wpad got the pac file")
+	}
+}
+
+func TestWpadOffByDefault(t *testing.T) {
+	p := newTestProxy(t)
+	if resp, _ := p.direct(t, "", "/wpad.dat"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/wpad.dat without -wpad got %s", resp.Status)
+	}
+	if _, body := p.direct(t, "wpad.corp.example", "/"); !strings.Contains(body, "This is an http proxy") {
+		t.Errorf("wpad host without -wpad got %.60q, want the landing page", body)
+	}
+}
@@ -26,3 +26,26 @@ func (listener *mitmListener) Close() error {
 func (listener *mitmListener) Addr() net.Addr {
 	return nil
 }
+
+// bufferedConn is a net.Conn whose reads are served from a reader, such as a
+// bufio.Reader that may already hold data read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.r.Read(b)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// locationRewrite points redirects to hosts matching pattern at target.
+type locationRewrite struct {
+	pattern string
+	scheme  string
+	host    string
+}
+
+// parseLocationRewrites parses a comma separated list of pattern=target
+// entries, the target being host[:port] or scheme://host[:port].
+func parseLocationRewrites(s string) ([]*locationRewrite, error) {
+	var rewrites []*locationRewrite
+	for _, item := range splitList(s) {
+		eq := strings.Index(item, "=")
+		if eq <= 0 || eq == len(item)-1 {
+			return nil, fmt.Errorf("Invalid location rewrite %q, want host=target", item)
+		}
+		rewrite := &locationRewrite{pattern: item[:eq], host: item[eq+1:]}
+		if i := strings.Index(rewrite.host, "://"); i >= 0 {
+			rewrite.scheme, rewrite.host = rewrite.host[:i], rewrite.host[i+3:]
+			if rewrite.scheme != "http" && rewrite.scheme != "https" {
+				return nil, fmt.Errorf("Invalid location rewrite %q, scheme must be http or https", item)
+			}
+		}
+		if rewrite.host == "" || strings.Contains(rewrite.host, "/") {
+			return nil, fmt.Errorf("Invalid location rewrite %q, want host=target", item)
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
+// rewriteLocation points the Location of a redirect in resp, answering req,
+// at the target of the first rule matching its host. Relative Locations
+// are resolved against the request url first and left alone if no rule
+// matches.
+func (hw *HandlerWrapper) rewriteLocation(req *http.Request, resp *http.Response) {
+	if len(hw.locationRules) == 0 || resp.StatusCode/100 != 3 {
+		return
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		logger.Debugln("parse location", location, "error:", err)
+		return
+	}
+	u = req.URL.ResolveReference(u)
+	for _, rewrite := range hw.locationRules {
+		if !matchHost(rewrite.pattern, u.Host) {
+			continue
+		}
+		if rewrite.scheme != "" {
+			u.Scheme = rewrite.scheme
+		}
+		u.Host = rewrite.host
+		resp.Header.Set("Location", u.String())
+		logger.Debugln("rewrote location", location, "to", u)
+		return
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func redirectOrigin(t *testing.T) *httptest.Server {
+	locations := map[string]string{
+		"/absolute": "http://other.test/x?y=1",
+		"/relative": "/next",
+		"/kept":     "http://kept.test/page",
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/created" {
+			// not a redirect
+			w.Header().Set("Location", "http://other.test/new")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		http.Redirect(w, r, locations[r.URL.Path], http.StatusFound)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestLocationRewritten(t *testing.T) {
+	origin := redirectOrigin(t)
+	p := newTestProxy(t, "-location-rewrite", "other.test=front.test:8443,127.0.0.1=https://front.test")
+	for path, want := range map[string]string{
+		"/absolute": "http://front.test:8443/x?y=1",
+		"/relative": "https://front.test/next",
+		"/kept":     "http://kept.test/page",
+		"/created":  "http://other.test/new",
+	} {
+		resp, err := p.client().Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("%s Location %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestLocationLeftAloneByDefault(t *testing.T) {
+	origin := redirectOrigin(t)
+	p := newTestProxy(t)
+	resp, err := p.client().Get(origin.URL + "/relative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if got := resp.Header.Get("Location"); got != "/next" {
+		t.Errorf("Location %q without -location-rewrite", got)
+	}
+}
+
+func TestLocationRewritesChecked(t *testing.T) {
+	for _, rules := range []string{"example.com", "=front.test", "example.com=", "example.com=ftp://front.test", "example.com=front.test/path"} {
+		if err := initError("-location-rewrite", rules); err == nil {
+			t.Errorf("-location-rewrite %q accepted", rules)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LevelError = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = map[string]int{
+	"error": LevelError,
+	"warn":  LevelWarn,
+	"info":  LevelInfo,
+	"debug": LevelDebug,
+}
+
+// ParseLevel returns the level called name: error, warn, info or debug.
+func ParseLevel(name string) (int, error) {
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// Logger is a log.Logger that drops messages more verbose than its level.
+// Its output and level can be changed while it is in use.
+type Logger struct {
+	*log.Logger
+	level int32
+}
+
+func NewLogger(out io.Writer, level int) *Logger {
+	return &Logger{
+		Logger: log.New(out, "[gomitmproxy]", log.LstdFlags|log.Llongfile),
+		level:  int32(level),
+	}
+}
+
+// Level returns the most verbose level l logs.
+func (l *Logger) Level() int {
+	return int(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel sets the most verbose level l logs.
+func (l *Logger) SetLevel(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) logln(level int, prefix string, v ...interface{}) {
+	if level <= l.Level() {
+		l.Output(3, prefix+fmt.Sprintln(v...))
+	}
+}
+
+func (l *Logger) logf(level int, prefix, format string, v ...interface{}) {
+	if level <= l.Level() {
+		l.Output(3, prefix+fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *Logger) Errorln(v ...interface{}) { l.logln(LevelError, "[ERROR] ", v...) }
+func (l *Logger) Warnln(v ...interface{})  { l.logln(LevelWarn, "[WARN] ", v...) }
+func (l *Logger) Infoln(v ...interface{})  { l.logln(LevelInfo, "[INFO] ", v...) }
+func (l *Logger) Debugln(v ...interface{}) { l.logln(LevelDebug, "[DEBUG] ", v...) }
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logf(LevelError, "[ERROR] ", format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf(LevelWarn, "[WARN] ", format, v...)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logf(LevelInfo, "[INFO] ", format, v...)
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf(LevelDebug, "[DEBUG] ", format, v...)
+}
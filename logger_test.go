@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLoggerDropsVerboseMessages(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelWarn)
+	l.Errorln("an error")
+	l.Warnf("a %s", "warning")
+	l.Infoln("some info")
+	l.Debugf("debug %d", 1)
+
+	out := buf.String()
+	for _, want := range []string{"[ERROR] an error", "[WARN] a warning"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+	for _, dropped := range []string{"some info", "debug 1"} {
+		if strings.Contains(out, dropped) {
+			t.Errorf("log at warn has %q", dropped)
+		}
+	}
+	// the file and line are those of the caller
+	if !strings.Contains(out, "logger_test.go:") {
+		t.Errorf("log lines lack the caller's file:\n%s", out)
+	}
+}
+
+func TestLoggerChangedWhileLogging(t *testing.T) {
+	l := NewLogger(io.Discard, LevelError)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.Debugln("from another goroutine")
+		}
+	}()
+	var buf syncBuffer
+	l.SetOutput(&buf)
+	l.SetLevel(LevelDebug)
+	<-done
+	l.Debugln("after the change")
+	if !strings.Contains(buf.String(), "[DEBUG] after the change") || l.Level() != LevelDebug {
+		t.Errorf("level %d logged:\n%s", l.Level(), buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]int{"error": LevelError, "WARN": LevelWarn, "Info": LevelInfo, "debug": LevelDebug} {
+		if got, err := ParseLevel(name); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %d, %v", name, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestDebugLevelLogsTransactions(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t)
+	for _, level := range []int{LevelInfo, LevelDebug} {
+		logged := captureLog(t, level)
+		resp, err := p.client().Get(origin.URL + "/logged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		got := strings.Contains(logged.String(), "GET "+origin.URL+"/logged")
+		if want := level == LevelDebug; got != want {
+			t.Errorf("level %d logged the transaction: %v, want %v\n%s", level, got, want, logged)
+		}
+	}
+}
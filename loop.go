@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var portSuffix = regexp.MustCompile(":[0-9]+$")
+
+// hostWithPort appends the default port to host unless it already has one.
+func hostWithPort(host, port string) string {
+	if portSuffix.MatchString(host) {
+		return host
+	}
+	return host + ":" + port
+}
+
+// checkAuthority validates the host[:port] target of a CONNECT: a host name,
+// IPv4 address or bracketed IPv6 address, and a port from 1 to 65535.
+func checkAuthority(authority string) error {
+	host, port := authority, ""
+	if h, p, err := net.SplitHostPort(authority); err == nil {
+		host, port = h, p
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	} else if strings.Contains(authority, ":") && !strings.HasPrefix(authority, "[") {
+		return err
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if strings.Contains(authority, "[") {
+		return fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid host %q", host)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultPort returns the port assumed for hosts without one, by scheme.
+func (hw *HandlerWrapper) defaultPort(scheme string) string {
+	if scheme == "https" {
+		return *hw.MyConfig.HTTPSPort
+	}
+	return *hw.MyConfig.HTTPPort
+}
+
+// requestAddr returns the host:port a proxy request is for. CONNECTs default
+// to the https port, other requests to the port of their scheme.
+func (hw *HandlerWrapper) requestAddr(req *http.Request) string {
+	if req.Method == "CONNECT" {
+		return hostWithPort(req.Host, hw.defaultPort("https"))
+	}
+	return hostWithPort(req.Host, hw.defaultPort(req.URL.Scheme))
+}
+
+// localIPsTTL is how long the host's interface addresses are trusted
+// before being listed again, as interfaces come and go.
+const localIPsTTL = 30 * time.Second
+
+// selfAddrs is what the proxy knows of its own addresses: the ports of its
+// listeners and the ips of the host.
+type selfAddrs struct {
+	mutex   sync.Mutex
+	ports   map[string]bool
+	ips     []net.IP
+	ipsTime time.Time
+}
+
+// add records a listener of the proxy bound to addr, host:port.
+func (s *selfAddrs) add(addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ports == nil {
+		s.ports = make(map[string]bool)
+	}
+	s.ports[port] = true
+}
+
+// listening reports whether the proxy has a listener on port.
+func (s *selfAddrs) listening(port string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ports[port]
+}
+
+// local reports whether ip is one of the host's own addresses.
+func (s *selfAddrs) local(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if time.Since(s.ipsTime) > localIPsTTL {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			logger.Warnln("list interface addrs error:", err)
+		}
+		s.ips = s.ips[:0]
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				s.ips = append(s.ips, ipNet.IP)
+			}
+		}
+		s.ipsTime = time.Now()
+	}
+	for _, localIP := range s.ips {
+		if localIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isProxyAddr reports whether addr (host:port) points back at one of the
+// proxy's own listeners, which would make the proxy connect to itself
+// forever. Only names on a port the proxy listens on are resolved, within
+// the dial timeout.
+func (hw *HandlerWrapper) isProxyAddr(ctx context.Context, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !hw.self.listening(port) {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(ctx, hw.dialer.Timeout)
+		defer cancel()
+		if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if hw.self.local(ip) {
+			return true
+		}
+	}
+	return false
+}
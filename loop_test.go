@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestLoopToProxyRefused(t *testing.T) {
+	p := newTestProxy(t)
+	resp, err := p.client().Get("http://" + p.URL.Host + "/anything")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("request to the proxy itself got %d, want 508", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("CONNECT", p.URL.String(), nil)
+	req.Host = "localhost:" + p.URL.Port()
+	conn := p.dial(t)
+	req.Write(conn)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("CONNECT to the proxy itself got %d, want 508", resp.StatusCode)
+	}
+}
+
+func TestLoopToOtherListenersRefused(t *testing.T) {
+	admin := freeAddr(t)
+	p := newTestProxy(t, "-admin", admin)
+	resp, err := p.client().Get("http://" + admin + "/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("request to the admin listener got %d, want 508", resp.StatusCode)
+	}
+}
+
+func TestNoLoopForOrigins(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); resp.StatusCode != http.StatusOK || body != "origin" {
+		t.Errorf("got %d %q, want 200 from the origin", resp.StatusCode, body)
+	}
+}
+
+func TestIsProxyAddr(t *testing.T) {
+	hw := newTestHandler(t, "-port", "18399")
+	ctx := context.Background()
+	for addr, want := range map[string]bool{
+		"127.0.0.1:18399":          true,
+		"localhost:18399":          true,
+		"[::1]:18399":              true,
+		"0.0.0.0:18399":            true,
+		"127.0.0.1:18400":          false,
+		"192.0.2.1:18399":          false,
+		"unresolvable.invalid:443": false,
+	} {
+		if got := hw.isProxyAddr(ctx, addr); got != want {
+			t.Errorf("isProxyAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestSelfAddrsCachesInterfaces(t *testing.T) {
+	var s selfAddrs
+	if !s.local(net.ParseIP("127.0.0.1")) {
+		t.Error("loopback not local")
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !s.local(ipNet.IP) {
+			t.Errorf("interface address %s not local", ipNet.IP)
+		}
+	}
+	listed := s.ipsTime
+	s.local(net.ParseIP("192.0.2.1"))
+	if s.ipsTime != listed {
+		t.Error("interface addresses listed again within the ttl")
+	}
+}
+
+func TestDefaultPortsDialed(t *testing.T) {
+	origin := textOrigin(t, "on the http port")
+	tlsServer := tlsOrigin(t)
+	p := newTestProxy(t, "-http-port", portOf(origin), "-https-port", portOf(tlsServer))
+
+	resp, err := p.client().Get("http://127.0.0.1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "on the http port" {
+		t.Errorf("portless http host got %s %q", resp.Status, body)
+	}
+
+	// a CONNECT without a port goes to the https port
+	conn := p.connect(t, "127.0.0.1")
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: pool})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("tunnel to the https port: %s", err)
+	}
+}
+
+func TestRequestAddr(t *testing.T) {
+	hw := newTestHandler(t, "-http-port", "8080", "-https-port", "8443")
+	for _, tc := range []struct{ method, url, host, want string }{
+		{"GET", "http://example.com/", "example.com", "example.com:8080"},
+		{"GET", "https://example.com/", "example.com", "example.com:8443"},
+		{"GET", "http://example.com:81/", "example.com:81", "example.com:81"},
+		{"CONNECT", "", "example.com", "example.com:8443"},
+		{"CONNECT", "", "example.com:443", "example.com:443"},
+	} {
+		req := httptest.NewRequest(tc.method, "http://placeholder/", nil)
+		req.URL, _ = url.Parse(tc.url)
+		req.Host = tc.host
+		if got := hw.requestAddr(req); got != tc.want {
+			t.Errorf("%s %s for %s dials %s, want %s", tc.method, tc.url, tc.host, got, tc.want)
+		}
+	}
+	if port := hw.connectPort("example.com"); port != "8443" {
+		t.Errorf("portless CONNECT intercepted as port %s, want 8443", port)
+	}
+}
+
+func TestMalformedConnectRefused(t *testing.T) {
+	p := newTestProxy(t)
+	dialed := make(chan string, 10)
+	p.DialFunc = memoryDial(dialed)
+	for _, target := range []string{":443", "example.com:0", "example.com:99999", "example.com:https",
+		"exa$mple.com:443", "a..b:443", "[not-ip]:443", "a:b:c", "[::1"} {
+		if status := connectStatus(t, p, target); status != http.StatusBadRequest {
+			t.Errorf("CONNECT %s got %d, want 400", target, status)
+		}
+	}
+	if len(dialed) > 0 {
+		t.Errorf("malformed CONNECT dialed %s", <-dialed)
+	}
+}
+
+func TestCheckAuthority(t *testing.T) {
+	for _, authority := range []string{"example.com:443", "example.com", "example.com.:443", "_srv.example.com:8443",
+		"10.0.0.1:443", "[::1]:443", "[2001:db8::1]", "xn--bcher-kva.example:443"} {
+		if err := checkAuthority(authority); err != nil {
+			t.Errorf("checkAuthority(%q) = %s", authority, err)
+		}
+	}
+	for _, authority := range []string{"", ":443", "host:", "host:-1", "ho st:443", "[example.com]:443",
+		strings.Repeat("a", 64) + ".com:443"} {
+		if err := checkAuthority(authority); err == nil {
+			t.Errorf("checkAuthority(%q) accepted", authority)
+		}
+	}
+}
+
+func TestOtherSchemesNotImplemented(t *testing.T) {
+	p := newTestProxy(t)
+	dialed := make(chan string, 10)
+	p.DialFunc = memoryDial(dialed)
+	for _, target := range []string{"ftp://example.com/pub/file.txt", "gopher://example.com/", "ws://example.com/socket"} {
+		conn := p.dial(t)
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\n\r\n", target)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); resp.StatusCode != http.StatusNotImplemented || !strings.Contains(body, "is not supported") {
+			t.Errorf("GET %s got %d %q, want 501", target, resp.StatusCode, body)
+		}
+	}
+	if len(dialed) > 0 {
+		t.Errorf("request for another scheme dialed %s", <-dialed)
+	}
+
+	// the scheme is case insensitive
+	origin := textOrigin(t, "upper")
+	p = newTestProxy(t)
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET HTTP://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr(), origin.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "upper" {
+		t.Errorf("HTTP:// url got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testCADir holds the CA the tests share, made once for the run so that
+// tests never rewrite the repo's CA files.
+var testCADir string
+
+func TestMain(m *testing.M) {
+	logger = NewLogger(io.Discard, LevelError)
+	log.SetOutput(io.Discard)
+	dir, err := os.MkdirTemp("", "gomitmproxy-test")
+	if err != nil {
+		panic(err)
+	}
+	testCADir = dir
+	ca := &HandlerWrapper{tlsConfig: NewTlsConfig(filepath.Join(dir, "ca-pk.pem"), filepath.Join(dir, "ca-cert.pem"), "", "")}
+	if err := ca.GenerateCertForClient(); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// copyTestCA copies the tests' CA into dir, returning the paths of its key
+// and cert files there. A proxy rewrites these files when its flags change
+// the CA, so each gets a copy of its own.
+func copyTestCA(dir string) (pk, cert string, err error) {
+	pk, cert = filepath.Join(dir, "ca-pk.pem"), filepath.Join(dir, "ca-cert.pem")
+	for _, path := range []string{pk, cert} {
+		b, err := os.ReadFile(filepath.Join(testCADir, filepath.Base(path)))
+		if err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return "", "", err
+		}
+	}
+	return pk, cert, nil
+}
+
+// testProxy is a proxy serving on a local listener for one test.
+type testProxy struct {
+	*HandlerWrapper
+	server *httptest.Server
+	URL    *url.URL
+}
+
+// newTestHandler returns a proxy configured by args as given on the command
+// line, with a copy of the tests' CA.
+func newTestHandler(t testing.TB, args ...string) *HandlerWrapper {
+	t.Helper()
+	pk, cert, err := copyTestCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestHandlerCA(t, pk, cert, args...)
+}
+
+// newTestHandlerCA returns a proxy like newTestHandler with the CA key and
+// cert in the files pk and cert, generated if missing. Tests changing how
+// the CA is made use it with files of their own.
+func newTestHandlerCA(t testing.TB, pk, cert string, args ...string) *HandlerWrapper {
+	t.Helper()
+	fs := flag.NewFlagSet("gomitmproxy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	conf := defineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := newTlsConfig(conf, pk, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw, err := InitConfig(conf, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hw.Close)
+	return hw
+}
+
+// initError returns the error InitConfig gives for args, nil if none.
+func initError(args ...string) error {
+	dir, err := os.MkdirTemp("", "gomitmproxy-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	pk, cert, err := copyTestCA(dir)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("gomitmproxy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	conf := defineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tlsConfig, err := newTlsConfig(conf, pk, cert)
+	if err != nil {
+		return err
+	}
+	hw, err := InitConfig(conf, tlsConfig)
+	if hw != nil {
+		hw.Close()
+	}
+	return err
+}
+
+// newTestProxy starts a proxy configured by args on a local listener, set
+// up as the proxy server of main sets it up.
+func newTestProxy(t *testing.T, args ...string) *testProxy {
+	t.Helper()
+	pk, cert, err := copyTestCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestProxyCA(t, pk, cert, args...)
+}
+
+// newTestProxyCA starts a proxy like newTestProxy with the CA key and cert
+// in the files pk and cert, as newTestHandlerCA does.
+func newTestProxyCA(t *testing.T, pk, cert string, args ...string) *testProxy {
+	t.Helper()
+	hw := newTestHandlerCA(t, pk, cert, args...)
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = hw.proxyServer()
+	server.Listener = &framingListener{server.Listener, server.Config.MaxHeaderBytes}
+	server.Start()
+	t.Cleanup(server.Close)
+	hw.self.add(server.Listener.Addr().String())
+	u, _ := url.Parse(server.URL)
+	return &testProxy{hw, server, u}
+}
+
+// client returns a client sending its requests through the proxy, trusting
+// the proxy's CA and not following redirects.
+func (p *testProxy) client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(p.URL),
+			TLSClientConfig: &tls.Config{RootCAs: testCAPool()},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// clientTrusting returns a client like client that also trusts the cert of
+// origin, for tunneled connections.
+func (p *testProxy) clientTrusting(origin *httptest.Server) *http.Client {
+	c := p.client()
+	pool := testCAPool()
+	pool.AddCert(origin.Certificate())
+	c.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+	return c
+}
+
+// dial opens a raw connection to the proxy.
+func (p *testProxy) dial(t *testing.T) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.URL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connect opens a CONNECT tunnel through the proxy to target, failing the
+// test unless the proxy answers 200.
+func (p *testProxy) connect(t *testing.T, target string) net.Conn {
+	t.Helper()
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s got %s", target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		t.Fatalf("CONNECT %s answer followed by %d bytes", target, br.Buffered())
+	}
+	return conn
+}
+
+// trust makes the proxy accept the cert of the TLS test server origin.
+func (p *testProxy) trust(origin *httptest.Server) {
+	pool := x509.NewCertPool()
+	pool.AddCert(origin.Certificate())
+	p.tlsConfig.ServerTLSConfig.RootCAs = pool
+}
+
+// admin serves the proxy's admin API on a local listener until the test
+// ends. The proxy needs -admin for the API's features to be on.
+func (p *testProxy) admin(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(p.adminHandler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// getJSON gets url and decodes its JSON body into v, returning the status.
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// testCAPool returns a pool holding the tests' CA cert.
+func testCAPool() *x509.CertPool {
+	pem, err := os.ReadFile(filepath.Join(testCADir, "ca-cert.pem"))
+	if err != nil {
+		panic(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	return pool
+}
+
+// portOf returns the port a test server listens on.
+func portOf(server *httptest.Server) string {
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	return port
+}
+
+// syncBuffer is a bytes.Buffer safe for the goroutines logging to it.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// captureLog logs at level into the returned buffer until the test ends.
+// The logger is changed in place rather than replaced, as connections of
+// earlier tests may still be logging through it.
+func captureLog(t *testing.T, level int) *syncBuffer {
+	buf := &syncBuffer{}
+	out, saved := logger.Writer(), logger.Level()
+	logger.SetOutput(buf)
+	logger.SetLevel(level)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetLevel(saved)
+	})
+	return buf
+}
+
+// captureStdLog sends what is logged through the standard logger into the
+// returned buffer until the test ends.
+func captureStdLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return buf
+}
+
+// readAll returns the body of resp, failing the test if it can't be read.
+func readAll(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
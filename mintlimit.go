@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errMintRateLimited is returned for handshakes needing a new cert while
+// minting is over the rate limit.
+var errMintRateLimited = errors.New("cert minting over the rate limit")
+
+// how often refused mints are logged at most
+const mintRefusedLogInterval = 10 * time.Second
+
+// mintLimiter is a token bucket capping how many certs are minted per
+// second, so scans with random SNIs can't keep the proxy minting. Up to
+// burst certs are minted at once after a quiet spell. A nil mintLimiter
+// allows everything.
+type mintLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	refused int
+	logged  time.Time
+}
+
+func newMintLimiter(rate float64, burst int) *mintLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &mintLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow reports whether a cert may be minted now, taking a token if so.
+func (l *mintLimiter) allow(name string) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+	l.refused++
+	if now.Sub(l.logged) >= mintRefusedLogInterval {
+		logger.Warnf("refused to mint %d certs over %g per second, the last for %s", l.refused, l.rate, name)
+		l.refused = 0
+		l.logged = now
+	}
+	return false
+}
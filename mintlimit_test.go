@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMintRateLimited(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	hw := newTestHandler(t, "-cert-mint-rate", "0.01", "-cert-mint-burst", "2")
+	for _, name := range []string{"one.test", "two.test"} {
+		if _, err := hw.FakeCertForName(name); err != nil {
+			t.Fatalf("mint for %s within the burst: %s", name, err)
+		}
+	}
+	if _, err := hw.FakeCertForName("three.test"); err != errMintRateLimited {
+		t.Errorf("mint past the burst got %v", err)
+	}
+	// cached certs are still served
+	if _, err := hw.FakeCertForName("one.test"); err != nil {
+		t.Errorf("cached cert refused: %s", err)
+	}
+	if !strings.Contains(logged.String(), "refused to mint 1 certs over 0.01 per second, the last for three.test") {
+		t.Errorf("refusal not logged:\n%s", logged)
+	}
+}
+
+func TestMintRateRefills(t *testing.T) {
+	hw := newTestHandler(t, "-cert-mint-rate", "20", "-cert-mint-burst", "1")
+	hw.FakeCertForName("first.test")
+	if _, err := hw.FakeCertForName("second.test"); err != errMintRateLimited {
+		t.Fatalf("second mint at once got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// a name refused before isn't held against it
+	if _, err := hw.FakeCertForName("second.test"); err != nil {
+		t.Errorf("mint after the bucket refilled: %s", err)
+	}
+}
+
+func TestMintRateLimitsUncached(t *testing.T) {
+	hw := newTestHandler(t, "-no-cert-cache", "-cert-mint-rate", "0.01", "-cert-mint-burst", "1")
+	hw.FakeCertForName("same.test")
+	if _, err := hw.FakeCertForName("same.test"); err != errMintRateLimited {
+		t.Errorf("second mint without a cache got %v", err)
+	}
+}
+
+func TestMintRateFailsHandshake(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-cert-mint-rate", "0.01", "-cert-mint-burst", "1")
+	handshakeThrough(t, p, origin, "allowed.test")
+	conn := tls.Client(p.connect(t, origin.Listener.Addr().String()),
+		&tls.Config{ServerName: "scanned.test", RootCAs: testCAPool()})
+	if err := conn.Handshake(); err == nil {
+		t.Error("handshake needing a cert over the mint rate succeeded")
+	}
+	// the name already minted for still handshakes
+	handshakeThrough(t, p, origin, "allowed.test")
+}
+
+func TestMintLimiterOff(t *testing.T) {
+	var l *mintLimiter
+	if newMintLimiter(0, 5) != nil || !l.allow("any.test") {
+		t.Error("-cert-mint-rate 0 limits minting")
+	}
+}
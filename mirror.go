@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// mirrorManifest is the name of the optional file in a mirror's root that
+// gives the status and headers of mirrored files, keyed by their path
+// relative to the root, e.g. "example.com/index.html".
+const mirrorManifest = "manifest.json"
+
+type mirrorMeta struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+}
+
+// Mirror serves responses from a directory tree holding a copy of sites, one
+// directory per host, as made by wget -m. A directory is served by its
+// index.html.
+type Mirror struct {
+	root     string
+	offline  bool
+	manifest map[string]*mirrorMeta
+}
+
+// NewMirror opens the mirror at root. If offline is true, requests missing
+// from the mirror get 404 instead of going to the network.
+func NewMirror(root string, offline bool) (*Mirror, error) {
+	if fi, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	m := &Mirror{root: root, offline: offline, manifest: make(map[string]*mirrorMeta)}
+	data, err := ioutil.ReadFile(filepath.Join(root, mirrorManifest))
+	if err == nil {
+		err = json.Unmarshal(data, &m.manifest)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read mirror manifest: %s", err)
+	}
+	return m, nil
+}
+
+// Response returns the mirrored response to req, or nil if the request
+// should go to the network.
+func (m *Mirror) Response(req *http.Request) *http.Response {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		hosts := []string{req.Host}
+		if host, _, err := net.SplitHostPort(req.Host); err == nil {
+			hosts = append(hosts, host)
+		}
+		for _, host := range hosts {
+			if resp := m.file(req, host); resp != nil {
+				return resp
+			}
+		}
+	}
+	if m.offline {
+		return syntheticResponse(req, http.StatusNotFound, nil, []byte("Not in the offline mirror\n"))
+	}
+	return nil
+}
+
+func (m *Mirror) file(req *http.Request, host string) *http.Response {
+	// path.Clean of a rooted path can't climb above the host directory
+	name := path.Join(host, path.Clean("/"+req.URL.Path))
+	fi, err := os.Stat(filepath.Join(m.root, filepath.FromSlash(name)))
+	if err == nil && fi.IsDir() {
+		name = path.Join(name, "index.html")
+	}
+	body, err := ioutil.ReadFile(filepath.Join(m.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil
+	}
+
+	status := http.StatusOK
+	header := make(http.Header)
+	if meta := m.manifest[name]; meta != nil {
+		if meta.Status != 0 {
+			status = meta.Status
+		}
+		for k, v := range meta.Header {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	if header.Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		header.Set("Content-Type", contentType)
+	}
+	return syntheticResponse(req, status, header, body)
+}
+
+// syntheticResponse builds a response to req made by the proxy itself.
+func syntheticResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// mirrorDir writes files, keyed by their slash separated path, into a new
+// mirror root and returns it.
+func mirrorDir(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestMirrorServesFiles(t *testing.T) {
+	root := mirrorDir(t, map[string]string{
+		"example.com/index.html":    "<p>home</p>",
+		"example.com/api/data.json": `{"ok":true}`,
+		"example.com/gone":          "moved away",
+		mirrorManifest:              `{"example.com/gone": {"status": 410, "header": {"x-mirrored": ["yes"], "content-type": ["text/plain"]}}}`,
+	})
+	p := newTestProxy(t, "-mirror", root)
+	for _, tc := range []struct {
+		path, body, contentType string
+		status                  int
+	}{
+		{"/", "<p>home</p>", "text/html; charset=utf-8", http.StatusOK},
+		{"/api/data.json", `{"ok":true}`, "application/json", http.StatusOK},
+		{"/gone", "moved away", "text/plain", http.StatusGone},
+	} {
+		resp, err := p.client().Get("http://example.com" + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readAll(t, resp)
+		if resp.StatusCode != tc.status || body != tc.body || resp.Header.Get("Content-Type") != tc.contentType {
+			t.Errorf("%s got %s %q %q, want %d %q %q", tc.path, resp.Status, resp.Header.Get("Content-Type"), body,
+				tc.status, tc.contentType, tc.body)
+		}
+		if tc.path == "/gone" && resp.Header.Get("X-Mirrored") != "yes" {
+			t.Errorf("manifest header missing, got %v", resp.Header)
+		}
+	}
+}
+
+func TestMirrorFallsBackToNetwork(t *testing.T) {
+	var hits atomic.Int32
+	origin := textOrigin(t, "from the network")
+	counted := origin.Config.Handler
+	origin.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		counted.ServeHTTP(w, r)
+	})
+	// the host is mirrored without its port
+	root := mirrorDir(t, map[string]string{"127.0.0.1/mirrored": "from the mirror"})
+	p := newTestProxy(t, "-mirror", root)
+	for path, want := range map[string]string{"/mirrored": "from the mirror", "/elsewhere": "from the network"} {
+		resp, err := p.client().Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); body != want {
+			t.Errorf("%s got %q, want %q", path, body, want)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("origin got %d requests, want only the unmirrored one", hits.Load())
+	}
+}
+
+func TestMirrorOffline(t *testing.T) {
+	root := mirrorDir(t, map[string]string{"example.com/index.html": "home", "secret": "outside any host"})
+	p := newTestProxy(t, "-mirror", root, "-mirror-offline")
+	for _, path := range []string{"/missing", "/../secret"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.URL.Opaque = "//example.com" + path
+		resp, err := p.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); resp.StatusCode != http.StatusNotFound || body == "outside any host" {
+			t.Errorf("%s offline got %s %q, want 404", path, resp.Status, body)
+		}
+	}
+	resp, err := p.client().Post("http://example.com/", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, resp); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("offline POST got %s, want 404", resp.Status)
+	}
+}
+
+func TestMirrorRootChecked(t *testing.T) {
+	file := filepath.Join(mirrorDir(t, map[string]string{"file": ""}), "file")
+	broken := mirrorDir(t, map[string]string{mirrorManifest: "{not json"})
+	for _, root := range []string{filepath.Join(t.TempDir(), "missing"), file, broken} {
+		if err := initError("-mirror", root); err == nil {
+			t.Errorf("-mirror %s accepted", root)
+		}
+	}
+}
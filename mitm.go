@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -11,11 +13,17 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,10 +37,59 @@ type HandlerWrapper struct {
 	issuingCertPem  []byte
 	serverTLSConfig *tls.Config
 	dynamicCerts    *Cache
+	refreshing      map[string]bool
+	certFailures    *certFailures
 	certMutex       sync.Mutex
-	https           bool
+	certLocks       nameLocks
+	mintLimit       *mintLimiter
+	interceptPorts  map[string]bool
+	interceptHosts  []string
+	interceptSNI    *regexp.Regexp
+	noProxy         []string
+	upstreamRules   []*upstreamRule
+	h2Upstream      *h2Upstream
+	exporter        *Exporter
+	self            selfAddrs
+	closeOnce       sync.Once
+	shadow          *url.URL
+	credentials     []*hostCredential
+	rewrites        []*hostRewrite
+	locationRules   []*locationRewrite
+	statusRules     []*statusRewrite
+	bandwidth       []*bandwidthRule
+	breaker         *Breaker
+	pool            *ConnPool
+	inflight        *ByteBudget
+	queue           *RequestQueue
+	httpsUpgrades   []*hostPathRule
+	gzipRequests    []*hostPathRule
+	reverse         *url.URL
+	pipe            *BodyPipe
+	replacer        *BodyReplacer
+	dialer          *net.Dialer
+	history         *History
+	events          *EventHub
+	cookies         *CookieRewriter
+	jar             http.CookieJar
+	landingPage     []byte
+	pacFile         []byte
+	respCache       *ResponseCache
+	mirror          *Mirror
+	recorder        *Recorder
+	tee             *Tee
+	ticketKeys      *ticketKeyRotator
+	redactor        *Redactor
+	filters         []BodyFilter
+	monitor         *Monitor
+	untrusted       *untrustedClients
+	paused          int32
 
 	client *http.Client
+
+	// DialFunc opens the connections to origins and upstream proxies. It
+	// defaults to a net.Dialer set up from MyConfig and can be replaced,
+	// e.g. to route through a custom transport or an in-memory pipe.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 func (hw *HandlerWrapper) GenerateCertForClient() (err error) {
@@ -51,12 +108,15 @@ func (hw *HandlerWrapper) GenerateCertForClient() (err error) {
 	}
 	hw.pkPem = hw.pk.PEMEncoded()
 	hw.issuingCert, err = LoadCertificateFromFile(hw.tlsConfig.CertFile)
-	if err != nil || hw.issuingCert.ExpiresBefore(time.Now().AddDate(0, ONE_MONTH, 0)) {
+	if err != nil || hw.issuingCert.ExpiresBefore(time.Now().AddDate(0, ONE_MONTH, 0)) ||
+		!sameStrings(hw.issuingCert.X509().PermittedDNSDomains, hw.tlsConfig.PermittedDNSDomains) {
 		hw.issuingCert, err = hw.pk.TLSCertificateFor(
 			hw.tlsConfig.Organization,
 			hw.tlsConfig.CommonName,
 			time.Now().AddDate(ONE_YEAR, 0, 0),
 			true,
+			nil,
+			hw.tlsConfig.PermittedDNSDomains,
 			nil)
 		if err != nil {
 			return fmt.Errorf("Unable to generate self-signed issuing certificate: %s", err)
@@ -68,26 +128,149 @@ func (hw *HandlerWrapper) GenerateCertForClient() (err error) {
 }
 
 func (hw *HandlerWrapper) FakeCertForName(name string) (cert *tls.Certificate, err error) {
-	kpCandidateIf, found := hw.dynamicCerts.Get(name)
+	certTTL := hw.tlsConfig.CertTTL
+	if hw.tlsConfig.DisableCertCache {
+		// minting touches no shared state, so no lock is needed
+		if !hw.mintLimit.allow(name) {
+			return nil, errMintRateLimited
+		}
+		return hw.mintCertOnce(name, certTTL)
+	}
+
+	kpCandidateIf, expiration, found := hw.dynamicCerts.GetWithExpiration(name)
 	if found {
+		if time.Until(expiration) < hw.tlsConfig.CertRefresh {
+			go hw.refreshCert(name)
+		}
 		return kpCandidateIf.(*tls.Certificate), nil
 	}
 
-	hw.certMutex.Lock()
-	defer hw.certMutex.Unlock()
+	unlock := hw.certLocks.lock(name)
+	defer unlock()
 	kpCandidateIf, found = hw.dynamicCerts.Get(name)
 	if found {
 		return kpCandidateIf.(*tls.Certificate), nil
 	}
+	if !hw.mintLimit.allow(name) {
+		return nil, errMintRateLimited
+	}
+
+	keyPair, err := hw.mintCertOnce(name, certTTL)
+	if err != nil {
+		return nil, err
+	}
+	hw.cacheCert(name, keyPair)
+	return keyPair, nil
+}
+
+// certExpiryMargin is how long before its cert expires a cached cert is
+// dropped, so handshakes are never handed one that is about to expire.
+const certExpiryMargin = time.Second
+
+// cacheCert caches keyPair for name until shortly before it expires. The
+// cert's own expiry counts rather than the ttl it was minted for, which it
+// falls short of by the time minting took and the rounding to seconds.
+func (hw *HandlerWrapper) cacheCert(name string, keyPair *tls.Certificate) {
+	hw.dynamicCerts.Set(name, keyPair, time.Until(keyPair.Leaf.NotAfter)-certExpiryMargin)
+}
+
+// mintCertOnce mints a cert for name unless minting one recently failed,
+// recording the outcome.
+func (hw *HandlerWrapper) mintCertOnce(name string, certTTL time.Duration) (*tls.Certificate, error) {
+	if err := hw.certFailures.check(name); err != nil {
+		return nil, err
+	}
+	keyPair, err := hw.mintCert(name, certTTL)
+	if err != nil {
+		hw.certFailures.fail(name, err)
+		return nil, err
+	}
+	hw.certFailures.succeed(name)
+	return keyPair, nil
+}
+
+// refreshCert replaces the cached cert for name, which is about to expire,
+// while handshakes keep using the old one. The rate limit, the failures of
+// earlier mints and the name's lock apply as they do to a first mint.
+func (hw *HandlerWrapper) refreshCert(name string) {
+	hw.certMutex.Lock()
+	if hw.refreshing[name] {
+		hw.certMutex.Unlock()
+		return
+	}
+	hw.refreshing[name] = true
+	hw.certMutex.Unlock()
+	defer func() {
+		hw.certMutex.Lock()
+		delete(hw.refreshing, name)
+		hw.certMutex.Unlock()
+	}()
+
+	unlock := hw.certLocks.lock(name)
+	defer unlock()
+	if !hw.mintLimit.allow(name) {
+		// a handshake after this one tries again
+		return
+	}
+	keyPair, err := hw.mintCertOnce(name, hw.tlsConfig.CertTTL)
+	if err != nil {
+		// failures are logged as they are recorded
+		logger.Debugln("Could not refresh mitm cert for", name, "error:", err)
+		return
+	}
+	hw.cacheCert(name, keyPair)
+	logger.Debugln("refreshed mitm cert for", name)
+}
+
+// warmCerts mints and caches certs for hosts ahead of their first handshake,
+// up to runtime.NumCPU() at a time.
+func (hw *HandlerWrapper) warmCerts(hosts []string) {
+	if hw.tlsConfig.DisableCertCache || len(hosts) == 0 {
+		return
+	}
+	start := time.Now()
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(runtime.NumCPU(), len(hosts)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				keyPair, err := hw.mintCert(name, hw.tlsConfig.CertTTL)
+				if err != nil {
+					logger.Warnf("Could not warm up mitm cert for name: %s error: %s", name, err)
+					continue
+				}
+				hw.cacheCert(name, keyPair)
+			}
+		}()
+	}
+	for _, name := range hosts {
+		names <- name
+	}
+	close(names)
+	wg.Wait()
+	logger.Infof("warmed up %d mitm certs in %s", len(hosts), time.Since(start))
+}
+
+// maxCertTTL keeps minted certs, backdated by a month, within the 825 days
+// of validity Apple platforms accept for TLS server certs.
+const maxCertTTL = (825 - 31) * 24 * time.Hour
+
+// mintCert issues a leaf cert for name valid for certTTL.
+func (hw *HandlerWrapper) mintCert(name string, certTTL time.Duration) (*tls.Certificate, error) {
+	if !hw.issuingCert.PermitsDNSName(name) {
+		return nil, fmt.Errorf("%s is not permitted by the CA name constraints", name)
+	}
 
-	//create certificate
-	certTTL := TWO_WEEKS
 	generatedCert, err := hw.pk.TLSCertificateFor(
 		hw.tlsConfig.Organization,
 		name,
 		time.Now().Add(certTTL),
 		false,
-		hw.issuingCert)
+		hw.issuingCert,
+		nil,
+		hw.tlsConfig.LeafExtensions)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to issue certificate: %s", err)
 	}
@@ -95,106 +278,550 @@ func (hw *HandlerWrapper) FakeCertForName(name string) (cert *tls.Certificate, e
 	if err != nil {
 		return nil, fmt.Errorf("Unable to parse keypair for tls: %s", err)
 	}
-
-	cacheTTL := certTTL - ONE_DAY
-	hw.dynamicCerts.Set(name, &keyPair, cacheTTL)
 	return &keyPair, nil
 }
 
-func (hw *HandlerWrapper) DumpHTTPAndHTTPs(resp http.ResponseWriter, req *http.Request) {
-	req.Header.Del("Proxy-Connection")
-	req.Header.Set("Connection", "Keep-Alive")
+// roundTrip sends req to its origin over a new connection, or an idle one
+// from the pool, and reads the response head, recording where the time went
+// into timing. The body is left to be read from the returned connection, an
+// *upstreamConn, which the caller has to close or put back in the pool. The
+// connection is closed early if ctx is done.
+func (hw *HandlerWrapper) roundTrip(ctx context.Context, req *http.Request, timing *Timing, order *headerOrder) (net.Conn, *bufio.Reader, *http.Response, error) {
+	start := time.Now()
+	ctx = traceDial(ctx, timing)
 
-	var reqDump []byte
+	host := hw.routeHost(ctx, req)
+	addr := hw.dialAddr(host)
+	if dst := originalDst(ctx); dst != "" {
+		// a redirected client already picked the address
+		addr = dst
+	}
+	// connections to one origin at different addresses aren't interchangeable
+	key := req.URL.Scheme + "://" + host + " at " + addr
+	var connOut net.Conn
+	var state *tls.ConnectionState
 	var err error
-	ch := make(chan bool)
-	// handle connection
-	go func() {
-		reqDump, err = httputil.DumpRequestOut(req, true)
-		ch <- true
-	}()
-	if err != nil {
-		logger.Println("DumpRequest error ", err)
+	reused := false
+	if hw.pool != nil {
+		if idle := hw.pool.Get(key); idle != nil {
+			connOut, state, reused = idle.Conn, idle.state, true
+			logger.Debugln(transactionID(ctx), "reusing idle connection to", key)
+		}
 	}
-	connIn, _, err := resp.(http.Hijacker).Hijack()
-	if err != nil {
-		logger.Println("hijack error:", err)
+	if connOut == nil {
+		if connOut, state, err = hw.dialUpstream(ctx, req, host, addr, timing); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	// a request without a body can go again if the origin closed an idle
+	// connection just as it was reused
+	retry := func(err error) (net.Conn, *bufio.Reader, *http.Response, error) {
+		connOut.Close()
+		if !reused || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, nil, nil, err
+		}
+		logger.Debugln(transactionID(ctx), "idle connection to", key, "failed, retrying:", err)
+		return hw.roundTrip(ctx, req, timing, order)
 	}
-	defer connIn.Close()
 
-	var respOut *http.Response
-	host := req.Host
+	// drop the origin connection if the exchange is abandoned
+	stop := context.AfterFunc(ctx, func() {
+		connOut.Close()
+	})
 
-	matched, _ := regexp.MatchString(":[0-9]+$", host)
+	if err = req.Write(connOut); err != nil {
+		stop()
+		return retry(fmt.Errorf("send to server error: %s", err))
+	}
 
-	if !hw.https {
-		if !matched {
-			host += ":80"
+	var src io.Reader = connOut
+	if order != nil {
+		src = order.reader(connOut)
+	}
+	outReader := bufio.NewReader(src)
+	if _, err = outReader.Peek(1); err == nil {
+		timing.FirstByte = time.Since(start)
+	}
+	respOut, err := http.ReadResponse(outReader, req)
+	// informational responses come ahead of the final one, the trace in
+	// ctx may pass them on
+	for err == nil && respOut.StatusCode < 200 && respOut.StatusCode != http.StatusSwitchingProtocols {
+		if trace := httptrace.ContextClientTrace(ctx); trace != nil && trace.Got1xxResponse != nil {
+			if err = trace.Got1xxResponse(respOut.StatusCode, textproto.MIMEHeader(respOut.Header)); err != nil {
+				break
+			}
 		}
+		respOut, err = http.ReadResponse(outReader, req)
+	}
+	if err != nil {
+		stop()
+		return retry(fmt.Errorf("read response error: %s", err))
+	}
+	respOut.TLS = state
+	return &upstreamConn{Conn: connOut, key: key, state: state, stop: stop}, outReader, respOut, nil
+}
 
-		connOut, err := net.DialTimeout("tcp", host, time.Second*30)
+// dialUpstream opens a new connection to addr for host, the origin of req,
+// with a TLS handshake for https.
+func (hw *HandlerWrapper) dialUpstream(ctx context.Context, req *http.Request, host, addr string, timing *Timing) (net.Conn, *tls.ConnectionState, error) {
+	if req.URL.Scheme != "https" {
+		connOut, err := hw.DialFunc(ctx, "tcp", addr)
 		if err != nil {
-			logger.Println("dial to", host, "error:", err)
-			return
+			return nil, nil, fmt.Errorf("dial to %s error: %s", addr, err)
 		}
+		return connOut, nil, nil
+	}
 
-		if err = req.Write(connOut); err != nil {
-			logger.Println("send to server error", err)
+	// the handshake keeps the original name for SNI and verification
+	// even when the connection goes to a rewritten address
+	connOut, err := hw.DialFunc(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial to %s error: %s", host, err)
+	}
+	tlsOut, err := handshake(ctx, connOut, host, hw.tlsConfig.UpstreamConfig(host), timing)
+	if err != nil {
+		connOut.Close()
+		return nil, nil, fmt.Errorf("tls handshake with %s error: %w", host, err)
+	}
+	cs := tlsOut.ConnectionState()
+	if certs := peerCerts(&cs); len(certs) > 0 {
+		logger.Debugf("%s %s presented %d certs, leaf %q issued by %q sha256 %s", transactionID(ctx), host,
+			len(certs), certs[0].Subject, certs[0].Issuer, certs[0].SHA256)
+	}
+	connOut = tlsOut
+	if hw.tee != nil {
+		connOut = hw.tee.Wrap(connOut, req.RemoteAddr)
+	}
+	return connOut, &cs, nil
+}
+
+// upstreamDone reports the outcome of a request to the circuit breaker.
+func (hw *HandlerWrapper) upstreamDone(upstream string, ok bool) {
+	if hw.breaker == nil {
+		return
+	} else if ok {
+		hw.breaker.Success(upstream)
+	} else {
+		hw.breaker.Failure(upstream)
+	}
+}
+
+// fetch gets the response to req from its origin. If cred was added to req,
+// a Digest challenge is answered by sending req again with authBody.
+func (hw *HandlerWrapper) fetch(ctx context.Context, req *http.Request, cred *hostCredential, authBody []byte, timing *Timing, order *headerOrder) (net.Conn, *bufio.Reader, *http.Response, error) {
+	connOut, outReader, respOut, err := hw.roundTrip(ctx, req, timing, order)
+	if err != nil || cred == nil || respOut.StatusCode != http.StatusUnauthorized {
+		return connOut, outReader, respOut, err
+	}
+	challenge := digestChallenge(respOut)
+	if challenge == "" {
+		return connOut, outReader, respOut, err
+	}
+	respOut.Body.Close()
+	connOut.Close()
+
+	req.Header.Set("Authorization", cred.digest(req, challenge))
+	req.Body = ioutil.NopCloser(bytes.NewReader(authBody))
+	return hw.roundTrip(ctx, req, timing, order)
+}
+
+func (hw *HandlerWrapper) DumpHTTPAndHTTPs(resp http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if req.URL.Scheme == "http" && matchHostPath(hw.httpsUpgrades, req) {
+		hw.upgradeToHTTPS(resp, req)
+		return
+	}
+	id := newTransactionID()
+	// the slot is freed once the exchange is done, before the connection
+	// goes on to serve more requests or to be relayed
+	holdsSlot := false
+	releaseSlot := func() {
+		if holdsSlot {
+			holdsSlot = false
+			hw.queue.Release()
+		}
+	}
+	if hw.queue != nil {
+		if !hw.queue.Acquire(req.Context(), hw.queue.High(req), *hw.MyConfig.QueueWait) {
+			logger.Warnln(id, "all", *hw.MyConfig.MaxConcurrent, "request slots taken with", hw.queue.Waiting(), "waiting, refusing", req.URL)
+			resp.Header().Set("Retry-After", "1")
+			respError(resp, http.StatusServiceUnavailable, "Too many requests through the proxy")
 			return
 		}
-
-		respOut, err = http.ReadResponse(bufio.NewReader(connOut), req)
-		if err != nil && err != io.EOF {
-			logger.Println("read response error:", err)
+		holdsSlot = true
+		defer releaseSlot()
+	}
+	if hw.inflight != nil && !hw.inflight.Admit(req.Context(), *hw.MyConfig.InflightWait) {
+		logger.Warnln(id, "over", *hw.MyConfig.MaxInflight, "bytes in flight, refusing", req.URL)
+		resp.Header().Set("Retry-After", "1")
+		respError(resp, http.StatusServiceUnavailable, "Too many bytes in flight through the proxy")
+		return
+	}
+	// what the transaction buffers counts against -max-inflight until it
+	// is done
+	lease := hw.inflight.lease()
+	defer lease.release()
+	// the server's body reader, unless the body gets buffered, is replaced
+	// once the connection is hijacked
+	serverBody := req.Body
+	upstream := hostWithPort(req.Host, hw.defaultPort(req.URL.Scheme))
+	// answer from the mirror or a fresh cache entry without the origin
+	var local *http.Response
+	if hw.mirror != nil {
+		local = hw.mirror.Response(req)
+	}
+	var cached *cacheEntry
+	if local == nil && hw.respCache != nil {
+		var fresh bool
+		if cached, fresh = hw.respCache.Lookup(req); fresh {
+			logger.Debugln(id, "serving", req.URL, "from cache")
+			local = cached.response(req)
+		}
+	}
+	if local == nil && hw.breaker != nil && !hw.breaker.Allow(upstream) {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(hw.breaker.cooldown.Seconds())))
+		msg := fmt.Sprintf("Upstream %s is failing, circuit breaker open", upstream)
+		respError(resp, http.StatusServiceUnavailable, msg)
+		return
+	}
+	hw.events.start(id, start, req)
+	var t *Transaction
+	// published before the connection goes on to serve more requests or
+	// to be relayed, either can take much longer than the transaction
+	finished := false
+	finish := func() {
+		if !finished {
+			finished = true
+			hw.events.finish(id, start, req, t)
 		}
+	}
+	defer finish()
 
+	req.Header.Del("Proxy-Connection")
+	hw.addVia(req.Header, req.ProtoMajor, req.ProtoMinor)
+	if *hw.MyConfig.TransactionHeader != "" {
+		req.Header.Set(*hw.MyConfig.TransactionHeader, id)
+	}
+	closeClient := req.Close || !*hw.MyConfig.KeepAlive
+	if isUpgradeRequest(req) {
+		// keep Connection: Upgrade, the connection is spliced afterwards
+		closeClient = true
+	} else if closeClient {
+		req.Header.Set("Connection", "close")
 	} else {
-		if !matched {
-			host += ":443"
+		req.Header.Set("Connection", "Keep-Alive")
+	}
+
+	// the shadow gets the request as the client sent it, before jar
+	// cookies or credentials for the origin are added
+	var shadowResult <-chan *capturedResponse
+	if hw.shadow != nil {
+		body, err := readBody(req)
+		if err != nil {
+			logger.Warnln(id, "read request body error:", err)
+		} else {
+			lease.add(len(body))
+			shadowResult = hw.shadowRequest(req, body)
 		}
+	}
 
-		connOut, err := tls.Dial("tcp", host, hw.tlsConfig.ServerTLSConfig)
+	if hw.jar != nil {
+		addJarCookies(hw.jar, req)
+	}
+	if hw.pipe != nil {
+		hw.pipe.Request(req)
+	}
+	if matchHostPath(hw.gzipRequests, req) {
+		n, err := compressRequest(req, *hw.MyConfig.GzipRequestsMin, *hw.MyConfig.GzipRequestsMax)
+		lease.add(n)
+		if err != nil {
+			logger.Warnln(id, "read request body to compress error:", err)
+		}
+	}
 
+	// buffer the body of requests we add credentials to, so they can be
+	// sent again to answer a digest challenge
+	var cred *hostCredential
+	var authBody []byte
+	if *hw.MyConfig.LogAuth {
+		logAuthAttempt(id, req, "client")
+	}
+	doh := *hw.MyConfig.LogDoH && isDoHRequest(req)
+	if doh {
+		logDoHQuery(id, req)
+	}
+	if req.Header.Get("Authorization") == "" {
+		if cred = hw.credentialFor(req.Host); cred != nil {
+			var err error
+			if authBody, err = readBody(req); err != nil {
+				logger.Warnln(id, "read request body error:", err)
+			}
+			lease.add(len(authBody))
+			req.Header.Set("Authorization", cred.basic())
+			if *hw.MyConfig.LogAuth {
+				logAuthAttempt(id, req, "proxy")
+			}
+		}
+	}
+
+	reqDump := dumpRequestHead(req)
+	connIn, bufrw, err := hijack(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
+		respBadGateway(resp, msg)
+		return
+	}
+	if req.Body == serverBody {
+		req.Body = hijackedBody(req, connIn, bufrw.Reader)
+	}
+	// the body streams to the origin and is captured on the way, up to
+	// maxDumpBody, instead of being buffered whole for the dump
+	var reqBody *bodyCapture
+	if req.ContentLength != 0 && hw.captureBody(req) {
+		reqBody = &bodyCapture{ReadCloser: req.Body, max: maxDumpBody, lease: lease}
+		req.Body = reqBody
+	}
+	// abandon the exchange with the origin if the client goes away. A body
+	// is read from the client connection too, so watch once it is sent.
+	ctx, cancel := context.WithCancel(withTransactionID(req.Context(), id))
+	defer cancel()
+	if *hw.MyConfig.Relay1xx && req.ProtoAtLeast(1, 1) {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusContinue {
+					// continueReader already told the client to go on
+					return nil
+				}
+				logger.Debugln(id, "relaying", code, "from", req.URL)
+				return writeInformational(connIn, code, http.Header(header))
+			},
+		})
+	}
+	stopWatching := func() {}
+	if req.ContentLength == 0 {
+		stopWatching = watchClient(connIn, bufrw.Reader, cancel)
+	}
+	defer func() {
+		stopWatching()
+		// the connection may go on to serve more requests, this one is done
+		// with what it buffered
+		lease.release()
+		releaseSlot()
+		finish()
+		if !closeClient {
+			// a body the origin wasn't sent still precedes the next request
+			if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+				closeClient = true
+			}
+		}
+		if closeClient {
+			connIn.Close()
+		} else {
+			hw.keepServing(connIn, bufrw.Reader, interceptedFrom(req.Context()))
+		}
+	}()
+
+	var connOut net.Conn
+	var outReader *bufio.Reader
+	var respOut *http.Response
+	var poolable bool
+	var timing *Timing
+	var order *headerOrder
+	var capped *responseCap
+	if local != nil {
+		respOut = local
+	} else {
+		revalidating := cached != nil && cached.addConditions(req)
+		timing = &Timing{}
+		if *hw.MyConfig.HeaderOrder {
+			order = &headerOrder{}
+		}
+		connOut, outReader, respOut, err = hw.fetch(ctx, req, cred, authBody, timing, order)
 		if err != nil {
-			logger.Panicln("tls dial to", host, "error:", err)
+			closeClient = true
+			writeError(connIn, http.StatusBadGateway, hw.upstreamErrorMessage(err))
+			hw.upstreamDone(upstream, false)
 			return
 		}
-		if err = req.Write(connOut); err != nil {
-			logger.Println("send to server error", err)
-			return
+		if req.ContentLength != 0 {
+			stopWatching = watchClient(connIn, bufrw.Reader, cancel)
+		}
+		// the connection can take another request once the response is
+		// read to the end, unless either side asked for it to be closed
+		poolable = hw.pool != nil && hw.tee == nil && !closeClient && !respOut.Close &&
+			respOut.StatusCode != http.StatusSwitchingProtocols && !closeDelimited(respOut, req)
+		defer func() {
+			if pooled, ok := connOut.(*upstreamConn); ok && poolable && pooled.stop() {
+				hw.pool.Put(pooled)
+			} else {
+				connOut.Close()
+			}
+		}()
+		hw.upstreamDone(upstream, respOut.StatusCode < 500)
+		if hw.jar != nil {
+			hw.jar.SetCookies(jarURL(req), respOut.Cookies())
+		}
+		if *hw.MyConfig.MaxResponse > 0 {
+			capped, err = capResponse(respOut, req.URL.String(), *hw.MyConfig.MaxResponse, *hw.MyConfig.MaxResponseAction == "truncate")
+			if err != nil {
+				logger.Warnln(id, "rejecting response from", req.URL, "of", respOut.ContentLength, "bytes")
+				poolable = false
+				closeClient = true
+				writeError(connIn, http.StatusBadGateway, fmt.Sprintf("Response from %s is over the %d bytes allowed", req.Host, *hw.MyConfig.MaxResponse))
+				return
+			}
 		}
 
-		respOut, err = http.ReadResponse(bufio.NewReader(connOut), req)
-		if err != nil && err != io.EOF {
-			logger.Println("read response error:", err)
+		if revalidating && respOut.StatusCode == http.StatusNotModified {
+			respOut.Body.Close()
+			respOut = hw.respCache.Revalidated(cached, respOut, req)
+		} else if hw.respCache != nil {
+			hw.respCache.Store(req, respOut)
 		}
+	}
 
+	if *hw.MyConfig.LogAuth {
+		logAuthChallenge(id, req, respOut)
+	}
+	if doh {
+		logDoHAnswer(id, req, respOut)
+	}
+	hw.rewriteStatus(req, respOut)
+	if hw.pipe != nil {
+		hw.pipe.Response(req, respOut)
+	}
+	if hw.replacer != nil {
+		hw.replacer.Response(req, respOut)
+	}
+	if *hw.MyConfig.Compress {
+		if err = compressResponse(respOut, req); err != nil {
+			logger.Debugln(id, "compress response error:", err)
+		}
 	}
 
-	if respOut == nil {
-		log.Println("respOut is nil")
-		return
+	if hw.cookies != nil {
+		hw.cookies.Rewrite(respOut.Header)
+	}
+	hw.rewriteLocation(req, respOut)
+	hw.addVia(respOut.Header, respOut.ProtoMajor, respOut.ProtoMinor)
+	if *hw.MyConfig.TransactionHeader != "" {
+		respOut.Header.Set(*hw.MyConfig.TransactionHeader, id)
 	}
 
-	respDump, err := httputil.DumpResponse(respOut, true)
-	if err != nil {
-		logger.Println("respDump error:", err)
+	upgraded := respOut.StatusCode == http.StatusSwitchingProtocols
+	if !upgraded {
+		// a body delimited by the origin closing the connection is passed on
+		// the same way, or as chunks so an HTTP/1.1 client can keep its
+		// connection
+		if closeDelimited(respOut, req) {
+			if *hw.MyConfig.Rechunk && req.ProtoAtLeast(1, 1) {
+				respOut.ProtoMajor, respOut.ProtoMinor = 1, 1
+				respOut.TransferEncoding = []string{"chunked"}
+			} else {
+				closeClient = true
+			}
+		}
+		respOut.Close = closeClient
+		if closeClient {
+			respOut.Header.Set("Connection", "close")
+		} else {
+			respOut.Header.Del("Connection")
+		}
 	}
 
-	_, err = connIn.Write(respDump)
-	if err != nil {
-		logger.Println("connIn write error:", err)
+	var respDump []byte
+	var out io.Writer = connIn
+	if *hw.MyConfig.FragmentSize > 0 {
+		out = &fragmentWriter{ctx: ctx, w: connIn, size: *hw.MyConfig.FragmentSize, delay: *hw.MyConfig.FragmentDelay}
+	}
+	if rate := hw.bandwidthFor(req); rate > 0 {
+		out = &pacedWriter{ctx: ctx, w: out, rate: rate}
 	}
+	if order != nil {
+		out = order.writer(out)
+	}
+	written := &countingWriter{w: out}
+	if hw.captureBody(req) {
+		respDump, err = httputil.DumpResponse(respOut, true)
+		if errors.Is(err, errResponseTooLarge) {
+			// nothing was sent yet, the client can still get a 502
+			logger.Warnln(id, "rejecting response from", req.URL, "over", *hw.MyConfig.MaxResponse, "bytes")
+			poolable = false
+			closeClient = true
+			writeError(connIn, http.StatusBadGateway, fmt.Sprintf("Response from %s is over the %d bytes allowed", req.Host, *hw.MyConfig.MaxResponse))
+			return
+		}
+		if err != nil {
+			logger.Debugln(id, "respDump error:", err)
+		}
+		lease.add(len(respDump))
 
-	hw.filter(respOut, req)
+		_, err = written.Write(respDump)
+	} else {
+		// nothing needs the body, stream it without buffering
+		err = respOut.Write(written)
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		// the head is out, all that can be done is to cut the response off
+		logger.Warnln(id, "aborting response from", req.URL, "over", *hw.MyConfig.MaxResponse, "bytes")
+		closeClient = true
+	} else if err != nil {
+		logger.Debugln(id, "connIn write error:", err)
+	}
+	if err != nil || outReader != nil && outReader.Buffered() > 0 || capped != nil && capped.over {
+		poolable = false
+	}
+
+	hw.runFilters(req, respDump, respOut.TLS)
+
+	if timing != nil {
+		logger.Debugf("%s %s %s dns=%s connect=%s tls=%s ttfb=%s total=%s", id, req.Method, req.URL,
+			timing.DNS, timing.Connect, timing.TLS, timing.FirstByte, time.Since(start))
+	}
 
-	if *hw.MyConfig.Monitor {
-		<-ch
-		go httpDump(reqDump, respOut)
+	requestSize := int64(len(reqDump))
+	if reqBody != nil {
+		if isChunked(req.TransferEncoding) {
+			// the captured body is decoded, so the dump gets its length
+			// in place of the chunked framing
+			reqDump = bytes.Replace(reqDump, []byte("Transfer-Encoding: chunked\r\n"),
+				[]byte(fmt.Sprintf("Content-Length: %d\r\n", reqBody.buf.Len())), 1)
+		}
+		reqDump = append(reqDump, reqBody.buf.Bytes()...)
+		requestSize += reqBody.n
+	}
+	t = newTransaction(start, req, reqDump, respOut, respDump)
+	t.ID = id
+	t.RequestSize = requestSize
+	t.ResponseSize = written.n
+	t.Timing = timing
+	if shadowResult != nil && *hw.MyConfig.ShadowDiff {
+		// the transaction is recorded with its diff once the shadow answers
+		go func() {
+			hw.diffShadow(t, req, respDump, <-shadowResult)
+			hw.record(t)
+		}()
 	} else {
-		<-ch
+		hw.record(t)
+	}
+	if hw.monitor != nil {
+		hw.monitor.Dump(req.URL.String(), reqDump, respOut)
 	}
 
+	if upgraded {
+		// the relay outlives the request, whose context the server cancels
+		// when the client watch's read is cut short
+		if pooled, ok := connOut.(*upstreamConn); ok && !pooled.stop() {
+			return
+		}
+		stopWatching()
+		// the relay can outlast the exchange by hours, what it buffered is
+		// done with
+		lease.release()
+		releaseSlot()
+		finish()
+		relayUpgraded(connIn, bufrw.Reader, connOut, outReader, req.URL.String(), *hw.MyConfig.WebSocketLog, *hw.MyConfig.TunnelLinger)
+	}
 }
 
 type RealTbkSetCookieReq struct {
@@ -217,210 +844,891 @@ type ServerReturnRsp struct {
 	OK bool `json:"ok"`
 }
 
-func (hw *HandlerWrapper) filter(resp *http.Response, req *http.Request) {
-	//if strings.Contains(req.RequestURI, "pub.alimama.com/common/code/getAuctionCode.json") {
-	if strings.Contains(req.RequestURI, "http://pub.alimama.com/common/getUnionPubContextInfo.json") {
-		servRspBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Println("server response read body error:", err)
-			return
-		}
-		fmt.Println("*-* server response:", string(servRspBody))
-		var srvRsp ServerReturnRsp
-		err = json.Unmarshal(servRspBody, &srvRsp)
-		if err != nil {
-			log.Println("response body:", string(servRspBody))
-			log.Println("Unmarshal server return http response error:", err)
-			return
-		}
+// record passes t, redacted, on to the exporter, the recorder and the
+// history.
+func (hw *HandlerWrapper) record(t *Transaction) {
+	hw.redactor.Transaction(t)
+	if hw.exporter != nil {
+		hw.exporter.Export(t)
+	}
+	if hw.recorder != nil {
+		hw.recorder.Record(t)
+	}
+	if hw.history != nil {
+		hw.history.Add(t)
+	}
+}
 
-		u := "http://tym.taoyumin.cn/index.php?r=search/setdata"
-		request := &RealTbkSetCookieReq{
-			Cookies: strings.Join(req.Header["Cookie"], ";"),
-			//TbToken:  req.Form.Get("_tb_token_"),
-			//Siteid:   req.Form.Get("siteid"),
-			//Adzoneid: req.Form.Get("adzoneid"),
-			MemberId: srvRsp.D.MemberId,
-		}
-		fmt.Println("**--** set cookie memberid:", request.MemberId, "cookie:", request.Cookies)
-		body, err := json.Marshal(request)
-		if err != nil {
-			log.Println("Marshal error:", err)
-			return
-		}
-		httpReq, err := http.NewRequest("POST", u, strings.NewReader(string(body)))
-		if err != nil {
-			log.Println("new http request error:", err)
-			return
-		}
-		httpReq.Header.Set("Content-Type", "application/json")
+// diffShadow records in t how the shadow's response differs from the
+// primary one in respDump.
+func (hw *HandlerWrapper) diffShadow(t *Transaction, req *http.Request, respDump []byte, shadow *capturedResponse) {
+	if shadow == nil {
+		return
+	}
+	primary, err := parseCapturedResponse(respDump, req)
+	if err != nil {
+		logger.Warnln("parse primary response for diff error:", err)
+		return
+	}
+	t.ShadowDiff = diffResponses(primary, shadow)
+	if len(t.ShadowDiff) > 0 {
+		log.Printf("shadow response differs for %s:\n\t%s", req.URL, strings.Join(t.ShadowDiff, "\n\t"))
+	}
+}
 
-		rsp, err := hw.client.Do(httpReq)
-		defer func() {
-			if rsp != nil {
-				rsp.Body.Close()
-			}
-		}()
-		if err != nil {
-			log.Println("do http request error:", err)
-			return
-		}
-		rspBody, err := ioutil.ReadAll(rsp.Body)
-		if err != nil {
-			log.Println("response read body error:", err)
-			return
+// captureBody reports whether the response body has to be buffered for
+// monitoring, exporting, recording, diffing or filtering instead of being
+// streamed to the client.
+func (hw *HandlerWrapper) captureBody(req *http.Request) bool {
+	return *hw.MyConfig.Monitor || hw.exporter != nil || hw.recorder != nil ||
+		(hw.shadow != nil && *hw.MyConfig.ShadowDiff) || len(hw.filtersFor(req)) > 0
+}
+
+// alimamaFilter reports the member id from alimama's union context info to
+// the cookie collector, along with the cookies the client sent.
+type alimamaFilter struct {
+	client *http.Client
+}
+
+func (f *alimamaFilter) Match(req *http.Request) bool {
+	//return strings.Contains(req.RequestURI, "pub.alimama.com/common/code/getAuctionCode.json")
+	return strings.Contains(req.RequestURI, "http://pub.alimama.com/common/getUnionPubContextInfo.json")
+}
+
+func (f *alimamaFilter) Filter(req *http.Request, resp *capturedResponse) {
+	servRspBody := resp.body
+	fmt.Println("*-* server response:", string(servRspBody))
+	var srvRsp ServerReturnRsp
+	err := json.Unmarshal(servRspBody, &srvRsp)
+	if err != nil {
+		log.Println("response body:", string(servRspBody))
+		log.Println("Unmarshal server return http response error:", err)
+		return
+	}
+
+	u := "http://tym.taoyumin.cn/index.php?r=search/setdata"
+	request := &RealTbkSetCookieReq{
+		Cookies: strings.Join(req.Header["Cookie"], ";"),
+		//TbToken:  req.Form.Get("_tb_token_"),
+		//Siteid:   req.Form.Get("siteid"),
+		//Adzoneid: req.Form.Get("adzoneid"),
+		MemberId: srvRsp.D.MemberId,
+	}
+	fmt.Println("**--** set cookie memberid:", request.MemberId, "cookie:", request.Cookies)
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Println("Marshal error:", err)
+		return
+	}
+	httpReq, err := http.NewRequest("POST", u, strings.NewReader(string(body)))
+	if err != nil {
+		log.Println("new http request error:", err)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	rsp, err := f.client.Do(httpReq)
+	defer func() {
+		if rsp != nil {
+			rsp.Body.Close()
 		}
+	}()
+	if err != nil {
+		log.Println("do http request error:", err)
+		return
+	}
+	rspBody, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		log.Println("response read body error:", err)
+		return
+	}
 
-		var response RealTbkSetCookieRsp
-		err = json.Unmarshal(rspBody, &response)
-		if err != nil {
-			log.Println("response body:", string(rspBody))
-			log.Println("Unmarshal http response error:", err)
+	var response RealTbkSetCookieRsp
+	err = json.Unmarshal(rspBody, &response)
+	if err != nil {
+		log.Println("response body:", string(rspBody))
+		log.Println("Unmarshal http response error:", err)
+		return
+	}
+	if response.State == 1000 {
+		fmt.Println("*--* URI:", req.RequestURI)
+		fmt.Println("*---* set cookies success. cookie req:", string(body), time.Now().String())
+		return
+	} else {
+		fmt.Println(response.State, "error msg:", response.Msg, time.Now().String())
+	}
+}
+
+func (hw *HandlerWrapper) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if hw.tooManyHeaders(req) {
+		respError(resp, http.StatusRequestHeaderFieldsTooLarge, "Too many request header fields")
+		return
+	}
+	if rejectAmbiguous(resp, req) {
+		return
+	}
+
+	if isDirectRequest(req) {
+		hw.ServeDirect(resp, req)
+		return
+	}
+	if hw.wantsInterstitial(req) {
+		hw.ServeInterstitial(resp, req)
+		return
+	}
+	if req.Method == "CONNECT" {
+		if err := checkAuthority(req.Host); err != nil {
+			respError(resp, http.StatusBadRequest, fmt.Sprintf("Malformed CONNECT target %q: %s", req.Host, err))
 			return
 		}
-		if response.State == 1000 {
-			fmt.Println("*--* URI:", req.RequestURI)
-			fmt.Println("*---* set cookies success. cookie req:", string(body), time.Now().String())
+	} else if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		// e.g. ftp:// urls, which would otherwise be sent to port 80
+		respError(resp, http.StatusNotImplemented, fmt.Sprintf("Scheme %q is not supported, only http and https are proxied", req.URL.Scheme))
+		return
+	}
+
+	raddr := hw.upstreamProxy(req)
+	target := raddr
+	if len(target) == 0 {
+		target = hw.dialAddr(hw.requestAddr(req))
+	}
+	if hw.isProxyAddr(req.Context(), target) {
+		if req.Method == "GET" && req.URL.Path == caPath {
+			// the interstitial links to the CA through the proxy itself
+			hw.ServeDirect(resp, req)
 			return
-		} else {
-			fmt.Println(response.State, "error msg:", response.Msg, time.Now().String())
 		}
+		msg := fmt.Sprintf("Refusing to proxy %s to the proxy itself: loop detected", target)
+		respError(resp, http.StatusLoopDetected, msg)
+		return
+	}
+	if hw.viaLoop(req) {
+		respError(resp, http.StatusLoopDetected, "Request already passed through this proxy: loop detected")
+		return
 	}
-}
-
-func (hw *HandlerWrapper) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 
-	raddr := *hw.MyConfig.Raddr
+	if req.Method == "CONNECT" && req.ProtoMajor == 2 {
+		// the tunnel is carried by the stream, there is no connection to hijack
+		hw.ServeH2Connect(resp, req, raddr)
+		return
+	}
 	if len(raddr) != 0 {
 		hw.Forward(resp, req, raddr)
+	} else if atomic.LoadInt32(&hw.paused) == 1 {
+		if req.Method == "CONNECT" {
+			hw.Tunnel(resp, req)
+		} else {
+			hw.Relay(resp, req)
+		}
 	} else {
 		if req.Method == "CONNECT" {
-			hw.https = true
+			if !hw.interceptPorts[hw.connectPort(req.Host)] {
+				hw.Tunnel(resp, req)
+				return
+			}
 			hw.InterceptHTTPs(resp, req)
 		} else {
-			hw.https = false
 			hw.DumpHTTPAndHTTPs(resp, req)
 		}
 	}
 }
 
 func (hw *HandlerWrapper) InterceptHTTPs(resp http.ResponseWriter, req *http.Request) {
-	addr := req.Host
-	host := strings.Split(addr, ":")[0]
-
-	cert, err := hw.FakeCertForName(host)
+	host, _, err := net.SplitHostPort(req.Host)
 	if err != nil {
-		msg := fmt.Sprintf("Could not get mitm cert for name: %s\nerror: %s", host, err)
-		respBadGateway(resp, msg)
+		host = req.Host
+	}
+	if !hw.interceptsHost(host) {
+		hw.Tunnel(resp, req)
 		return
 	}
 
 	// handle connection
-	connIn, _, err := resp.(http.Hijacker).Hijack()
+	connIn, _, err := hijack(resp)
 	if err != nil {
 		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
 		respBadGateway(resp, msg)
 		return
 	}
+	tlsConfig := hw.interceptConfig(host)
+	if hw.interceptSNI != nil {
+		go hw.interceptBySNI(connIn, req, host, tlsConfig)
+	} else {
+		go hw.serveTLS(tls.Server(connIn, tlsConfig), host, req.Host)
+	}
+
+	connIn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+}
+
+// interceptConfig returns the TLS config for a client connection to host
+// being intercepted, minting its cert for the server name the client asks
+// for, host if none.
+func (hw *HandlerWrapper) interceptConfig(host string) *tls.Config {
 	tlsConfig := copyTlsConfig(hw.tlsConfig.ServerTLSConfig)
-	tlsConfig.Certificates = []tls.Certificate{*cert}
-	tlsConnIn := tls.Server(connIn, tlsConfig)
-	listener := &mitmListener{tlsConnIn}
-	handler := http.HandlerFunc(func(resp2 http.ResponseWriter, req2 *http.Request) {
-		req2.URL.Scheme = "https"
-		req2.URL.Host = req2.Host
-		hw.DumpHTTPAndHTTPs(resp2, req2)
+	if hw.tlsConfig.ForceHTTP1 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	// mint the cert during the handshake, once the real SNI is known
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := hello.ServerName
+		if name == "" {
+			name = host
+		}
+		// failures are logged as they are recorded
+		return hw.FakeCertForName(name)
+	}
+	if len(hw.tlsConfig.ClientAuth) > 0 {
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return hw.tlsConfig.clientAuthConfig(tlsConfig, name), nil
+		}
+	}
+	return tlsConfig
+}
 
-	})
+// interceptsHost reports whether CONNECTs to host are decrypted. Without an
+// allowlist all hosts are.
+func (hw *HandlerWrapper) interceptsHost(host string) bool {
+	if len(hw.interceptHosts) == 0 {
+		return true
+	}
+	for _, pattern := range hw.interceptHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
 
+// serveIntercepted proxies a request decrypted from an intercepted CONNECT,
+// or sent in the clear on a connection redirected to -transparent.
+func (hw *HandlerWrapper) serveIntercepted(resp http.ResponseWriter, req *http.Request) {
+	if hw.tooManyHeaders(req) {
+		respError(resp, http.StatusRequestHeaderFieldsTooLarge, "Too many request header fields")
+		return
+	}
+	if rejectAmbiguous(resp, req) {
+		return
+	}
+	if hw.viaLoop(req) {
+		respError(resp, http.StatusLoopDetected, "Request already passed through this proxy: loop detected")
+		return
+	}
+	req.URL.Scheme = "https"
+	if req.TLS == nil {
+		req.URL.Scheme = "http"
+	}
+	req.URL.Host = req.Host
+	hw.DumpHTTPAndHTTPs(resp, req)
+}
+
+// keepServing hands a hijacked client connection back to an http server so
+// further requests sent on it are proxied as well. br holds any bytes the
+// client already sent past the previous request. ic is the intercepted
+// connection it was decrypted from, nil for plain http.
+func (hw *HandlerWrapper) keepServing(conn net.Conn, br *bufio.Reader, ic *interceptedConn) {
+	if br != nil && br.Buffered() > 0 {
+		conn = &bufferedConn{conn, br}
+	}
+	if state := reverseState(conn); state != nil {
+		hw.serveConn(conn, hw.reverseHandler(*state))
+	} else if ic != nil {
+		hw.serveConn(conn, hw.interceptedHandler(ic))
+	} else if redirectedDst(conn) != "" {
+		hw.serveConn(conn, http.HandlerFunc(hw.serveTransparent))
+	} else {
+		hw.serveConn(conn, hw)
+	}
+}
+
+// watchClient calls cancel if the client closes conn while the origin is
+// still working on its request, so an abandoned request stops holding the
+// origin connection. The returned stop ends the watch, leaving anything the
+// client already sent buffered in br.
+func watchClient(conn net.Conn, br *bufio.Reader, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
 	go func() {
-		err = http.Serve(listener, handler)
-		if err != nil && err != io.EOF {
-			logger.Printf("Error serving mitm'ed connection: %s", err)
+		defer close(done)
+		if _, err := br.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			logger.Debugln("client went away:", err)
+			cancel()
 		}
 	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// wake the pending peek without losing what it may read
+			conn.SetReadDeadline(time.Unix(1, 0))
+			<-done
+			conn.SetReadDeadline(time.Time{})
+		})
+	}
+}
 
-	connIn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+// serveConn serves http requests arriving on a single connection.
+func (hw *HandlerWrapper) serveConn(conn net.Conn, handler http.Handler) {
+	// every request hands the connection to a fresh server, which only times
+	// out the header, so wait out the idle time between requests here
+	if idle := *hw.MyConfig.ClientIdle; idle > 0 {
+		br := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(idle))
+		if _, err := br.Peek(1); err != nil {
+			logger.Debugln("closing idle client connection:", err)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn = &bufferedConn{conn, br}
+	}
+	server := &http.Server{Handler: handler, MaxHeaderBytes: *hw.MyConfig.MaxHeaderBytes,
+		ReadHeaderTimeout: *hw.MyConfig.HeaderTimeout, IdleTimeout: *hw.MyConfig.ClientIdle,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if dst := redirectedDst(c); dst != "" {
+				ctx = withOriginalDst(ctx, dst)
+			}
+			return withFramingTap(ctx, c)
+		}}
+	err := server.Serve(&mitmListener{newFramingTap(conn, *hw.MyConfig.MaxHeaderBytes)})
+	if err != nil && err != io.EOF {
+		logger.Debugf("Error serving mitm'ed connection: %s", err)
+	}
 }
 
-func (hw *HandlerWrapper) Forward(resp http.ResponseWriter, req *http.Request, raddr string) {
-	connIn, _, err := resp.(http.Hijacker).Hijack()
-	connOut, err := net.Dial("tcp", raddr)
+// closeDelimited reports whether the body of resp ends only when the origin
+// closes the connection.
+func closeDelimited(resp *http.Response, req *http.Request) bool {
+	if req.Method == "HEAD" || resp.StatusCode/100 == 1 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return resp.ContentLength == -1 && len(resp.TransferEncoding) == 0
+}
+
+// Tunnel connects the client straight to the CONNECT target without
+// decrypting anything.
+func (hw *HandlerWrapper) Tunnel(resp http.ResponseWriter, req *http.Request) {
+	addr := hw.dialAddr(hostWithPort(req.Host, hw.defaultPort("https")))
+	connOut, err := hw.DialFunc(req.Context(), "tcp", addr)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to dial %s: %s", addr, err)
+		respBadGateway(resp, msg)
+		return
+	}
+	defer connOut.Close()
+
+	connIn, _, err := hijack(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
+		respBadGateway(resp, msg)
+		return
+	}
+	defer connIn.Close()
+
+	b := []byte("HTTP/1.1 200 Connection Established\r\n" +
+		"Proxy-Agent: gomitmproxy/" + Version + "\r\n\r\n")
+	if _, err = connIn.Write(b); err != nil {
+		logger.Debugln("Write Connect err:", err)
+		return
+	}
+	if err = Transport(connIn, connOut, *hw.MyConfig.TunnelLinger); err != nil {
+		logger.Debugln("tunnel", req.Host, "error:", err)
+	}
+}
+
+// Relay passes a plain http request to its origin and the response back
+// without inspecting or changing either. The client connection is closed
+// afterwards, as it is spliced to that one origin.
+func (hw *HandlerWrapper) Relay(resp http.ResponseWriter, req *http.Request) {
+	addr := hw.dialAddr(hostWithPort(req.Host, hw.defaultPort("http")))
+	connOut, err := hw.DialFunc(req.Context(), "tcp", addr)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to dial %s: %s", addr, err)
+		respBadGateway(resp, msg)
+		return
+	}
+	defer connOut.Close()
+
+	connIn, bufrw, err := hijack(resp)
 	if err != nil {
-		logger.Println("dial tcp error", err)
+		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
+		respBadGateway(resp, msg)
+		return
+	}
+	defer connIn.Close()
+	req.Body = hijackedBody(req, connIn, bufrw.Reader)
+
+	req.Header.Del("Proxy-Connection")
+	if !isUpgradeRequest(req) {
+		req.Header.Set("Connection", "close")
+	}
+	if err = req.Write(connOut); err != nil {
+		logger.Debugln("send to server err", err)
+		return
+	}
+	if bufrw.Reader.Buffered() > 0 {
+		connIn = &bufferedConn{connIn, bufrw.Reader}
+	}
+	if err = Transport(connIn, connOut, *hw.MyConfig.TunnelLinger); err != nil {
+		logger.Debugln("relay", req.Host, "error:", err)
+	}
+}
+
+func (hw *HandlerWrapper) Forward(resp http.ResponseWriter, req *http.Request, raddr string) {
+	target := hw.requestAddr(req)
+
+	// the client only gets its 200 once the upstream proxy has opened the
+	// tunnel, otherwise it would be connected to nothing
+	var connOut net.Conn
+	var err error
+	if hw.h2Upstream != nil {
+		ctx, cancel := context.WithTimeout(req.Context(), hw.dialer.Timeout)
+		connOut, err = hw.h2Upstream.connect(ctx, raddr, target)
+		cancel()
+		if err != nil {
+			msg := fmt.Sprintf("Upstream proxy %s failed to connect to %s over http/2: %s", raddr, target, err)
+			respError(resp, upstreamErrorStatus(err), msg)
+			return
+		}
+	} else {
+		connOut, err = hw.DialFunc(req.Context(), "tcp", raddr)
+		if err != nil {
+			msg := fmt.Sprintf("Unable to dial upstream proxy %s: %s", raddr, err)
+			respError(resp, upstreamErrorStatus(err), msg)
+			return
+		}
+
+		connOut.SetDeadline(time.Now().Add(hw.dialer.Timeout))
+		err = connectProxyServer(connOut, target)
+		connOut.SetDeadline(time.Time{})
+		if err != nil {
+			connOut.Close()
+			msg := fmt.Sprintf("Upstream proxy %s failed to connect to %s: %s", raddr, target, err)
+			respError(resp, upstreamErrorStatus(err), msg)
+			return
+		}
 	}
+	defer connOut.Close()
 
-	err = connectProxyServer(connOut, raddr)
+	connIn, bufrw, err := hijack(resp)
 	if err != nil {
-		logger.Println("connectProxyServer error:", err)
+		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
+		respBadGateway(resp, msg)
+		return
 	}
+	defer connIn.Close()
 
 	if req.Method == "CONNECT" {
 		b := []byte("HTTP/1.1 200 Connection Established\r\n" +
 			"Proxy-Agent: gomitmproxy/" + Version + "\r\n\r\n")
 		_, err := connIn.Write(b)
 		if err != nil {
-			logger.Println("Write Connect err:", err)
+			logger.Debugln("Write Connect err:", err)
 			return
 		}
 	} else {
+		req.Body = hijackedBody(req, connIn, bufrw.Reader)
 		req.Header.Del("Proxy-Connection")
 		req.Header.Set("Connection", "Keep-Alive")
+		hw.addVia(req.Header, req.ProtoMajor, req.ProtoMinor)
 		if err = req.Write(connOut); err != nil {
-			logger.Println("send to server err", err)
+			logger.Debugln("send to server err", err)
 			return
 		}
 	}
-	err = Transport(connIn, connOut)
+	if bufrw.Reader.Buffered() > 0 {
+		connIn = &bufferedConn{connIn, bufrw.Reader}
+	}
+	if *hw.MyConfig.ForwardIdle > 0 {
+		var stop func()
+		connIn, connOut, stop = closeWhenIdle(connIn, connOut, *hw.MyConfig.ForwardIdle)
+		defer stop()
+	}
+	err = Transport(connIn, connOut, *hw.MyConfig.TunnelLinger)
 	if err != nil {
 		log.Println("trans error ", err)
 	}
 }
 
 func InitConfig(conf *Cfg, tlsConfig *TlsConfig) (*HandlerWrapper, error) {
+	if *conf.DialTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid dial timeout %s, want above 0", *conf.DialTimeout)
+	}
+	if tlsConfig.CertTTL <= 0 || tlsConfig.CertRefresh <= 0 || tlsConfig.CertRefresh >= tlsConfig.CertTTL {
+		return nil, fmt.Errorf("Invalid cert ttl %s and refresh %s, want 0 < refresh < ttl",
+			tlsConfig.CertTTL, tlsConfig.CertRefresh)
+	}
+	if tlsConfig.CertTTL > maxCertTTL {
+		return nil, fmt.Errorf("Invalid cert ttl %s, Apple platforms reject certs valid for longer than %s", tlsConfig.CertTTL, maxCertTTL)
+	}
 	hw := &HandlerWrapper{
 		MyConfig:     conf,
 		tlsConfig:    tlsConfig,
 		dynamicCerts: NewCache(),
+		refreshing:   make(map[string]bool),
+		certFailures: newCertFailures(tlsConfig.CertFailTTL),
+		mintLimit:    newMintLimiter(tlsConfig.MintRate, tlsConfig.MintBurst),
 		client:       &http.Client{},
+		// net.Dialer races the address families of dual-stack hosts
+		// (Happy Eyeballs), so a dead IPv6 route falls back to IPv4 quickly
+		dialer: &net.Dialer{
+			Timeout:       *conf.DialTimeout,
+			FallbackDelay: *conf.FallbackDelay,
+			KeepAlive:     *conf.TCPKeepAlive,
+		},
+	}
+	hw.DialFunc = hw.dial
+	hw.self.add(":" + *conf.Port)
+	for _, addr := range []string{*conf.Admin, *conf.Health, *conf.Transparent} {
+		hw.self.add(addr)
+	}
+	if *conf.Reverse != "" {
+		hw.self.add(*conf.ReverseListen)
+	}
+	hw.filters = []BodyFilter{&alimamaFilter{hw.client}}
+	hw.interceptHosts = splitList(*conf.InterceptHosts)
+	if *conf.InterceptSNI != "" {
+		sni, err := regexp.Compile(*conf.InterceptSNI)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid intercept sni pattern: %s", err)
+		}
+		hw.interceptSNI = sni
+	}
+	hw.noProxy = splitList(*conf.NoProxy)
+	hw.interceptPorts = make(map[string]bool)
+	for _, port := range splitList(*conf.InterceptPorts) {
+		hw.interceptPorts[port] = true
+	}
+	if *conf.Collector != "" {
+		hw.exporter = NewExporter(*conf.Collector, &http.Client{Timeout: *conf.CollectorTimeout}, *conf.CollectorBatch, *conf.CollectorQueue, *conf.CollectorKeep)
+	}
+	var err error
+	if *conf.Record != "" {
+		if hw.recorder, err = NewRecorder(*conf.Record); err != nil {
+			return nil, err
+		}
+	}
+	if hw.redactor, err = NewRedactor(*conf.RedactHeaders, *conf.RedactBody); err != nil {
+		return nil, err
+	}
+	if *conf.Monitor {
+		hw.monitor = NewMonitor(*conf.MonitorWorkers, *conf.MonitorQueue, *conf.MonitorBlock, hw.redactor)
+	}
+	if *conf.Tee != "" {
+		if hw.tee, err = NewTee(*conf.Tee); err != nil {
+			return nil, err
+		}
+	}
+	if *conf.Shadow != "" {
+		shadow, err := parseUpstreamURL(*conf.Shadow)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse shadow upstream: %s", err)
+		}
+		hw.shadow = shadow
+	}
+	hw.landingPage = []byte(defaultLandingPage)
+	if *conf.Landing != "" {
+		if hw.landingPage, err = ioutil.ReadFile(*conf.Landing); err != nil {
+			return nil, fmt.Errorf("Unable to read landing page: %s", err)
+		}
+	}
+	if *conf.Pac != "" {
+		if hw.pacFile, err = ioutil.ReadFile(*conf.Pac); err != nil {
+			return nil, fmt.Errorf("Unable to read pac file: %s", err)
+		}
+	}
+	if *conf.CAInterstitial {
+		hw.untrusted = newUntrustedClients()
+	}
+	if *conf.Admin != "" && *conf.History > 0 {
+		hw.history = NewHistory(*conf.History, *conf.HistoryBytes)
+	}
+	if *conf.Admin != "" && *conf.EventsBuffer > 0 {
+		hw.events = NewEventHub(*conf.EventsBuffer, hw.redactor)
+	}
+	if *conf.Mirror != "" {
+		if hw.mirror, err = NewMirror(*conf.Mirror, *conf.MirrorOffline); err != nil {
+			return nil, err
+		}
+	}
+	if *conf.CacheEntries > 0 {
+		hw.respCache = NewResponseCache(*conf.CacheEntries, *conf.CacheEntrySize)
+	}
+	if *conf.Pipe != "" {
+		hw.pipe, err = NewBodyPipe(*conf.Pipe, *conf.PipeTypes, *conf.PipeBodies, *conf.PipeTimeout, *conf.PipeMax)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hw.replacer, err = NewBodyReplacer(*conf.Replace, *conf.ReplaceRegexp, *conf.ReplaceTypes, *conf.ReplaceMax); err != nil {
+		return nil, err
+	}
+	if *conf.UpstreamIdle > 0 {
+		hw.pool = NewConnPool(*conf.UpstreamIdle)
+	}
+	if *conf.MaxInflight > 0 {
+		hw.inflight = NewByteBudget(*conf.MaxInflight)
+	}
+	if *conf.Reverse != "" {
+		if hw.reverse, err = parseReverseBackend(*conf.Reverse); err != nil {
+			return nil, err
+		}
+	}
+	if *conf.UpstreamH2 != "" {
+		if hw.h2Upstream, err = hw.newH2Upstream(*conf.UpstreamH2); err != nil {
+			return nil, err
+		}
+	}
+	hw.httpsUpgrades = parseHostPathRules(*conf.UpgradeHTTPS)
+	hw.gzipRequests = parseHostPathRules(*conf.GzipRequests)
+	if status := *conf.UpgradeStatus; status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+		return nil, fmt.Errorf("Invalid https upgrade status %d, want 301 or 308", status)
+	}
+	if *conf.MaxConcurrent > 0 {
+		hw.queue = NewRequestQueue(*conf.MaxConcurrent, *conf.Priority)
+	}
+	if *conf.BreakerFailures > 0 {
+		hw.breaker = NewBreaker(*conf.BreakerFailures, *conf.BreakerCooldown)
+	}
+	if *conf.CookieJar {
+		// without a public suffix list, which the standard library lacks, a
+		// site can set cookies for a whole tld; acceptable for testing
+		hw.jar, _ = cookiejar.New(nil)
+	}
+	if *conf.CookieStrip != "" || *conf.CookieDomain != "" {
+		hw.cookies, err = NewCookieRewriter(*conf.CookieStrip, *conf.CookieDomain)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hw.rewrites, err = parseRewrites(*conf.Rewrite); err != nil {
+		return nil, err
+	}
+	if action := *conf.MaxResponseAction; action != "reject" && action != "truncate" {
+		return nil, fmt.Errorf("Invalid max response action %q, want reject or truncate", action)
+	}
+	if policy := *conf.SNIMismatch; policy != "ignore" && policy != "log" && policy != "reject" {
+		return nil, fmt.Errorf("Invalid sni mismatch policy %q, want ignore, log or reject", policy)
+	}
+	if route := *conf.RouteBy; route != "host" && route != "sni" {
+		return nil, fmt.Errorf("Invalid route by %q, want host or sni", route)
 	}
-	err := hw.GenerateCertForClient()
+	if hw.statusRules, err = parseStatusRewrites(*conf.StatusRewrite); err != nil {
+		return nil, err
+	}
+	if hw.bandwidth, err = parseBandwidthRules(*conf.Bandwidth); err != nil {
+		return nil, err
+	}
+	if hw.locationRules, err = parseLocationRewrites(*conf.LocationRewrite); err != nil {
+		return nil, err
+	}
+	if hw.upstreamRules, err = parseUpstreamRules(*conf.UpstreamRules); err != nil {
+		return nil, err
+	}
+	hw.credentials, err = parseCredentials(*conf.Auth)
 	if err != nil {
 		return nil, err
 	}
+	if *conf.TicketRotation > 0 && tlsConfig.ServerTLSConfig != nil {
+		if hw.ticketKeys, err = newTicketKeyRotator(tlsConfig.ServerTLSConfig); err != nil {
+			return nil, fmt.Errorf("Unable to generate session ticket key: %s", err)
+		}
+		go hw.ticketKeys.run(*conf.TicketRotation)
+	}
+	err = hw.GenerateCertForClient()
+	if err != nil {
+		return nil, err
+	}
+	hw.warmCerts(splitList(*conf.WarmCerts))
 	return hw, nil
 }
 
+// connectPort returns the port of a CONNECT authority, the https default
+// port if it has none.
+func (hw *HandlerWrapper) connectPort(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return hw.defaultPort("https")
+	}
+	return port
+}
+
 func copyTlsConfig(template *tls.Config) *tls.Config {
-	tlsConfig := &tls.Config{}
-	if template != nil {
-		*tlsConfig = *template
+	if template == nil {
+		return &tls.Config{}
 	}
-	return tlsConfig
+	return template.Clone()
+}
+
+// Close flushes and closes the capture outputs that need it on shutdown.
+// Calls after the first do nothing.
+func (hw *HandlerWrapper) Close() {
+	hw.closeOnce.Do(hw.close)
+}
+
+func (hw *HandlerWrapper) close() {
+	if hw.ticketKeys != nil {
+		hw.ticketKeys.Close()
+	}
+	if hw.pool != nil {
+		hw.pool.Close()
+	}
+	if hw.exporter != nil {
+		hw.exporter.Close()
+	}
+	if hw.recorder != nil {
+		if err := hw.recorder.Close(); err != nil {
+			logger.Warnln("close recorder error:", err)
+		}
+	}
+	if hw.tee != nil {
+		if err := hw.tee.Close(); err != nil {
+			logger.Warnln("close tee error:", err)
+		}
+	}
+}
+
+// tooManyHeaders reports whether req carries more header fields than
+// allowed. The size of the header block is limited by the http server
+// reading it, which answers 431 on its own.
+func (hw *HandlerWrapper) tooManyHeaders(req *http.Request) bool {
+	if *hw.MyConfig.MaxHeaders <= 0 {
+		return false
+	}
+	n := 0
+	for _, values := range req.Header {
+		n += len(values)
+	}
+	return n > *hw.MyConfig.MaxHeaders
+}
+
+// upstreamErrorStatus returns the status reporting a failure to reach an
+// upstream: 504 if it timed out, 502 otherwise.
+func upstreamErrorStatus(err error) int {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// hijack takes over the client connection behind resp.
+func hijack(resp http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	return hijacker.Hijack()
 }
 
 func respBadGateway(resp http.ResponseWriter, msg string) {
+	respError(resp, http.StatusBadGateway, msg)
+}
+
+func respError(resp http.ResponseWriter, code int, msg string) {
 	log.Println(msg)
-	resp.WriteHeader(502)
+	resp.WriteHeader(code)
 	resp.Write([]byte(msg))
 }
 
-//两个io口的连接
-func Transport(conn1, conn2 net.Conn) (err error) {
+// writeError writes a complete error response to a hijacked client
+// connection, which should be closed afterwards.
+func writeError(conn net.Conn, code int, msg string) {
+	log.Println(msg)
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+		Close:         true,
+	}
+	if err := resp.Write(conn); err != nil {
+		logger.Debugln("write error response error:", err)
+	}
+}
+
+// Transport copies between conn1 and conn2 both ways until one side is done
+// sending. A positive linger then passes that on to the other side as a
+// half-close and gives it that long to finish its part.
+func Transport(conn1, conn2 net.Conn, linger time.Duration) (err error) {
 	rChan := make(chan error, 1)
 	wChan := make(chan error, 1)
 
 	go MyCopy(conn1, conn2, wChan)
 	go MyCopy(conn2, conn1, rChan)
 
+	var rest chan error
 	select {
 	case err = <-wChan:
+		rest = rChan
+		if linger > 0 && err == nil {
+			closeWrite(conn2)
+		}
 	case err = <-rChan:
+		rest = wChan
+		if linger > 0 && err == nil {
+			closeWrite(conn1)
+		}
+	}
+	if linger <= 0 || err != nil {
+		return
 	}
 
+	timer := time.NewTimer(linger)
+	defer timer.Stop()
+	select {
+	case err = <-rest:
+	case <-timer.C:
+		// the open direction may still have had data coming, which is lost
+		logger.Warnln("tunnel to", conn2.RemoteAddr(), "still open", linger, "after a half-close, cutting it off")
+	}
 	return
 }
 
+// closeWrite shuts down the writing side of conn, looking through the
+// proxy's own wrappers, if the underlying connection supports it.
+func closeWrite(conn net.Conn) {
+	for conn != nil {
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			if err := c.CloseWrite(); err != nil {
+				logger.Debugln("close write error:", err)
+			}
+			return
+		}
+		conn = innerConn(conn)
+	}
+}
+
+// innerConn returns the connection wrapped by one of the proxy's own
+// wrappers or a TLS connection, nil for any other.
+func innerConn(conn net.Conn) net.Conn {
+	switch c := conn.(type) {
+	case *bufferedConn:
+		return c.Conn
+	case *teeConn:
+		return c.Conn
+	case *upstreamConn:
+		return c.Conn
+	case *framingTap:
+		return c.Conn
+	case *idleConn:
+		return c.Conn
+	case *redirectedConn:
+		return c.Conn
+	case *reverseConn:
+		return c.Conn
+	case *tls.Conn:
+		return c.NetConn()
+	}
+	return nil
+}
+
 func MyCopy(src io.Reader, dst io.Writer, ch chan<- error) {
 	_, err := io.Copy(dst, src)
 	ch <- err
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLargeResponseStreamed(t *testing.T) {
+	release := make(chan struct{})
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(chunk)
+		w.(http.Flusher).Flush()
+		// the rest only follows once the client got the start
+		<-release
+		for i := 0; i < 256; i++ {
+			w.Write(chunk)
+		}
+	}))
+	defer origin.Close()
+	p := newTestProxy(t)
+
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len(chunk))
+	got := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("response held back until the origin finished it")
+	}
+	close(release)
+
+	h := sha256.New()
+	h.Write(first)
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.New()
+	for i := 0; i < 257; i++ {
+		want.Write(chunk)
+	}
+	if n+int64(len(first)) != int64(257*len(chunk)) || !bytes.Equal(h.Sum(nil), want.Sum(nil)) {
+		t.Errorf("got %d bytes differing from the %d sent", n+int64(len(first)), 257*len(chunk))
+	}
+}
+
+// fakeDNS answers every A query with a4 and every AAAA query with a6, over
+// udp on a local port, and returns a resolver asking it.
+func fakeDNS(t *testing.T, a4, a6 net.IP) *net.Resolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			// the question follows the 12 byte header
+			end := 12
+			for end < n && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(q[end-4:])
+			resp := append([]byte{}, q[:end]...)
+			resp[2] |= 0x84 // response, authoritative
+			resp[3] = 0x80  // recursion available, NOERROR
+			binary.BigEndian.PutUint16(resp[6:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			var ip net.IP
+			if qtype == 1 {
+				ip = a4.To4()
+			} else if qtype == 28 {
+				ip = a6.To16()
+			}
+			if ip != nil {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, 12)
+				resp = binary.BigEndian.AppendUint16(resp, qtype)
+				resp = append(resp, 0, 1, 0, 0, 0, 60)
+				resp = binary.BigEndian.AppendUint16(resp, uint16(len(ip)))
+				resp = append(resp, ip...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", pc.LocalAddr().String())
+		},
+	}
+}
+
+func TestDialFallsBackAcrossAddressFamilies(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no ipv6 loopback:", err)
+	}
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reached over ipv6"))
+	}))
+	origin.Listener = l
+	origin.Start()
+	defer origin.Close()
+	p := newTestProxy(t, "-fallback-delay", "100ms")
+	// nothing listens on the ipv4 loopback port, the ipv6 one answers
+	p.dialer.Resolver = fakeDNS(t, net.ParseIP("127.0.0.1"), net.ParseIP("::1"))
+
+	resp, err := p.client().Get("http://dualstack.test:" + portOf(origin) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); resp.StatusCode != http.StatusOK || got != "reached over ipv6" {
+		t.Errorf("got %s %q", resp.Status, got)
+	}
+}
+
+func TestDialRacesDeadAddressFamily(t *testing.T) {
+	origin := textOrigin(t, "reached over ipv4")
+	p := newTestProxy(t, "-fallback-delay", "100ms")
+	// 100::/64 is a discard prefix, dials to it hang until they time out
+	p.dialer.Resolver = fakeDNS(t, net.ParseIP("127.0.0.1"), net.ParseIP("100::1"))
+
+	start := time.Now()
+	resp, err := p.client().Get("http://dualstack.test:" + portOf(origin) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); resp.StatusCode != http.StatusOK || got != "reached over ipv4" {
+		t.Fatalf("got %s %q", resp.Status, got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dual-stack dial took %s, the dead family wasn't raced", elapsed)
+	}
+}
+
+func TestDialerConfiguredFromFlags(t *testing.T) {
+	hw := newTestHandler(t, "-fallback-delay", "50ms", "-dial-timeout", "3s")
+	if hw.dialer.FallbackDelay != 50*time.Millisecond || hw.dialer.Timeout != 3*time.Second {
+		t.Errorf("dialer has fallback delay %s and timeout %s", hw.dialer.FallbackDelay, hw.dialer.Timeout)
+	}
+}
+
+// rawOrigin answers every request on its connections with response, written
+// as is, closing the connection after when closeAfter is set.
+func rawOrigin(t *testing.T, response string, closeAfter bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					io.Copy(io.Discard, req.Body)
+					io.WriteString(conn, response)
+					if closeAfter {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// proxyGet sends a GET for url on conn, an open connection to the proxy,
+// and reads the response.
+func proxyGet(t *testing.T, conn net.Conn, br *bufio.Reader, proto, rawURL string) (*http.Response, string) {
+	t.Helper()
+	u, _ := url.Parse(rawURL)
+	fmt.Fprintf(conn, "GET %s %s\r\nHost: %s\r\n\r\n", rawURL, proto, u.Host)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readAll(t, resp)
+}
+
+func TestCloseDelimitedResponsePassedOn(t *testing.T) {
+	origin := rawOrigin(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil close", true)
+	p := newTestProxy(t)
+	conn := p.dial(t)
+	br := bufio.NewReader(conn)
+	resp, body := proxyGet(t, conn, br, "HTTP/1.1", "http://"+origin.Addr().String()+"/")
+	if body != "until close" || !resp.Close || len(resp.TransferEncoding) > 0 {
+		t.Errorf("got %q close=%v te=%v, want the body delimited by close", body, resp.Close, resp.TransferEncoding)
+	}
+	if !closedWithin(conn, 2*time.Second) {
+		t.Error("client connection left open after a close delimited body")
+	}
+}
+
+func TestRechunkKeepsClientConnection(t *testing.T) {
+	origin := rawOrigin(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil close", true)
+	p := newTestProxy(t, "-rechunk")
+	conn := p.dial(t)
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		resp, body := proxyGet(t, conn, br, "HTTP/1.1", "http://"+origin.Addr().String()+"/")
+		if body != "until close" || resp.Close || len(resp.TransferEncoding) == 0 {
+			t.Fatalf("request %d got %q close=%v te=%v, want it chunked", i, body, resp.Close, resp.TransferEncoding)
+		}
+	}
+
+	// an HTTP/1.0 client can't take chunks
+	conn = p.dial(t)
+	br = bufio.NewReader(conn)
+	resp, body := proxyGet(t, conn, br, "HTTP/1.0", "http://"+origin.Addr().String()+"/")
+	if body != "until close" || !resp.Close || len(resp.TransferEncoding) > 0 {
+		t.Errorf("HTTP/1.0 client got %q close=%v te=%v", body, resp.Close, resp.TransferEncoding)
+	}
+}
+
+func TestBodylessResponseNotCloseDelimited(t *testing.T) {
+	origin := rawOrigin(t, "HTTP/1.1 204 No Content\r\n\r\n", false)
+	p := newTestProxy(t)
+	conn := p.dial(t)
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		resp, _ := proxyGet(t, conn, br, "HTTP/1.1", "http://"+origin.Addr().String()+"/")
+		if resp.StatusCode != http.StatusNoContent || resp.Close {
+			t.Fatalf("request %d got %s close=%v", i, resp.Status, resp.Close)
+		}
+	}
+}
+
+func TestCertCacheReusesMintedCerts(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	first := handshakeThrough(t, p, origin, "cached.test")
+	second := handshakeThrough(t, p, origin, "cached.test")
+	if first.SerialNumber.Cmp(second.SerialNumber) != 0 {
+		t.Error("a second handshake for the same name got a new cert")
+	}
+	if _, found := p.dynamicCerts.Get("cached.test"); !found {
+		t.Error("minted cert not cached")
+	}
+}
+
+func TestNoCertCacheMintsEveryHandshake(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-no-cert-cache")
+	first := handshakeThrough(t, p, origin, "uncached.test")
+	second := handshakeThrough(t, p, origin, "uncached.test")
+	if first.SerialNumber.Cmp(second.SerialNumber) == 0 {
+		t.Error("-no-cert-cache handed out the same cert twice")
+	}
+	if _, found := p.dynamicCerts.Get("uncached.test"); found {
+		t.Error("cert cached with -no-cert-cache")
+	}
+}
+
+func TestHijackFailureAnswered(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	tunnel := tlsOrigin(t)
+	hw := newTestHandler(t, "-intercept-ports", "8443")
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", origin.URL+"/", nil),
+		httptest.NewRequest("CONNECT", tunnel.Listener.Addr().String(), nil),
+		httptest.NewRequest("CONNECT", "example.com:8443", nil),
+	} {
+		// a recorder can't be hijacked, as with an http/2 client
+		rec := httptest.NewRecorder()
+		hw.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadGateway || !bytes.Contains(rec.Body.Bytes(), []byte("underlying connection")) {
+			t.Errorf("%s %s answered %d %q", req.Method, req.URL, rec.Code, rec.Body)
+		}
+	}
+}
+
+// trailerOrigin streams a body followed by a Grpc-Status trailer, counting
+// the requests it answers.
+func trailerOrigin(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "streamed")
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestTrailersForwarded(t *testing.T) {
+	var hits atomic.Int32
+	origin := trailerOrigin(t, &hits)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	resp, err := p.client().Get(origin.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "streamed" || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("got %q with trailer %v", body, resp.Trailer)
+	}
+	if tr := lastTransaction(t, p); tr.ResponseTrailer.Get("Grpc-Status") != "0" {
+		t.Errorf("recorded trailer %v", tr.ResponseTrailer)
+	}
+}
+
+// headerStatus sends a GET for url through p with header and returns the
+// answer's status.
+func headerStatus(t *testing.T, p *testProxy, url string, header http.Header) int {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = header
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	return resp.StatusCode
+}
+
+func TestHeaderLimits(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	tlsServer := tlsOrigin(t)
+	// the server allows 4096 bytes over the limit
+	p := newTestProxy(t, "-max-header-bytes", "1024", "-max-headers", "10", "-intercept-ports", portOf(tlsServer))
+	p.trust(tlsServer)
+	large := http.Header{"X-Large": {strings.Repeat("x", 8192)}}
+	many := http.Header{}
+	for i := 0; i < 11; i++ {
+		many.Set(fmt.Sprintf("X-Field-%d", i), "v")
+	}
+	for _, url := range []string{origin.URL, tlsServer.URL} {
+		if status := headerStatus(t, p, url, large); status != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("%s with an 8k header got %d", url, status)
+		}
+		if status := headerStatus(t, p, url, many); status != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("%s with 11 header fields got %d", url, status)
+		}
+		if status := headerStatus(t, p, url, http.Header{"X-Small": {"v"}}); status != http.StatusOK {
+			t.Errorf("%s within the limits got %d", url, status)
+		}
+	}
+}
+
+func TestHeaderCountUnlimitedByDefault(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t)
+	many := http.Header{}
+	for i := 0; i < 200; i++ {
+		many.Set(fmt.Sprintf("X-Field-%d", i), "v")
+	}
+	if status := headerStatus(t, p, origin.URL, many); status != http.StatusOK {
+		t.Errorf("200 header fields got %d", status)
+	}
+}
+
+// abortWatchOrigin holds every request until its client goes away, after
+// writing the first byte of the body when streamed is set, and reports on
+// gone when it does.
+func abortWatchOrigin(t *testing.T, streamed bool) (*httptest.Server, chan struct{}) {
+	gone := make(chan struct{}, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streamed {
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			gone <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(origin.Close)
+	return origin, gone
+}
+
+func TestClientDisconnectAbortsUpstream(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		origin, gone := abortWatchOrigin(t, streamed)
+		p := newTestProxy(t)
+		conn := p.dial(t)
+		fmt.Fprintf(conn, "GET %s/slow HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+		if streamed {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn.Close()
+		select {
+		case <-gone:
+		case <-time.After(5 * time.Second):
+			t.Errorf("streamed %v: origin exchange kept going after the client left", streamed)
+		}
+	}
+}
+
+func TestCertRefreshedBeforeExpiry(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-cert-ttl", "3s", "-cert-refresh", "2500ms")
+	first := handshakeThrough(t, p, origin, "refresh.test")
+	if until := time.Until(first.NotAfter); until > 4*time.Second || until < time.Second {
+		t.Fatalf("cert valid for another %s, want the -cert-ttl of 3s", until)
+	}
+	// once within the refresh margin the old cert is still handed out
+	// while a new one is minted
+	time.Sleep(time.Second)
+	if again := handshakeThrough(t, p, origin, "refresh.test"); again.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Error("cert within the refresh margin not reused while refreshing")
+	}
+	for time.Now().Before(first.NotAfter) {
+		if next := handshakeThrough(t, p, origin, "refresh.test"); next.SerialNumber.Cmp(first.SerialNumber) != 0 {
+			if !next.NotAfter.After(first.NotAfter) {
+				t.Errorf("refreshed cert expires %s, not after the old one at %s", next.NotAfter, first.NotAfter)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("cert not refreshed before it expired")
+}
+
+func TestCertRefreshHonorsFailures(t *testing.T) {
+	p := newTestProxy(t)
+	cert, err := p.FakeCertForName("failing.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expires, _ := p.dynamicCerts.GetWithExpiration("failing.test")
+	if !expires.Before(cert.Leaf.NotAfter) {
+		t.Errorf("cert cached until %s, not before it expires at %s", expires, cert.Leaf.NotAfter)
+	}
+	// a refresh within the failure ttl keeps the cached cert rather than
+	// minting again
+	p.certFailures.fail("failing.test", errors.New("mint failed"))
+	p.refreshCert("failing.test")
+	if cached, _ := p.dynamicCerts.Get("failing.test"); cached != cert {
+		t.Error("cert refreshed while minting for its name was failing")
+	}
+	if got := p.certFailures.snapshot()["failing.test"]; got.Count != 1 {
+		t.Errorf("%d failures after the refresh, want the recorded one", got.Count)
+	}
+}
+
+func TestWarmCertsMintedAtStartup(t *testing.T) {
+	origin := tlsOrigin(t)
+	hosts := []string{"a.warm.test", "b.warm.test", "c.warm.test"}
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-warm-certs", strings.Join(hosts, ","))
+	warmed := make(map[string]*tls.Certificate)
+	for _, name := range hosts {
+		cert, found := p.dynamicCerts.Get(name)
+		if !found {
+			t.Fatalf("no cert for %s after startup", name)
+		}
+		warmed[name] = cert.(*tls.Certificate)
+	}
+	// handshakes get the warmed certs rather than minting their own
+	for _, name := range hosts {
+		leaf := handshakeThrough(t, p, origin, name)
+		if !bytes.Equal(leaf.Raw, warmed[name].Certificate[0]) {
+			t.Errorf("handshake for %s not shown the warmed cert", name)
+		}
+	}
+	if n := len(p.dynamicCerts.Expirations()); n != len(hosts) {
+		t.Errorf("%d certs cached, want the %d warmed", n, len(hosts))
+	}
+}
+
+func TestWarmCertsSkippedWithoutCache(t *testing.T) {
+	p := newTestProxy(t, "-no-cert-cache", "-warm-certs", "a.warm.test")
+	if n := len(p.dynamicCerts.Expirations()); n != 0 {
+		t.Errorf("%d certs warmed with -no-cert-cache", n)
+	}
+}
+
+func TestCertTTLValidated(t *testing.T) {
+	for _, args := range [][]string{
+		{"-cert-ttl", "0s"},
+		{"-cert-refresh", "0s"},
+		{"-cert-ttl", "1h", "-cert-refresh", "1h"},
+		{"-cert-ttl", "1h", "-cert-refresh", "2h"},
+	} {
+		if err := initError(args...); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+// upstreamProxy serves the CONNECTs reaching it with handle, which gets the
+// connection after the request was read, and returns its address.
+func upstreamProxy(t *testing.T, handle func(conn net.Conn, req *http.Request)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err == nil {
+					handle(conn, req)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// connectStatus sends a CONNECT for target to p and returns the status of
+// the answer.
+func connectStatus(t *testing.T, p *testProxy, target string) int {
+	t.Helper()
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestForwardedConnectFailuresReported(t *testing.T) {
+	refusing := upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	})
+	hung := upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		time.Sleep(5 * time.Second)
+	})
+	for _, tc := range []struct {
+		name, raddr string
+		status      int
+	}{
+		{"unreachable", freeAddr(t), http.StatusBadGateway},
+		{"refusing", refusing, http.StatusBadGateway},
+		{"hung", hung, http.StatusGatewayTimeout},
+	} {
+		p := newTestProxy(t, "-raddr", tc.raddr, "-dial-timeout", "200ms")
+		if status := connectStatus(t, p, "example.com:443"); status != tc.status {
+			t.Errorf("%s upstream proxy answered CONNECT with %d, want %d", tc.name, status, tc.status)
+		}
+	}
+}
+
+func TestForwardedConnectTunnels(t *testing.T) {
+	origin := tlsOrigin(t)
+	targets := make(chan string, 1)
+	raddr := upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		targets <- req.Host
+		connOut, err := net.Dial("tcp", origin.Listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer connOut.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		go io.Copy(connOut, conn)
+		io.Copy(conn, connOut)
+	})
+	p := newTestProxy(t, "-raddr", raddr)
+	resp, err := p.clientTrusting(origin).Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "tls origin" {
+		t.Errorf("body %q", body)
+	}
+	if target := <-targets; target != "example.com:443" {
+		t.Errorf("upstream proxy asked for %q, want example.com:443", target)
+	}
+}
+
+// memoryDial is a DialFunc connecting to in-memory origins that answer
+// every request with the address dialed, or echo when the first bytes
+// aren't a request. It records the addresses on dialed.
+func memoryDial(dialed chan<- string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			br := bufio.NewReader(server)
+			if line, _ := br.Peek(4); string(line) == "ping" {
+				io.Copy(server, br)
+				return
+			}
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.Method == "CONNECT" {
+				// an upstream proxy opening a tunnel
+				io.WriteString(server, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				io.Copy(server, br)
+				return
+			}
+			fmt.Fprintf(server, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(addr), addr)
+		}()
+		return client, nil
+	}
+}
+
+func TestDialFuncReplaced(t *testing.T) {
+	dialed := make(chan string, 10)
+	p := newTestProxy(t)
+	p.DialFunc = memoryDial(dialed)
+
+	resp, err := p.client().Get("http://in-memory.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "in-memory.test:80" {
+		t.Errorf("got %q from the in-memory origin", got)
+	}
+
+	conn := p.connect(t, "in-memory.test:8443")
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel echoed %q %v", buf, err)
+	}
+	for _, want := range []string{"in-memory.test:80", "in-memory.test:8443"} {
+		if got := <-dialed; got != want {
+			t.Errorf("dialed %s, want %s", got, want)
+		}
+	}
+}
+
+func TestDialFuncUsedForUpstreamProxy(t *testing.T) {
+	dialed := make(chan string, 10)
+	p := newTestProxy(t, "-raddr", "upstream-proxy.test:3128")
+	p.DialFunc = memoryDial(dialed)
+	conn := p.connect(t, "in-memory.test:443")
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel through the upstream proxy echoed %q %v", buf, err)
+	}
+	if got := <-dialed; got != "upstream-proxy.test:3128" {
+		t.Errorf("dialed %s, want the upstream proxy", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// monitorDump is a request/response pair waiting to be printed.
+type monitorDump struct {
+	url     string
+	reqDump []byte
+	resp    *http.Response
+}
+
+// Monitor prints request/response pairs in monitor mode from a fixed number
+// of goroutines, so a burst of traffic can't pile up unbounded goroutines
+// and buffered bodies. When the queue is full it either makes the request
+// wait for room or drops the oldest queued pair.
+type Monitor struct {
+	queue    chan *monitorDump
+	block    bool
+	redactor *Redactor
+	dropped  int64
+	// out is where the pairs are printed, stdout unless changed before the
+	// first pair is queued.
+	out io.Writer
+}
+
+// NewMonitor starts a Monitor printing with workers goroutines from a queue
+// of queueSize pairs. More than one worker can interleave the output.
+func NewMonitor(workers, queueSize int, block bool, redactor *Redactor) *Monitor {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	m := &Monitor{
+		queue:    make(chan *monitorDump, queueSize),
+		block:    block,
+		redactor: redactor,
+		out:      os.Stdout,
+	}
+	for i := 0; i < workers; i++ {
+		go m.run()
+	}
+	return m
+}
+
+// Dump queues the pair for printing. resp's body must be in memory already,
+// it is read and closed once the pair is printed or dropped.
+func (m *Monitor) Dump(url string, reqDump []byte, resp *http.Response) {
+	d := &monitorDump{url, reqDump, resp}
+	if m.block {
+		m.queue <- d
+		return
+	}
+	for {
+		select {
+		case m.queue <- d:
+			return
+		default:
+		}
+		select {
+		case old := <-m.queue:
+			old.resp.Body.Close()
+			n := atomic.AddInt64(&m.dropped, 1)
+			logger.Debugln("monitor queue full, dropped dump of", old.url, "total dropped:", n)
+		default:
+		}
+	}
+}
+
+func (m *Monitor) run() {
+	for d := range m.queue {
+		httpDump(m.out, d.reqDump, d.resp, m.redactor)
+	}
+}
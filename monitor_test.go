@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// monitorOutput sends what m prints until the test ends to the returned
+// channel, one dump at a time.
+func monitorOutput(t *testing.T, m *Monitor) <-chan string {
+	r, w := io.Pipe()
+	m.out = w
+	t.Cleanup(func() { w.Close() })
+	printed := make(chan string, 10)
+	go func() {
+		defer r.Close()
+		var out strings.Builder
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			out.WriteString(line)
+			if err != nil {
+				return
+			}
+			if strings.Contains(line, "END") {
+				printed <- out.String()
+				out.Reset()
+			}
+		}
+	}()
+	return printed
+}
+
+// watchedBody is a response body telling whether it was read or closed,
+// whose reads wait for release when it is set.
+type watchedBody struct {
+	io.Reader
+	release chan struct{}
+	read    chan struct{}
+	closed  atomic.Bool
+}
+
+func newWatchedBody(release chan struct{}) *watchedBody {
+	return &watchedBody{Reader: strings.NewReader("body"), release: release, read: make(chan struct{}, 1)}
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	select {
+	case b.read <- struct{}{}:
+	default:
+	}
+	if b.release != nil {
+		<-b.release
+	}
+	return b.Reader.Read(p)
+}
+
+func (b *watchedBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+var monitoredReq = []byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+func monitored(body *watchedBody) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}
+}
+
+// busyMonitor returns a Monitor with one worker kept busy printing a pair
+// until release is closed.
+func busyMonitor(t *testing.T, queueSize int, block bool, release chan struct{}) *Monitor {
+	m := NewMonitor(1, queueSize, block, nil)
+	m.out = io.Discard
+	busy := newWatchedBody(release)
+	m.Dump("http://example.com/busy", monitoredReq, monitored(busy))
+	select {
+	case <-busy.read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor worker never started printing")
+	}
+	return m
+}
+
+func TestMonitorDropsOldestWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	m := busyMonitor(t, 1, false, release)
+	var bodies []*watchedBody
+	for i := 0; i < 3; i++ {
+		body := newWatchedBody(nil)
+		bodies = append(bodies, body)
+		m.Dump("http://example.com/", monitoredReq, monitored(body))
+	}
+	if n := atomic.LoadInt64(&m.dropped); n != 2 {
+		t.Errorf("%d dumps dropped, want 2", n)
+	}
+	// the dropped ones were the oldest, and their bodies got closed
+	if !bodies[0].closed.Load() || !bodies[1].closed.Load() || bodies[2].closed.Load() {
+		t.Errorf("closed bodies %v %v %v, want the first two", bodies[0].closed.Load(), bodies[1].closed.Load(), bodies[2].closed.Load())
+	}
+}
+
+func TestMonitorBlocksWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	m := busyMonitor(t, 1, true, release)
+	m.Dump("http://example.com/", monitoredReq, monitored(newWatchedBody(nil)))
+	queued := make(chan struct{})
+	last := newWatchedBody(nil)
+	go func() {
+		m.Dump("http://example.com/", monitoredReq, monitored(last))
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("dump into a full -monitor-block queue didn't wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dump still waiting after the queue drained")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !last.closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !last.closed.Load() {
+		t.Error("waiting dump never printed")
+	}
+	if n := atomic.LoadInt64(&m.dropped); n != 0 {
+		t.Errorf("%d dumps dropped with -monitor-block", n)
+	}
+}
+
+func TestMonitorPrintsProxiedRequests(t *testing.T) {
+	origin := textOrigin(t, "monitored")
+	p := newTestProxy(t, "-m", "-monitor-workers", "2", "-monitor-queue", "8")
+	if p.monitor == nil {
+		t.Fatal("no monitor with -m")
+	}
+	p.monitor.out = io.Discard
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "monitored" {
+		t.Errorf("monitored request got %q", body)
+	}
+	if q := cap(p.monitor.queue); q != 8 {
+		t.Errorf("monitor queue of %d, want -monitor-queue 8", q)
+	}
+}
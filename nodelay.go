@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// setNoDelay turns Nagle's algorithm off on conn when noDelay is set, on
+// otherwise. Connections that aren't tcp, e.g. on the unix socket, are left
+// alone.
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tap, ok := conn.(*framingTap); ok {
+		conn = tap.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(noDelay); err != nil {
+		logger.Debugln("set nodelay on", conn.RemoteAddr(), "error:", err)
+	}
+}
+
+// noDelayConnContext applies -nodelay to accepted client connections, which
+// stays in effect once they are hijacked for CONNECT.
+func (hw *HandlerWrapper) noDelayConnContext(ctx context.Context, conn net.Conn) context.Context {
+	setNoDelay(conn, *hw.MyConfig.NoDelay)
+	return ctx
+}
+
+// dial is the default DialFunc, applying -nodelay to upstream connections.
+func (hw *HandlerWrapper) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := hw.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	setNoDelay(conn, *hw.MyConfig.NoDelay)
+	return conn, nil
+}
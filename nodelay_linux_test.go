@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// noDelayOf returns whether TCP_NODELAY is set on conn.
+func noDelayOf(conn net.Conn) (bool, error) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var noDelay int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		noDelay, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return noDelay != 0, err
+}
+
+func TestNoDelayOfClientConnections(t *testing.T) {
+	for _, noDelay := range []bool{true, false} {
+		hw := newTestHandler(t, "-nodelay="+strconv.FormatBool(noDelay))
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// as the proxy server does for each connection it accepts
+		hw.proxyServer().ConnContext(context.Background(), conn)
+		got, err := noDelayOf(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != noDelay {
+			t.Errorf("-nodelay=%v gave accepted connections TCP_NODELAY %v", noDelay, got)
+		}
+	}
+}
+
+func TestNoDelayOfUpstreamConnections(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	for _, noDelay := range []bool{true, false} {
+		p := newTestProxy(t, "-nodelay="+strconv.FormatBool(noDelay))
+		type dialedConn struct {
+			noDelay bool
+			err     error
+		}
+		dialed := make(chan dialedConn, 1)
+		dial := p.DialFunc
+		p.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err == nil {
+				got, err := noDelayOf(conn)
+				dialed <- dialedConn{got, err}
+			}
+			return conn, err
+		}
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		if got := <-dialed; got.err != nil {
+			t.Fatal(got.err)
+		} else if got.noDelay != noDelay {
+			t.Errorf("-nodelay=%v gave upstream connections TCP_NODELAY %v", noDelay, got.noDelay)
+		}
+	}
+}
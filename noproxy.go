@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// noProxyEnv returns the no-proxy list set in the environment.
+func noProxyEnv() string {
+	if v := os.Getenv("NO_PROXY"); v != "" {
+		return v
+	}
+	return os.Getenv("no_proxy")
+}
+
+// directUpstream in an upstream rule sends matching hosts directly.
+const directUpstream = "direct"
+
+// upstreamRule routes requests to hosts matching pattern through proxy.
+type upstreamRule struct {
+	pattern string
+	proxy   string
+}
+
+// parseUpstreamRules parses a comma separated list of pattern=host:port
+// entries, or pattern=direct for hosts not to send through any proxy.
+func parseUpstreamRules(s string) ([]*upstreamRule, error) {
+	var rules []*upstreamRule
+	for _, item := range splitList(s) {
+		eq := strings.Index(item, "=")
+		if eq <= 0 || eq == len(item)-1 {
+			return nil, fmt.Errorf("Invalid upstream rule %q, want host=proxy", item)
+		}
+		proxy := item[eq+1:]
+		if proxy != directUpstream {
+			if _, _, err := net.SplitHostPort(proxy); err != nil {
+				return nil, fmt.Errorf("Invalid upstream rule %q: %s", item, err)
+			}
+		}
+		rules = append(rules, &upstreamRule{pattern: item[:eq], proxy: proxy})
+	}
+	return rules, nil
+}
+
+// upstreamProxy returns the upstream proxy req is forwarded to, empty if it
+// is handled directly. The first upstream rule matching its host decides,
+// otherwise the default upstream proxy is used unless the host is in the
+// no-proxy list.
+func (hw *HandlerWrapper) upstreamProxy(req *http.Request) string {
+	addr := hw.requestAddr(req)
+	for _, rule := range hw.upstreamRules {
+		if matchHost(rule.pattern, addr) {
+			if rule.proxy == directUpstream {
+				return ""
+			}
+			return rule.proxy
+		}
+	}
+	raddr := *hw.MyConfig.Raddr
+	if raddr == "" {
+		return ""
+	}
+	for _, entry := range hw.noProxy {
+		if matchNoProxy(entry, addr) {
+			return ""
+		}
+	}
+	return raddr
+}
+
+// matchNoProxy reports whether the host:port addr matches an entry of a
+// NO_PROXY style list: * for all hosts, an IP address or CIDR range, or a
+// domain matching itself and its subdomains, with or without a leading dot.
+// An entry with a port only matches that port.
+func matchNoProxy(entry, addr string) bool {
+	if entry == "*" {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && ipNet.Contains(ip)
+	}
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		if p != port {
+			return false
+		}
+		entry = h
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	domain := strings.TrimPrefix(strings.ToLower(entry), "*")
+	domain = strings.TrimPrefix(domain, ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
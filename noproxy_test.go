@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestNoProxyHostsHandledDirectly(t *testing.T) {
+	origin := textOrigin(t, "direct")
+	// the upstream proxy opens tunnels to itself
+	raddr := upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 12\r\nConnection: close\r\n\r\nvia upstream")
+		}
+	})
+	tlsServer := tlsOrigin(t)
+	port := portOf(origin)
+	// the example.test names reach the origin through a rewrite
+	p := newTestProxy(t, "-raddr", raddr, "-rewrite", "*.example.test=127.0.0.1",
+		"-no-proxy", "10.0.0.0/8,.example.test,127.0.0.1:"+port+",127.0.0.1:"+portOf(tlsServer))
+	for url, want := range map[string]string{
+		origin.URL:                             "direct",
+		"http://127.0.0.1:1/":                  "via upstream",
+		"http://localhost:" + port + "/":       "via upstream",
+		"http://api.example.test:" + port:      "direct",
+		"http://example.test.evil.com:" + port: "via upstream",
+	} {
+		resp, err := p.client().Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, resp); got != want {
+			t.Errorf("%s got %q, want %q", url, got, want)
+		}
+	}
+
+	// CONNECTs are tunneled directly too
+	resp, err := p.clientTrusting(tlsServer).Get(tlsServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "tls origin" {
+		t.Errorf("no-proxy CONNECT got %q", got)
+	}
+}
+
+// namedUpstream is an upstream proxy answering every request it tunnels
+// with its name.
+func namedUpstream(t *testing.T, name string) string {
+	return upstreamProxy(t, func(conn net.Conn, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(name), name)
+		}
+	})
+}
+
+func TestUpstreamRulesRouteHosts(t *testing.T) {
+	origin := textOrigin(t, "direct")
+	port := portOf(origin)
+	de, us := namedUpstream(t, "via de"), namedUpstream(t, "via us")
+	p := newTestProxy(t, "-raddr", namedUpstream(t, "via default"), "-rewrite", "*.test=127.0.0.1",
+		"-no-proxy", "nearby.test",
+		"-upstream-rules", "*.de.test="+de+",*.us.test="+us+",local.test=direct,nearby.test="+us)
+	for host, want := range map[string]string{
+		"shop.de.test":   "via de",
+		"shop.us.test":   "via us",
+		"local.test":     "direct",
+		"other.test":     "via default",
+		"shop.de.test.x": "via default",
+		// rules come before the no-proxy list
+		"nearby.test": "via us",
+	} {
+		resp, err := p.client().Get("http://" + host + ":" + port + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, resp); got != want {
+			t.Errorf("%s got %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestUpstreamRulesWithoutDefault(t *testing.T) {
+	origin := textOrigin(t, "direct")
+	p := newTestProxy(t, "-upstream-rules", "127.0.0.1="+namedUpstream(t, "via rule"))
+	for url, want := range map[string]string{
+		origin.URL: "via rule",
+		"http://localhost:" + portOf(origin) + "/": "direct",
+	} {
+		resp, err := p.client().Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, resp); got != want {
+			t.Errorf("%s got %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestUpstreamRulesChecked(t *testing.T) {
+	for _, rules := range []string{"example.com", "=proxy.test:3128", "example.com=", "example.com=proxy.test"} {
+		if err := initError("-upstream-rules", rules); err == nil {
+			t.Errorf("-upstream-rules %q accepted", rules)
+		}
+	}
+}
+
+func TestNoProxyFromEnvironment(t *testing.T) {
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "internal.test")
+	hw := newTestHandler(t, "-raddr", "proxy.test:3128")
+	req, _ := http.NewRequest("GET", "http://build.internal.test/", nil)
+	if got := hw.upstreamProxy(req); got != "" {
+		t.Errorf("$no_proxy host forwarded to %q", got)
+	}
+	t.Setenv("NO_PROXY", "other.test")
+	hw = newTestHandler(t, "-raddr", "proxy.test:3128")
+	if got := hw.upstreamProxy(req); got != "proxy.test:3128" {
+		t.Errorf("$NO_PROXY not preferred, host forwarded to %q", got)
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	for _, tc := range []struct {
+		entry, addr string
+		want        bool
+	}{
+		{"*", "anything.test:80", true},
+		{"example.com", "example.com:443", true},
+		{"example.com", "www.example.com:443", true},
+		{".example.com", "example.com:443", true},
+		{"*.example.com", "www.example.com:80", true},
+		{"example.com", "badexample.com:80", false},
+		{"example.com:8080", "example.com:8080", true},
+		{"example.com:8080", "example.com:80", false},
+		{"192.168.0.0/16", "192.168.4.2:80", true},
+		{"192.168.0.0/16", "10.0.0.1:80", false},
+		{"::1", "[::1]:443", true},
+		{"10.0.0.1", "10.0.0.2:80", false},
+		{"Example.COM", "www.example.com:80", true},
+	} {
+		if got := matchNoProxy(tc.entry, tc.addr); got != tc.want {
+			t.Errorf("matchNoProxy(%q, %q) = %v, want %v", tc.entry, tc.addr, got, tc.want)
+		}
+	}
+}
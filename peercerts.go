@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// peerCert describes a certificate an origin presented.
+type peerCert struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	SHA256    string    `json:"sha256"`
+}
+
+func newPeerCert(cert *x509.Certificate) *peerCert {
+	sum := sha256.Sum256(cert.Raw)
+	return &peerCert{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+}
+
+// peerCerts describes the chain presented on a TLS connection, leaf first,
+// nil for connections without TLS.
+func peerCerts(state *tls.ConnectionState) []*peerCert {
+	if state == nil {
+		return nil
+	}
+	var certs []*peerCert
+	for _, cert := range state.PeerCertificates {
+		certs = append(certs, newPeerCert(cert))
+	}
+	return certs
+}
+
+// upstreamErrorMessage returns the message a failed upstream exchange is
+// answered with. In strict mode, a cert that failed to verify is described
+// along with the chain the origin presented.
+func (hw *HandlerWrapper) upstreamErrorMessage(err error) string {
+	var certErr *tls.CertificateVerificationError
+	if !*hw.MyConfig.StrictUpstreamTLS || !errors.As(err, &certErr) {
+		return err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "The origin's certificate failed to verify, the request was not sent.\n\n%s\n\nPresented chain, leaf first:\n", err)
+	for i, cert := range certErr.UnverifiedCertificates {
+		c := newPeerCert(cert)
+		fmt.Fprintf(&b, "\n%d. subject: %s\n   issuer: %s\n   dns names: %s\n   valid: %s to %s\n   sha256: %s\n",
+			i, c.Subject, c.Issuer, strings.Join(c.DNSNames, ", "),
+			c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339), c.SHA256)
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chainFilter passes on the TLS state of the responses it is handed.
+type chainFilter struct {
+	got chan *tls.ConnectionState
+}
+
+func (f *chainFilter) Match(req *http.Request) bool {
+	return true
+}
+
+func (f *chainFilter) Filter(req *http.Request, resp *capturedResponse) {
+	f.got <- resp.tls
+}
+
+func TestUpstreamCertsCaptured(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-admin", "127.0.0.1:0")
+	p.trust(origin)
+	f := &chainFilter{make(chan *tls.ConnectionState, 10)}
+	p.filters = append(p.filters, f)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+
+	want := origin.Certificate()
+	sum := sha256.Sum256(want.Raw)
+	certs := lastTransaction(t, p).UpstreamCerts
+	if len(certs) != 1 {
+		t.Fatalf("%d upstream certs captured, want the origin's 1", len(certs))
+	}
+	if certs[0].SHA256 != hex.EncodeToString(sum[:]) || certs[0].Serial != want.SerialNumber.String() ||
+		certs[0].Subject != want.Subject.String() || !sameStrings(certs[0].DNSNames, want.DNSNames) {
+		t.Errorf("captured %+v, not the origin's cert", certs[0])
+	}
+
+	select {
+	case state := <-f.got:
+		if state == nil || len(state.PeerCertificates) != 1 || !state.PeerCertificates[0].Equal(want) {
+			t.Error("filter not handed the origin's chain")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("filter never called")
+	}
+}
+
+func TestNoUpstreamCertsForPlainHTTP(t *testing.T) {
+	origin := textOrigin(t, "plain")
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if certs := lastTransaction(t, p).UpstreamCerts; certs != nil {
+		t.Errorf("plain http transaction has upstream certs %+v", certs)
+	}
+}
+
+// untrustedOriginGet gets origin, whose cert the proxy doesn't trust,
+// through a proxy intercepting it and configured by args.
+func untrustedOriginGet(t *testing.T, origin *httptest.Server, args ...string) (int, string) {
+	t.Helper()
+	p := newTestProxy(t, append([]string{"-intercept-ports", portOf(origin)}, args...)...)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, readAll(t, resp)
+}
+
+func TestStrictUpstreamTLSDescribesChain(t *testing.T) {
+	origin := tlsOrigin(t)
+	sum := sha256.Sum256(origin.Certificate().Raw)
+	status, body := untrustedOriginGet(t, origin, "-strict-upstream-tls")
+	if status != http.StatusBadGateway {
+		t.Errorf("untrusted origin got %d, want 502", status)
+	}
+	for _, want := range []string{"failed to verify", "unknown authority", "issuer: O=Acme Co", hex.EncodeToString(sum[:])} {
+		if !strings.Contains(body, want) {
+			t.Errorf("error page lacks %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestUpstreamTLSFailureAnswered(t *testing.T) {
+	origin := tlsOrigin(t)
+	sum := sha256.Sum256(origin.Certificate().Raw)
+	status, body := untrustedOriginGet(t, origin)
+	if status != http.StatusBadGateway || !strings.Contains(body, "tls handshake with") {
+		t.Errorf("untrusted origin got %d %q", status, body)
+	}
+	if strings.Contains(body, hex.EncodeToString(sum[:])) {
+		t.Error("chain described without -strict-upstream-tls")
+	}
+
+	// an origin that's gone is answered too
+	origin.Close()
+	if status, _ := untrustedOriginGet(t, origin, "-strict-upstream-tls"); status != http.StatusBadGateway {
+		t.Errorf("unreachable origin got %d, want 502", status)
+	}
+}
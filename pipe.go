@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errPipeOutputTooLarge stops a command printing more than the size limit.
+var errPipeOutputTooLarge = errors.New("output over the size limit")
+
+// BodyPipe passes bodies with matching content types through an external
+// command, run by sh with the body on stdin, and replaces them with what it
+// prints. A body is left as it was if the command fails, times out or
+// either body is over the size limit. The command gets the direction,
+// request or response, and the url in GOMITMPROXY_DIRECTION and
+// GOMITMPROXY_URL.
+type BodyPipe struct {
+	command   string
+	types     []string
+	requests  bool
+	responses bool
+	timeout   time.Duration
+	max       int64
+}
+
+// NewBodyPipe returns a BodyPipe running command on the bodies of the
+// content types matching types, a comma separated list of patterns like
+// text/* or application/*+json, going in direction: request, response or
+// both.
+func NewBodyPipe(command, types, direction string, timeout time.Duration, max int64) (*BodyPipe, error) {
+	p := &BodyPipe{command: command, types: splitList(types), timeout: timeout, max: max}
+	switch direction {
+	case "request":
+		p.requests = true
+	case "response":
+		p.responses = true
+	case "both":
+		p.requests, p.responses = true, true
+	default:
+		return nil, fmt.Errorf("Invalid pipe direction %q, want request, response or both", direction)
+	}
+	for _, pattern := range p.types {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pipe content type %q: %s", pattern, err)
+		}
+	}
+	return p, nil
+}
+
+// matches reports whether a body with header is to be piped. Encoded
+// bodies aren't, the command would get the compressed bytes.
+func (p *BodyPipe) matches(header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	return matchesMediaType(p.types, header)
+}
+
+// matchesMediaType reports whether the media type of the Content-Type in
+// header matches one of patterns.
+func matchesMediaType(patterns []string, header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Request pipes the body of req. Only bodies of a known length are, as one
+// over the limit couldn't be put back once the connection is hijacked.
+func (p *BodyPipe) Request(req *http.Request) {
+	if !p.requests || req.ContentLength <= 0 || req.ContentLength > p.max || !p.matches(req.Header) {
+		return
+	}
+	body, n, ok := p.pipe(req.Body, req.ContentLength, "request", req.URL.String())
+	req.Body = body
+	if ok {
+		req.ContentLength = n
+		req.TransferEncoding = nil
+	}
+}
+
+// Response pipes the body of resp, answering req.
+func (p *BodyPipe) Response(req *http.Request, resp *http.Response) {
+	if !p.responses || req.Method == "HEAD" || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.Body == nil || !p.matches(resp.Header) {
+		return
+	}
+	body, n, ok := p.pipe(resp.Body, resp.ContentLength, "response", req.URL.String())
+	resp.Body = body
+	if ok {
+		resp.ContentLength = n
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+}
+
+// pipe reads body, of length bytes or -1 if unknown, and runs it through
+// the command. It returns the command's output and its length, or the body
+// as it was and false.
+func (p *BodyPipe) pipe(body io.ReadCloser, length int64, direction, url string) (io.ReadCloser, int64, bool) {
+	if length > p.max {
+		return body, 0, false
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, p.max+1))
+	if err != nil || int64(len(buf)) > p.max {
+		if err != nil {
+			logger.Debugln("read", direction, "body of", url, "to pipe error:", err)
+		}
+		rest := io.MultiReader(bytes.NewReader(buf), body)
+		return struct {
+			io.Reader
+			io.Closer
+		}{rest, body}, 0, false
+	}
+	body.Close()
+	out, err := p.run(buf, direction, url)
+	if err != nil {
+		logger.Warnln("pipe", direction, "body of", url, "error:", err)
+		return ioutil.NopCloser(bytes.NewReader(buf)), 0, false
+	}
+	return ioutil.NopCloser(bytes.NewReader(out)), int64(len(out)), true
+}
+
+func (p *BodyPipe) run(body []byte, direction, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.command)
+	cmd.Env = append(os.Environ(), "GOMITMPROXY_DIRECTION="+direction, "GOMITMPROXY_URL="+url)
+	cmd.Stdin = bytes.NewReader(body)
+	out := &limitedBuffer{max: p.max, cancel: cancel}
+	var stderr bytes.Buffer
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	// don't wait on children of the shell still holding the pipes
+	cmd.WaitDelay = 100 * time.Millisecond
+	if err := cmd.Run(); err != nil {
+		if out.over {
+			return nil, errPipeOutputTooLarge
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %s", p.timeout)
+		}
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.buf.Bytes(), nil
+}
+
+// limitedBuffer buffers up to max bytes, failing writes past them and
+// calling cancel to stop the writer as well. The buffer isn't embedded, its
+// ReadFrom would get around the limit.
+type limitedBuffer struct {
+	buf    bytes.Buffer
+	max    int64
+	over   bool
+	cancel func()
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()+len(p)) > b.max {
+		b.over = true
+		b.cancel()
+		return 0, errPipeOutputTooLarge
+	}
+	return b.buf.Write(p)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// bodyOrigin sends the body of each request it gets, and its declared
+// length, to got.
+func bodyOrigin(t *testing.T) (*httptest.Server, chan string) {
+	got := make(chan string, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- strconv.FormatInt(r.ContentLength, 10) + " " + string(b)
+	}))
+	t.Cleanup(origin.Close)
+	return origin, got
+}
+
+// getThrough gets url through p and returns the response and its body.
+func getThrough(t *testing.T, p *testProxy, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := p.client().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readAll(t, resp)
+}
+
+func TestPipeTransformsResponse(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{"greeting": "hello", "drop": true}`, false)
+	p := newTestProxy(t, "-pipe", "jq -c 'del(.drop)'")
+	resp, body := getThrough(t, p, origin.URL)
+	if body != `{"greeting":"hello"}`+"\n" {
+		t.Errorf("piped response %q", body)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("piped response declares %d bytes, has %d", resp.ContentLength, len(body))
+	}
+}
+
+func TestPipeTransformsRequest(t *testing.T) {
+	origin, got := bodyOrigin(t)
+	p := newTestProxy(t, "-pipe", "tr a-z A-Z", "-pipe-bodies", "request")
+	resp, err := p.client().Post(origin.URL, "application/json", strings.NewReader(`{"a":"lower"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if g := <-got; g != `13 {"A":"LOWER"}` {
+		t.Errorf("origin got %q", g)
+	}
+}
+
+func TestPipeGetsDirectionAndURL(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{}`, false)
+	p := newTestProxy(t, "-pipe", `printf '%s %s' "$GOMITMPROXY_DIRECTION" "$GOMITMPROXY_URL"`)
+	if _, body := getThrough(t, p, origin.URL+"/x?y=1"); body != "response "+origin.URL+"/x?y=1" {
+		t.Errorf("command printed %q", body)
+	}
+}
+
+func TestPipeContentTypes(t *testing.T) {
+	text := textOrigin(t, "plain")
+	json := jsonOrigin(t, "a", `{"a":1}`, false)
+	zipped := jsonOrigin(t, "a", `{"a":1}`, true)
+	p := newTestProxy(t, "-pipe", "echo piped", "-pipe-types", "text/*")
+	if _, body := getThrough(t, p, text.URL); body != "piped\n" {
+		t.Errorf("text/plain body %q, want it piped", body)
+	}
+	if _, body := getThrough(t, p, json.URL); body != `{"a":1}` {
+		t.Errorf("application/json body %q, want it left alone", body)
+	}
+
+	// encoded bodies aren't piped, the command would get compressed bytes
+	p = newTestProxy(t, "-pipe", "echo piped")
+	// the client asked for gzip, so it decodes the body itself
+	if resp, body := getThrough(t, p, zipped.URL); !resp.Uncompressed || body != `{"a":1}` {
+		t.Errorf("gzipped body %q, uncompressed by the client %v", body, resp.Uncompressed)
+	}
+}
+
+func TestPipeFailureLeavesBody(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{"a":"unchanged"}`, false)
+	for name, args := range map[string][]string{
+		"failing":      {"-pipe", "echo partial; exit 1"},
+		"slow":         {"-pipe", "sleep 5", "-pipe-timeout", "100ms"},
+		"large body":   {"-pipe", "echo piped", "-pipe-max", "8"},
+		"large output": {"-pipe", "head -c 100 /dev/zero", "-pipe-max", "64"},
+	} {
+		p := newTestProxy(t, args...)
+		if _, body := getThrough(t, p, origin.URL); body != `{"a":"unchanged"}` {
+			t.Errorf("%s command: body %q, want it unchanged", name, body)
+		}
+	}
+}
+
+func TestPipeChecked(t *testing.T) {
+	for _, args := range [][]string{
+		{"-pipe", "cat", "-pipe-bodies", "sideways"},
+		{"-pipe", "cat", "-pipe-types", "text/["},
+	} {
+		if err := initError(args...); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
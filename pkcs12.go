@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// encodePKCS12 packages a key, its cert and the certs above it into a
+// PKCS#12 file encrypted with password. It is only set in binaries built
+// with -tags pkcs12.
+var encodePKCS12 func(key interface{}, cert *x509.Certificate, chain []*x509.Certificate, password string) ([]byte, error)
+
+// encodePKCS12TrustStore packages certs without any key into a PKCS#12
+// file encrypted with password. It is set along with encodePKCS12.
+var encodePKCS12TrustStore func(certs []*x509.Certificate, password string) ([]byte, error)
+
+// ExportPKCS12 returns the CA cert as PKCS#12, for platforms that install a
+// CA from a .p12 or .pfx file. If name isn't empty it returns the leaf cert
+// minted for name instead, with the CA above it. Minted certs share the
+// CA's key, which is only included with withKey.
+func (hw *HandlerWrapper) ExportPKCS12(name, password string, withKey bool) ([]byte, error) {
+	if encodePKCS12 == nil {
+		return nil, errors.New("PKCS#12 export needs pkcs12 support, build with -tags pkcs12")
+	}
+	ca := hw.issuingCert.X509()
+	if name == "" {
+		if !withKey {
+			return encodePKCS12TrustStore([]*x509.Certificate{ca}, password)
+		}
+		return encodePKCS12(hw.pk.rsaKey, ca, nil, password)
+	}
+	leaf, err := hw.FakeCertForName(name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(leaf.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !withKey {
+		return encodePKCS12TrustStore([]*x509.Certificate{cert, ca}, password)
+	}
+	return encodePKCS12(leaf.PrivateKey, cert, []*x509.Certificate{ca}, password)
+}
+
+// exportsKey reports whether /ca.p12 may include the CA's key: only when
+// it is encrypted with a -p12-password and the admin api, which has no
+// authentication of its own, listens on loopback alone.
+func (hw *HandlerWrapper) exportsKey() bool {
+	return *hw.MyConfig.P12Password != "" && loopbackOnly(*hw.MyConfig.Admin)
+}
+
+// loopbackOnly reports whether listening on addr accepts local connections
+// alone.
+func loopbackOnly(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handlePKCS12 serves ExportPKCS12 on GET /ca.p12, encrypted with
+// -p12-password. ?name=host exports the leaf cert for host instead. The key
+// is left out unless exportsKey allows it.
+func (hw *HandlerWrapper) handlePKCS12(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.Header().Set("Allow", "GET")
+		respError(resp, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	name := req.URL.Query().Get("name")
+	withKey := hw.exportsKey()
+	if !withKey {
+		logger.Infoln("exporting PKCS#12 without the CA key, it needs a -p12-password and -admin on a loopback address")
+	}
+	p12, err := hw.ExportPKCS12(name, *hw.MyConfig.P12Password, withKey)
+	if err != nil {
+		respError(resp, http.StatusInternalServerError, fmt.Sprintf("Unable to export PKCS#12: %s", err))
+		return
+	}
+	filename := "gomitmproxy-ca.p12"
+	if name != "" {
+		filename = "gomitmproxy-" + name + ".p12"
+	}
+	resp.Header().Set("Content-Type", "application/x-pkcs12")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	resp.Write(p12)
+}
@@ -0,0 +1,19 @@
+//go:build pkcs12
+
+package main
+
+import (
+	"crypto/x509"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func init() {
+	// the legacy algorithms are the ones every platform imports
+	encodePKCS12 = func(key interface{}, cert *x509.Certificate, chain []*x509.Certificate, password string) ([]byte, error) {
+		return pkcs12.LegacyDES.Encode(key, cert, chain, password)
+	}
+	encodePKCS12TrustStore = func(certs []*x509.Certificate, password string) ([]byte, error) {
+		return pkcs12.LegacyDES.EncodeTrustStore(certs, password)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build pkcs12
+
+package main
+
+import (
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestPKCS12RoundTrip(t *testing.T) {
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-p12-password", "s3cret")
+	p12, err := p.ExportPKCS12("", "s3cret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(p12, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(p.issuingCert.X509()) || len(chain) != 0 || !p.pk.rsaKey.Equal(key) {
+		t.Errorf("decoded %s with %d certs above it, key matching %v", cert.Subject, len(chain), p.pk.rsaKey.Equal(key))
+	}
+
+	// without the key only the certs are packaged
+	p12, err = p.ExportPKCS12("example.com", "s3cret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := pkcs12.DecodeChain(p12, "s3cret"); err == nil {
+		t.Error("certs exported without the key hold one")
+	}
+	certs, err := pkcs12.DecodeTrustStore(p12, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].VerifyHostname("example.com") != nil || !certs[1].Equal(p.issuingCert.X509()) {
+		t.Errorf("decoded %d certs", len(certs))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// fakePKCS12 stands in for the encoders of pkcs12 builds until the test
+// ends, describing what they were given instead of encoding it.
+func fakePKCS12(t *testing.T) {
+	encode, encodeTrustStore := encodePKCS12, encodePKCS12TrustStore
+	t.Cleanup(func() { encodePKCS12, encodePKCS12TrustStore = encode, encodeTrustStore })
+	encodePKCS12 = func(key interface{}, cert *x509.Certificate, chain []*x509.Certificate, password string) ([]byte, error) {
+		return []byte(fmt.Sprintf("key and %d certs, password %q", 1+len(chain), password)), nil
+	}
+	encodePKCS12TrustStore = func(certs []*x509.Certificate, password string) ([]byte, error) {
+		return []byte(fmt.Sprintf("%d certs, password %q", len(certs), password)), nil
+	}
+}
+
+func getP12(t *testing.T, p *testProxy, query string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(p.admin(t).URL + "/ca.p12" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readAll(t, resp)
+}
+
+func TestPKCS12KeyNeedsPasswordAndLoopbackAdmin(t *testing.T) {
+	fakePKCS12(t)
+	for _, tc := range []struct {
+		admin, password string
+		withKey         bool
+	}{
+		{"127.0.0.1:8081", "s3cret", true},
+		{"localhost:8081", "s3cret", true},
+		{"[::1]:8081", "s3cret", true},
+		{"127.0.0.1:8081", "", false},
+		{":8081", "s3cret", false},
+		{"0.0.0.0:8081", "s3cret", false},
+		{"192.168.1.2:8081", "s3cret", false},
+	} {
+		p := newTestProxy(t, "-admin", tc.admin, "-p12-password", tc.password)
+		want := map[string]string{
+			"":                  fmt.Sprintf("1 certs, password %q", tc.password),
+			"?name=example.com": fmt.Sprintf("2 certs, password %q", tc.password),
+		}
+		if tc.withKey {
+			want[""] = "key and " + want[""]
+			want["?name=example.com"] = "key and " + want["?name=example.com"]
+		}
+		for query, want := range want {
+			if resp, got := getP12(t, p, query); resp.StatusCode != http.StatusOK || got != want {
+				t.Errorf("-admin %s -p12-password %q: /ca.p12%s got %d %q, want %q", tc.admin, tc.password, query, resp.StatusCode, got, want)
+			}
+		}
+	}
+}
+
+func TestPKCS12ServedAsAttachment(t *testing.T) {
+	fakePKCS12(t)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	resp, _ := getP12(t, p, "?name=example.com")
+	if resp.Header.Get("Content-Type") != "application/x-pkcs12" ||
+		resp.Header.Get("Content-Disposition") != `attachment; filename="gomitmproxy-example.com.p12"` {
+		t.Errorf("served as %q, %q", resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"))
+	}
+	resp, err := http.Post(p.admin(t).URL+"/ca.p12", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /ca.p12 got %s", resp.Status)
+	}
+}
+
+func TestPKCS12NeedsBuildTag(t *testing.T) {
+	if encodePKCS12 != nil {
+		t.Skip("built with -tags pkcs12")
+	}
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	if resp, _ := getP12(t, p, ""); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("/ca.p12 without pkcs12 support got %s", resp.Status)
+	}
+}
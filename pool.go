@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIdlePerOrigin is how many idle connections ConnPool keeps per origin.
+const maxIdlePerOrigin = 4
+
+// upstreamConn is a connection to an origin as roundTrip returns it, with
+// what is needed to pool it once its response has been read.
+type upstreamConn struct {
+	net.Conn
+	key   string
+	state *tls.ConnectionState
+	// stop keeps the connection from being closed when the request's
+	// context is done, it returns false if that already happened
+	stop  func() bool
+	since time.Time
+}
+
+// ConnPool keeps upstream connections whose response was read to the end,
+// so later requests to the same origin skip the dial and handshake. A
+// reaper closes those idle for longer than timeout.
+type ConnPool struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	idle    map[string][]*upstreamConn
+	done    chan struct{}
+}
+
+// NewConnPool starts a ConnPool closing connections idle for timeout.
+func NewConnPool(timeout time.Duration) *ConnPool {
+	p := &ConnPool{
+		timeout: timeout,
+		idle:    make(map[string][]*upstreamConn),
+		done:    make(chan struct{}),
+	}
+	go p.reap(max(timeout/2, 100*time.Millisecond))
+	return p
+}
+
+// Get returns an idle connection to the origin key, nil if there is none
+// that is still open.
+func (p *ConnPool) Get(key string) *upstreamConn {
+	for {
+		p.mutex.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mutex.Unlock()
+			return nil
+		}
+		conn := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.mutex.Unlock()
+		if time.Since(conn.since) < p.timeout && idleAlive(conn) {
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+// Put keeps conn for reuse, or closes it if its origin already has
+// maxIdlePerOrigin idle connections or the pool is closed.
+func (p *ConnPool) Put(conn *upstreamConn) {
+	p.mutex.Lock()
+	if p.idle == nil || len(p.idle[conn.key]) >= maxIdlePerOrigin {
+		p.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	conn.since = time.Now()
+	p.idle[conn.key] = append(p.idle[conn.key], conn)
+	p.mutex.Unlock()
+}
+
+// Idle returns the number of idle connections.
+func (p *ConnPool) Idle() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n := 0
+	for _, conns := range p.idle {
+		n += len(conns)
+	}
+	return n
+}
+
+// reap closes the connections idle for longer than timeout every interval,
+// until the pool is closed.
+func (p *ConnPool) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		var expired []*upstreamConn
+		p.mutex.Lock()
+		for key, conns := range p.idle {
+			kept := conns[:0]
+			for _, conn := range conns {
+				if time.Since(conn.since) >= p.timeout {
+					expired = append(expired, conn)
+				} else {
+					kept = append(kept, conn)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.mutex.Unlock()
+		for _, conn := range expired {
+			conn.Close()
+		}
+		if len(expired) > 0 {
+			logger.Debugln("closed", len(expired), "idle upstream connections")
+		}
+	}
+}
+
+// Close stops the reaper and closes the idle connections. Connections put
+// back afterwards are closed straight away.
+func (p *ConnPool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+	if idle == nil {
+		return
+	}
+	close(p.done)
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// idleAlive reports whether an idle connection is still open, the origin
+// having neither closed it nor sent anything on it while it was idle.
+func idleAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
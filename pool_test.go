@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingOrigin answers with body after delay and counts the connections
+// it accepted and those since closed.
+type countingOrigin struct {
+	*httptest.Server
+	opened, closed atomic.Int32
+}
+
+func newCountingOrigin(t *testing.T, body string, delay time.Duration) *countingOrigin {
+	o := &countingOrigin{}
+	o.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		io.WriteString(w, body)
+	}))
+	o.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			o.opened.Add(1)
+		case http.StateClosed:
+			o.closed.Add(1)
+		}
+	}
+	o.Start()
+	t.Cleanup(o.Close)
+	return o
+}
+
+// getThroughNew gets url through p on a client connection of its own, so
+// only the proxy's pool can share the upstream connection. The client
+// connection is left open, closing it right away would abandon the exchange
+// before its upstream connection is pooled.
+func getThroughNew(t *testing.T, p *testProxy, url string) string {
+	t.Helper()
+	resp, err := p.client().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, resp)
+}
+
+// pooled waits a while for p to pool n idle connections and returns how
+// many it has.
+func pooled(p *testProxy, n int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.pool.Idle() != n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return p.pool.Idle()
+}
+
+func TestIdleUpstreamReused(t *testing.T) {
+	origin := newCountingOrigin(t, "pooled", 0)
+	p := newTestProxy(t, "-upstream-idle", "5s")
+	for i := 0; i < 3; i++ {
+		if body := getThroughNew(t, p, origin.URL); body != "pooled" {
+			t.Fatalf("request %d got %q", i, body)
+		}
+		pooled(p, 1)
+	}
+	if n := origin.opened.Load(); n != 1 {
+		t.Errorf("origin got %d connections for 3 requests, want 1", n)
+	}
+	if n := pooled(p, 1); n != 1 {
+		t.Errorf("%d idle connections pooled, want 1", n)
+	}
+}
+
+func TestIdleUpstreamReaped(t *testing.T) {
+	origin := newCountingOrigin(t, "pooled", 0)
+	p := newTestProxy(t, "-upstream-idle", "200ms")
+	getThroughNew(t, p, origin.URL)
+	if n := pooled(p, 1); n != 1 {
+		t.Fatalf("%d idle connections pooled, want 1", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for origin.closed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if origin.closed.Load() != 1 || p.pool.Idle() != 0 {
+		t.Errorf("after the idle timeout %d connections closed, %d pooled", origin.closed.Load(), p.pool.Idle())
+	}
+	// the next request dials again
+	if body := getThroughNew(t, p, origin.URL); body != "pooled" || origin.opened.Load() != 2 {
+		t.Errorf("request after the reap got %q over %d connections", body, origin.opened.Load())
+	}
+}
+
+func TestActiveUpstreamKept(t *testing.T) {
+	// the response takes several idle timeouts to come
+	origin := newCountingOrigin(t, "slow", 500*time.Millisecond)
+	p := newTestProxy(t, "-upstream-idle", "100ms")
+	if body := getThroughNew(t, p, origin.URL); body != "slow" {
+		t.Errorf("slow response got %q", body)
+	}
+	if n := origin.closed.Load(); n != 0 {
+		t.Errorf("%d connections in use were closed", n)
+	}
+}
+
+func TestUpstreamPoolClosedOnShutdown(t *testing.T) {
+	origin := newCountingOrigin(t, "pooled", 0)
+	p := newTestProxy(t, "-upstream-idle", "1h")
+	getThroughNew(t, p, origin.URL)
+	pooled(p, 1)
+	p.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for origin.closed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if origin.closed.Load() != 1 || p.pool.Idle() != 0 {
+		t.Errorf("after closing the pool %d connections closed, %d pooled", origin.closed.Load(), p.pool.Idle())
+	}
+	select {
+	case <-p.pool.done:
+	default:
+		t.Error("reaper still running after the pool closed")
+	}
+}
+
+// getRedirected sends a request for host on a connection that was
+// redirected to the transparent listener on its way to dst.
+func getRedirected(t *testing.T, p *testProxy, host, dst string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	// left open as in getThroughNew
+	t.Cleanup(func() { client.Close() })
+	go p.serveConn(&redirectedConn{server, dst}, http.HandlerFunc(p.serveTransparent))
+	fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, resp)
+}
+
+func TestIdleUpstreamKeyedByAddress(t *testing.T) {
+	first := newCountingOrigin(t, "first", 0)
+	second := newCountingOrigin(t, "second", 0)
+	p := newTestProxy(t, "-upstream-idle", "5s")
+	// both clients named the same host but connected to different servers
+	if body := getRedirected(t, p, "shared.example.test", first.Listener.Addr().String()); body != "first" {
+		t.Errorf("redirected to the first origin got %q", body)
+	}
+	pooled(p, 1)
+	if body := getRedirected(t, p, "shared.example.test", second.Listener.Addr().String()); body != "second" {
+		t.Errorf("redirected to the second origin got %q", body)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestQueue caps how many requests are proxied at once. Requests arriving
+// while every slot is taken wait in line, and a freed slot goes to the
+// longest waiting high priority request before any other.
+type RequestQueue struct {
+	mutex  sync.Mutex
+	max    int
+	active int
+	// waiting holds the high priority waiters, then the others, oldest
+	// first
+	waiting  [2][]chan struct{}
+	priority []*hostPathRule
+}
+
+// NewRequestQueue returns a RequestQueue letting max requests through at
+// once. priority is a comma separated list of host[/path] entries, e.g.
+// *.example.com or localhost/healthz, the host a shell pattern and the path
+// a prefix, for the requests to let through first.
+func NewRequestQueue(max int, priority string) *RequestQueue {
+	return &RequestQueue{max: max, priority: parseHostPathRules(priority)}
+}
+
+// High reports whether req is to be let through ahead of others.
+func (q *RequestQueue) High(req *http.Request) bool {
+	return matchHostPath(q.priority, req)
+}
+
+// Acquire takes a slot for a request, waiting up to wait for one to be
+// freed. It reports false if none was, and the request must not go on.
+func (q *RequestQueue) Acquire(ctx context.Context, high bool, wait time.Duration) bool {
+	q.mutex.Lock()
+	if q.active < q.max {
+		q.active++
+		q.mutex.Unlock()
+		return true
+	}
+	level := 1
+	if high {
+		level = 0
+	}
+	ready := make(chan struct{})
+	q.waiting[level] = append(q.waiting[level], ready)
+	q.mutex.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, waiter := range q.waiting[level] {
+		if waiter == ready {
+			q.waiting[level] = append(q.waiting[level][:i], q.waiting[level][i+1:]...)
+			return false
+		}
+	}
+	// handed a slot just as the wait ended, pass it on
+	q.release()
+	return false
+}
+
+// Release frees the slot of a request that is done.
+func (q *RequestQueue) Release() {
+	q.mutex.Lock()
+	q.release()
+	q.mutex.Unlock()
+}
+
+// release hands the slot to the next waiter in line, if any. q.mutex must
+// be held.
+func (q *RequestQueue) release() {
+	for level, waiting := range q.waiting {
+		if len(waiting) > 0 {
+			close(waiting[0])
+			q.waiting[level] = waiting[1:]
+			return
+		}
+	}
+	q.active--
+}
+
+// Waiting returns the number of requests waiting for a slot.
+func (q *RequestQueue) Waiting() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.waiting[0]) + len(q.waiting[1])
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueueRefusesWhenFull(t *testing.T) {
+	origin, read, release := holdingOrigin(t)
+	p := newTestProxy(t, "-max-concurrent", "1", "-queue-wait", "0")
+	held := holdBudget(t, p, origin, read)
+
+	resp, body := getThrough(t, p, origin.URL)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("request over -max-concurrent got %s %q", resp.Status, body)
+	}
+	close(release)
+	if status := <-held; status != http.StatusOK {
+		t.Errorf("held request got %d", status)
+	}
+	if resp, _ = getThrough(t, p, origin.URL); resp.StatusCode != http.StatusOK {
+		t.Errorf("request after the slot was freed got %s", resp.Status)
+	}
+}
+
+func TestQueueWaitsForSlot(t *testing.T) {
+	origin, read, release := holdingOrigin(t)
+	p := newTestProxy(t, "-max-concurrent", "1", "-queue-wait", "5s")
+	held := holdBudget(t, p, origin, read)
+
+	waited := make(chan int, 1)
+	go func() {
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			waited <- 0
+			return
+		}
+		resp.Body.Close()
+		waited <- resp.StatusCode
+	}()
+	select {
+	case status := <-waited:
+		t.Fatalf("request got %d while the only slot was taken", status)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-held
+	if status := <-waited; status != http.StatusOK {
+		t.Errorf("waiting request got %d once the slot was freed", status)
+	}
+}
+
+// The slot is the request's, not the connection's: a kept-alive client
+// connection, or an upgraded one being relayed, holds none.
+func TestQueueSlotFreedBeforeKeepAlive(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t, "-max-concurrent", "1", "-queue-wait", "0")
+	idle := p.client()
+	t.Cleanup(idle.CloseIdleConnections)
+	resp, err := idle.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+
+	if resp, _ = getThrough(t, p, origin.URL); resp.StatusCode != http.StatusOK {
+		t.Errorf("request beside an idle kept-alive connection got %s", resp.Status)
+	}
+}
+
+func TestQueueSlotFreedBeforeRelay(t *testing.T) {
+	ws := wsEchoOrigin(t)
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t, "-max-concurrent", "1", "-queue-wait", "0")
+	upgradeThrough(t, p, ws)
+
+	if resp, _ := getThrough(t, p, origin.URL); resp.StatusCode != http.StatusOK {
+		t.Errorf("request beside a relayed websocket got %s", resp.Status)
+	}
+}
+
+func TestQueuePriorityFirst(t *testing.T) {
+	q := NewRequestQueue(1, "localhost/healthz")
+	if !q.High(httptestRequest("http://localhost/healthz/live")) || q.High(httptestRequest("http://localhost/api")) {
+		t.Fatal("-priority entries matched the wrong requests")
+	}
+	q.Acquire(context.Background(), false, 0)
+
+	order := make(chan string, 2)
+	wait := func(name string, high bool) {
+		if q.Acquire(context.Background(), high, 5*time.Second) {
+			order <- name
+			q.Release()
+		}
+	}
+	go wait("low", false)
+	for q.Waiting() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go wait("high", true)
+	for q.Waiting() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Release()
+	if first, second := <-order, <-order; first != "high" || second != "low" {
+		t.Errorf("slots went to %s then %s, want the high priority waiter first", first, second)
+	}
+}
+
+func TestQueueWaitEndsOnCancel(t *testing.T) {
+	q := NewRequestQueue(1, "")
+	q.Acquire(context.Background(), false, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if q.Acquire(ctx, false, time.Minute) {
+		t.Fatal("canceled request got a taken slot")
+	}
+	if n := q.Waiting(); n != 0 {
+		t.Errorf("%d still waiting after the cancel", n)
+	}
+	// the slot goes back to being free once released
+	q.Release()
+	if !q.Acquire(context.Background(), false, 0) {
+		t.Error("released slot not free")
+	}
+}
+
+func httptestRequest(url string) *http.Request {
+	req, _ := http.NewRequest("GET", url, nil)
+	return req
+}
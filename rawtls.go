@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+)
+
+// maxMethodLen is the longest request method looksLikeHTTP accepts.
+const maxMethodLen = 24
+
+// looksLikeHTTP reports whether the stream read through br starts with a
+// request line, i.e. a method token followed by a space. It waits for the
+// client to send something, so protocols where the server speaks first
+// are not detected.
+func looksLikeHTTP(br *bufio.Reader) bool {
+	for n := 1; n <= maxMethodLen+1; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch c := b[n-1]; {
+		case c == ' ':
+			return n > 1
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// relayDecrypted passes a decrypted client stream that isn't http on to
+// addr, the target of its CONNECT, over a new TLS connection.
+func (hw *HandlerWrapper) relayDecrypted(conn net.Conn, addr string) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), hw.dialer.Timeout)
+	defer cancel()
+	connOut, err := hw.DialFunc(ctx, "tcp", hw.dialAddr(addr))
+	if err != nil {
+		logger.Warnln("dial", addr, "for non-http stream error:", err)
+		return
+	}
+	defer connOut.Close()
+	tlsOut, err := handshake(ctx, connOut, addr, hw.tlsConfig.UpstreamConfig(addr), &Timing{})
+	if err != nil {
+		logger.Warnln("tls dial to", addr, "for non-http stream error:", err)
+		return
+	}
+	logger.Debugln("relaying non-http stream to", addr)
+	if err = Transport(conn, tlsOut, *hw.MyConfig.TunnelLinger); err != nil {
+		logger.Debugln("relay", addr, "error:", err)
+	}
+}
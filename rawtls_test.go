@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsEchoOrigin serves TLS with the cert of the tls test server origin,
+// echoing back what it gets, and returns its address.
+func tlsEchoOrigin(t *testing.T, origin *httptest.Server) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", origin.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNonHTTPStreamRelayed(t *testing.T) {
+	origin := tlsOrigin(t)
+	addr := tlsEchoOrigin(t, origin)
+	_, port, _ := net.SplitHostPort(addr)
+	p := newTestProxy(t, "-intercept-ports", port)
+	p.trust(origin)
+
+	conn := p.connect(t, addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: testCAPool()})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if org := tlsConn.ConnectionState().PeerCertificates[0].Issuer.Organization; len(org) == 0 || org[0] != "gomitmproxy"+Version {
+		t.Fatalf("stream not intercepted, cert issued by %v", org)
+	}
+	// a binary protocol, then one whose first word looks like a method
+	for _, msg := range []string{"\x00\x01\x02binary\n", "HELLO\tthere\n"} {
+		tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(tlsConn, msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(tlsConn, got); err != nil {
+			t.Fatalf("no echo of %q: %s", msg, err)
+		}
+		if string(got) != msg {
+			t.Errorf("echo %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestLooksLikeHTTP(t *testing.T) {
+	for stream, want := range map[string]bool{
+		"GET / HTTP/1.1\r\n":           true,
+		"PROPFIND /dav HTTP/1.1\r\n":   true,
+		"M-SEARCH * HTTP/1.1\r\n":      true,
+		"\x16\x03\x01\x00":             false,
+		" GET /":                       false,
+		"SSH-2.0-OpenSSH_9.0\r\n":      false,
+		strings.Repeat("A", 40) + " /": false,
+		"GET":                          false,
+	} {
+		if got := looksLikeHTTP(bufio.NewReader(strings.NewReader(stream))); got != want {
+			t.Errorf("looksLikeHTTP(%q) = %v, want %v", stream, got, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	recordBatch = 100
+	recordQueue = 1000
+)
+
+const recordSchema = `CREATE TABLE IF NOT EXISTS transactions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	host TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	request_header TEXT,
+	request_body BLOB,
+	response_header TEXT,
+	response_body BLOB,
+	duration_ms REAL
+)`
+
+// Recorder writes transactions into a SQLite database for later querying.
+// Like the Exporter it queues transactions and writes them in batches from a
+// single goroutine, so the database never slows proxying down.
+type Recorder struct {
+	db    *sql.DB
+	queue chan *Transaction
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRecorder opens or creates the database at path. The sqlite driver is
+// only linked into binaries built with -tags sqlite.
+func NewRecorder(path string) (*Recorder, error) {
+	if !hasDriver("sqlite") {
+		return nil, errors.New("recording needs sqlite support, build with -tags sqlite")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(recordSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	r := &Recorder{
+		db:    db,
+		queue: make(chan *Transaction, recordQueue),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+func hasDriver(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Record queues t for writing, dropping it if the queue is full.
+func (r *Recorder) Record(t *Transaction) {
+	select {
+	case r.queue <- t:
+	default:
+		logger.Warnln("recorder queue full, dropping transaction", t.URL)
+	}
+}
+
+// Close writes the transactions still queued and closes the database. It
+// must be called once Record no longer is.
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+	return r.db.Close()
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	var batch []*Transaction
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.insert(batch); err != nil {
+			logger.Warnln("record transactions error:", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case t := <-r.queue:
+			batch = append(batch, t)
+			if len(batch) >= recordBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-r.stop:
+			for {
+				select {
+				case t := <-r.queue:
+					batch = append(batch, t)
+					continue
+				default:
+				}
+				break
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (r *Recorder) insert(batch []*Transaction) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO transactions (time, host, method, url, status,
+		request_header, request_body, response_header, response_body, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, t := range batch {
+		var host string
+		if u, err := url.Parse(t.URL); err == nil {
+			host = u.Host
+		}
+		reqHeader, _ := json.Marshal(t.RequestHeader)
+		respHeader, _ := json.Marshal(t.ResponseHeader)
+		_, err = stmt.Exec(t.Time, host, t.Method, t.URL, t.Status,
+			string(reqHeader), []byte(t.RequestBody), string(respHeader), []byte(t.ResponseBody),
+			float64(t.Duration)/float64(time.Millisecond))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,138 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLite stands in for the sqlite driver, which only builds with -tags
+// sqlite. It remembers the urls inserted into each database and whether the
+// database was closed.
+type fakeSQLite struct {
+	mutex sync.Mutex
+	dbs   map[string]*fakeDB
+}
+
+type fakeDB struct {
+	urls   []string
+	open   int
+	closed bool
+}
+
+var sqliteFake = &fakeSQLite{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("sqlite", sqliteFake)
+}
+
+func (d *fakeSQLite) db(name string) *fakeDB {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.dbs[name] == nil {
+		d.dbs[name] = &fakeDB{}
+	}
+	return d.dbs[name]
+}
+
+// state returns the urls inserted into the database name and whether every
+// connection to it was closed.
+func (d *fakeSQLite) state(name string) ([]string, bool) {
+	db := d.db(name)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), db.urls...), db.closed && db.open == 0
+}
+
+func (d *fakeSQLite) Open(name string) (driver.Conn, error) {
+	db := d.db(name)
+	d.mutex.Lock()
+	db.open++
+	d.mutex.Unlock()
+	return &fakeConn{d, db}, nil
+}
+
+type fakeConn struct {
+	d  *fakeSQLite
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.d.mutex.Lock()
+	defer c.d.mutex.Unlock()
+	c.db.open--
+	c.db.closed = true
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(strings.TrimSpace(s.query), "INSERT") {
+		s.c.d.mutex.Lock()
+		s.c.db.urls = append(s.c.db.urls, args[3].(string))
+		s.c.d.mutex.Unlock()
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+func TestRecorderWritesTransactions(t *testing.T) {
+	origin := textOrigin(t, "recorded")
+	name := t.Name() + ".db"
+	p := newTestProxy(t, "-record", name)
+	for _, path := range []string{"/one", "/two"} {
+		resp, err := p.client().Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+	}
+	// the batch waits for the ticker, closing writes it out
+	p.Close()
+	urls, closed := sqliteFake.state(name)
+	if len(urls) != 2 || urls[0] != origin.URL+"/one" || urls[1] != origin.URL+"/two" {
+		t.Errorf("database got %q", urls)
+	}
+	if !closed {
+		t.Error("database left open by Close")
+	}
+}
+
+func TestRecorderCloseFlushesQueue(t *testing.T) {
+	name := t.Name() + ".db"
+	r, err := NewRecorder(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < recordBatch+10; i++ {
+		r.Record(&Transaction{URL: "http://example.com/"})
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if urls, closed := sqliteFake.state(name); len(urls) != recordBatch+10 || !closed {
+		t.Errorf("%d of %d transactions written by close, closed=%v", len(urls), recordBatch+10, closed)
+	}
+}
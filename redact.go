@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+const redactedValue = "[REDACTED]"
+
+var contentLengthLine = regexp.MustCompile(`(?im)^Content-Length:[ \t]*[0-9]+`)
+
+// Redactor hides secrets in what the proxy logs and captures, while the
+// traffic it forwards is left alone. Header fields are redacted by name, urls
+// and bodies by a pattern: its matches are replaced, or only the groups in
+// them if it has any. A nil Redactor redacts nothing.
+type Redactor struct {
+	headers map[string]bool
+	pattern *regexp.Regexp
+}
+
+// NewRedactor returns a Redactor for the comma separated header names and
+// the body pattern, nil if both are empty.
+func NewRedactor(headers, pattern string) (*Redactor, error) {
+	names := splitList(headers)
+	if len(names) == 0 && pattern == "" {
+		return nil, nil
+	}
+	r := &Redactor{headers: make(map[string]bool)}
+	for _, name := range names {
+		r.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	if pattern != "" {
+		var err error
+		if r.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid redaction pattern: %s", err)
+		}
+	}
+	return r, nil
+}
+
+// Header returns a copy of h with the redacted fields' values replaced.
+func (r *Redactor) Header(h http.Header) http.Header {
+	if r == nil || h == nil || len(r.headers) == 0 {
+		return h
+	}
+	redacted := h.Clone()
+	for name, values := range redacted {
+		if r.headers[name] {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// Body returns b with the pattern's matches replaced.
+func (r *Redactor) Body(b []byte) []byte {
+	if r == nil || r.pattern == nil {
+		return b
+	}
+	var out []byte
+	last := 0
+	for _, m := range r.pattern.FindAllSubmatchIndex(b, -1) {
+		spans := m[2:]
+		if len(spans) == 0 {
+			spans = m[:2]
+		}
+		for i := 0; i < len(spans); i += 2 {
+			start, end := spans[i], spans[i+1]
+			if start < last {
+				continue
+			}
+			out = append(out, b[last:start]...)
+			out = append(out, redactedValue...)
+			last = end
+		}
+	}
+	if out == nil {
+		return b
+	}
+	return append(out, b[last:]...)
+}
+
+// Dump redacts a raw http message dump, keeping its Content-Length in line
+// with the redacted body so the dump still parses.
+func (r *Redactor) Dump(dump []byte) []byte {
+	if r == nil {
+		return dump
+	}
+	i := bytes.Index(dump, []byte("\r\n\r\n"))
+	if i < 0 {
+		return r.Body(dump)
+	}
+	lines := bytes.Split(dump[:i], []byte("\r\n"))
+	for n, line := range lines[1:] {
+		if j := bytes.IndexByte(line, ':'); j > 0 && r.headers[http.CanonicalHeaderKey(string(line[:j]))] {
+			lines[n+1] = append(line[:j:j], ": "+redactedValue...)
+		}
+	}
+	head := r.Body(bytes.Join(lines, []byte("\r\n")))
+	body := r.Body(dump[i+4:])
+	if len(body) != len(dump)-i-4 {
+		head = contentLengthLine.ReplaceAll(head, []byte("Content-Length: "+strconv.Itoa(len(body))))
+	}
+	return append(append(head, "\r\n\r\n"...), body...)
+}
+
+// Transaction redacts the url, headers and bodies of t in place. The
+// headers are replaced by redacted copies as they may still be in use.
+func (r *Redactor) Transaction(t *Transaction) {
+	if r == nil {
+		return
+	}
+	t.URL = string(r.Body([]byte(t.URL)))
+	t.RequestHeader = r.Header(t.RequestHeader)
+	t.ResponseHeader = r.Header(t.ResponseHeader)
+	t.ResponseTrailer = r.Header(t.ResponseTrailer)
+	t.RequestBody = string(r.Body([]byte(t.RequestBody)))
+	t.ResponseBody = string(r.Body([]byte(t.ResponseBody)))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// secretOrigin answers with a token in its body and sends what it got in
+// the Authorization field and the body of each request to got.
+func secretOrigin(t *testing.T) (*httptest.Server, chan string) {
+	got := make(chan string, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- r.Header.Get("Authorization") + " " + string(b)
+		w.Header().Set("Set-Cookie", "session=s3cret")
+		io.WriteString(w, `{"token":"abc123"}`)
+	}))
+	t.Cleanup(origin.Close)
+	return origin, got
+}
+
+func postSecret(t *testing.T, p *testProxy, url string) string {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(`{"token":"xyz789"}`))
+	req.Header.Set("Authorization", "Bearer hunter2")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, resp)
+}
+
+func TestRedactedInCaptures(t *testing.T) {
+	c := newCollector(t)
+	origin, got := secretOrigin(t)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-collector", c.URL, "-collector-batch", "1",
+		"-redact-headers", "authorization,Set-Cookie", "-redact-body", `"token":"([^"]*)"`)
+
+	// the origin and the client see the secrets untouched
+	if body := postSecret(t, p, origin.URL+"/login?token=abc"); body != `{"token":"abc123"}` {
+		t.Errorf("client got %q", body)
+	}
+	if g := <-got; g != `Bearer hunter2 {"token":"xyz789"}` {
+		t.Errorf("origin got %q", g)
+	}
+
+	select {
+	case batch := <-c.got:
+		tx := batch[0]
+		if h := tx.RequestHeader.Get("Authorization"); h != redactedValue {
+			t.Errorf("captured Authorization %q", h)
+		}
+		if h := tx.ResponseHeader.Get("Set-Cookie"); h != redactedValue {
+			t.Errorf("captured Set-Cookie %q", h)
+		}
+		if tx.RequestBody != `{"token":"[REDACTED]"}` || tx.ResponseBody != `{"token":"[REDACTED]"}` {
+			t.Errorf("captured bodies %q and %q", tx.RequestBody, tx.ResponseBody)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing posted to the collector")
+	}
+
+	// the redacted copies don't leak into the history either
+	tx := lastTransaction(t, p)
+	if h := tx.RequestHeader.Get("Authorization"); h != redactedValue {
+		t.Errorf("history Authorization %q", h)
+	}
+}
+
+func TestRedactedInMonitor(t *testing.T) {
+	origin, _ := secretOrigin(t)
+	p := newTestProxy(t, "-m", "-monitor-block",
+		"-redact-headers", "Authorization,Set-Cookie", "-redact-body", `"token":"([^"]*)"`)
+
+	printed := monitorOutput(t, p.monitor)
+	postSecret(t, p, origin.URL+"/login")
+
+	select {
+	case out := <-printed:
+		for _, secret := range []string{"hunter2", "xyz789", "abc123", "s3cret"} {
+			if strings.Contains(out, secret) {
+				t.Errorf("monitor printed %q:\n%s", secret, out)
+			}
+		}
+		if !strings.Contains(out, redactedValue) {
+			t.Errorf("monitor printed nothing redacted:\n%s", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing printed by the monitor")
+	}
+}
+
+func TestRedactorDumpKeepsContentLength(t *testing.T) {
+	r, err := NewRedactor("Cookie", `secret`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := []byte("POST /a HTTP/1.1\r\nHost: example.com\r\nCookie: id=1\r\nContent-Length: 11\r\n\r\nsecret=true")
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(r.Dump(dump))))
+	if err != nil {
+		t.Fatalf("redacted dump doesn't parse: %s", err)
+	}
+	b, _ := io.ReadAll(req.Body)
+	if string(b) != "[REDACTED]=true" || req.Header.Get("Cookie") != redactedValue {
+		t.Errorf("redacted dump has Cookie %q and body %q", req.Header.Get("Cookie"), b)
+	}
+}
+
+func TestRedactorOffByDefault(t *testing.T) {
+	r, err := NewRedactor("", "")
+	if r != nil || err != nil {
+		t.Fatalf("NewRedactor of nothing = %v, %v", r, err)
+	}
+	h := http.Header{"Authorization": {"Bearer x"}}
+	if r.Header(h).Get("Authorization") != "Bearer x" || string(r.Body([]byte("x"))) != "x" {
+		t.Error("nil Redactor redacted")
+	}
+	if err := initError("-redact-body", "("); err == nil {
+		t.Error("invalid redaction pattern accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// replaceRule replaces a literal string, or the matches of a regexp, in a
+// body. A regexp's replacement may refer to its groups as $1 or ${name}.
+type replaceRule struct {
+	literal     []byte
+	pattern     *regexp.Regexp
+	replacement []byte
+}
+
+// parseReplaceRule parses a rule of the form /find/replacement, where the
+// first character separates find from the replacement and can be any that
+// find doesn't contain, e.g. |https://api.example.com|http://localhost:8080.
+func parseReplaceRule(rule string, isRegexp bool) (*replaceRule, error) {
+	if len(rule) < 2 {
+		return nil, fmt.Errorf("Invalid replace rule %q, want /find/replacement", rule)
+	}
+	find, replacement, ok := strings.Cut(rule[1:], rule[:1])
+	if !ok || find == "" {
+		return nil, fmt.Errorf("Invalid replace rule %q, want /find/replacement", rule)
+	}
+	r := &replaceRule{replacement: []byte(replacement)}
+	if !isRegexp {
+		r.literal = []byte(find)
+		return r, nil
+	}
+	var err error
+	if r.pattern, err = regexp.Compile(find); err != nil {
+		return nil, fmt.Errorf("Invalid replace regexp %q: %s", find, err)
+	}
+	return r, nil
+}
+
+func (r *replaceRule) apply(body []byte) []byte {
+	if r.pattern != nil {
+		return r.pattern.ReplaceAll(body, r.replacement)
+	}
+	return bytes.ReplaceAll(body, r.literal, r.replacement)
+}
+
+// BodyReplacer applies find and replace rules to response bodies with
+// matching content types, in the order they were given. Gzipped bodies are
+// decoded first and, if anything was replaced, sent on uncompressed. Bodies
+// over the size limit are passed on unchanged.
+type BodyReplacer struct {
+	rules []*replaceRule
+	types []string
+	max   int64
+}
+
+// NewBodyReplacer returns a BodyReplacer for the literal and regexp rules,
+// nil if there are none. types is a comma separated list of content type
+// patterns like text/*.
+func NewBodyReplacer(literals, regexps []string, types string, max int64) (*BodyReplacer, error) {
+	if len(literals) == 0 && len(regexps) == 0 {
+		return nil, nil
+	}
+	r := &BodyReplacer{types: splitList(types), max: max}
+	for _, pattern := range r.types {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid replace content type %q: %s", pattern, err)
+		}
+	}
+	for i, rules := range [][]string{literals, regexps} {
+		for _, rule := range rules {
+			parsed, err := parseReplaceRule(rule, i == 1)
+			if err != nil {
+				return nil, err
+			}
+			r.rules = append(r.rules, parsed)
+		}
+	}
+	return r, nil
+}
+
+// Response applies the rules to the body of resp, answering req.
+func (r *BodyReplacer) Response(req *http.Request, resp *http.Response) {
+	if req.Method == "HEAD" || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.Body == nil || resp.ContentLength > r.max || !matchesMediaType(r.types, resp.Header) {
+		return
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		return
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, r.max+1))
+	if err != nil || int64(len(buf)) > r.max {
+		if err != nil {
+			logger.Debugln("read response body of", req.URL, "to replace error:", err)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+
+	body := buf
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return
+		}
+		if body, err = ioutil.ReadAll(io.LimitReader(zr, r.max+1)); err != nil || int64(len(body)) > r.max {
+			return
+		}
+	}
+	replaced := body
+	for _, rule := range r.rules {
+		replaced = rule.apply(replaced)
+	}
+	if bytes.Equal(replaced, body) {
+		return
+	}
+	logger.Debugln("replaced in response body of", req.URL)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(replaced))
+	resp.ContentLength = int64(len(replaced))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(replaced)))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// getReplaced gets url through p, checking the body is as long as the
+// response says.
+func getReplaced(t *testing.T, p *testProxy, url string) (*http.Response, string) {
+	t.Helper()
+	resp, body := getThrough(t, p, url)
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("response declares %d bytes, has %d", resp.ContentLength, len(body))
+	}
+	return resp, body
+}
+
+func TestReplaceLiteral(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{"api":"https://api.example.com/v1","cdn":"https://api.example.com.cdn"}`, false)
+	p := newTestProxy(t, "-replace", "|https://api.example.com|http://localhost:8080")
+	if _, body := getReplaced(t, p, origin.URL); body != `{"api":"http://localhost:8080/v1","cdn":"http://localhost:8080.cdn"}` {
+		t.Errorf("replaced body %q", body)
+	}
+}
+
+func TestReplaceRegexpAfterLiterals(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{"version":"v12","host":"old.example.com"}`, false)
+	p := newTestProxy(t, "-replace-regexp", `/"v(\d+)"/"version $1"`,
+		"-replace", "/old.example.com/new.example.com", "-replace-regexp", `/(\w+)\.example\.com/$1.test`)
+	if _, body := getReplaced(t, p, origin.URL); body != `{"version":"version 12","host":"new.test"}` {
+		t.Errorf("replaced body %q", body)
+	}
+}
+
+func TestReplaceGzipped(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{"host":"old.example.com"}`, true)
+	p := newTestProxy(t, "-replace", "/old/new")
+	// sent on uncompressed, the client has nothing to decode
+	resp, body := getReplaced(t, p, origin.URL)
+	if body != `{"host":"new.example.com"}` || resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("replaced body %q, Content-Encoding %q", body, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestReplaceLeavesOtherBodies(t *testing.T) {
+	origin := jsonOrigin(t, "a", `{"host":"old.example.com"}`, false)
+	for name, args := range map[string][]string{
+		"other type": {"-replace", "/old/new", "-replace-types", "text/*"},
+		"too large":  {"-replace", "/old/new", "-replace-max", "8"},
+	} {
+		p := newTestProxy(t, args...)
+		if _, body := getReplaced(t, p, origin.URL); body != `{"host":"old.example.com"}` {
+			t.Errorf("%s: body %q, want it unchanged", name, body)
+		}
+	}
+}
+
+func TestReplaceRulesChecked(t *testing.T) {
+	for _, args := range [][]string{
+		{"-replace", "x"},
+		{"-replace", "//new"},
+		{"-replace", "/old"},
+		{"-replace-regexp", "/(/new"},
+		{"-replace", "/old/new", "-replace-types", "text/["},
+	} {
+		if err := initError(args...); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
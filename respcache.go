@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache caches responses to GET requests. Fresh entries are served
+// without asking the origin; stale entries carrying an ETag or Last-Modified
+// validator are revalidated with a conditional request, and their body is
+// served again when the origin answers 304 Not Modified. Requests carrying
+// cookies, whose responses may be personal, bypass the cache.
+type ResponseCache struct {
+	mutex        sync.Mutex
+	entries      map[string]*list.Element
+	lru          *list.List
+	maxEntries   int
+	maxEntrySize int64
+}
+
+type cacheEntry struct {
+	url string
+	// the request header fields the response varies on, with the values
+	// of the request it was stored for
+	vary    http.Header
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewResponseCache creates a ResponseCache holding at most maxEntries
+// responses, none with a body larger than maxEntrySize.
+func NewResponseCache(maxEntries int, maxEntrySize int64) *ResponseCache {
+	return &ResponseCache{
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+		maxEntries:   maxEntries,
+		maxEntrySize: maxEntrySize,
+	}
+}
+
+// Lookup returns the entry cached for req, if any, and whether it is still
+// fresh enough to be served without revalidation. A client asking for
+// no-cache gets the entry only for revalidation.
+func (rc *ResponseCache) Lookup(req *http.Request) (entry *cacheEntry, fresh bool) {
+	if bypassesCache(req) {
+		return nil, false
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	elem := rc.entries[req.URL.String()]
+	if elem == nil {
+		return nil, false
+	}
+	entry = elem.Value.(*cacheEntry)
+	if !entry.matches(req) {
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	cacheControl := req.Header.Get("Cache-Control")
+	if hasDirective(cacheControl, "no-cache") || hasDirective(cacheControl, "max-age=0") ||
+		hasDirective(req.Header.Get("Pragma"), "no-cache") {
+		return entry, false
+	}
+	return entry, time.Now().Before(entry.expires)
+}
+
+// bypassesCache reports whether req may neither be answered from the cache
+// nor have its response stored: it isn't a GET, carries cookies the
+// response may depend on, or the client asked for no-store.
+func bypassesCache(req *http.Request) bool {
+	return req.Method != "GET" || req.Header.Get("Cookie") != "" ||
+		hasDirective(req.Header.Get("Cache-Control"), "no-store")
+}
+
+// hasDirective reports whether the comma separated list of directives value,
+// e.g. a Cache-Control header, holds directive, with any argument when
+// directive is only a name.
+func hasDirective(value, directive string) bool {
+	for _, d := range strings.Split(value, ",") {
+		d = strings.TrimSpace(d)
+		name, _, _ := strings.Cut(d, "=")
+		if strings.EqualFold(d, directive) || strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// varyFields returns the request header fields named by the Vary headers
+// of a response with header.
+func varyFields(header http.Header) []string {
+	var fields []string
+	for _, vary := range header["Vary"] {
+		for _, field := range strings.Split(vary, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+// matches reports whether req sends the same values as the request entry
+// was stored for in every header field the response varies on.
+func (entry *cacheEntry) matches(req *http.Request) bool {
+	for field, values := range entry.vary {
+		if strings.Join(req.Header.Values(field), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// addConditions makes req conditional on entry's validators and reports
+// whether it did. Requests the client already made conditional are left
+// alone, since the client expects the origin's answer to its own condition.
+func (entry *cacheEntry) addConditions(req *http.Request) bool {
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	etag := entry.header.Get("Etag")
+	lastModified := entry.header.Get("Last-Modified")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return etag != "" || lastModified != ""
+}
+
+// response builds a response to req from the cached entry.
+func (entry *cacheEntry) response(req *http.Request) *http.Response {
+	header := make(http.Header)
+	for k, v := range entry.header {
+		header[k] = append([]string(nil), v...)
+	}
+	return syntheticResponse(req, entry.status, header, entry.body)
+}
+
+// Revalidated refreshes entry with the headers of a 304 response and returns
+// the cached response to serve instead. Requests read cached entries without
+// the lock, so entry is left as it is and a refreshed copy takes its place.
+func (rc *ResponseCache) Revalidated(entry *cacheEntry, notModified *http.Response, req *http.Request) *http.Response {
+	refreshed := *entry
+	refreshed.header = make(http.Header, len(entry.header))
+	for k, v := range entry.header {
+		refreshed.header[k] = v
+	}
+	for k, v := range notModified.Header {
+		switch k {
+		case "Connection", "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		refreshed.header[k] = append([]string(nil), v...)
+	}
+	refreshed.expires = freshUntil(refreshed.header)
+	rc.mutex.Lock()
+	if elem := rc.entries[entry.url]; elem != nil && elem.Value == entry {
+		elem.Value = &refreshed
+	}
+	rc.mutex.Unlock()
+	return refreshed.response(req)
+}
+
+// cacheable reports whether resp to req may be stored.
+func cacheable(req *http.Request, resp *http.Response) bool {
+	if bypassesCache(req) || resp.StatusCode != http.StatusOK ||
+		req.Header.Get("Authorization") != "" || resp.Header.Get("Set-Cookie") != "" ||
+		len(resp.Trailer) > 0 {
+		// trailers arrive after the body and are not kept with the entry
+		return false
+	}
+	cacheControl := resp.Header.Get("Cache-Control")
+	if hasDirective(cacheControl, "no-store") || hasDirective(cacheControl, "private") {
+		return false
+	}
+	for _, field := range varyFields(resp.Header) {
+		if field == "*" {
+			// varies on more than the request, never matches
+			return false
+		}
+	}
+	hasValidator := resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+	return hasValidator || freshUntil(resp.Header).After(time.Now())
+}
+
+// freshUntil returns when a response with header goes stale.
+func freshUntil(header http.Header) time.Time {
+	now := time.Now()
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-cache") {
+		return now
+	}
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			if age, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				return now.Add(time.Duration(age) * time.Second)
+			}
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires
+	}
+	return now
+}
+
+// Store arranges for resp to be cached once its body has been read through,
+// if it is cacheable and small enough.
+func (rc *ResponseCache) Store(req *http.Request, resp *http.Response) {
+	if !cacheable(req, resp) || resp.ContentLength > rc.maxEntrySize {
+		return
+	}
+	entry := &cacheEntry{
+		url:     req.URL.String(),
+		vary:    make(http.Header),
+		status:  resp.StatusCode,
+		header:  make(http.Header),
+		expires: freshUntil(resp.Header),
+	}
+	for _, field := range varyFields(resp.Header) {
+		entry.vary[field] = req.Header.Values(field)
+	}
+	for k, v := range resp.Header {
+		entry.header[k] = append([]string(nil), v...)
+	}
+	resp.Body = &cacheFiller{ReadCloser: resp.Body, cache: rc, entry: entry}
+}
+
+func (rc *ResponseCache) add(entry *cacheEntry) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if elem := rc.entries[entry.url]; elem != nil {
+		rc.lru.Remove(elem)
+	}
+	rc.entries[entry.url] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.maxEntries {
+		oldest := rc.lru.Remove(rc.lru.Back()).(*cacheEntry)
+		delete(rc.entries, oldest.url)
+	}
+}
+
+// cacheFiller copies a response body as it is read and adds the entry to
+// the cache once the whole body has been seen.
+type cacheFiller struct {
+	io.ReadCloser
+	cache *ResponseCache
+	entry *cacheEntry
+	buf   bytes.Buffer
+	full  bool
+}
+
+func (cf *cacheFiller) Read(p []byte) (int, error) {
+	n, err := cf.ReadCloser.Read(p)
+	if !cf.full {
+		cf.buf.Write(p[:n])
+		if int64(cf.buf.Len()) > cf.cache.maxEntrySize {
+			cf.full = true
+			cf.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !cf.full {
+		cf.entry.body = cf.buf.Bytes()
+		cf.cache.add(cf.entry)
+		cf.full = true
+	}
+	return n, err
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// cacheOrigin counts the requests reaching it and answers each path with
+// the headers given by its query, e.g. ?Cache-Control=max-age=60, with a
+// body numbering the request. Requests matching the ETag "v1" get 304.
+type cacheOrigin struct {
+	*httptest.Server
+	hits atomic.Int32
+	// the conditional header of the last request, if any
+	conditional atomic.Value
+}
+
+func newCacheOrigin(t *testing.T) *cacheOrigin {
+	o := &cacheOrigin{}
+	o.conditional.Store("")
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := o.hits.Add(1)
+		o.conditional.Store(r.Header.Get("If-None-Match"))
+		for k, v := range r.URL.Query() {
+			w.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` && w.Header().Get("Etag") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+// cachedGet sends a GET for url through p with the header lines given as
+// name: value pairs, returning the body.
+func cachedGet(t *testing.T, p *testProxy, url string, header ...string) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	for _, line := range header {
+		name, value, _ := strings.Cut(line, ": ")
+		req.Header.Add(name, value)
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s got %s", url, resp.Status)
+	}
+	return readAll(t, resp)
+}
+
+func TestCacheServesFreshResponses(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	url := o.URL + "/fresh?Cache-Control=max-age=60"
+	for i := 0; i < 3; i++ {
+		if got := cachedGet(t, p, url); got != "response 1" {
+			t.Errorf("request %d got %q, want the cached first response", i, got)
+		}
+	}
+	if o.hits.Load() != 1 {
+		t.Errorf("origin got %d requests for a fresh response", o.hits.Load())
+	}
+}
+
+func TestCacheRevalidatesStaleResponses(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	url := o.URL + `/stale?Etag="v1"&Cache-Control=no-cache`
+	cachedGet(t, p, url)
+	if got := cachedGet(t, p, url); got != "response 1" {
+		t.Errorf("revalidated response got %q, want the cached body", got)
+	}
+	if o.hits.Load() != 2 || o.conditional.Load() != `"v1"` {
+		t.Errorf("origin got %d requests, the last conditional on %q", o.hits.Load(), o.conditional.Load())
+	}
+}
+
+func TestCacheRevalidatedConcurrently(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	url := o.URL + `/stale?Etag="v1"&Cache-Control=no-cache`
+	cachedGet(t, p, url)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", url, nil)
+			resp, err := p.client().Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if got, _ := io.ReadAll(resp.Body); string(got) != "response 1" {
+				t.Errorf("revalidated response got %q, want the cached body", got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheBypassedByCookieRequests(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	url := o.URL + "/personal?Cache-Control=max-age=60"
+	if got := cachedGet(t, p, url, "Cookie: user=alice"); got != "response 1" {
+		t.Fatalf("got %q", got)
+	}
+	if got := cachedGet(t, p, url, "Cookie: user=bob"); got != "response 2" {
+		t.Errorf("response to one cookie served to another: %q", got)
+	}
+
+	// nor is a shared entry served to a request with cookies
+	cachedGet(t, p, url)
+	if got := cachedGet(t, p, url, "Cookie: user=alice"); got != "response 4" {
+		t.Errorf("cached response served to a request with cookies: %q", got)
+	}
+}
+
+func TestCacheHonoursRequestDirectives(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	url := o.URL + `/directives?Etag="v1"&Cache-Control=max-age=60`
+	cachedGet(t, p, url)
+
+	// no-cache has a fresh entry revalidated
+	if got := cachedGet(t, p, url, "Cache-Control: no-cache"); got != "response 1" || o.hits.Load() != 2 {
+		t.Errorf("no-cache got %q after %d origin requests", got, o.hits.Load())
+	}
+	if o.conditional.Load() != `"v1"` {
+		t.Error("no-cache request not made conditional on the cached entry")
+	}
+	cachedGet(t, p, url, "Pragma: no-cache")
+	if o.hits.Load() != 3 {
+		t.Error("Pragma: no-cache served from the cache")
+	}
+
+	// no-store goes to the origin unconditionally
+	if got := cachedGet(t, p, url, "Cache-Control: no-store"); got != "response 4" || o.conditional.Load() != "" {
+		t.Errorf("no-store got %q, conditional on %q", got, o.conditional.Load())
+	}
+	newURL := o.URL + "/nostore?Cache-Control=max-age=60"
+	cachedGet(t, p, newURL, "Cache-Control: no-store")
+	cachedGet(t, p, newURL)
+	if o.hits.Load() != 6 {
+		t.Error("response to a no-store request was stored")
+	}
+}
+
+func TestCacheRespectsVary(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	url := o.URL + "/vary?Cache-Control=max-age=60&Vary=User-Agent,Accept-Language"
+	cachedGet(t, p, url, "User-Agent: a", "Accept-Language: en")
+	if got := cachedGet(t, p, url, "User-Agent: a", "Accept-Language: en"); got != "response 1" {
+		t.Errorf("same variant got %q, want it from the cache", got)
+	}
+	if got := cachedGet(t, p, url, "User-Agent: a", "Accept-Language: de"); got != "response 2" {
+		t.Errorf("another language got %q, the cached variant", got)
+	}
+	if got := cachedGet(t, p, url, "User-Agent: b", "Accept-Language: de"); got != "response 3" {
+		t.Errorf("another user agent got %q, the cached variant", got)
+	}
+
+	star := o.URL + "/star?Cache-Control=max-age=60&Vary=*"
+	cachedGet(t, p, star)
+	if got := cachedGet(t, p, star); got != "response 5" {
+		t.Errorf("Vary: * response served from the cache: %q", got)
+	}
+}
+
+func TestCacheSkipsPrivateResponses(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "10")
+	for _, query := range []string{
+		"Cache-Control=private,max-age=60",
+		`Cache-Control=private="Set-Cookie",max-age=60`,
+		"Cache-Control=no-store,max-age=60",
+		"Cache-Control=max-age=60&Set-Cookie=a=1",
+	} {
+		before := o.hits.Load()
+		url := o.URL + "/private?" + strings.ReplaceAll(query, `"`, "%22")
+		cachedGet(t, p, url)
+		cachedGet(t, p, url)
+		if o.hits.Load()-before != 2 {
+			t.Errorf("response with %s was cached", query)
+		}
+	}
+	before := o.hits.Load()
+	url := o.URL + "/auth?Cache-Control=max-age=60"
+	cachedGet(t, p, url, "Authorization: Bearer x")
+	cachedGet(t, p, url, "Authorization: Bearer x")
+	if o.hits.Load()-before != 2 {
+		t.Error("response to an authorized request was cached")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	o := newCacheOrigin(t)
+	p := newTestProxy(t, "-cache", "2")
+	a, b, c := o.URL+"/a?Cache-Control=max-age=60", o.URL+"/b?Cache-Control=max-age=60", o.URL+"/c?Cache-Control=max-age=60"
+	cachedGet(t, p, a)
+	cachedGet(t, p, b)
+	cachedGet(t, p, a)
+	cachedGet(t, p, c) // evicts b
+	before := o.hits.Load()
+	cachedGet(t, p, a)
+	cachedGet(t, p, c)
+	if o.hits.Load() != before {
+		t.Error("recently used entries evicted")
+	}
+	cachedGet(t, p, b)
+	if o.hits.Load() != before+1 {
+		t.Error("least recently used entry kept")
+	}
+}
+
+func TestTrailersNotCached(t *testing.T) {
+	var hits atomic.Int32
+	origin := trailerOrigin(t, &hits)
+	p := newTestProxy(t, "-cache", "10")
+	for i := 0; i < 2; i++ {
+		resp, err := p.client().Get(origin.URL + "/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); body != "streamed" || resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("request %d got %q with trailer %v", i, body, resp.Trailer)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("origin answered %d of 2 requests, a response with trailers was cached", hits.Load())
+	}
+}
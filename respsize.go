@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// errResponseTooLarge fails reading a response body past -max-response.
+var errResponseTooLarge = errors.New("response body over the size limit")
+
+// responseCap limits a response body to max bytes as it is streamed. Past
+// them it either ends the body early, truncating it, or fails the read so
+// the response is aborted.
+type responseCap struct {
+	body      io.ReadCloser
+	max       int64
+	remaining int64
+	truncate  bool
+	url       string
+	// over is set once the body turned out larger than max
+	over bool
+}
+
+// capResponse limits the body of resp, answering a request for url, to max
+// bytes. A body known to be too large fails at once with
+// errResponseTooLarge, unless it is to be truncated.
+func capResponse(resp *http.Response, url string, max int64, truncate bool) (*responseCap, error) {
+	c := &responseCap{body: resp.Body, max: max, remaining: max, truncate: truncate, url: url}
+	if resp.ContentLength > max {
+		if !truncate {
+			return nil, errResponseTooLarge
+		}
+		logger.Warnln("truncating response from", url, "of", resp.ContentLength, "bytes to", max)
+		c.over = true
+		resp.ContentLength = max
+		resp.Header.Set("Content-Length", strconv.FormatInt(max, 10))
+	}
+	resp.Body = c
+	return c, nil
+}
+
+func (c *responseCap) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		if c.over {
+			return 0, c.overErr()
+		}
+		// a read of one more byte tells a body of exactly max bytes from
+		// a larger one
+		var b [1]byte
+		n, err := c.body.Read(b[:])
+		if n == 0 {
+			return 0, err
+		}
+		c.over = true
+		if c.truncate {
+			logger.Warnln("truncating response from", c.url, "at", c.max, "bytes")
+		}
+		return 0, c.overErr()
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.body.Read(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *responseCap) overErr() error {
+	if c.truncate {
+		return io.EOF
+	}
+	return fmt.Errorf("%w of %d bytes", errResponseTooLarge, c.max)
+}
+
+func (c *responseCap) Close() error {
+	return c.body.Close()
+}
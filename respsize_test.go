@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sizedOrigin answers with n bytes, with a Content-Length unless streamed,
+// in which case they are flushed out chunked.
+func sizedOrigin(t *testing.T, n int, streamed bool) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", n)
+		if !streamed {
+			io.WriteString(w, body)
+			return
+		}
+		for len(body) > 0 {
+			chunk := body[:min(len(body), 4)]
+			body = body[len(chunk):]
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestMaxResponseRejectsContentLength(t *testing.T) {
+	p := newTestProxy(t, "-max-response", "10")
+	resp, body := getThrough(t, p, sizedOrigin(t, 11, false).URL)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "over the 10 bytes allowed") {
+		t.Errorf("response over -max-response got %s %q", resp.Status, body)
+	}
+	// one of exactly the cap passes
+	resp, body = getThrough(t, p, sizedOrigin(t, 10, false).URL)
+	if resp.StatusCode != http.StatusOK || len(body) != 10 {
+		t.Errorf("response at -max-response got %s of %d bytes", resp.Status, len(body))
+	}
+}
+
+func TestMaxResponseAbortsStreamed(t *testing.T) {
+	p := newTestProxy(t, "-max-response", "10")
+	resp, err := p.client().Get(sizedOrigin(t, 40, true).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err == nil || len(b) > 10 {
+		t.Errorf("streamed response over -max-response read %d bytes, err %v", len(b), err)
+	}
+	// a streamed body of exactly the cap isn't cut off
+	resp, body := getThrough(t, p, sizedOrigin(t, 10, true).URL)
+	if resp.StatusCode != http.StatusOK || len(body) != 10 {
+		t.Errorf("streamed response at -max-response got %s of %d bytes", resp.Status, len(body))
+	}
+}
+
+func TestMaxResponseRejectsCaptured(t *testing.T) {
+	p := newTestProxy(t, "-m", "-max-response", "10")
+	p.monitor.out = io.Discard
+	// the captured body is buffered before anything is sent, so even a
+	// streamed one can still be answered with a 502
+	resp, _ := getThrough(t, p, sizedOrigin(t, 40, true).URL)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("captured response over -max-response got %s", resp.Status)
+	}
+}
+
+func TestMaxResponseTruncates(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	p := newTestProxy(t, "-max-response", "10", "-max-response-action", "truncate")
+	for _, streamed := range []bool{false, true} {
+		resp, body := getThrough(t, p, sizedOrigin(t, 40, streamed).URL)
+		if resp.StatusCode != http.StatusOK || body != strings.Repeat("x", 10) {
+			t.Errorf("truncated response (streamed %v) got %s %q", streamed, resp.Status, body)
+		}
+		if !streamed && resp.ContentLength != 10 {
+			t.Errorf("truncated Content-Length %d", resp.ContentLength)
+		}
+	}
+	if n := strings.Count(logged.String(), "truncating response"); n != 2 {
+		t.Errorf("%d truncations logged, want 2:\n%s", n, logged)
+	}
+}
+
+func TestMaxResponseAction(t *testing.T) {
+	if err := initError("-max-response-action", "drop"); err == nil {
+		t.Error("invalid -max-response-action accepted")
+	}
+}
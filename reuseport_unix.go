@@ -0,0 +1,21 @@
+//go:build (linux && !(mips || mipsle || mips64 || mips64le)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEPORT on a listening socket, letting several
+// sockets, in this process or others, listen on the same port with the
+// kernel spreading connections between them.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,103 @@
+//go:build (linux && !(mips || mipsle || mips64 || mips64le)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+// reusePortOf returns whether SO_REUSEPORT is set on the socket of l.
+func reusePortOf(t *testing.T, l net.Listener) bool {
+	t.Helper()
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		on, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return on != 0
+}
+
+func listenTestProxy(t *testing.T, args ...string) ([]net.Listener, error) {
+	listeners, err := listenProxy(newTestHandler(t, args...).MyConfig, "127.0.0.1:0")
+	for _, l := range listeners {
+		t.Cleanup(func() { l.Close() })
+	}
+	return listeners, err
+}
+
+func TestReusePortListeners(t *testing.T) {
+	listeners, err := listenTestProxy(t, "-reuse-port", "-listeners", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 3 {
+		t.Fatalf("%d listeners, want 3", len(listeners))
+	}
+	for _, l := range listeners {
+		if !reusePortOf(t, l) {
+			t.Errorf("listener on %s without SO_REUSEPORT", l.Addr())
+		}
+		if l.Addr().String() != listeners[0].Addr().String() {
+			t.Errorf("listener on %s, want all on %s", l.Addr(), listeners[0].Addr())
+		}
+	}
+
+	// another process can listen on the port too
+	lc := net.ListenConfig{Control: reusePortControl}
+	other, err := lc.Listen(t.Context(), "tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("sharing the port: %s", err)
+	}
+	other.Close()
+}
+
+func TestReusePortServesProxy(t *testing.T) {
+	origin := textOrigin(t, "reused")
+	p := newTestProxy(t, "-reuse-port", "-listeners", "2")
+	listeners, err := listenProxy(p.MyConfig, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners {
+		server := httptest.NewUnstartedServer(nil)
+		server.Config = p.proxyServer()
+		server.Listener = l
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+	p.URL.Host = listeners[0].Addr().String()
+	for i := 0; i < 10; i++ {
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); body != "reused" {
+			t.Errorf("got %q", body)
+		}
+	}
+}
+
+func TestReusePortOffByDefault(t *testing.T) {
+	listeners, err := listenTestProxy(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || reusePortOf(t, listeners[0]) {
+		t.Errorf("%d listeners, SO_REUSEPORT set without -reuse-port", len(listeners))
+	}
+	if _, err := listenTestProxy(t, "-listeners", "2"); err == nil {
+		t.Error("-listeners 2 accepted without -reuse-port")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// reverseConn is a client connection accepted by the -reverse-listen
+// listener, whose requests all go to the -reverse backend.
+type reverseConn struct {
+	net.Conn
+}
+
+// reverseState returns the client's handshake if conn, or a connection it
+// wraps, was accepted by the reverse proxy listener, nil if it wasn't.
+func reverseState(conn net.Conn) *tls.ConnectionState {
+	var state *tls.ConnectionState
+	for conn != nil {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			cs := c.ConnectionState()
+			state = &cs
+		case *reverseConn:
+			return state
+		}
+		conn = innerConn(conn)
+	}
+	return nil
+}
+
+// parseReverseBackend parses the -reverse backend url, http or https with
+// a host and no path.
+func parseReverseBackend(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("Invalid reverse proxy backend %q, want http[s]://host[:port]", s)
+	}
+	return u, nil
+}
+
+// ServeReverse serves the connections accepted from l as a reverse proxy in
+// front of the -reverse backend: clients speak TLS to the proxy, which
+// presents certs minted for the names they ask for, and every request goes
+// to the backend the way intercepted ones go to their origin.
+func (hw *HandlerWrapper) ServeReverse(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logger.Warnln("accept reverse proxy connection error:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go hw.serveReverseConn(conn)
+	}
+}
+
+func (hw *HandlerWrapper) serveReverseConn(conn net.Conn) {
+	// clients sending no SNI get a cert for the backend's name
+	tlsConn := tls.Server(&reverseConn{conn}, hw.interceptConfig(hw.reverse.Hostname()))
+	tlsConn.SetDeadline(time.Now().Add(hw.dialer.Timeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		logger.Debugf("TLS handshake with %s for the reverse proxy error: %s", clientIP(conn.RemoteAddr().String()), err)
+		conn.Close()
+		return
+	}
+	hw.serveConn(tlsConn, hw.reverseHandler(tlsConn.ConnectionState()))
+}
+
+// reverseHandler serves the requests sent on a reverse proxy connection
+// with the handshake state, the server seeing a wrapped conn it can't fill
+// req.TLS from.
+func (hw *HandlerWrapper) reverseHandler(state tls.ConnectionState) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.TLS = &state
+		hw.serveReverse(resp, req)
+	})
+}
+
+// serveReverse proxies a request sent to the reverse proxy on to the
+// backend, telling it where the request was sent to and from in
+// X-Forwarded headers.
+func (hw *HandlerWrapper) serveReverse(resp http.ResponseWriter, req *http.Request) {
+	if hw.tooManyHeaders(req) {
+		respError(resp, http.StatusRequestHeaderFieldsTooLarge, "Too many request header fields")
+		return
+	}
+	if rejectAmbiguous(resp, req) {
+		return
+	}
+	if hw.viaLoop(req) {
+		respError(resp, http.StatusLoopDetected, "Request already passed through this proxy: loop detected")
+		return
+	}
+	forwardedFor := clientIP(req.RemoteAddr)
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.URL.Scheme = hw.reverse.Scheme
+	req.URL.Host = hw.reverse.Host
+	req.Host = hw.reverse.Host
+	hw.DumpHTTPAndHTTPs(resp, req)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+)
+
+// reverseListen serves p's reverse proxy on a local listener until the test
+// ends and returns its address.
+func reverseListen(t *testing.T, p *testProxy) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.ServeReverse(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// reverseClient returns a client sending every request to the reverse
+// proxy at addr, trusting the proxy's CA.
+func reverseClient(t *testing.T, addr string) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: testCAPool()},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// forwardedBackend answers with the Host and X-Forwarded fields it got.
+func forwardedBackend(t *testing.T, tls bool) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join([]string{r.Host, r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"),
+			r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto")}, " "))
+	})
+	backend := httptest.NewUnstartedServer(handler)
+	if tls {
+		backend.StartTLS()
+	} else {
+		backend.Start()
+	}
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestReverseProxiesToBackend(t *testing.T) {
+	backend := forwardedBackend(t, false)
+	p := newTestProxy(t, "-reverse", backend.URL)
+	client := reverseClient(t, reverseListen(t, p))
+	backendHost := backend.Listener.Addr().String()
+
+	// the second request goes down the same kept-alive connection
+	for i, forwardedFor := range []string{"", "10.0.0.1"} {
+		reused := false
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace),
+			"GET", "https://app.example.test/a?b=c", nil)
+		want := backendHost + " /a?b=c 127.0.0.1 app.example.test https"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			want = backendHost + " /a?b=c 10.0.0.1, 127.0.0.1 app.example.test https"
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readAll(t, resp); body != want {
+			t.Errorf("backend got %q, want %q", body, want)
+		}
+		if err := resp.TLS.PeerCertificates[0].VerifyHostname("app.example.test"); err != nil {
+			t.Errorf("reverse proxy cert: %s", err)
+		}
+		if reused != (i > 0) {
+			t.Errorf("request %d reused a connection: %v", i, reused)
+		}
+	}
+}
+
+func TestReverseToTLSBackend(t *testing.T) {
+	backend := forwardedBackend(t, true)
+	p := newTestProxy(t, "-reverse", backend.URL)
+	p.trust(backend)
+	resp, err := reverseClient(t, reverseListen(t, p)).Get("https://app.example.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); !strings.HasPrefix(body, backend.Listener.Addr().String()+" / ") {
+		t.Errorf("https backend got %q", body)
+	}
+}
+
+func TestReverseWithoutSNI(t *testing.T) {
+	backend := forwardedBackend(t, false)
+	p := newTestProxy(t, "-reverse", backend.URL)
+	addr := reverseListen(t, p)
+	// an ip as ServerName sends no SNI, the cert is for the backend's name
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "127.0.0.1", RootCAs: testCAPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestReverseBackend(t *testing.T) {
+	for _, backend := range []string{"ftp://example.com", "http://", "http://example.com/app", "example.com:80", "http://example.com/?a=1"} {
+		if err := initError("-reverse", backend); err == nil {
+			t.Errorf("-reverse %q accepted", backend)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostRewrite sends connections for hosts matching pattern to target
+// instead, while requests and certs keep using the original name.
+type hostRewrite struct {
+	pattern string
+	target  string
+}
+
+// parseRewrites parses a comma separated list of pattern=target entries,
+// e.g. prod.example.com=10.0.0.5 or *.example.com=staging:8443. A target
+// without a port keeps the port of the original address.
+func parseRewrites(s string) ([]*hostRewrite, error) {
+	var rewrites []*hostRewrite
+	for _, item := range splitList(s) {
+		eq := strings.Index(item, "=")
+		if eq <= 0 || eq == len(item)-1 {
+			return nil, fmt.Errorf("Invalid rewrite %q, want host=target", item)
+		}
+		rewrites = append(rewrites, &hostRewrite{pattern: item[:eq], target: item[eq+1:]})
+	}
+	return rewrites, nil
+}
+
+// dialAddr returns the address to dial for addr (host:port) after applying
+// the first matching rewrite rule.
+func (hw *HandlerWrapper) dialAddr(addr string) string {
+	for _, rewrite := range hw.rewrites {
+		if !matchHost(rewrite.pattern, addr) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(rewrite.target); err == nil {
+			return rewrite.target
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return rewrite.target
+		}
+		return net.JoinHostPort(rewrite.target, port)
+	}
+	return addr
+}
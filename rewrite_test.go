@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteDialsTarget(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer origin.Close()
+	port := portOf(origin)
+
+	for _, rule := range []string{"prod.example.test=127.0.0.1", "*.example.test=127.0.0.1:" + port} {
+		p := newTestProxy(t, "-rewrite", rule)
+		resp, err := p.client().Get("http://prod.example.test:" + port + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, resp); got != "prod.example.test:"+port {
+			t.Errorf("-rewrite %s: origin got Host %q, want the original name", rule, got)
+		}
+	}
+}
+
+func TestRewriteKeepsNameForTLS(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName)
+	}))
+	defer origin.Close()
+	port := portOf(origin)
+	// the test server's cert is for example.com
+	p := newTestProxy(t, "-rewrite", "example.com=127.0.0.1", "-intercept-ports", port)
+	p.trust(origin)
+
+	resp, err := p.client().Get("https://example.com:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "example.com" {
+		t.Errorf("origin got SNI %q, want the original name", got)
+	}
+}
+
+func TestRewriteAppliesToTunnels(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled")
+	}))
+	defer origin.Close()
+	// port 443 would be intercepted, this CONNECT is tunneled
+	p := newTestProxy(t, "-rewrite", "tunnel.example.test=127.0.0.1:"+portOf(origin), "-intercept-ports", "8443")
+	conn := p.connect(t, "tunnel.example.test:443")
+	pool := testCAPool()
+	pool.AddCert(origin.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: pool})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	b, _ := io.ReadAll(tlsConn)
+	if len(b) == 0 || string(b[len(b)-len("tunneled"):]) != "tunneled" {
+		t.Errorf("tunnel got %q", b)
+	}
+}
+
+func TestParseRewritesRejectsMalformed(t *testing.T) {
+	for _, s := range []string{"host", "=target", "host="} {
+		if err := initError("-rewrite", s); err == nil {
+			t.Errorf("-rewrite %q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// oidSCTList identifies the embedded SignedCertificateTimestampList
+// extension of RFC 6962.
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// minSCTLen is the size of a v1 SCT with no extensions and an empty
+// signature: version, log id, timestamp, extensions length, hash and
+// signature algorithms and signature length.
+const minSCTLen = 1 + 32 + 8 + 2 + 2 + 2
+
+// loadSCTExtension reads one binary SCT, TLS encoded as served by CT logs,
+// from each of paths and returns the extension embedding them all in a
+// leaf cert. The SCTs aren't verified, and won't verify against minted
+// certs, they only satisfy clients that check for their presence.
+func loadSCTExtension(paths []string) (pkix.Extension, error) {
+	var list []byte
+	for _, path := range paths {
+		sct, err := ioutil.ReadFile(path)
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		if len(sct) < minSCTLen || sct[0] != 0 || len(sct) > 0xffff {
+			return pkix.Extension{}, fmt.Errorf("%s is not a v1 SCT", path)
+		}
+		list = binary.BigEndian.AppendUint16(list, uint16(len(sct)))
+		list = append(list, sct...)
+	}
+	if len(list) > 0xffff {
+		return pkix.Extension{}, fmt.Errorf("SCT list is %d bytes, at most %d fit", len(list), 0xffff)
+	}
+	value, err := asn1.Marshal(append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...))
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidSCTList, Value: value}, nil
+}
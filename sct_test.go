@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSCT writes a v1 SCT from the log with id logID to a file in dir and
+// returns the SCT and its path.
+func writeSCT(t *testing.T, dir string, logID byte) ([]byte, string) {
+	t.Helper()
+	sct := []byte{0}
+	sct = append(sct, bytes.Repeat([]byte{logID}, 32)...)
+	sct = binary.BigEndian.AppendUint64(sct, 1700000000000)
+	// no extensions, an ecdsa sha256 signature
+	sct = append(sct, 0, 0, 4, 3, 0, 4, 1, 2, 3, 4)
+	path := filepath.Join(dir, string('a'+logID)+".sct")
+	if err := os.WriteFile(path, sct, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return sct, path
+}
+
+// embeddedSCTs returns the SCTs embedded in cert, nil if it has none.
+func embeddedSCTs(t *testing.T, cert *x509.Certificate) [][]byte {
+	t.Helper()
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+		var list []byte
+		if _, err := asn1.Unmarshal(ext.Value, &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+			t.Fatalf("malformed SCT list %x", list)
+		}
+		var scts [][]byte
+		for list = list[2:]; len(list) > 0; {
+			n := int(binary.BigEndian.Uint16(list))
+			scts = append(scts, list[2:2+n])
+			list = list[2+n:]
+		}
+		return scts
+	}
+	return nil
+}
+
+func TestSCTsEmbeddedInMintedCerts(t *testing.T) {
+	dir := t.TempDir()
+	first, firstPath := writeSCT(t, dir, 1)
+	second, secondPath := writeSCT(t, dir, 2)
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-sct", firstPath+","+secondPath)
+
+	leaf := handshakeThrough(t, p, origin, "sct.example.test")
+	scts := embeddedSCTs(t, leaf)
+	if len(scts) != 2 || !bytes.Equal(scts[0], first) || !bytes.Equal(scts[1], second) {
+		t.Errorf("minted cert embeds SCTs %x", scts)
+	}
+	// the CA itself gets none
+	if scts := embeddedSCTs(t, p.issuingCert.X509()); scts != nil {
+		t.Errorf("CA cert embeds SCTs %x", scts)
+	}
+}
+
+func TestNoSCTsByDefault(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	if scts := embeddedSCTs(t, handshakeThrough(t, p, origin, "sct.example.test")); scts != nil {
+		t.Errorf("minted cert embeds SCTs %x without -sct", scts)
+	}
+}
+
+func TestSCTFilesChecked(t *testing.T) {
+	dir := t.TempDir()
+	notSCT := filepath.Join(dir, "cert.pem")
+	if err := os.WriteFile(notSCT, []byte("-----BEGIN CERTIFICATE-----\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{notSCT, filepath.Join(dir, "missing.sct")} {
+		if err := initError("-sct", path); err == nil {
+			t.Errorf("-sct %s accepted", path)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseUpstreamURL parses an upstream given either as a url or as host:port,
+// which is taken to be plain http.
+func parseUpstreamURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	return url.Parse(s)
+}
+
+// readBody buffers the body of req and replaces it with the buffered copy so
+// it can still be sent.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// shadowRequest sends a copy of req carrying body to the shadow upstream in
+// the background. The shadow's response is delivered on the returned
+// channel, nil if the request failed.
+func (hw *HandlerWrapper) shadowRequest(req *http.Request, body []byte) <-chan *capturedResponse {
+	result := make(chan *capturedResponse, 1)
+	shadowReq := req.Clone(context.Background())
+	shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	go func() {
+		resp, err := hw.sendUpstream(hw.shadow, shadowReq)
+		if err != nil {
+			logger.Warnln("shadow request", req.URL, "error:", err)
+		}
+		result <- resp
+	}()
+	return result
+}
+
+// sendUpstream sends req to the upstream at u over a fresh connection and
+// returns the response, keeping up to maxDiffBody of the body. The whole
+// exchange is given -shadow-timeout, so an upstream that stops answering
+// doesn't hold the transaction waiting on the result.
+func (hw *HandlerWrapper) sendUpstream(u *url.URL, req *http.Request) (*capturedResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *hw.MyConfig.ShadowTimeout)
+	defer cancel()
+	addr := hostWithPort(u.Host, hw.defaultPort(u.Scheme))
+	conn, err := hw.DialFunc(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if u.Scheme == "https" {
+		tlsConfig := hw.tlsConfig.UpstreamConfig(addr).Clone()
+		tlsConfig.ServerName = u.Hostname()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req.Close = true
+	req.Header.Set("Connection", "close")
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, err
+	}
+	// the connection is closed after, so the body past maxDiffBody is left
+	// unread
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDiffBody))
+	if err != nil {
+		return nil, err
+	}
+	return &capturedResponse{status: resp.StatusCode, header: resp.Header, body: decodeBody(resp.Header, body)}, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shadowed is what a shadow upstream got.
+type shadowed struct {
+	method, path, body string
+	header             http.Header
+}
+
+// shadowUpstream answers with body and passes on what it got.
+func shadowUpstream(t *testing.T, body string, tls bool) (*httptest.Server, <-chan shadowed) {
+	got := make(chan shadowed, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- shadowed{r.Method, r.URL.Path, string(b), r.Header}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	})
+	var server *httptest.Server
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	t.Cleanup(server.Close)
+	return server, got
+}
+
+func TestShadowGetsCopy(t *testing.T) {
+	origin := textOrigin(t, "primary")
+	shadow, got := shadowUpstream(t, "shadow", false)
+	p := newTestProxy(t, "-shadow", shadow.URL)
+
+	resp, err := p.client().Post(origin.URL+"/submit", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "primary" {
+		t.Errorf("client got %q, want the primary's response", body)
+	}
+	select {
+	case s := <-got:
+		if s.method != "POST" || s.path != "/submit" || s.body != "payload" {
+			t.Errorf("shadow got %s %s %q", s.method, s.path, s.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow got no copy")
+	}
+}
+
+func TestShadowCopyLacksInjectedCredentials(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+	}))
+	defer origin.Close()
+	shadow, got := shadowUpstream(t, "", false)
+	host := origin.Listener.Addr().String()
+	p := newTestProxy(t, "-shadow", shadow.URL, "-cookie-jar", "-auth", host+"=user:password")
+
+	for i := 0; i < 2; i++ {
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		select {
+		case s := <-got:
+			// the second request gets the jar's cookie on its way to the origin
+			if s.header.Get("Cookie") != "" || s.header.Get("Authorization") != "" {
+				t.Errorf("request %d: shadow got Cookie %q Authorization %q", i, s.header.Get("Cookie"), s.header.Get("Authorization"))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("shadow got no copy")
+		}
+	}
+}
+
+func TestShadowDefaultPortAndUpstreamTLS(t *testing.T) {
+	origin := textOrigin(t, "primary")
+	shadow, got := shadowUpstream(t, "shadow", true)
+	// the shadow url has no port, -https-port supplies it
+	p := newTestProxy(t, "-shadow", "https://127.0.0.1", "-https-port", portOf(shadow))
+	p.trust(shadow)
+
+	resp, err := p.client().Get(origin.URL + "/tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	select {
+	case s := <-got:
+		if s.path != "/tls" {
+			t.Errorf("shadow got %s", s.path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow over tls on the -https-port got no copy")
+	}
+}
+
+func TestShadowDiffRecorded(t *testing.T) {
+	c := newCollector(t)
+	origin := textOrigin(t, "primary")
+	shadow, _ := shadowUpstream(t, "different", false)
+	p := newTestProxy(t, "-shadow", shadow.URL, "-shadow-diff", "-collector", c.URL, "-collector-batch", "1")
+
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	select {
+	case batch := <-c.got:
+		if len(batch[0].ShadowDiff) == 0 {
+			t.Error("transaction recorded without the shadow's differences")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction never recorded")
+	}
+}
+
+func TestShadowDiffHungShadowTimesOut(t *testing.T) {
+	c := newCollector(t)
+	origin := textOrigin(t, "primary")
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	p := newTestProxy(t, "-shadow", hung.URL, "-shadow-diff", "-shadow-timeout", "200ms",
+		"-collector", c.URL, "-collector-batch", "1")
+
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	select {
+	case batch := <-c.got:
+		if len(batch) != 1 || batch[0].ResponseBody != "primary" {
+			t.Errorf("collector got %+v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction held waiting on a hung shadow")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// framingTap records the header block of the first request read from a
+// client connection as it was sent. The http server drops Content-Length
+// when Transfer-Encoding is present, and Transfer-Encoding from HTTP/1.0
+// requests, which hides the ambiguous framing request smuggling relies on.
+type framingTap struct {
+	net.Conn
+	max    int
+	mutex  sync.Mutex
+	header []byte
+	// done is set once the header block is complete or given up on
+	done  bool
+	taken bool
+}
+
+func newFramingTap(conn net.Conn, maxHeaderBytes int) *framingTap {
+	// the http server allows 4096 bytes on top of MaxHeaderBytes
+	return &framingTap{Conn: conn, max: maxHeaderBytes + 4096}
+}
+
+func (t *framingTap) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if n > 0 {
+		t.record(b[:n])
+	}
+	return n, err
+}
+
+func (t *framingTap) record(b []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.done {
+		return
+	}
+	if len(t.header) == 0 && b[0] == 0x16 {
+		// a TLS handshake, the requests are only seen decrypted
+		t.done = true
+		return
+	}
+	t.header = append(t.header, b...)
+	if i := bytes.Index(t.header, headerEnd); i >= 0 {
+		t.header = t.header[:i+len(headerEnd)]
+		t.done = true
+	} else if len(t.header) > t.max {
+		t.header = nil
+		t.done = true
+	}
+}
+
+// take returns the recorded header block to the first caller, nil to later
+// ones and if there is none.
+func (t *framingTap) take() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.taken || !t.done {
+		return nil
+	}
+	t.taken = true
+	return t.header
+}
+
+// CloseWrite half-closes the connection underneath, if it can be. The http
+// server does before closing a connection it refused a request on, so the
+// client reads the answer rather than a reset.
+func (t *framingTap) CloseWrite() error {
+	for conn := t.Conn; conn != nil; conn = innerConn(conn) {
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			return c.CloseWrite()
+		}
+	}
+	return nil
+}
+
+// framingListener wraps accepted connections in a framingTap.
+type framingListener struct {
+	net.Listener
+	maxHeaderBytes int
+}
+
+func (l *framingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newFramingTap(conn, l.maxHeaderBytes), nil
+}
+
+type framingTapKey struct{}
+
+// withFramingTap is a ConnContext making the framingTap of conn, if any,
+// available to handlers.
+func withFramingTap(ctx context.Context, conn net.Conn) context.Context {
+	if tap, ok := conn.(*framingTap); ok {
+		return context.WithValue(ctx, framingTapKey{}, tap)
+	}
+	return ctx
+}
+
+// ambiguousFraming returns why req has framing an origin could read
+// differently than the proxy, "" if it has none: both Content-Length and
+// Transfer-Encoding, or Transfer-Encoding on an HTTP/1.0 request. Repeated
+// or invalid Content-Length and Transfer-Encoding other than chunked are
+// refused by the http server already. Only the first request on a
+// connection is checked, the others reach the proxy through keepServing as
+// the first on a connection of their own, unless the one before was
+// answered by the proxy itself.
+func ambiguousFraming(req *http.Request) string {
+	if req.ProtoMajor != 1 {
+		return ""
+	}
+	tap, ok := req.Context().Value(framingTapKey{}).(*framingTap)
+	if !ok {
+		return ""
+	}
+	header := tap.take()
+	if header == nil {
+		return ""
+	}
+	lines := strings.Split(string(bytes.TrimSuffix(header, headerEnd)), "\r\n")
+	var contentLength, transferEncoding bool
+	for _, line := range lines[1:] {
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "Content-Length":
+			contentLength = true
+		case "Transfer-Encoding":
+			transferEncoding = true
+		}
+	}
+	switch {
+	case transferEncoding && contentLength:
+		return "both Content-Length and Transfer-Encoding"
+	case transferEncoding && strings.HasSuffix(lines[0], " HTTP/1.0"):
+		return "Transfer-Encoding on an HTTP/1.0 request"
+	}
+	return ""
+}
+
+// rejectAmbiguous answers 400 to a request with ambiguous framing, closing
+// the connection as where the request ends is unclear, and reports whether
+// it did.
+func rejectAmbiguous(resp http.ResponseWriter, req *http.Request) bool {
+	reason := ambiguousFraming(req)
+	if reason == "" {
+		return false
+	}
+	logger.Warnln("rejected possible request smuggling from", req.RemoteAddr, req.Method, req.URL, "with", reason)
+	resp.Header().Set("Connection", "close")
+	respError(resp, http.StatusBadRequest, "Ambiguous request framing: "+reason)
+	return true
+}
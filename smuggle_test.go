@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawExchange sends each of reqs in turn on a connection of its own to p,
+// reading the response to one before sending the next, and returns their
+// statuses.
+func rawExchange(t *testing.T, p *testProxy, reqs ...string) []int {
+	t.Helper()
+	conn := p.dial(t)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	var statuses []int
+	for _, req := range reqs {
+		io.WriteString(conn, req)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, resp)
+		statuses = append(statuses, resp.StatusCode)
+	}
+	return statuses
+}
+
+func TestAmbiguousFramingRejected(t *testing.T) {
+	origin, got := bodyOrigin(t)
+	p := newTestProxy(t)
+	host := origin.Listener.Addr().String()
+	for name, req := range map[string]string{
+		"CL and TE": "POST " + origin.URL + " HTTP/1.1\r\nHost: " + host +
+			"\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"TE and CL": "POST " + origin.URL + " HTTP/1.1\r\nHost: " + host +
+			"\r\nTransfer-Encoding: chunked\r\ncontent-length: 4\r\n\r\n0\r\n\r\n",
+		"TE on HTTP/1.0": "POST " + origin.URL + " HTTP/1.0\r\nHost: " + host +
+			"\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	} {
+		if statuses := rawExchange(t, p, req); statuses[0] != http.StatusBadRequest {
+			t.Errorf("%s got %d, want 400", name, statuses[0])
+		}
+	}
+	select {
+	case g := <-got:
+		t.Errorf("ambiguous request reached the origin with %q", g)
+	default:
+	}
+}
+
+func TestUnambiguousFramingPasses(t *testing.T) {
+	origin, got := bodyOrigin(t)
+	p := newTestProxy(t)
+	host := origin.Listener.Addr().String()
+	for name, req := range map[string]string{
+		"CL": "POST " + origin.URL + " HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 4\r\n\r\nbody",
+		"TE": "POST " + origin.URL + " HTTP/1.1\r\nHost: " + host + "\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+	} {
+		if statuses := rawExchange(t, p, req); statuses[0] != http.StatusOK {
+			t.Errorf("%s got %d", name, statuses[0])
+		}
+		if g := <-got; !strings.HasSuffix(g, " body") {
+			t.Errorf("%s: origin got %q", name, g)
+		}
+	}
+}
+
+func TestAmbiguousFramingRejectedLaterOnConnection(t *testing.T) {
+	origin, _ := bodyOrigin(t)
+	p := newTestProxy(t)
+	host := origin.Listener.Addr().String()
+	statuses := rawExchange(t, p, "GET "+origin.URL+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n",
+		"POST "+origin.URL+" HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n")
+	if fmt.Sprint(statuses) != "[200 400]" {
+		t.Errorf("got %v, want the second request refused", statuses)
+	}
+}
+
+func TestOversizedHeaderAnswered(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t, "-max-header-bytes", "1024")
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("X-Large", strings.Repeat("x", 8192))
+	// the client gets to read the answer, not a reset connection
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("8k header got %s, want 431", resp.Status)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var errHelloRead = errors.New("client hello read")
+
+// sniffConn feeds a TLS handshake the bytes read from a client while
+// dropping whatever the handshake would send back.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c sniffConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// peekServerName reads the ClientHello a client starts its TLS handshake
+// with and returns the server name it asks for, empty without SNI. The
+// returned conn replays the bytes read before continuing with conn.
+func peekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	var read bytes.Buffer
+	var name string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	err := tls.Server(sniffConn{conn, io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	replay := &bufferedConn{conn, io.MultiReader(&read, conn)}
+	if err != nil && !errors.Is(err, errHelloRead) {
+		return "", replay, err
+	}
+	return name, replay, nil
+}
+
+// interceptBySNI decides from the server name the client asks for whether
+// to intercept its already confirmed CONNECT to req.Host, and tunnels it
+// untouched if not.
+func (hw *HandlerWrapper) interceptBySNI(conn net.Conn, req *http.Request, host string, tlsConfig *tls.Config) {
+	name, conn, err := peekServerName(conn, hw.dialer.Timeout)
+	if err != nil {
+		logger.Debugln("read client hello for", req.Host, "error:", err)
+		conn.Close()
+		return
+	}
+	if name == "" {
+		name = host
+	}
+	if hw.interceptSNI.MatchString(name) {
+		hw.serveTLS(tls.Server(conn, tlsConfig), name, req.Host)
+		return
+	}
+
+	defer conn.Close()
+	addr := hw.dialAddr(hostWithPort(req.Host, hw.defaultPort("https")))
+	ctx, cancel := context.WithTimeout(context.Background(), hw.dialer.Timeout)
+	connOut, err := hw.DialFunc(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		logger.Warnln("dial", addr, "for tunneled", name, "error:", err)
+		return
+	}
+	defer connOut.Close()
+	if err = Transport(conn, connOut, *hw.MyConfig.TunnelLinger); err != nil {
+		logger.Debugln("tunnel", req.Host, "error:", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// statusRewrite replaces the status from with to in responses to requests
+// whose host matches pattern and whose path starts with prefix.
+type statusRewrite struct {
+	pattern string
+	prefix  string
+	from    int
+	to      int
+}
+
+// parseStatusRewrites parses a comma separated list of host[/path]=from:to
+// entries, e.g. api.example.com/v1/=301:302 or *=418:200. The host is a
+// shell pattern, the path a prefix.
+func parseStatusRewrites(s string) ([]*statusRewrite, error) {
+	var rewrites []*statusRewrite
+	for _, item := range splitList(s) {
+		target, codes, ok := strings.Cut(item, "=")
+		from, to, ok2 := strings.Cut(codes, ":")
+		if !ok || !ok2 || target == "" {
+			return nil, fmt.Errorf("Invalid status rewrite %q, want host[/path]=from:to", item)
+		}
+		rewrite := &statusRewrite{pattern: target}
+		if i := strings.Index(target, "/"); i >= 0 {
+			rewrite.pattern, rewrite.prefix = target[:i], target[i:]
+		}
+		var err error
+		if rewrite.from, err = parseStatus(from); err != nil {
+			return nil, fmt.Errorf("Invalid status rewrite %q: %s", item, err)
+		}
+		if rewrite.to, err = parseStatus(to); err != nil {
+			return nil, fmt.Errorf("Invalid status rewrite %q: %s", item, err)
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
+// parseStatus parses a final status code. Informational ones can't be
+// rewritten, they don't end a response.
+func parseStatus(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 200 || code > 999 {
+		return 0, fmt.Errorf("%q is not a final status code", s)
+	}
+	return code, nil
+}
+
+// rewriteStatus applies the first status rewrite matching req to resp.
+func (hw *HandlerWrapper) rewriteStatus(req *http.Request, resp *http.Response) {
+	for _, rewrite := range hw.statusRules {
+		if resp.StatusCode != rewrite.from || !matchHost(rewrite.pattern, req.Host) ||
+			!strings.HasPrefix(req.URL.Path, rewrite.prefix) {
+			continue
+		}
+		logger.Debugln("rewrote status", rewrite.from, "to", rewrite.to, "for", req.URL)
+		resp.StatusCode = rewrite.to
+		resp.Status = fmt.Sprintf("%d %s", rewrite.to, http.StatusText(rewrite.to))
+		if rewrite.to == http.StatusNoContent || rewrite.to == http.StatusNotModified {
+			// the body isn't sent, read it off the upstream connection
+			resp.Body.Close()
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+		}
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// statusOrigin answers with the status in the code query parameter.
+func statusOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.Header().Set("Location", "/moved")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "status %d", code)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestStatusRewritten(t *testing.T) {
+	origin := statusOrigin(t)
+	p := newTestProxy(t, "-status-rewrite", "127.0.0.1/api/=418:200,*=301:302")
+	c := p.client()
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/api/teapot?code=418", http.StatusOK},
+		{"/other?code=418", http.StatusTeapot},
+		{"/api/teapot?code=404", http.StatusNotFound},
+		{"/anywhere?code=301", http.StatusFound},
+	} {
+		resp, err := c.Get(origin.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readAll(t, resp)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s got %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+		// only the status changes
+		if code := tc.path[len(tc.path)-3:]; body != "status "+code || resp.Header.Get("Location") != "/moved" {
+			t.Errorf("%s got body %q, Location %q", tc.path, body, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestStatusRewrittenToNoContent(t *testing.T) {
+	origin := statusOrigin(t)
+	p := newTestProxy(t, "-status-rewrite", "*=200:204")
+	c := p.client()
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(origin.URL + "?code=200")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the origin's body is dropped, leaving the connection usable
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent || len(b) != 0 {
+			t.Errorf("request %d got %d with %q", i, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestStatusRewritesChecked(t *testing.T) {
+	for _, rules := range []string{"example.com", "example.com=301", "=301:302", "*=301:abc", "*=100:200", "*=200:1000"} {
+		if err := initError("-status-rewrite", rules); err == nil {
+			t.Errorf("-status-rewrite %q accepted", rules)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// keepAliveOf returns whether conn sends keep-alive probes and after how
+// many idle seconds.
+func keepAliveOf(conn net.Conn) (on bool, idle int, err error) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return false, 0, err
+	}
+	var keepAlive int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if keepAlive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr == nil {
+			idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return keepAlive == 1, idle, err
+}
+
+func TestTCPKeepAliveOfClientConnections(t *testing.T) {
+	for _, tc := range []struct {
+		period string
+		on     bool
+		idle   int
+	}{{"15s", true, 15}, {"40s", true, 40}, {"-1s", false, 0}} {
+		hw := newTestHandler(t, "-tcp-keepalive", tc.period)
+		lc := listenConfig(hw.MyConfig)
+		l, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		on, idle, err := keepAliveOf(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if on != tc.on || (on && idle != tc.idle) {
+			t.Errorf("-tcp-keepalive %s gave accepted connections keep-alive %v after %ds", tc.period, on, idle)
+		}
+	}
+}
+
+func TestTCPKeepAliveOfUpstreamConnections(t *testing.T) {
+	origin := textOrigin(t, "ok")
+	p := newTestProxy(t, "-tcp-keepalive", "40s")
+	type keepAlive struct {
+		on   bool
+		idle int
+		err  error
+	}
+	dialed := make(chan keepAlive, 1)
+	dial := p.DialFunc
+	p.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			// checked while open, the connection is closed after the response
+			on, idle, err := keepAliveOf(conn)
+			dialed <- keepAlive{on, idle, err}
+		}
+		return conn, err
+	}
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if got := <-dialed; got.err != nil {
+		t.Fatal(got.err)
+	} else if !got.on || got.idle != 40 {
+		t.Errorf("upstream connection keep-alive %v after %ds, want after 40s", got.on, got.idle)
+	}
+}
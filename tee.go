@@ -0,0 +1,128 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const teeQueue = 1024
+
+// Tee copies the decrypted bytes exchanged with origins to a sink for
+// external analysis tools. Every chunk read or written becomes a frame:
+//
+//	<time> <request|response> <client addr> <server addr> <length>\n<bytes>\n
+//
+// Frames are written from a single goroutine and dropped when the sink
+// falls behind, so a slow reader never stalls proxying.
+type Tee struct {
+	w     io.WriteCloser
+	queue chan []byte
+	done  chan struct{}
+}
+
+// NewTee opens sink, which is tcp:host:port, unix:path or a file path. A
+// file path may name a pipe; other files are appended to, gzip compressed
+// if the path ends in .gz.
+func NewTee(sink string) (*Tee, error) {
+	var w io.WriteCloser
+	var err error
+	switch {
+	case strings.HasPrefix(sink, "tcp:"):
+		w, err = net.Dial("tcp", sink[len("tcp:"):])
+	case strings.HasPrefix(sink, "unix:"):
+		w, err = net.Dial("unix", sink[len("unix:"):])
+	default:
+		var f *os.File
+		f, err = os.OpenFile(sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err == nil && strings.HasSuffix(sink, ".gz") {
+			w = &gzipFile{gzip.NewWriter(f), f}
+		} else {
+			w = f
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &Tee{w: w, queue: make(chan []byte, teeQueue), done: make(chan struct{})}
+	go t.run()
+	return t, nil
+}
+
+func (t *Tee) run() {
+	defer close(t.done)
+	for frame := range t.queue {
+		if frame == nil {
+			return
+		}
+		if _, err := t.w.Write(frame); err != nil {
+			logger.Warnln("tee write error:", err)
+		}
+	}
+}
+
+// Close writes out the frames queued so far and closes the sink. Frames
+// made afterwards are dropped.
+func (t *Tee) Close() error {
+	t.queue <- nil
+	<-t.done
+	return t.w.Close()
+}
+
+// gzipFile compresses writes into a file, closing both together.
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (gf *gzipFile) Close() error {
+	err := gf.Writer.Close()
+	if closeErr := gf.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (t *Tee) frame(direction, client, server string, data []byte) {
+	header := fmt.Sprintf("%s %s %s %s %d\n", time.Now().Format(time.RFC3339Nano), direction, client, server, len(data))
+	frame := make([]byte, 0, len(header)+len(data)+1)
+	frame = append(append(append(frame, header...), data...), '\n')
+	select {
+	case t.queue <- frame:
+	default:
+		logger.Warnln("tee queue full, dropping frame for", client, server)
+	}
+}
+
+// Wrap returns conn, an origin connection for the client at clientAddr, with
+// everything written to and read from it copied to the tee.
+func (t *Tee) Wrap(conn net.Conn, clientAddr string) net.Conn {
+	return &teeConn{Conn: conn, tee: t, client: clientAddr, server: conn.RemoteAddr().String()}
+}
+
+type teeConn struct {
+	net.Conn
+	tee    *Tee
+	client string
+	server string
+}
+
+func (c *teeConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.tee.frame("request", c.client, c.server, p[:n])
+	}
+	return n, err
+}
+
+func (c *teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.tee.frame("response", c.client, c.server, p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type teeFrame struct {
+	direction, client, server string
+	data                      string
+}
+
+// readTeeFrames parses the frames in r, failing the test on a malformed one.
+func readTeeFrames(t *testing.T, r io.Reader) []teeFrame {
+	t.Helper()
+	var frames []teeFrame
+	br := bufio.NewReader(r)
+	for {
+		header, err := br.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 5 {
+			t.Fatalf("frame header %q", header)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			t.Fatalf("frame header %q: %s", header, err)
+		}
+		n, err := strconv.Atoi(fields[4])
+		if err != nil {
+			t.Fatalf("frame header %q: %s", header, err)
+		}
+		data := make([]byte, n+1)
+		if _, err := io.ReadFull(br, data); err != nil || data[n] != '\n' {
+			t.Fatalf("frame of %d bytes cut short: %v", n, err)
+		}
+		frames = append(frames, teeFrame{fields[1], fields[2], fields[3], string(data[:n])})
+	}
+}
+
+// teeGet gets url of a TLS origin through a proxy teeing to sink, closing
+// the proxy after so the sink holds every frame.
+func teeGet(t *testing.T, sink string) string {
+	t.Helper()
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-tee", sink)
+	p.trust(origin)
+	resp, err := p.client().Get(origin.URL + "/teed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	p.Close()
+	return origin.Listener.Addr().String()
+}
+
+// checkTeeFrames checks frames hold the plaintext request and response
+// exchanged with the origin at server.
+func checkTeeFrames(t *testing.T, frames []teeFrame, server string) {
+	t.Helper()
+	var request, response string
+	for _, f := range frames {
+		if f.server != server || !strings.HasPrefix(f.client, "127.0.0.1:") {
+			t.Errorf("frame between %s and %s, want the origin %s", f.client, f.server, server)
+		}
+		switch f.direction {
+		case "request":
+			request += f.data
+		case "response":
+			response += f.data
+		default:
+			t.Errorf("frame direction %q", f.direction)
+		}
+	}
+	if !strings.HasPrefix(request, "GET /teed HTTP/1.1\r\n") {
+		t.Errorf("teed request %q", request)
+	}
+	if !strings.HasPrefix(response, "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("teed response %q", response)
+	}
+}
+
+func TestTeeToFile(t *testing.T) {
+	sink := filepath.Join(t.TempDir(), "tee.log")
+	server := teeGet(t, sink)
+	f, err := os.Open(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTeeFrames(t, readTeeFrames(t, f), server)
+}
+
+func TestTeeToGzipFile(t *testing.T) {
+	sink := filepath.Join(t.TempDir(), "tee.log.gz")
+	server := teeGet(t, sink)
+	f, err := os.Open(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTeeFrames(t, readTeeFrames(t, zr), server)
+}
+
+func TestTeeToUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(got)
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+	server := teeGet(t, "unix:"+path)
+	select {
+	case b := <-got:
+		checkTeeFrames(t, readTeeFrames(t, strings.NewReader(string(b))), server)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tee socket not closed with the proxy")
+	}
+}
+
+func TestTeeSinkMustOpen(t *testing.T) {
+	if err := initError("-tee", "unix:"+filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Error("unreachable tee socket accepted")
+	}
+}
+
+func TestTeeGzipFileAppendedAcrossRuns(t *testing.T) {
+	sink := filepath.Join(t.TempDir(), "tee.log.gz")
+	first := teeGet(t, sink)
+	second := teeGet(t, sink)
+	f, err := os.Open(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// every run adds a gzip member, read on as one stream
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstFrames, secondFrames []teeFrame
+	for _, frame := range readTeeFrames(t, zr) {
+		if frame.server == first {
+			firstFrames = append(firstFrames, frame)
+		} else {
+			secondFrames = append(secondFrames, frame)
+		}
+	}
+	checkTeeFrames(t, firstFrames, first)
+	checkTeeFrames(t, secondFrames, second)
+}
+
+func TestTeeDropsFramesAfterClose(t *testing.T) {
+	sink := filepath.Join(t.TempDir(), "tee.log.gz")
+	tee, err := NewTee(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee.frame("request", "127.0.0.1:1", "127.0.0.1:2", []byte("before"))
+	if err := tee.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tee.frame("request", "127.0.0.1:1", "127.0.0.1:2", []byte("after"))
+	f, err := os.Open(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := readTeeFrames(t, zr); len(frames) != 1 || frames[0].data != "before" {
+		t.Errorf("closed tee holds %+v, want only the frame before close", frames)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+)
+
+// ticketKeysKept is how many session ticket keys are valid at once: the
+// current one, which encrypts new tickets, and the ones before it, so that
+// recently issued tickets still resume.
+const ticketKeysKept = 3
+
+// ticketKeyRotator periodically replaces the session ticket keys of a TLS
+// server config, so a leaked key only exposes the sessions of a short window.
+type ticketKeyRotator struct {
+	config *tls.Config
+	keys   [][32]byte
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newTicketKeyRotator(config *tls.Config) (*ticketKeyRotator, error) {
+	r := &ticketKeyRotator{config: config, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rotate makes a fresh key the current one, dropping the oldest key once
+// ticketKeysKept are in use.
+func (r *ticketKeyRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > ticketKeysKept {
+		r.keys = r.keys[:ticketKeysKept]
+	}
+	r.config.SetSessionTicketKeys(r.keys)
+	return nil
+}
+
+// run rotates the keys every interval until Close is called.
+func (r *ticketKeyRotator) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.rotate(); err != nil {
+				logger.Warnln("rotate session ticket keys error:", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close stops the rotation started by run and waits for it to end.
+func (r *ticketKeyRotator) Close() {
+	close(r.stop)
+	<-r.done
+}
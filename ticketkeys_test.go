@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resumingClient returns a client like p.client that keeps no connections
+// but keeps TLS sessions for resumption.
+func resumingClient(p *testProxy) *http.Client {
+	c := p.client()
+	transport := c.Transport.(*http.Transport)
+	transport.DisableKeepAlives = true
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
+	return c
+}
+
+// resumed gets url with c and reports whether the TLS session resumed.
+func resumed(t *testing.T, c *http.Client, url string) bool {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	return resp.TLS.DidResume
+}
+
+func TestSessionResumedAcrossRotations(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	p.trust(origin)
+	c := resumingClient(p)
+	if resumed(t, c, origin.URL) {
+		t.Fatal("first connection resumed")
+	}
+	if !resumed(t, c, origin.URL) {
+		t.Fatal("session not resumed")
+	}
+	// tickets stay good while their key is among the last few
+	for i := 0; i < ticketKeysKept-1; i++ {
+		p.ticketKeys.rotate()
+	}
+	if !resumed(t, c, origin.URL) {
+		t.Error("session not resumed with a recent key")
+	}
+	for i := 0; i < ticketKeysKept; i++ {
+		p.ticketKeys.rotate()
+	}
+	if resumed(t, c, origin.URL) {
+		t.Error("session resumed with a key rotated out")
+	}
+}
+
+func TestSessionsNeverResumeWithoutRotation(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-ticket-rotation", "0")
+	p.trust(origin)
+	c := resumingClient(p)
+	for i := 0; i < 3; i++ {
+		if resumed(t, c, origin.URL) {
+			t.Fatal("session resumed with a key per connection")
+		}
+	}
+}
+
+func TestTicketKeysRotatedUntilClose(t *testing.T) {
+	hw := newTestHandler(t, "-ticket-rotation", "10ms")
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		hw.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't stop the rotation")
+	}
+	// the rotation has ended, reading the keys races nothing
+	if len(hw.ticketKeys.keys) != ticketKeysKept {
+		t.Errorf("%d keys in use after rotating, want %d", len(hw.ticketKeys.keys), ticketKeysKept)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"time"
+)
+
+// Timing breaks down where the time of an upstream exchange went. The
+// overall time of a transaction is its Duration.
+type Timing struct {
+	DNS       time.Duration `json:"dns"`
+	Connect   time.Duration `json:"connect"`
+	TLS       time.Duration `json:"tls"`
+	FirstByte time.Duration `json:"firstByte"`
+}
+
+// traceDial returns a context reporting name resolution and connect times of
+// dials made with it into timing.
+func traceDial(ctx context.Context, timing *Timing) context.Context {
+	var dnsStart, connectStart time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { timing.DNS = time.Since(dnsStart) },
+		ConnectStart: func(string, string) {
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(string, string, error) { timing.Connect = time.Since(connectStart) },
+	})
+}
+
+// handshake runs a TLS client handshake for host over conn, recording its
+// time into timing.
+func handshake(ctx context.Context, conn net.Conn, host string, config *tls.Config, timing *Timing) (*tls.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(host)
+	}
+	start := time.Now()
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	timing.TLS = time.Since(start)
+	return tlsConn, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lastTransaction returns the transaction p recorded last, which needs
+// -admin for the history.
+func lastTransaction(t *testing.T, p *testProxy) *Transaction {
+	t.Helper()
+	recent := p.history.Recent(1)
+	if len(recent) == 0 {
+		t.Fatal("no transaction recorded")
+	}
+	return recent[0]
+}
+
+func TestTimingRecorded(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	logged := captureLog(t, LevelDebug)
+	// a name, so there is a lookup to time
+	url := "http://localhost:" + portOf(origin) + "/timed"
+	resp, err := p.client().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+
+	timing := lastTransaction(t, p).Timing
+	if timing == nil || timing.Connect <= 0 || timing.FirstByte < 50*time.Millisecond || timing.TLS != 0 {
+		t.Fatalf("recorded timing %+v", timing)
+	}
+	if !strings.Contains(logged.String(), "GET "+url+" dns=") || !strings.Contains(logged.String(), " ttfb=") {
+		t.Errorf("timing not logged:\n%s", logged)
+	}
+}
+
+func TestTimingRecordsTLSHandshake(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-intercept-ports", portOf(origin))
+	p.trust(origin)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if timing := lastTransaction(t, p).Timing; timing == nil || timing.TLS <= 0 || timing.FirstByte <= 0 {
+		t.Errorf("recorded timing %+v, want a tls handshake time", timing)
+	}
+}
+
+func TestTraceDialReportsPhases(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	timing := &Timing{}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := (&net.Dialer{}).DialContext(traceDial(context.Background(), timing), "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if timing.Connect <= 0 {
+		t.Errorf("connect not timed: %+v", timing)
+	}
+}
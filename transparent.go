@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// redirectedConn is a client connection the firewall redirected to the
+// transparent listener, dst being the address the client connected to.
+type redirectedConn struct {
+	net.Conn
+	dst string
+}
+
+// redirectedDst returns the address conn, or a connection it wraps, was
+// headed to before being redirected, empty if it wasn't.
+func redirectedDst(conn net.Conn) string {
+	for conn != nil {
+		if c, ok := conn.(*redirectedConn); ok {
+			return c.dst
+		}
+		conn = innerConn(conn)
+	}
+	return ""
+}
+
+type originalDstKey struct{}
+
+// withOriginalDst returns a copy of ctx carrying dst, where the client of
+// a redirected connection sent it.
+func withOriginalDst(ctx context.Context, dst string) context.Context {
+	return context.WithValue(ctx, originalDstKey{}, dst)
+}
+
+// originalDst returns the address ctx carries, empty if it has none.
+func originalDst(ctx context.Context) string {
+	dst, _ := ctx.Value(originalDstKey{}).(string)
+	return dst
+}
+
+// ServeTransparent proxies the connections accepted from l, which clients
+// are sent to by an iptables REDIRECT rule without knowing of the proxy.
+// Each is sent on to the address the client connected to, read from the
+// socket with SO_ORIGINAL_DST. TLS on the intercepted ports is decrypted
+// as after a CONNECT, other TLS is tunneled and plain http proxied.
+func (hw *HandlerWrapper) ServeTransparent(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logger.Warnln("accept transparent connection error:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go hw.serveRedirected(conn)
+	}
+}
+
+func (hw *HandlerWrapper) serveRedirected(conn net.Conn) {
+	dst, err := getOriginalDst(conn)
+	if err != nil {
+		logger.Warnln("read original destination of", conn.RemoteAddr(), "error:", err)
+		conn.Close()
+		return
+	}
+	if dst == conn.LocalAddr().String() {
+		// not redirected, sending it on would loop
+		logger.Warnln("connection from", conn.RemoteAddr(), "was made straight to the transparent listener, closing it")
+		conn.Close()
+		return
+	}
+	hw.serveRedirectedTo(conn, dst)
+}
+
+// serveRedirectedTo proxies conn, which its client made to dst.
+func (hw *HandlerWrapper) serveRedirectedTo(conn net.Conn, dst string) {
+	conn = &redirectedConn{conn, dst}
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(hw.dialer.Timeout))
+	first, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn = &bufferedConn{conn, br}
+	if first[0] != 0x16 {
+		hw.serveConn(conn, http.HandlerFunc(hw.serveTransparent))
+		return
+	}
+	host, port, _ := net.SplitHostPort(dst)
+	if !hw.interceptPorts[port] || atomic.LoadInt32(&hw.paused) == 1 {
+		hw.tunnelRedirected(conn, dst)
+		return
+	}
+	hw.serveTLS(tls.Server(conn, hw.interceptConfig(host)), host, dst)
+}
+
+// serveTransparent proxies a plain http request sent on a redirected
+// connection, which carries no url but the path.
+func (hw *HandlerWrapper) serveTransparent(resp http.ResponseWriter, req *http.Request) {
+	if req.Host == "" {
+		req.Host = originalDst(req.Context())
+	}
+	hw.serveIntercepted(resp, req)
+}
+
+// tunnelRedirected relays a redirected connection to dst untouched.
+func (hw *HandlerWrapper) tunnelRedirected(conn net.Conn, dst string) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), hw.dialer.Timeout)
+	connOut, err := hw.DialFunc(ctx, "tcp", dst)
+	cancel()
+	if err != nil {
+		logger.Warnln("dial", dst, "for redirected", conn.RemoteAddr(), "error:", err)
+		return
+	}
+	defer connOut.Close()
+	if err = Transport(conn, connOut, *hw.MyConfig.TunnelLinger); err != nil {
+		logger.Debugln("tunnel", dst, "error:", err)
+	}
+}
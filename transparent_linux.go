@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which
+// IP6T_SO_ORIGINAL_DST shares, missing from package syscall.
+const soOriginalDst = 80
+
+// getOriginalDst returns the address a connection redirected by netfilter
+// was made to, as host:port.
+func getOriginalDst(conn net.Conn) (string, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return "", errors.New("not a socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var sockaddr []byte
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if !ipv6 {
+			// the 16 bytes of a sockaddr_in fit the multicast address
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+				sockaddr = mreq.Multiaddr[:]
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); sockErr == nil {
+			addr := info.Addr
+			sockaddr = binary.NativeEndian.AppendUint16(nil, addr.Family)
+			sockaddr = binary.NativeEndian.AppendUint16(sockaddr, addr.Port)
+			sockaddr = binary.NativeEndian.AppendUint32(sockaddr, addr.Flowinfo)
+			sockaddr = append(sockaddr, addr.Addr[:]...)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return sockaddrString(sockaddr)
+}
+
+// sockaddrString formats a raw sockaddr_in or sockaddr_in6, its family in
+// host byte order and its port in network byte order, as host:port.
+func sockaddrString(b []byte) (string, error) {
+	if len(b) < 4 {
+		return "", fmt.Errorf("sockaddr of %d bytes is too short", len(b))
+	}
+	var ip net.IP
+	switch family := binary.NativeEndian.Uint16(b); family {
+	case syscall.AF_INET:
+		if len(b) < 8 {
+			return "", fmt.Errorf("sockaddr_in of %d bytes is too short", len(b))
+		}
+		ip = net.IP(b[4:8])
+	case syscall.AF_INET6:
+		if len(b) < 24 {
+			return "", fmt.Errorf("sockaddr_in6 of %d bytes is too short", len(b))
+		}
+		ip = net.IP(b[8:24])
+	default:
+		return "", fmt.Errorf("unsupported address family %d", family)
+	}
+	port := binary.BigEndian.Uint16(b[2:4])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
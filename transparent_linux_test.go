@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+func TestSockaddrString(t *testing.T) {
+	in := binary.NativeEndian.AppendUint16(nil, syscall.AF_INET)
+	in = binary.BigEndian.AppendUint16(in, 443)
+	in = append(in, 10, 0, 0, 1)
+	in6 := binary.NativeEndian.AppendUint16(nil, syscall.AF_INET6)
+	in6 = binary.BigEndian.AppendUint16(in6, 8443)
+	in6 = append(in6, 0, 0, 0, 0)
+	in6 = append(in6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+	for _, c := range []struct {
+		b    []byte
+		want string
+	}{
+		{in, "10.0.0.1:443"},
+		// the 16 bytes of a sockaddr_in padded out
+		{append(in, make([]byte, 8)...), "10.0.0.1:443"},
+		{in6, "[2001:db8::1]:8443"},
+	} {
+		if got, err := sockaddrString(c.b); err != nil || got != c.want {
+			t.Errorf("sockaddrString(%x) = %q, %v, want %s", c.b, got, err, c.want)
+		}
+	}
+	for _, b := range [][]byte{in[:3], in[:6], in6[:20], {0xff, 0xff, 0, 0}} {
+		if got, err := sockaddrString(b); err == nil {
+			t.Errorf("sockaddrString(%x) = %q, want an error", b, got)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// getOriginalDst needs netfilter's SO_ORIGINAL_DST, only found on linux.
+func getOriginalDst(conn net.Conn) (string, error) {
+	return "", errors.New("transparent mode is only supported on linux")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// redirectedTo returns the client end of a connection p serves as if the
+// firewall had redirected it there from dst.
+func redirectedTo(t *testing.T, p *testProxy, dst string) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.serveRedirectedTo(server, dst)
+	return client
+}
+
+// hostOrigin answers with the Host it got.
+func hostOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin got "+r.Host)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestTransparentPlainHTTP(t *testing.T) {
+	origin := hostOrigin(t)
+	p := newTestProxy(t)
+	conn := redirectedTo(t, p, origin.Listener.Addr().String())
+	br := bufio.NewReader(conn)
+	// the client knows nothing of the proxy, it sends a path and its Host,
+	// which doesn't resolve, and keeps the connection for a second request
+	for _, host := range []string{"app.example.test", ""} {
+		fmt.Fprintf(conn, "GET /a HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "origin got " + host
+		if host == "" {
+			// a request without Host goes to the original destination
+			want += origin.Listener.Addr().String()
+		}
+		if body := readAll(t, resp); resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("request for Host %q got %s %q, want %q", host, resp.Status, body, want)
+		}
+	}
+}
+
+func TestTransparentInterceptsTLS(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	p.trust(origin)
+	// trusting only the proxy's CA
+	conn := tls.Client(redirectedTo(t, p, origin.Listener.Addr().String()),
+		&tls.Config{ServerName: "example.com", RootCAs: testCAPool()})
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "tls origin" {
+		t.Errorf("intercepted redirected request got %q", body)
+	}
+}
+
+func TestTransparentTunnelsOtherTLS(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", "8443")
+	pool := testCAPool()
+	pool.AddCert(origin.Certificate())
+	conn := tls.Client(redirectedTo(t, p, origin.Listener.Addr().String()),
+		&tls.Config{ServerName: "example.com", RootCAs: pool})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().PeerCertificates[0].Equal(origin.Certificate()) {
+		t.Error("TLS to a port not intercepted wasn't tunneled to the origin")
+	}
+}
+
+func TestTransparentRefusesDirectConnections(t *testing.T) {
+	p := newTestProxy(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.ServeTransparent(l)
+	t.Cleanup(func() { l.Close() })
+	// made straight to the listener, no redirect to undo
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", l.Addr())
+	if n, err := conn.Read(make([]byte, 1)); n > 0 || err == nil || isTimeout(err) {
+		t.Errorf("direct connection answered or left open: %d bytes, %v", n, err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
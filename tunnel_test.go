@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lateReplyOrigin reads a request until the client half-closes, then replies
+// after delay, and returns its address.
+func lateReplyOrigin(t *testing.T, delay time.Duration, reply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+				time.Sleep(delay)
+				io.WriteString(conn, reply)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// halfCloseThrough sends a request through a tunnel to addr, half-closes
+// it and returns what comes back.
+func halfCloseThrough(t *testing.T, p *testProxy, addr string) string {
+	t.Helper()
+	conn := p.connect(t, addr)
+	io.WriteString(conn, "request")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, _ := io.ReadAll(conn)
+	return string(b)
+}
+
+func TestTunnelLingersAfterHalfClose(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	addr := lateReplyOrigin(t, 100*time.Millisecond, "late reply")
+	p := newTestProxy(t, "-tunnel-linger", "2s")
+	if got := halfCloseThrough(t, p, addr); got != "late reply" {
+		t.Errorf("got %q after a half-close, want the late reply", got)
+	}
+	if strings.Contains(logged.String(), "after a half-close") {
+		t.Errorf("tunnel ending within the linger logged:\n%s", logged)
+	}
+
+	// without lingering both sides close at once
+	p = newTestProxy(t, "-tunnel-linger", "0")
+	if got := halfCloseThrough(t, p, addr); got != "" {
+		t.Errorf("got %q with -tunnel-linger 0", got)
+	}
+}
+
+func TestTunnelLingerBounded(t *testing.T) {
+	logged := captureLog(t, LevelWarn)
+	addr := lateReplyOrigin(t, 2*time.Second, "too late")
+	p := newTestProxy(t, "-tunnel-linger", "200ms")
+	start := time.Now()
+	if got := halfCloseThrough(t, p, addr); got != "" {
+		t.Errorf("got %q after the linger was over", got)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("tunnel open %s after a half-close, want about the 200ms linger", waited)
+	}
+	// the tunnel is closed once the linger ran out, its end is logged by then
+	if want := "tunnel to " + addr + " still open 200ms after a half-close, cutting it off"; !strings.Contains(logged.String(), want) {
+		t.Errorf("log lacks %q, got:\n%s", want, logged)
+	}
+}
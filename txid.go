@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type transactionIDKey struct{}
+
+// newTransactionID returns a random id to tell a transaction apart in logs,
+// captures and headers.
+func newTransactionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withTransactionID returns a copy of ctx carrying id.
+func withTransactionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, transactionIDKey{}, id)
+}
+
+// transactionID returns the id ctx carries, "-" if it has none.
+func transactionID(ctx context.Context) string {
+	if id, ok := ctx.Value(transactionIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
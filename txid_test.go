@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// txidOrigin answers with the X-Transaction-Id it got.
+func txidOrigin(t *testing.T, newServer func(http.Handler) *httptest.Server) *httptest.Server {
+	origin := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Transaction-Id"))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestTransactionIDPropagated(t *testing.T) {
+	origin := txidOrigin(t, httptest.NewTLSServer)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0", "-intercept-ports", portOf(origin),
+		"-transaction-header", "X-Transaction-Id")
+	p.trust(origin)
+	logged := captureLog(t, LevelDebug)
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		resp, err := p.client().Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := readAll(t, resp)
+		id := resp.Header.Get("X-Transaction-Id")
+		if len(id) != 16 || sent != id {
+			t.Fatalf("origin got id %q, client %q", sent, id)
+		}
+		if seen[id] {
+			t.Errorf("id %s given to two transactions", id)
+		}
+		seen[id] = true
+		if got := lastTransaction(t, p).ID; got != id {
+			t.Errorf("captured id %q, client got %q", got, id)
+		}
+		// the upstream handshake is logged with it
+		if !strings.Contains(logged.String(), id+" "+origin.Listener.Addr().String()+" presented") {
+			t.Errorf("id %s not in the log:\n%s", id, logged)
+		}
+	}
+}
+
+func TestTransactionHeaderOffByDefault(t *testing.T) {
+	origin := txidOrigin(t, httptest.NewServer)
+	p := newTestProxy(t, "-admin", "127.0.0.1:0")
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := readAll(t, resp); sent != "" || resp.Header.Get("X-Transaction-Id") != "" {
+		t.Errorf("id sent without -transaction-header, origin got %q", sent)
+	}
+	// captures are tagged regardless
+	if id := lastTransaction(t, p).ID; len(id) != 16 {
+		t.Errorf("captured id %q", id)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// untrustedTTL is how long a client that rejected a minted cert is offered
+// the CA interstitial on its next plain http page load.
+const untrustedTTL = 10 * time.Minute
+
+const interstitialPage = `<!DOCTYPE html>
+<html>
+<head><title>gomitmproxy: certificate not trusted</title></head>
+<body>
+<h1>Your device does not trust this proxy yet</h1>
+<p>A secure connection made through this proxy just failed because its CA
+certificate is not installed on this device. To browse https sites through
+the proxy, <a href="%s">download the CA certificate</a> and install it as a
+trusted root, then reload the failing page.</p>
+<p><a href="%s">Continue to %s</a></p>
+</body>
+</html>
+`
+
+// untrustedClients remembers the clients, by ip, whose last intercepted
+// handshake failed because they don't trust the CA.
+type untrustedClients struct {
+	mu      sync.Mutex
+	clients map[string]time.Time
+}
+
+func newUntrustedClients() *untrustedClients {
+	return &untrustedClients{clients: make(map[string]time.Time)}
+}
+
+func (u *untrustedClients) mark(ip string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for client, expires := range u.clients {
+		if now.After(expires) {
+			delete(u.clients, client)
+		}
+	}
+	u.clients[ip] = now.Add(untrustedTTL)
+}
+
+func (u *untrustedClients) clear(ip string) {
+	u.mu.Lock()
+	delete(u.clients, ip)
+	u.mu.Unlock()
+}
+
+// take reports whether ip is marked, clearing the mark so each failure
+// shows the interstitial once.
+func (u *untrustedClients) take(ip string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	expires, ok := u.clients[ip]
+	delete(u.clients, ip)
+	return ok && time.Now().Before(expires)
+}
+
+// clientIP returns the ip part of a remote address.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// rejectsCert reports whether a server handshake error is the client
+// refusing the cert it was sent, rather than e.g. a dropped connection.
+// OpenSSL based clients such as curl abort TLS 1.3 handshakes with an alert
+// the server can't decrypt, which shows as a bad record MAC.
+func rejectsCert(err error) bool {
+	msg := err.Error()
+	if strings.Contains(msg, "bad record MAC") {
+		return true
+	}
+	return strings.Contains(msg, "remote error: tls:") &&
+		(strings.Contains(msg, "certificate") || strings.Contains(msg, "unknown ca"))
+}
+
+// serveTLS completes the handshake of an intercepted client connection for
+// host, a CONNECT to addr, before serving it, logging failures. Clients
+// rejecting the minted cert most likely lack the CA and are marked for the
+// interstitial. Streams that turn out not to be http are relayed to addr.
+func (hw *HandlerWrapper) serveTLS(conn *tls.Conn, host, addr string) {
+	ip := clientIP(conn.RemoteAddr().String())
+	conn.SetDeadline(time.Now().Add(hw.dialer.Timeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		if !rejectsCert(err) {
+			logger.Debugf("TLS handshake with %s for %s error: %s", ip, host, err)
+			return
+		}
+		logger.Warnf("Client %s rejected the mitm cert for %s, is the CA installed? error: %s", ip, host, err)
+		if hw.untrusted != nil {
+			hw.untrusted.mark(ip)
+		}
+		return
+	}
+	if hw.untrusted != nil {
+		hw.untrusted.clear(ip)
+	}
+	br := bufio.NewReader(conn)
+	if _, err = br.Peek(1); err != nil {
+		conn.Close()
+		return
+	}
+	if !looksLikeHTTP(br) {
+		hw.relayDecrypted(&bufferedConn{conn, br}, hostWithPort(addr, hw.defaultPort("https")))
+		return
+	}
+	// the server sees a bufferedConn, so it can't fill in req.TLS itself
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		logger.Debugf("Client %s presented cert %q for %s", ip, state.PeerCertificates[0].Subject, host)
+	}
+	hw.serveConn(&bufferedConn{conn, br}, hw.interceptedHandler(&interceptedConn{state, addr}))
+}
+
+// wantsInterstitial reports whether req is a page load by a client that
+// just failed to trust the CA.
+func (hw *HandlerWrapper) wantsInterstitial(req *http.Request) bool {
+	if hw.untrusted == nil || req.Method != "GET" || !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	return hw.untrusted.take(clientIP(req.RemoteAddr))
+}
+
+// ServeInterstitial answers a plain http page load with a page explaining
+// how to install the CA, linking to the page that was asked for.
+func (hw *HandlerWrapper) ServeInterstitial(resp http.ResponseWriter, req *http.Request) {
+	ca := caPath
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		ca = "http://" + addr.String() + caPath
+	}
+	target := html.EscapeString(req.URL.String())
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(resp, interstitialPage, html.EscapeString(ca), target, target)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rejectCert makes a client not trusting the CA fail an intercepted
+// handshake to origin, and waits for the proxy to have seen it fail.
+func rejectCert(t *testing.T, p *testProxy, originURL string) {
+	t.Helper()
+	c := p.client()
+	c.Transport.(*http.Transport).TLSClientConfig = &tls.Config{}
+	if resp, err := c.Get(originURL); err == nil {
+		resp.Body.Close()
+		t.Fatal("client not trusting the CA accepted the mitm cert")
+	}
+	if p.untrusted == nil {
+		time.Sleep(100 * time.Millisecond)
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.untrusted.mu.Lock()
+		n := len(p.untrusted.clients)
+		p.untrusted.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("rejected handshake not noticed")
+}
+
+// getPage gets url through the proxy as a browser loading a page would.
+func getPage(t *testing.T, p *testProxy, url string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readAll(t, resp)
+}
+
+func TestInterstitialAfterRejectedCert(t *testing.T) {
+	origin := tlsOrigin(t)
+	plain := textOrigin(t, "plain page")
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-ca-interstitial")
+	rejectCert(t, p, origin.URL)
+
+	resp, body := getPage(t, p, plain.URL+"/page")
+	if !strings.Contains(body, "download the CA certificate") || !strings.Contains(body, plain.URL+"/page") {
+		t.Fatalf("page load after a rejected cert got %q", body)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("interstitial Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}
+	// the CA it links to downloads through the proxy
+	ca := "http://" + p.URL.Host + caPath
+	if !strings.Contains(body, ca) {
+		t.Fatalf("interstitial doesn't link to %s: %q", ca, body)
+	}
+	resp, pem := getPage(t, p, ca)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(pem, "BEGIN CERTIFICATE") {
+		t.Errorf("CA link got %s %.40q", resp.Status, pem)
+	}
+
+	// shown once, the reload gets the page
+	if _, body = getPage(t, p, plain.URL+"/page"); body != "plain page" {
+		t.Errorf("second page load got %q", body)
+	}
+}
+
+func TestInterstitialOnlyForPageLoads(t *testing.T) {
+	origin := tlsOrigin(t)
+	plain := textOrigin(t, "plain page")
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-ca-interstitial")
+	rejectCert(t, p, origin.URL)
+	// an api call isn't a page a person is looking at
+	resp, err := p.client().Get(plain.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readAll(t, resp); body != "plain page" {
+		t.Errorf("non html request got %q", body)
+	}
+}
+
+func TestInterstitialClearedByTrustingHandshake(t *testing.T) {
+	origin := tlsOrigin(t)
+	plain := textOrigin(t, "plain page")
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-ca-interstitial")
+	p.trust(origin)
+	rejectCert(t, p, origin.URL)
+	// the CA got installed
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, resp)
+	if _, body := getPage(t, p, plain.URL); body != "plain page" {
+		t.Errorf("page load after a trusting handshake got %q", body)
+	}
+}
+
+func TestInterstitialOffByDefault(t *testing.T) {
+	origin := tlsOrigin(t)
+	plain := textOrigin(t, "plain page")
+	p := newTestProxy(t, "-intercept-ports", portOf(origin))
+	rejectCert(t, p, origin.URL)
+	if _, body := getPage(t, p, plain.URL); body != "plain page" {
+		t.Errorf("page load without -ca-interstitial got %q", body)
+	}
+}
+
+func TestRejectsCert(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"remote error: tls: bad certificate":                true,
+		"remote error: tls: unknown certificate authority":  true,
+		"local error: tls: bad record MAC":                  true,
+		"EOF":                                               false,
+		"remote error: tls: protocol version not supported": false,
+	} {
+		if got := rejectsCert(errors.New(msg)); got != want {
+			t.Errorf("rejectsCert(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// upgradeToHTTPS answers a plain http request with a redirect to the same
+// url over https instead of proxying it, as a server sending its clients
+// to https, e.g. ahead of HSTS, would. The http port is dropped from the
+// url, any other is kept.
+func (hw *HandlerWrapper) upgradeToHTTPS(resp http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, port, err := net.SplitHostPort(host); err == nil && port == hw.defaultPort("http") {
+		host = h
+		if strings.Contains(h, ":") {
+			// an ipv6 address
+			host = "[" + h + "]"
+		}
+	}
+	target := "https://" + host + req.URL.RequestURI()
+	logger.Debugln("upgrading", req.URL, "to", target)
+	resp.Header().Set("Location", target)
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteHeader(*hw.MyConfig.UpgradeStatus)
+	fmt.Fprintf(resp, "Moved to %s\n", target)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeHTTPSRedirects(t *testing.T) {
+	origin, got := bodyOrigin(t)
+	p := newTestProxy(t, "-upgrade-https", "127.0.0.1/login")
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	resp, body := getThrough(t, p, origin.URL+"/login/form?next=/home")
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("matching request got %s", resp.Status)
+	}
+	// a port other than the http one is kept
+	want := "https://" + host + "/login/form?next=/home"
+	if loc := resp.Header.Get("Location"); loc != want || !strings.Contains(body, want) {
+		t.Errorf("redirected to %q with %q, want %s", loc, body, want)
+	}
+	// other paths are proxied
+	if resp, _ = getThrough(t, p, origin.URL+"/other"); resp.StatusCode != http.StatusOK {
+		t.Errorf("request outside -upgrade-https got %s", resp.Status)
+	}
+	if len(got) != 1 {
+		t.Errorf("origin got %d requests, want only the one not redirected", len(got))
+	}
+}
+
+func TestUpgradeHTTPSDropsHTTPPort(t *testing.T) {
+	p := newTestProxy(t, "-upgrade-https", "*.example.test,::1", "-upgrade-status", "308")
+	for url, want := range map[string]string{
+		"http://www.example.test/a?b=c":  "https://www.example.test/a?b=c",
+		"http://www.example.test:80/a":   "https://www.example.test/a",
+		"http://www.example.test:8080/a": "https://www.example.test:8080/a",
+		"http://[::1]:80/a":              "https://[::1]/a",
+	} {
+		resp, _ := getThrough(t, p, url)
+		if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != want {
+			t.Errorf("%s got %s to %q, want 308 to %s", url, resp.Status, resp.Header.Get("Location"), want)
+		}
+	}
+}
+
+func TestUpgradeHTTPSLeavesHTTPS(t *testing.T) {
+	origin := tlsOrigin(t)
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-upgrade-https", "*")
+	p.trust(origin)
+	if resp, body := getThrough(t, p, origin.URL); resp.StatusCode != http.StatusOK || body != "tls origin" {
+		t.Errorf("intercepted https request got %s %q", resp.Status, body)
+	}
+}
+
+func TestUpgradeStatus(t *testing.T) {
+	if err := initError("-upgrade-status", "302"); err == nil {
+		t.Error("-upgrade-status 302 accepted")
+	}
+}
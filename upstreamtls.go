@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// UpstreamTLS overrides the TLS settings used to dial hosts matching
+// Pattern. Zero fields keep the global ServerTLSConfig settings.
+type UpstreamTLS struct {
+	Pattern      string
+	MinVersion   uint16
+	MaxVersion   uint16
+	CipherSuites []uint16
+	NextProtos   []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseUpstreamTLS parses semicolon separated host=key:value,... rules, e.g.
+// old.example.com=max:1.2,ciphers:TLS_RSA_WITH_AES_128_CBC_SHA;*.h1.test=alpn:http/1.1.
+// Keys are min, max, ciphers and alpn; lists are separated by +.
+func parseUpstreamTLS(s string) ([]*UpstreamTLS, error) {
+	var rules []*UpstreamTLS
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("Invalid upstream tls rule %q, want host=key:value,...", item)
+		}
+		rule := &UpstreamTLS{Pattern: item[:eq]}
+		for _, setting := range splitList(item[eq+1:]) {
+			colon := strings.Index(setting, ":")
+			if colon <= 0 {
+				return nil, fmt.Errorf("Invalid upstream tls setting %q, want key:value", setting)
+			}
+			if err := rule.set(setting[:colon], setting[colon+1:]); err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *UpstreamTLS) set(key, value string) error {
+	switch key {
+	case "min", "max":
+		version, ok := tlsVersions[value]
+		if !ok {
+			return fmt.Errorf("Unknown tls version %q", value)
+		}
+		if key == "min" {
+			rule.MinVersion = version
+		} else {
+			rule.MaxVersion = version
+		}
+	case "ciphers":
+		for _, name := range strings.Split(value, "+") {
+			id, ok := cipherSuiteID(name)
+			if !ok {
+				return fmt.Errorf("Unknown cipher suite %q", name)
+			}
+			rule.CipherSuites = append(rule.CipherSuites, id)
+		}
+	case "alpn":
+		rule.NextProtos = strings.Split(value, "+")
+	default:
+		return fmt.Errorf("Unknown upstream tls setting %q", key)
+	}
+	return nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// UpstreamConfig returns the TLS config for dialing host: ServerTLSConfig
+// with the settings of the first matching Upstream rule applied.
+func (tc *TlsConfig) UpstreamConfig(host string) *tls.Config {
+	for _, rule := range tc.Upstream {
+		if !matchHost(rule.Pattern, host) {
+			continue
+		}
+		config := tc.ServerTLSConfig.Clone()
+		if rule.MinVersion != 0 {
+			config.MinVersion = rule.MinVersion
+		}
+		if rule.MaxVersion != 0 {
+			config.MaxVersion = rule.MaxVersion
+		}
+		if rule.CipherSuites != nil {
+			config.CipherSuites = rule.CipherSuites
+		}
+		if rule.NextProtos != nil {
+			config.NextProtos = rule.NextProtos
+		}
+		return config
+	}
+	return tc.ServerTLSConfig
+}
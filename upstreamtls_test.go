@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tlsInfoOrigin answers with the version and cipher suite its client
+// negotiated.
+func tlsInfoOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", tls.VersionName(r.TLS.Version), tls.CipherSuiteName(r.TLS.CipherSuite))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func upstreamTLSInfo(t *testing.T, args ...string) string {
+	t.Helper()
+	origin := tlsInfoOrigin(t)
+	p := newTestProxy(t, append(args, "-intercept-ports", portOf(origin))...)
+	p.trust(origin)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, resp)
+}
+
+func TestUpstreamTLSRules(t *testing.T) {
+	if got := upstreamTLSInfo(t); got != "TLS 1.3 TLS_AES_128_GCM_SHA256" {
+		t.Errorf("default upstream tls %q", got)
+	}
+	if got := upstreamTLSInfo(t, "-upstream-tls", "127.0.0.1=max:1.2,ciphers:TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"); got != "TLS 1.2 TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384" {
+		t.Errorf("upstream tls with a matching rule %q", got)
+	}
+	if got := upstreamTLSInfo(t, "-upstream-tls", "other.test=max:1.2;*.0.0.1=max:1.2"); got[:7] != "TLS 1.2" {
+		t.Errorf("second rule matching by pattern not applied: %q", got)
+	}
+	if got := upstreamTLSInfo(t, "-upstream-tls", "other.test=max:1.2"); got[:7] != "TLS 1.3" {
+		t.Errorf("rule for another host applied: %q", got)
+	}
+}
+
+func TestUpstreamTLSALPN(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.NegotiatedProtocol))
+	}))
+	origin.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	origin.StartTLS()
+	defer origin.Close()
+	p := newTestProxy(t, "-intercept-ports", portOf(origin), "-upstream-tls", "127.0.0.1=alpn:http/1.1")
+	p.trust(origin)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "http/1.1" {
+		t.Errorf("origin negotiated %q, want http/1.1", got)
+	}
+}
+
+func TestParseUpstreamTLSRejectsMalformed(t *testing.T) {
+	for _, s := range []string{"host", "host=max", "host=max:1.4", "host=ciphers:TLS_NOPE", "host=color:blue"} {
+		if err := initError("-upstream-tls", s); err == nil {
+			t.Errorf("-upstream-tls %q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// addVia appends the proxy's Via entry (RFC 7230 section 5.7.1) for a
+// message of the given protocol version to header.
+func (hw *HandlerWrapper) addVia(header http.Header, major, minor int) {
+	if *hw.MyConfig.Via == "" {
+		return
+	}
+	header.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, *hw.MyConfig.Via))
+}
+
+// viaLoop reports whether req has already passed through this proxy, as its
+// Via header names the proxy's own identifier.
+func (hw *HandlerWrapper) viaLoop(req *http.Request) bool {
+	if *hw.MyConfig.Via == "" {
+		return false
+	}
+	for _, value := range req.Header["Via"] {
+		for _, hop := range strings.Split(value, ",") {
+			// protocol received-by [comment]
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], *hw.MyConfig.Via) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// viaOrigin answers with the Via header it got.
+func viaOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Via", "1.1 origin-cdn")
+		io.WriteString(w, strings.Join(r.Header["Via"], ", "))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestViaAdded(t *testing.T) {
+	origin := viaOrigin(t)
+	p := newTestProxy(t, "-via", "gomitmproxy")
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Via", "1.0 corporate")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "1.0 corporate, 1.1 gomitmproxy" {
+		t.Errorf("origin got Via %q", got)
+	}
+	if got := resp.Header.Values("Via"); strings.Join(got, ", ") != "1.1 origin-cdn, 1.1 gomitmproxy" {
+		t.Errorf("client got Via %q", got)
+	}
+}
+
+func TestViaOffByDefault(t *testing.T) {
+	origin := viaOrigin(t)
+	p := newTestProxy(t)
+	resp, err := p.client().Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, resp); got != "" || len(resp.Header.Values("Via")) != 1 {
+		t.Errorf("origin got Via %q, client %q", got, resp.Header.Values("Via"))
+	}
+}
+
+func TestViaLoopRefused(t *testing.T) {
+	origin := viaOrigin(t)
+	tunnel := tlsOrigin(t)
+	p := newTestProxy(t, "-via", "gomitmproxy")
+	for _, via := range []string{"1.1 gomitmproxy", "1.0 corporate, HTTP/1.1 GoMitmProxy (gateway)"} {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		req.Header.Set("Via", via)
+		resp, err := p.client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readAll(t, resp); resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("request with Via %q got %s", via, resp.Status)
+		}
+
+		req, _ = http.NewRequest("CONNECT", p.URL.String(), nil)
+		req.Host = tunnel.Listener.Addr().String()
+		req.Header.Set("Via", via)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Body.Close(); resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("CONNECT with Via %q got %s", via, resp.Status)
+		}
+	}
+
+	// another proxy's name containing ours is no loop
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Via", "1.1 gomitmproxy-edge")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, resp); resp.StatusCode != http.StatusOK {
+		t.Errorf("request via another proxy got %s", resp.Status)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// payload bytes of each frame shown in the log
+const wsPreviewSize = 64
+
+var wsOpcodeNames = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+// isUpgradeRequest reports whether req asks to switch protocols, e.g. to a
+// websocket.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayUpgraded splices the client and origin connections together after a
+// protocol switch. inReader and outReader hold anything already read from
+// connIn and connOut. When logFrames is set the websocket frames flowing in
+// both directions are logged without altering the stream. linger is passed
+// on to Transport.
+func relayUpgraded(connIn net.Conn, inReader *bufio.Reader, connOut net.Conn, outReader *bufio.Reader, url string, logFrames bool, linger time.Duration) {
+	var in, out io.Reader = inReader, outReader
+	if logFrames {
+		in = io.TeeReader(in, &wsFrameLogger{direction: "-->", url: url})
+		out = io.TeeReader(out, &wsFrameLogger{direction: "<--", url: url})
+	}
+	err := Transport(&bufferedConn{connIn, in}, &bufferedConn{connOut, out}, linger)
+	if err != nil {
+		logger.Debugln("relay upgraded connection", url, "error:", err)
+	}
+}
+
+type wsFrame struct {
+	fin    bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+// wsHeaderLen returns the size of the frame header starting with b, which
+// must hold at least two bytes.
+func wsHeaderLen(b []byte) int {
+	n := 2
+	switch b[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+// parseWSHeader parses the frame header b, rejecting a 64-bit length with
+// the most significant bit set, which RFC 6455 forbids.
+func parseWSHeader(b []byte) (*wsFrame, error) {
+	frame := &wsFrame{
+		fin:    b[0]&0x80 != 0,
+		opcode: b[0] & 0x0f,
+		masked: b[1]&0x80 != 0,
+		length: int64(b[1] & 0x7f),
+	}
+	rest := b[2:]
+	switch frame.length {
+	case 126:
+		frame.length = int64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		length := binary.BigEndian.Uint64(rest)
+		if length>>63 != 0 {
+			return nil, fmt.Errorf("frame length %#x has the most significant bit set", length)
+		}
+		frame.length = int64(length)
+		rest = rest[8:]
+	}
+	if frame.masked {
+		copy(frame.mask[:], rest)
+	}
+	return frame, nil
+}
+
+// wsFrameLogger parses a websocket byte stream written to it in arbitrary
+// pieces and logs every frame. After a malformed frame it stops logging,
+// as the frames that follow can't be found.
+type wsFrameLogger struct {
+	direction string
+	url       string
+	failed    bool
+
+	header  []byte
+	frame   *wsFrame
+	read    int64
+	payload []byte
+
+	// opcode and length so far of a fragmented message
+	message    byte
+	messageLen int64
+}
+
+func (l *wsFrameLogger) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && !l.failed {
+		if l.frame == nil {
+			need := 2
+			if len(l.header) >= 2 {
+				need = wsHeaderLen(l.header)
+			}
+			take := need - len(l.header)
+			if take > len(p) {
+				take = len(p)
+			}
+			l.header = append(l.header, p[:take]...)
+			p = p[take:]
+			if len(l.header) < 2 || len(l.header) < wsHeaderLen(l.header) {
+				continue
+			}
+			frame, err := parseWSHeader(l.header)
+			if err != nil {
+				log.Printf("websocket %s %s not logged any further: %s", l.direction, l.url, err)
+				l.failed = true
+				break
+			}
+			l.frame = frame
+			l.header = l.header[:0]
+			l.payload = l.payload[:0]
+			l.read = 0
+		} else {
+			take := int64(len(p))
+			if left := l.frame.length - l.read; take > left {
+				take = max(left, 0)
+			}
+			for i, c := range p[:take] {
+				pos := l.read + int64(i)
+				if pos >= wsPreviewSize {
+					break
+				}
+				if l.frame.masked {
+					c ^= l.frame.mask[pos%4]
+				}
+				l.payload = append(l.payload, c)
+			}
+			l.read += take
+			p = p[take:]
+		}
+		if l.frame != nil && l.read >= l.frame.length {
+			l.logFrame()
+			l.frame = nil
+		}
+	}
+	return n, nil
+}
+
+func (l *wsFrameLogger) logFrame() {
+	frame := l.frame
+	name, ok := wsOpcodeNames[frame.opcode]
+	if !ok {
+		name = fmt.Sprintf("opcode %d", frame.opcode)
+	}
+
+	var detail string
+	switch frame.opcode {
+	case 0x1:
+		detail = fmt.Sprintf("%q", l.payload)
+	case 0x8:
+		if len(l.payload) >= 2 {
+			detail = fmt.Sprintf("code %d %q", binary.BigEndian.Uint16(l.payload), l.payload[2:])
+		}
+	case 0x0:
+		if l.message == 0x1 {
+			detail = fmt.Sprintf("%q", l.payload)
+		} else {
+			detail = fmt.Sprintf("% x", l.payload)
+		}
+	default:
+		detail = fmt.Sprintf("% x", l.payload)
+	}
+	if frame.length > wsPreviewSize {
+		detail += "..."
+	}
+	log.Printf("websocket %s %s %s fin=%v masked=%v len=%d %s",
+		l.direction, l.url, name, frame.fin, frame.masked, frame.length, detail)
+
+	// control frames may be interleaved with the fragments of a message
+	if frame.opcode >= 0x8 {
+		return
+	}
+	if frame.opcode != 0x0 {
+		l.message = frame.opcode
+		l.messageLen = 0
+	}
+	l.messageLen += frame.length
+	if frame.fin {
+		if frame.opcode == 0x0 {
+			log.Printf("websocket %s %s fragmented %s message complete len=%d",
+				l.direction, l.url, wsOpcodeNames[l.message], l.messageLen)
+		}
+		l.message = 0
+	}
+}
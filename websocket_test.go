@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsFrameBytes encodes a websocket frame, masked as clients send them.
+func wsFrameBytes(opcode byte, fin, masked bool, payload []byte) []byte {
+	b := []byte{opcode, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] = byte(len(payload))
+	case len(payload) < 1<<16:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// wsEchoOrigin switches to a websocket and answers each frame it reads with
+// an unmasked text frame of its payload, until the client closes.
+func wsEchoOrigin(t *testing.T) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		for {
+			head := make([]byte, 2)
+			if _, err := io.ReadFull(rw, head); err != nil {
+				return
+			}
+			rest := make([]byte, wsHeaderLen(head)-2)
+			io.ReadFull(rw, rest)
+			frame, err := parseWSHeader(append(head, rest...))
+			if err != nil {
+				return
+			}
+			payload := make([]byte, frame.length)
+			io.ReadFull(rw, payload)
+			for i := range payload {
+				payload[i] ^= frame.mask[i%4]
+			}
+			if frame.opcode == 0x8 {
+				return
+			}
+			conn.Write(wsFrameBytes(0x1, true, false, payload))
+		}
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestWebSocketRelayedAndLogged(t *testing.T) {
+	logged := captureStdLog(t)
+	origin := wsEchoOrigin(t)
+	p := newTestProxy(t, "-ws")
+
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/chat HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	conn.Write(wsFrameBytes(0x1, true, true, []byte("hello")))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echo := make([]byte, 7)
+	if _, err := io.ReadFull(br, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo[2:]) != "hello" {
+		t.Errorf("echoed frame payload %q", echo[2:])
+	}
+	conn.Write(wsFrameBytes(0x8, true, true, []byte{0x03, 0xe8}))
+
+	want := []string{
+		`websocket --> ` + origin.URL + `/chat text fin=true masked=true len=5 "hello"`,
+		`websocket <-- ` + origin.URL + `/chat text fin=true masked=false len=5 "hello"`,
+		`websocket --> ` + origin.URL + `/chat close fin=true masked=true len=2 code 1000 ""`,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, line := range want {
+		for !strings.Contains(logged.String(), line) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !strings.Contains(logged.String(), line) {
+			t.Errorf("log lacks %q, got:\n%s", line, logged)
+		}
+	}
+}
+
+func TestWSFrameLoggerFragmentsAndPieces(t *testing.T) {
+	logged := captureStdLog(t)
+	var stream []byte
+	stream = append(stream, wsFrameBytes(0x1, false, true, []byte("hel"))...)
+	stream = append(stream, wsFrameBytes(0x9, true, true, []byte{0xab})...)
+	stream = append(stream, wsFrameBytes(0x0, true, true, []byte("lo"))...)
+	stream = append(stream, wsFrameBytes(0x2, true, false, make([]byte, 300))...)
+	l := &wsFrameLogger{direction: "-->", url: "ws://example.com/"}
+	// a byte at a time, as a stream may be read
+	for i := range stream {
+		l.Write(stream[i : i+1])
+	}
+	for _, line := range []string{
+		`text fin=false masked=true len=3 "hel"`,
+		`ping fin=true masked=true len=1 ab`,
+		`continuation fin=true masked=true len=2 "lo"`,
+		`fragmented text message complete len=5`,
+		`binary fin=true masked=false len=300 00 00`,
+	} {
+		if !strings.Contains(logged.String(), line) {
+			t.Errorf("log lacks %q, got:\n%s", line, logged)
+		}
+	}
+	if !strings.Contains(logged.String(), "...") {
+		t.Error("long payload preview not marked as cut")
+	}
+}
+
+func TestWSFrameLoggerRejectsHugeLength(t *testing.T) {
+	logged := captureStdLog(t)
+	l := &wsFrameLogger{direction: "<--", url: "ws://example.com/"}
+	// a 64-bit length with the most significant bit set
+	stream := []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 1, 0xde, 0xad}
+	stream = append(stream, wsFrameBytes(0x1, true, false, []byte("after"))...)
+	if n, err := l.Write(stream); n != len(stream) || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	if !strings.Contains(logged.String(), "not logged any further") {
+		t.Errorf("malformed frame not reported, got:\n%s", logged)
+	}
+	if strings.Contains(logged.String(), "after") {
+		t.Errorf("frames logged after a malformed one:\n%s", logged)
+	}
+}
+
+func TestWebSocketNotLoggedByDefault(t *testing.T) {
+	logged := captureStdLog(t)
+	origin := wsEchoOrigin(t)
+	p := newTestProxy(t)
+	conn := p.dial(t)
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	br := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(wsFrameBytes(0x1, true, true, []byte("quiet")))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(br, make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logged.String(), "websocket") {
+		t.Errorf("frames logged without -ws:\n%s", logged)
+	}
+}